@@ -0,0 +1,709 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// This portion of code implements appends to sdfs files. Appends go through
+// the master node, which handles one append of a file at a time so that
+// every replica applies the appends of a file in the same order:
+// 		1. the writer sends the appended data to every replica of the file
+//		   under a staging name, like a put, and the replicas confirm it
+//		   with a STOREACK message
+//		2. once W replicas confirmed the data, the master node sends an
+//		   APPENDAPPLY message with the checksum of the current version.
+//		   A replica that stores the current version keeps it as
+//		   <sdfs name>@<version>, appends the data to a copy of the replica
+//		   that replaces the replica, keeps the current version under the
+//		   staging name and answers with the new
+//		   checksum in an APPENDREPLY message
+//		3. the master node commits the new version with the replicas that
+//		   applied the append. Replicas that did not are dropped from the
+//		   replica list and the file is queued for repair
+//		4. the master node sends an APPENDFINISH message to the replicas.
+//		   If the append was committed they remove the current version they
+//		   kept, otherwise they restore it
+// Puts, appends and renames of a file hold the lock of the file, so they
+// are committed one at a time without blocking the other files.
+// The replica list keeps the sha256 state of the latest version next to its
+// checksum, so a replica only hashes the appended data instead of the whole
+// file. Files stored as blocks or shards can't be appended to.
+
+// one append waiting for the replicas to store the appended data
+type pendingAppend struct {
+	stagingName string
+	checksum string
+	acked map[string]bool
+	ackChan chan bool
+}
+
+// appends waiting for store acknowledgements, maps put id to append,
+// guarded by storeLock
+var pendingAppends = make(map[string]*pendingAppend)
+
+// the lock of a sdfs file and the number of callers that hold it or
+// wait for it
+type writeLock struct {
+	sync.Mutex
+	users int
+}
+
+// one lock per sdfs file that is being written, removed once it is not
+// used, guarded by appendLock
+var writeLocks = make(map[string]*writeLock)
+
+// appends applied on this node that the master node has not finished yet,
+// maps staging name to the version the replica had before, guarded by
+// appendLock
+var appliedAppends = make(map[string]storedFile)
+var appendLock sync.Mutex
+
+
+// func handleAppend(localFileName string, sdfsFileName string) error
+// ------------------------------------------------------------------
+// Description: This function handles the append instruction. It blocks
+//				until the master node committed the append or rejected it
+// Input:   localFileName string: the local file that is appended
+// 			sdfsFileName string: the sdfs file that is appended to
+// Output:  nil if the append is committed
+func handleAppend(localFileName string, sdfsFileName string) error {
+	if isInternalName(sdfsFileName) {
+		fmt.Printf("Can't append to SDFS file %v. Older versions can't be changed\n", sdfsFileName)
+		return errors.New("invalid sdfs file name")
+	}
+	if !Exist(LOCALFILEPATH + localFileName) || isDir(LOCALFILEPATH + localFileName) {
+		fmt.Printf("Can't execute append instruction. Local file %v does not exist!\n", localFileName)
+		return errors.New("local file does not exist")
+	}
+	checksum, fileSize, err := fileChecksum(LOCALFILEPATH + localFileName)
+	if err == nil && fileSize == 0 {
+		err = errors.New("local file is empty")
+	}
+	if err != nil {
+		fmt.Printf("Can't execute append instruction. Local file %v can't be appended: %v\n", localFileName, err.Error())
+		return err
+	}
+
+	logMsg := fmt.Sprintf("Appending local file %v to SDFS file %v\n", localFileName, sdfsFileName)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+
+	if isMaster {
+		version, err := appendFile(sdfsFileName, localFileName, strconv.Itoa(selfID), checksum, fileSize, newRequestID())
+		if err != nil {
+			fmt.Printf("Append to SDFS file %v rejected: %v\n", sdfsFileName, err.Error())
+			return err
+		}
+		fmt.Printf("Append to SDFS file %v committed as version %v\n", sdfsFileName, version)
+		return nil
+	}
+
+	putID, _ := newWaiter(1)
+	sentMap := make(map[string]string)
+	sentMap[LOCALNAME] = localFileName
+	sentMap[SDFSNAME] = sdfsFileName
+	sentMap[PUTID] = putID
+	sentMap[CHECKSUM] = checksum
+	sentMap[SDFSSIZE] = strconv.FormatInt(fileSize, 10)
+	msgContent, _ := json.Marshal(sentMap)
+	msgSent := MakeMessage(APPENDREQ, string(msgContent), strconv.Itoa(selfID))
+	sendRequest(masterID, msgSent)
+
+	err = waitPutResponse(putID)
+	if err != nil {
+		fmt.Printf("Append to SDFS file %v rejected: %v\n", sdfsFileName, err.Error())
+	}
+	return err
+}
+
+
+// func lockSDFSFile(sdfsFileName string)
+// ------------------------------------------------------------------
+// Description: A helper function that takes the lock that orders the
+//				puts, appends and renames of a sdfs file
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  None
+func lockSDFSFile(sdfsFileName string) {
+	appendLock.Lock()
+	lock, ok := writeLocks[sdfsFileName]
+	if !ok {
+		lock = &writeLock{}
+		writeLocks[sdfsFileName] = lock
+	}
+	lock.users++
+	appendLock.Unlock()
+	lock.Lock()
+}
+
+
+// func unlockSDFSFile(sdfsFileName string)
+// ------------------------------------------------------------------
+// Description: A helper function that releases the lock of a sdfs file
+//				and forgets it if nobody waits for it
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  None
+func unlockSDFSFile(sdfsFileName string) {
+	appendLock.Lock()
+	defer appendLock.Unlock()
+	lock := writeLocks[sdfsFileName]
+	lock.users--
+	if lock.users == 0 {
+		delete(writeLocks, sdfsFileName)
+	}
+	lock.Unlock()
+}
+
+
+// func appendFile(sdfsFileName string, localFileName string, writerID string, checksum string, size int64, putID string) (int, error)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to append a
+//				local file of the writer to a sdfs file
+// Input:   sdfsFileName string: the sdfs file that is appended to
+//			localFileName string: the local file on the writer
+//			writerID string: node id of which the local file is present
+// 			checksum string: sha256 of the local file
+// 			size int64: size of the local file
+//			putID string: the id of the append request
+// Output:  the version of the file after the append and the rejection
+//			reason
+func appendFile(sdfsFileName string, localFileName string, writerID string, checksum string, size int64, putID string) (int, error) {
+	lockSDFSFile(sdfsFileName)
+	defer unlockSDFSFile(sdfsFileName)
+
+	fileLock.RLock()
+	sdfsMap, ok := replicateList[sdfsFileName]
+	parts := ok && (sdfsMap[BLOCKLIST] != "" || sdfsMap[SHARDLIST] != "")
+	baseChecksum := sdfsMap[CHECKSUM]
+	fileLock.RUnlock()
+	if !ok {
+		return 0, errors.New("sdfs file does not exist")
+	}
+	if parts {
+		return 0, errors.New("sdfs file is stored as blocks or shards")
+	}
+	nodes := liveReplicas(sdfsFileName)
+	quorum := getWriteQuorum(sdfsFileName, 0)
+	if quorum == 0 {
+		quorum = len(nodes) / 2 + 1
+	}
+	if quorum > len(nodes) {
+		return 0, fmt.Errorf("write quorum %d exceeds the %d live replicas", quorum, len(nodes))
+	}
+
+	staged := stageAppend(sdfsFileName, localFileName, writerID, checksum, putID, nodes)
+	if len(staged) < quorum {
+		for _, nodeID := range staged {
+			deleteReplica(stagingName(sdfsFileName, putID), nodeID)
+		}
+		return 0, fmt.Errorf("only %d of %d required replicas stored the appended data within %v", len(staged), quorum, STORETIMEOUT)
+	}
+
+	return applyAppend(sdfsFileName, putID, baseChecksum, size, nodes, staged)
+}
+
+
+// func stageAppend(sdfsFileName string, localFileName string, writerID string, checksum string, putID string, nodes []int) []int
+// ------------------------------------------------------------------
+// Description: This function asks the writer to send the appended data to
+//				the replicas and waits until they all stored it or
+//				STORETIMEOUT passes
+// Input:   sdfsFileName string: the sdfs file that is appended to
+//			localFileName string: the local file on the writer
+//			writerID string: node id of the writer
+// 			checksum string: sha256 of the local file
+//			putID string: the id of the append request
+//			nodes []int: the node ids of the replicas
+// Output:  the node ids of the replicas that stored the data
+func stageAppend(sdfsFileName string, localFileName string, writerID string, checksum string, putID string, nodes []int) []int {
+	pa := &pendingAppend{
+		stagingName: stagingName(sdfsFileName, putID),
+		checksum: checksum,
+		acked: make(map[string]bool),
+		ackChan: make(chan bool, len(nodes)),
+	}
+	storeLock.Lock()
+	pendingAppends[putID] = pa
+	storeLock.Unlock()
+	defer func() {
+		storeLock.Lock()
+		delete(pendingAppends, putID)
+		storeLock.Unlock()
+	}()
+
+	writer, _ := strconv.Atoi(writerID)
+	if writer == selfID {
+		for _, nodeID := range nodes {
+			go WriteToNode(localFileName, LOCALNAME, pa.stagingName, SDFSNAME, nodeID, checksum)
+		}
+	} else {
+		receiverMap := make(map[string]string)
+		slots := replicaSlots(len(nodes))
+		for i, nodeID := range nodes {
+			receiverMap[slots[i]] = strconv.Itoa(nodeID)
+		}
+		receiverMap[SENDERNAME] = localFileName
+		receiverMap[RECEIVERNAME] = pa.stagingName
+		receiverMap[CHECKSUM] = checksum
+		receiverMap[SENDERTYPE] = LOCALNAME
+		receiverMap[RECEIVERTYPE] = SDFSNAME
+		msgContent, _ := json.Marshal(receiverMap)
+		msgSent := MakeMessage(WRITE, string(msgContent), strconv.Itoa(selfID))
+		sendRequest(writer, msgSent)
+	}
+
+	deadline := time.After(STORETIMEOUT)
+	for numAcked := 0; numAcked < len(nodes); {
+		select {
+		case <-pa.ackChan:
+			storeLock.Lock()
+			numAcked = len(pa.acked)
+			storeLock.Unlock()
+		case <-deadline:
+			numAcked = len(nodes)
+		}
+	}
+
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	staged := make([]int, 0, len(pa.acked))
+	for _, nodeID := range nodes {
+		if pa.acked[strconv.Itoa(nodeID)] {
+			staged = append(staged, nodeID)
+		}
+	}
+	return staged
+}
+
+
+// func recordAppendAck(putID string, nodeID string, checksum string) bool
+// ------------------------------------------------------------------
+// Description: This function is called by the master node when a replica
+//				confirms that a staged file is stored, before the pending
+//				puts are looked up
+// Input:   putID string: the id of the put or append request
+//			nodeID string: the node id of the replica
+//			checksum string: the checksum of the stored file
+// Output:  true if the staged file belongs to a running append
+func recordAppendAck(putID string, nodeID string, checksum string) bool {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	pa, ok := pendingAppends[putID]
+	if !ok {
+		return false
+	}
+	if checksum == pa.checksum {
+		pa.acked[nodeID] = true
+		select {
+		case pa.ackChan <- true:
+		default:
+		}
+	}
+	return true
+}
+
+
+// func applyAppend(sdfsFileName string, putID string, baseChecksum string, size int64, nodes []int, staged []int) (int, error)
+// ------------------------------------------------------------------
+// Description: This function asks the replicas that stored the appended
+//				data to apply it and commits the new version with the
+//				replicas that did
+// Input:   sdfsFileName string: the sdfs file that is appended to
+//			putID string: the id of the append request
+//			baseChecksum string: the checksum of the version the append
+//								 was staged for
+// 			size int64: size of the appended data
+//			nodes []int: the node ids of the replicas
+//			staged []int: the node ids of the replicas that stored the data
+// Output:  the new version and the rejection reason
+func applyAppend(sdfsFileName string, putID string, baseChecksum string, size int64, nodes []int, staged []int) (int, error) {
+	fileLock.RLock()
+	sdfsMap, ok := replicateList[sdfsFileName]
+	applyMap := make(map[string]string)
+	applyMap[SDFSNAME] = sdfsFileName
+	applyMap[SENDERNAME] = stagingName(sdfsFileName, putID)
+	applyMap[CHECKSUM] = sdfsMap[CHECKSUM]
+	applyMap[HASHSTATE] = sdfsMap[HASHSTATE]
+	fileLock.RUnlock()
+	if !ok || applyMap[CHECKSUM] != baseChecksum {
+		for _, nodeID := range staged {
+			deleteReplica(applyMap[SENDERNAME], nodeID)
+		}
+		return 0, errors.New("sdfs file was written or deleted during the append")
+	}
+	version := getVersion(sdfsFileName)
+	applyMap[FILEVERSION] = strconv.Itoa(version + 1)
+	if retainedVersions() > 1 {
+		applyMap[RECEIVERNAME] = versionName(sdfsFileName, version)
+	}
+
+	replies := requestApply(applyMap, staged)
+	applied := make(map[string]bool)
+	newChecksum := ""
+	hashState := ""
+	for _, nodeID := range staged {
+		reply, ok := replies[nodeID]
+		if !ok || reply[PUTSTATUS] != TRUE {
+			continue
+		}
+		// every replica appended the same data to the same version
+		if newChecksum == "" {
+			newChecksum, hashState = reply[CHECKSUM], reply[HASHSTATE]
+		}
+		if reply[CHECKSUM] == newChecksum {
+			applied[strconv.Itoa(nodeID)] = true
+		}
+	}
+	// puts and renames of the file wait for its lock, a delete or the
+	// rename of a directory does not
+	conflictLock.Lock()
+	fileLock.Lock()
+	sdfsMap, ok = replicateList[sdfsFileName]
+	if len(applied) == 0 || !ok || sdfsMap[CHECKSUM] != baseChecksum {
+		fileLock.Unlock()
+		conflictLock.Unlock()
+		// the replicas that applied the append restore the current version
+		finishAppend(applyMap, staged, false)
+		if len(applied) == 0 {
+			return 0, errors.New("no replica applied the append")
+		}
+		return 0, errors.New("sdfs file was written or deleted during the append")
+	}
+
+	// the replicas that did not apply the append store an older version
+	archived := make(map[string]string)
+	dropped := make([]int, 0)
+	for key, value := range sdfsMap {
+		archived[key] = value
+	}
+	for _, key := range fileSlots(sdfsMap) {
+		if sdfsMap[key] == "" || applied[sdfsMap[key]] {
+			continue
+		}
+		archived[key] = ""
+		nodeID, _ := strconv.Atoi(sdfsMap[key])
+		dropped = append(dropped, nodeID)
+		sdfsMap[key] = ""
+		replicateCounter[strconv.Itoa(nodeID)]--
+	}
+	oldSize, _ := strconv.ParseInt(sdfsMap[SDFSSIZE], 10, 64)
+	sdfsMap[CHECKSUM] = newChecksum
+	sdfsMap[HASHSTATE] = hashState
+	sdfsMap[SDFSSIZE] = strconv.FormatInt(oldSize + size, 10)
+	sdfsMap[FILEVERSION] = strconv.Itoa(version + 1)
+	sdfsMap[LASTUPDATE] = time.Now().Format("2006-01-02T15:04:05.000Z")
+	if applyMap[RECEIVERNAME] != "" {
+		replicateList[applyMap[RECEIVERNAME]] = archived
+		for _, key := range fileSlots(archived) {
+			if archived[key] != "" {
+				replicateCounter[archived[key]]++
+			}
+		}
+	}
+	fileLock.Unlock()
+	conflictLock.Unlock()
+
+	if applyMap[RECEIVERNAME] != "" {
+		publishReplicaDelta(sdfsFileName, applyMap[RECEIVERNAME])
+		pruneVersions(sdfsFileName, version + 1)
+	} else {
+		publishReplicaDelta(sdfsFileName)
+	}
+	// dropped replicas are deleted, so they may keep the append as well
+	finishAppend(applyMap, staged, true)
+	for _, nodeID := range dropped {
+		deleteReplica(sdfsFileName, nodeID)
+	}
+	if len(dropped) > 0 {
+		queueRepair(sdfsFileName)
+	}
+
+	logMsg := fmt.Sprintf("Appended %d bytes to SDFS file %v as version %v on %d of %d replicas\n", size, sdfsFileName, version + 1, len(applied), len(nodes))
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+	return version + 1, nil
+}
+
+
+// func requestApply(applyMap map[string]string, nodes []int) map[int]map[string]string
+// ------------------------------------------------------------------
+// Description: This function sends an APPENDAPPLY message to replicas and
+//				waits up to STORETIMEOUT for their replies
+// Input:   applyMap map[string]string: the content of the message
+//			nodes []int: the node ids of the replicas
+// Output:  maps node id to the reply of the replica
+func requestApply(applyMap map[string]string, nodes []int) map[int]map[string]string {
+	readID, response := newWaiter(len(nodes))
+	defer removeWaiter(readID)
+
+	applyMap[READID] = readID
+	msgContent, _ := json.Marshal(applyMap)
+	msgSent := MakeMessage(APPENDAPPLY, string(msgContent), strconv.Itoa(selfID))
+	replies := make(map[int]map[string]string)
+	waiting := 0
+	for _, nodeID := range nodes {
+		if nodeID == selfID {
+			replies[selfID] = appendLocal(applyMap)
+			continue
+		}
+		sendTCPRequest(nodeID, msgSent)
+		waiting++
+	}
+
+	timeout := time.After(STORETIMEOUT)
+	for waiting > 0 {
+		select {
+		case replyMap := <-response:
+			nodeID, _ := strconv.Atoi(replyMap[RECEIVERID])
+			replies[nodeID] = replyMap
+			waiting--
+		case <-timeout:
+			return replies
+		}
+	}
+	return replies
+}
+
+
+// func handleAppendApply(msgContent string, senderID int)
+// ------------------------------------------------------------------
+// Description: This function answers an APPENDAPPLY message after the
+//				appended data is applied to the replica
+// Input:   msgContent string: the content of the APPENDAPPLY message
+//			senderID int: the node id of the master node
+// Output:  None
+func handleAppendApply(msgContent string, senderID int) {
+	applyMap := make(map[string]string)
+	err := json.Unmarshal([]byte(msgContent), &applyMap)
+	ErrorHandler("Unmarshal error append apply", err, false)
+
+	replyContent, _ := json.Marshal(appendLocal(applyMap))
+	msgSent := MakeMessage(APPENDREPLY, string(replyContent), strconv.Itoa(selfID))
+	sendTCPRequest(senderID, msgSent)
+}
+
+
+// func appendLocal(applyMap map[string]string) map[string]string
+// ------------------------------------------------------------------
+// Description: This function appends a staged file to the replica of a
+//				sdfs file in the sdfs directory if the replica stores the
+//				version the append was made to
+// Input:   applyMap map[string]string: the content of the APPENDAPPLY
+//										message
+// Output:  the content of the APPENDREPLY message
+func appendLocal(applyMap map[string]string) map[string]string {
+	sdfsFileName := applyMap[SDFSNAME]
+	replyMap := make(map[string]string)
+	replyMap[READID] = applyMap[READID]
+	replyMap[RECEIVERID] = strconv.Itoa(selfID)
+	replyMap[PUTSTATUS] = FALSE
+
+	stored, ok := lookupStored(sdfsFileName)
+	if !ok || stored.checksum != applyMap[CHECKSUM] {
+		_ = os.Remove(SDFSFILEPATH + applyMap[SENDERNAME])
+		replyMap[PUTREASON] = "replica does not store the current version"
+		return replyMap
+	}
+	state, err := restoreHash(sdfsFileName, applyMap[HASHSTATE])
+	if err != nil {
+		_ = os.Remove(SDFSFILEPATH + applyMap[SENDERNAME])
+		replyMap[PUTREASON] = err.Error()
+		return replyMap
+	}
+	version, _ := strconv.Atoi(applyMap[FILEVERSION])
+	if applyMap[RECEIVERNAME] != "" {
+		localCopy(SDFSFILEPATH + sdfsFileName, SDFSFILEPATH + applyMap[RECEIVERNAME])
+		recordStored(applyMap[RECEIVERNAME], stored.checksum, version - 1)
+	}
+
+	err = appendStaged(applyMap[SENDERNAME], sdfsFileName, state)
+	if err != nil {
+		// the replica is unchanged
+		ErrorHandler("Can't append to sdfs file " + sdfsFileName, err, false)
+		_ = os.Remove(SDFSFILEPATH + applyMap[SENDERNAME])
+		replyMap[PUTREASON] = err.Error()
+		return replyMap
+	}
+	marshaled, _ := state.(encoding.BinaryMarshaler).MarshalBinary()
+	checksum := hex.EncodeToString(state.Sum(nil))
+	recordStored(sdfsFileName, checksum, version)
+	appendLock.Lock()
+	appliedAppends[applyMap[SENDERNAME]] = stored
+	appendLock.Unlock()
+
+	replyMap[PUTSTATUS] = TRUE
+	replyMap[CHECKSUM] = checksum
+	replyMap[HASHSTATE] = hex.EncodeToString(marshaled)
+	return replyMap
+}
+
+
+// func restoreHash(sdfsFileName string, hashState string) (hash.Hash, error)
+// ------------------------------------------------------------------
+// Description: A helper function that gets the sha256 state of a replica,
+//				from the replica list or by hashing the replica if the
+//				replica list has none yet
+// Input:   sdfsFileName string: the name of the replica
+//			hashState string: the hex encoded state, empty if unknown
+// Output:  the sha256 state and the error if it can't be restored
+func restoreHash(sdfsFileName string, hashState string) (hash.Hash, error) {
+	state := sha256.New()
+	if hashState != "" {
+		marshaled, err := hex.DecodeString(hashState)
+		if err == nil {
+			err = state.(encoding.BinaryUnmarshaler).UnmarshalBinary(marshaled)
+		}
+		return state, err
+	}
+
+	f, err := os.Open(SDFSFILEPATH + sdfsFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, err = io.Copy(state, f)
+	return state, err
+}
+
+
+// func appendStaged(stagingName string, sdfsFileName string, state hash.Hash) error
+// ------------------------------------------------------------------
+// Description: A helper function that appends a staged file to a copy of
+//				a replica and hashes the appended data. The copy replaces
+//				the replica and the replica is kept under the staging name,
+//				so a reader never sees a half appended replica and the
+//				append can be undone
+// Input:   stagingName string: the name of the staged file
+//			sdfsFileName string: the name of the replica
+//			state hash.Hash: the sha256 state of the replica
+// Output:  the error if the data can't be appended, the replica is
+//			unchanged then
+func appendStaged(stagingName string, sdfsFileName string, state hash.Hash) error {
+	partialPath := SDFSFILEPATH + stagingName + PARTIALSUFFIX
+	err := copyAppended(partialPath, SDFSFILEPATH + sdfsFileName, SDFSFILEPATH + stagingName, state)
+	if err == nil {
+		err = os.Remove(SDFSFILEPATH + stagingName)
+	}
+	if err == nil {
+		err = os.Link(SDFSFILEPATH + sdfsFileName, SDFSFILEPATH + stagingName)
+	}
+	if err == nil {
+		err = os.Rename(partialPath, SDFSFILEPATH + sdfsFileName)
+	}
+	if err != nil {
+		_ = os.Remove(partialPath)
+	}
+	return err
+}
+
+
+// func copyAppended(partialPath string, replicaPath string, stagedPath string, state hash.Hash) error
+// ------------------------------------------------------------------
+// Description: A helper function that writes a replica followed by the
+//				staged data to a new file
+// Input:   partialPath string: path to the new file
+//			replicaPath string: path to the replica
+//			stagedPath string: path to the staged data
+//			state hash.Hash: the sha256 state of the replica
+// Output:  the error if the file can't be written
+func copyAppended(partialPath string, replicaPath string, stagedPath string, state hash.Hash) error {
+	replica, err := os.Open(replicaPath)
+	if err != nil {
+		return err
+	}
+	defer replica.Close()
+	staged, err := os.Open(stagedPath)
+	if err != nil {
+		return err
+	}
+	defer staged.Close()
+	fileInfo, err := replica.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(partialPath, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, fileInfo.Mode())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, replica)
+	if err == nil {
+		_, err = io.Copy(io.MultiWriter(out, state), staged)
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+
+// func finishAppend(applyMap map[string]string, nodes []int, committed bool)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to tell the
+//				replicas whether an append they were asked to apply is
+//				committed
+// Input:   applyMap map[string]string: the content of the APPENDAPPLY
+//										message
+//			nodes []int: the node ids of the replicas
+//			committed bool: whether the append is committed
+// Output:  None
+func finishAppend(applyMap map[string]string, nodes []int, committed bool) {
+	finishMap := make(map[string]string)
+	finishMap[SDFSNAME] = applyMap[SDFSNAME]
+	finishMap[SENDERNAME] = applyMap[SENDERNAME]
+	finishMap[RECEIVERNAME] = applyMap[RECEIVERNAME]
+	finishMap[PUTSTATUS] = strconv.FormatBool(committed)
+	msgContent, _ := json.Marshal(finishMap)
+	msgSent := MakeMessage(APPENDFINISH, string(msgContent), strconv.Itoa(selfID))
+	for _, nodeID := range nodes {
+		if nodeID == selfID {
+			finishLocalAppend(finishMap)
+			continue
+		}
+		sendTCPRequest(nodeID, msgSent)
+	}
+}
+
+
+// func finishLocalAppend(finishMap map[string]string)
+// ------------------------------------------------------------------
+// Description: This function removes the version a replica kept during an
+//				append, or restores it if the append was not committed
+// Input:   finishMap map[string]string: the content of the APPENDFINISH
+//										 message
+// Output:  None
+func finishLocalAppend(finishMap map[string]string) {
+	stagingName := finishMap[SENDERNAME]
+	appendLock.Lock()
+	previous, applied := appliedAppends[stagingName]
+	delete(appliedAppends, stagingName)
+	appendLock.Unlock()
+
+	if finishMap[PUTSTATUS] == TRUE || !applied {
+		_ = os.Remove(SDFSFILEPATH + stagingName)
+		return
+	}
+	sdfsFileName := finishMap[SDFSNAME]
+	err := os.Rename(SDFSFILEPATH + stagingName, SDFSFILEPATH + sdfsFileName)
+	ErrorHandler("Can't restore replica " + sdfsFileName, err, false)
+	if err != nil {
+		return
+	}
+	recordStored(sdfsFileName, previous.checksum, previous.version)
+	if finishMap[RECEIVERNAME] != "" {
+		_ = os.Remove(SDFSFILEPATH + finishMap[RECEIVERNAME])
+	}
+
+	logMsg := fmt.Sprintf("Append to SDFS file %v was not committed, replica restored\n", sdfsFileName)
+	WriteLog(logFile, logMsg, false)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// This portion of code implements the rebalancer of the master node. The
+// utilization of a node is the share of its sdfs volume that is used, as
+// in its last NODEREPORT, and the imbalance score of the cluster is the
+// difference between the highest and the lowest utilization. Every
+// BALANCETIME the master node moves replicas from the most to the least
+// utilized nodes until the score is within the threshold:
+// 		1. a node takes part in at most one migration at a time
+//		2. the destination receives a copy from the source and is asked for
+//		   its checksum until it stores the file
+//		3. the replica slot is moved to the destination, the replica list
+//		   change is published and the copy on the source is deleted
+// A replica only moves to a node whose zone stores no other replica of
+// the file, or to the zone it leaves, so placement across failure domains
+// is kept. Files larger than half the difference in used bytes are not
+// moved, so that migrations never swap the roles of two nodes.
+
+// the imbalance score above which replicas are moved, set with -balance
+var balanceThreshold = 0.1
+
+// the state of the rebalancer on the master node, guarded by balanceLock
+type balanceState struct {
+	score float64
+	checked time.Time
+	migrating map[string]string
+	moving map[string]bool
+	moved int
+	failed int
+	bytesMoved int64
+}
+
+var balance = balanceState{migrating: make(map[string]string), moving: make(map[string]bool)}
+var balanceLock sync.Mutex
+
+
+// func nodeUtilization() map[string]float64
+// ------------------------------------------------------------------
+// Description: A helper function that computes the utilization of every
+//				live node that reported its capacity
+// Input:   None
+// Output:  maps node id to the used share of its sdfs volume
+func nodeUtilization() map[string]float64 {
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+	utilization := make(map[string]float64)
+	for nodeIDStr := range replicateCounter {
+		nodeID, _ := strconv.Atoi(nodeIDStr)
+		if _, ok := memberHost[nodeID]; !ok && nodeID != selfID {
+			continue
+		}
+		node := placementInfo(nodeIDStr)
+		if node.free < 0 || node.used + node.free == 0 {
+			continue
+		}
+		utilization[nodeIDStr] = float64(node.used) / float64(node.used + node.free)
+	}
+	return utilization
+}
+
+
+// func imbalanceScore(utilization map[string]float64) float64
+// ------------------------------------------------------------------
+// Description: A helper function that computes the imbalance score
+// Input:   utilization map[string]float64: the utilization of every node
+// Output:  the difference between the highest and the lowest utilization
+func imbalanceScore(utilization map[string]float64) float64 {
+	if len(utilization) < 2 {
+		return 0
+	}
+	low, high := 1.0, 0.0
+	for _, used := range utilization {
+		if used < low {
+			low = used
+		}
+		if used > high {
+			high = used
+		}
+	}
+	return high - low
+}
+
+
+// func balanceRoutine()
+// ------------------------------------------------------------------
+// Description: This routine computes the imbalance score every BALANCETIME
+//				on the master node, and starts migrations between the most
+//				and the least utilized nodes that are not migrating yet
+// Input:   None
+// Output:  None
+func balanceRoutine() {
+	for {
+		time.Sleep(BALANCETIME)
+		if !isMaster {
+			continue
+		}
+
+		utilization := nodeUtilization()
+		score := imbalanceScore(utilization)
+		balanceLock.Lock()
+		balance.score = score
+		balance.checked = time.Now()
+		threshold := balanceThreshold
+		balanceLock.Unlock()
+		if score <= threshold {
+			continue
+		}
+
+		nodes := make([]string, 0, len(utilization))
+		for nodeID := range utilization {
+			nodes = append(nodes, nodeID)
+		}
+		sort.Slice(nodes, func(i, j int) bool {
+			return utilization[nodes[i]] > utilization[nodes[j]]
+		})
+
+		// pair the fullest nodes with the emptiest ones
+		for i, j := 0, len(nodes) - 1; i < j; i, j = i + 1, j - 1 {
+			source, destination := nodes[i], nodes[j]
+			if utilization[source] - utilization[destination] <= threshold {
+				break
+			}
+			if !startMigration(source, destination) {
+				continue
+			}
+			go migrateReplica(source, destination)
+		}
+	}
+}
+
+
+// func startMigration(source string, destination string) bool
+// ------------------------------------------------------------------
+// Description: A helper function that marks two nodes as migrating
+// Input:   source string: the node id of the source
+//			destination string: the node id of the destination
+// Output:  false if either node takes part in a migration already
+func startMigration(source string, destination string) bool {
+	balanceLock.Lock()
+	defer balanceLock.Unlock()
+	for from, to := range balance.migrating {
+		if from == source || from == destination || to == source || to == destination {
+			return false
+		}
+	}
+	balance.migrating[source] = destination
+	return true
+}
+
+
+// func finishMigration(source string, size int64, err error)
+// ------------------------------------------------------------------
+// Description: A helper function that records the end of a migration
+// Input:   source string: the node id of the source
+//			size int64: the size of the moved replica
+//			err error: the reason the migration failed, nil if it succeeded
+// Output:  None
+func finishMigration(source string, size int64, err error) {
+	balanceLock.Lock()
+	defer balanceLock.Unlock()
+	delete(balance.migrating, source)
+	if err != nil {
+		balance.failed++
+		return
+	}
+	balance.moved++
+	balance.bytesMoved += size
+}
+
+
+// func pickMigration(source string, destination string) (string, string, int64)
+// ------------------------------------------------------------------
+// Description: A helper function that picks the replica that moves from a
+//				source to a destination: the largest one that fits on the
+//				destination, is at most half the difference in used bytes
+//				and keeps the replicas of its file on distinct zones
+// Input:   source string: the node id of the source
+//			destination string: the node id of the destination
+// Output:  the sdfs file, its replica slot on the source and its size,
+//			an empty name if no replica can move
+func pickMigration(source string, destination string) (string, string, int64) {
+	type candidate struct {
+		name string
+		slot string
+		size int64
+	}
+
+	fileLock.RLock()
+	from, to := placementInfo(source), placementInfo(destination)
+	limit := (from.used - to.used) / 2
+	if to.free < limit {
+		limit = to.free
+	}
+	candidates := make([]candidate, 0)
+	for sdfsFileName, sdfsMap := range replicateList {
+		fileSize, _ := strconv.ParseInt(sdfsMap[SDFSSIZE], 10, 64)
+		if fileSize > limit {
+			continue
+		}
+		slot := ""
+		movable := true
+		for _, key := range fileSlots(sdfsMap) {
+			nodeID := sdfsMap[key]
+			if nodeID == source {
+				slot = key
+			} else if nodeID == destination {
+				movable = false
+			} else if nodeID != "" && to.zone != from.zone && placementInfo(nodeID).zone == to.zone {
+				movable = false
+			}
+		}
+		if slot != "" && movable {
+			candidates = append(candidates, candidate{sdfsFileName, slot, fileSize})
+		}
+	}
+	fileLock.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].size > candidates[j].size
+	})
+
+	for _, c := range candidates {
+		// the shards of a file stay on distinct nodes
+		movable := true
+		if isShardName(c.name) {
+			parent, _ := shardParent(c.name)
+			for _, shard := range fileShards(parent) {
+				if isReplicaNode(shard, destination) {
+					movable = false
+				}
+			}
+		}
+		if movable {
+			return c.name, c.slot, c.size
+		}
+	}
+	return "", "", 0
+}
+
+
+// func migrateReplica(source string, destination string)
+// ------------------------------------------------------------------
+// Description: This function moves one replica from a source to a
+//				destination on the master node
+// Input:   source string: the node id of the source
+//			destination string: the node id of the destination
+// Output:  None
+func migrateReplica(source string, destination string) {
+	sdfsFileName, slot, fileSize := pickMigration(source, destination)
+	if sdfsFileName == "" {
+		balanceLock.Lock()
+		delete(balance.migrating, source)
+		balanceLock.Unlock()
+		return
+	}
+	balanceLock.Lock()
+	balance.moving[sdfsFileName] = true
+	balanceLock.Unlock()
+	err := moveReplica(sdfsFileName, slot, source, destination, fileSize)
+	balanceLock.Lock()
+	delete(balance.moving, sdfsFileName)
+	balanceLock.Unlock()
+	finishMigration(source, fileSize, err)
+	if err != nil {
+		logMsg := fmt.Sprintf("Can't move SDFS file %v from node %v to node %v: %v\n", sdfsFileName, source, destination, err.Error())
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+	}
+}
+
+
+// func moveReplica(sdfsFileName string, slot string, source string, destination string, fileSize int64) error
+// ------------------------------------------------------------------
+// Description: This function copies a replica to the destination, moves
+//				its replica slot and deletes the copy on the source
+// Input:   sdfsFileName string: the name of the sdfs file
+//			slot string: the replica slot of the source
+//			source string: the node id of the source
+//			destination string: the node id of the destination
+//			fileSize int64: the size of the file
+// Output:  the error if the destination did not store the file
+func moveReplica(sdfsFileName string, slot string, source string, destination string, fileSize int64) error {
+	fileLock.RLock()
+	checksum := replicateList[sdfsFileName][CHECKSUM]
+	fileLock.RUnlock()
+	if !reserveSpace(destination, fileSize) {
+		return fmt.Errorf("node %v has no room for %d bytes", destination, fileSize)
+	}
+
+	logMsg := fmt.Sprintf("Moving SDFS file %v from node %v to node %v\n", sdfsFileName, source, destination)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+
+	sourceID, _ := strconv.Atoi(source)
+	destinationID, _ := strconv.Atoi(destination)
+	requestTransfer(sourceID, sdfsFileName, sdfsFileName, SDFSNAME, checksum, destinationID)
+
+	if !waitStored(sdfsFileName, destinationID, checksum) {
+		deleteReplica(sdfsFileName, destinationID)
+		return fmt.Errorf("node %v did not store the file within %v", destination, STORETIMEOUT)
+	}
+
+	fileLock.Lock()
+	sdfsMap, ok := replicateList[sdfsFileName]
+	// the file may have been written again, deleted or repaired meanwhile
+	if !ok || sdfsMap[CHECKSUM] != checksum || sdfsMap[slot] != source {
+		fileLock.Unlock()
+		deleteReplica(sdfsFileName, destinationID)
+		return fmt.Errorf("the replica changed during the move")
+	}
+	sdfsMap[slot] = destination
+	replicateCounter[source]--
+	replicateCounter[destination]++
+	fileLock.Unlock()
+
+	publishReplicaDelta(sdfsFileName)
+	deleteReplica(sdfsFileName, sourceID)
+	return nil
+}
+
+
+// func handleBalance(threshold string)
+// ------------------------------------------------------------------
+// Description: This function handles the balance instruction which sets
+//				the imbalance score above which replicas are moved
+// Input:   threshold string: the threshold in percent of the volume
+// Output:  None
+func handleBalance(threshold string) {
+	percent, err := strconv.ParseFloat(threshold, 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		fmt.Println("Please enter the threshold as a percentage between 0 and 100")
+		return
+	}
+	balanceLock.Lock()
+	balanceThreshold = percent / 100
+	balanceLock.Unlock()
+
+	logMsg := fmt.Sprintf("Balance threshold set to %v%%\n", percent)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+}
+
+
+// func printBalanceStatus()
+// ------------------------------------------------------------------
+// Description: This function prints the imbalance score, the utilization
+//				of every node and the progress of the rebalancer
+// Input:   None
+// Output:  None
+func printBalanceStatus() {
+	if !isMaster {
+		fmt.Printf("The rebalancer runs on the master node: %v\n", memberHost[masterID])
+		return
+	}
+
+	utilization := nodeUtilization()
+	nodes := make([]string, 0, len(utilization))
+	for nodeID := range utilization {
+		nodes = append(nodes, nodeID)
+	}
+	sort.Strings(nodes)
+
+	balanceLock.Lock()
+	defer balanceLock.Unlock()
+	fmt.Printf("-->> Imbalance score: %.1f%%, threshold: %.1f%%, last checked: %v\n", balance.score * 100, balanceThreshold * 100, balance.checked.Format("15:04:05"))
+	fmt.Printf("-->> Moved %d replicas (%d bytes), %d migrations failed, %d in progress\n", balance.moved, balance.bytesMoved, balance.failed, len(balance.migrating))
+	for _, nodeID := range nodes {
+		fmt.Printf("->-> node %v: %.1f%% used\n", nodeID, utilization[nodeID] * 100)
+	}
+	for source, destination := range balance.migrating {
+		fmt.Printf("->-> moving a replica from node %v to node %v\n", source, destination)
+	}
+}
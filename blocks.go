@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// This portion of code implements block-based storage of large sdfs files.
+// A local file larger than BLOCKSIZE is split into blocks when it is put.
+// Every block is put as its own internal sdfs file
+// <sdfs name>@blk-<put id>-<index>, so that blocks are placed, replicated,
+// scrubbed and repaired independently. Blocks end on a line break, so
+// every block is also a valid maple input split. Once all blocks are
+// committed, the master node commits the sdfs file itself as an entry
+// without replicas that lists its blocks. Erasure-coded files (see
+// erasure.go) are committed the same way with their shards. Gets fetch the blocks and
+// reassemble them locally.
+
+// one block of a local file that is being put
+type blockPart struct {
+	localName string
+	checksum string
+	size int64
+}
+
+
+// func blockName(sdfsFileName string, putID string, index int) string
+// ------------------------------------------------------------------
+// Description: A helper function that gives the name a block of a large
+//				sdfs file is stored as
+// Input:   sdfsFileName string: the name of the sdfs file
+//			putID string: the id of the put that wrote the block
+//			index int: the index of the block in the file
+// Output:  the name of the block in the replica list
+func blockName(sdfsFileName string, putID string, index int) string {
+	return sdfsFileName + VERSIONSEP + BLOCKTAG + putID + "-" + strconv.Itoa(index)
+}
+
+
+// func fileBlocks(sdfsFileName string) []string
+// ------------------------------------------------------------------
+// Description: A helper function that lists the blocks of a sdfs file
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  the names of the blocks in order, empty if the file is not
+//			stored as blocks
+func fileBlocks(sdfsFileName string) []string {
+	fileLock.RLock()
+	blockList := replicateList[sdfsFileName][BLOCKLIST]
+	fileLock.RUnlock()
+	if blockList == "" {
+		return nil
+	}
+
+	var blocks []string
+	err := json.Unmarshal([]byte(blockList), &blocks)
+	ErrorHandler("Unmarshal error block list", err, false)
+	return blocks
+}
+
+
+// func inputSplits(sdfsFileName string) []string
+// ------------------------------------------------------------------
+// Description: A helper function that gives the maple input splits of a
+//				sdfs file, i.e. its blocks or the file itself
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  the sdfs names of the input splits
+func inputSplits(sdfsFileName string) []string {
+	if blocks := fileBlocks(sdfsFileName); len(blocks) > 0 {
+		return blocks
+	}
+	return []string{sdfsFileName}
+}
+
+
+// func splitBlocks(localFileName string) ([]blockPart, error)
+// ------------------------------------------------------------------
+// Description: This function splits a local file into blocks of about
+//				BLOCKSIZE bytes. Every block but the last one ends on a
+//				line break, unless no line break follows within
+//				LINEWINDOW bytes, then the block has exactly BLOCKSIZE bytes
+// Input:   localFileName string: the local file to be split
+// Output:  the blocks, stored as <local name>@blk-<index>, and the error
+//			if the file can't be split
+func splitBlocks(localFileName string) ([]blockPart, error) {
+	in, err := os.Open(LOCALFILEPATH + localFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	reader := bufio.NewReaderSize(in, int(LINEWINDOW))
+
+	var parts []blockPart
+	for index := 0; ; index++ {
+		part := blockPart{localName: localFileName + VERSIONSEP + BLOCKTAG + strconv.Itoa(index)}
+		out, err := os.Create(LOCALFILEPATH + part.localName)
+		if err != nil {
+			removeBlockParts(parts)
+			return nil, err
+		}
+
+		hash := sha256.New()
+		writer := io.MultiWriter(out, hash)
+		part.size, err = io.CopyN(writer, reader, BLOCKSIZE)
+		if err == nil {
+			// extend the block to the end of the current line, if it ends
+			// within the window
+			var window []byte
+			window, err = reader.Peek(int(LINEWINDOW))
+			rest := len(window)
+			if i := bytes.IndexByte(window, '\n'); i >= 0 {
+				rest = i + 1
+			} else if err == nil {
+				rest = 0
+			}
+			_, _ = writer.Write(window[:rest])
+			_, _ = reader.Discard(rest)
+			part.size += int64(rest)
+			// the bytes after the line break start the next block
+			if err == io.EOF && rest < len(window) {
+				err = nil
+			}
+		}
+		_ = out.Close()
+		part.checksum = hex.EncodeToString(hash.Sum(nil))
+
+		if err != nil && err != io.EOF {
+			removeBlockParts(append(parts, part))
+			return nil, err
+		}
+		if part.size == 0 {
+			_ = os.Remove(LOCALFILEPATH + part.localName)
+			return parts, nil
+		}
+		parts = append(parts, part)
+		if err == io.EOF {
+			return parts, nil
+		}
+	}
+}
+
+
+// func removeBlockParts(parts []blockPart)
+// ------------------------------------------------------------------
+// Description: A helper function that removes the local blocks of a put
+// Input:   parts []blockPart: the local blocks
+// Output:  None
+func removeBlockParts(parts []blockPart) {
+	for _, part := range parts {
+		_ = os.Remove(LOCALFILEPATH + part.localName)
+	}
+}
+
+
+// func putBlocks(localFileName string, sdfsFileName string, policy string, quorum int, factor int, checksum string, fileSize int64) error
+// ------------------------------------------------------------------
+// Description: This function puts a large local file as blocks. Every block
+//				is put with the write quorum of the file, then the master
+//				node commits the list of blocks under the conflict policy
+// Input:   localFileName string: local file name in the put instruction
+// 			sdfsFileName string: sdfs file name in the put instruction
+//			policy string: conflict policy of the put
+//			quorum int: write quorum of the put
+//			factor int: replication factor of the blocks
+//			checksum string: the checksum of the whole local file
+//			fileSize int64: the size of the whole local file
+// Output:  nil if the put is committed
+func putBlocks(localFileName string, sdfsFileName string, policy string, quorum int, factor int, checksum string, fileSize int64) error {
+	parts, err := splitBlocks(localFileName)
+	if err != nil {
+		logMsg := fmt.Sprintf("Can't execute put instruction. Local file %v can't be split into blocks: %v\n", localFileName, err.Error())
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		return err
+	}
+
+	logMsg := fmt.Sprintf("Distributing local file %v as SDFS file %v in %d blocks\n", localFileName, sdfsFileName, len(parts))
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+
+	putID := newRequestID()
+	blocks := make([]string, 0, len(parts))
+	for i, part := range parts {
+		block := blockName(sdfsFileName, putID, i)
+		err = putFile(part.localName, block, CONFLICTREJECT, quorum, factor, "", part.checksum, part.size)
+
+		// replicas beyond the quorum may still be reading the local block
+		path := LOCALFILEPATH + part.localName
+		time.AfterFunc(STORETIMEOUT, func() {
+			_ = os.Remove(path)
+		})
+
+		if err != nil {
+			removeBlockParts(parts[i + 1:])
+			for _, committed := range blocks {
+				handleDelete(committed)
+			}
+			fmt.Printf("Put SDFS file %v rejected: block %d failed: %v\n", sdfsFileName, i, err.Error())
+			return err
+		}
+		blocks = append(blocks, block)
+	}
+
+	blockList, _ := json.Marshal(blocks)
+	fields := make(map[string]string)
+	fields[BLOCKLIST] = string(blockList)
+	return commitPartsRequest(sdfsFileName, policy, checksum, fileSize, fields)
+}
+
+
+// func commitPartsRequest(sdfsFileName string, policy string, checksum string, fileSize int64, fields map[string]string) error
+// ------------------------------------------------------------------
+// Description: This function asks the master node to commit a sdfs file
+//				whose blocks or shards are all committed
+// Input:   sdfsFileName string: the sdfs file to be written
+//			policy string: conflict policy of the put
+//			checksum string: the checksum of the whole file
+//			fileSize int64: the size of the whole file
+//			fields map[string]string: the block list, or the shard list
+//									  with the erasure scheme
+// Output:  nil if the put is committed
+func commitPartsRequest(sdfsFileName string, policy string, checksum string, fileSize int64, fields map[string]string) error {
+	if isMaster {
+		version, err := commitParts(sdfsFileName, policy, checksum, fileSize, fields)
+		if err != nil {
+			fmt.Printf("Put SDFS file %v rejected: %v\n", sdfsFileName, err.Error())
+			return err
+		}
+		fmt.Printf("Put SDFS file %v committed as version %v\n", sdfsFileName, version)
+		return nil
+	}
+
+	putID, _ := newWaiter(1)
+	sentMap := make(map[string]string)
+	for key, value := range fields {
+		sentMap[key] = value
+	}
+	sentMap[SDFSNAME] = sdfsFileName
+	sentMap[PUTPOLICY] = policy
+	sentMap[PUTID] = putID
+	sentMap[CHECKSUM] = checksum
+	sentMap[SDFSSIZE] = strconv.FormatInt(fileSize, 10)
+
+	// the list of a large file does not fit into a datagram
+	msgContent, _ := json.Marshal(sentMap)
+	msgSent := MakeMessage(WRITEREQ, string(msgContent), strconv.Itoa(selfID))
+	sendTCPRequest(masterID, msgSent)
+
+	err := waitPutResponse(putID)
+	if err != nil {
+		fmt.Printf("Put SDFS file %v rejected: %v\n", sdfsFileName, err.Error())
+	}
+	return err
+}
+
+
+// func handleCommitParts(msgContent string, senderID int)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to commit the
+//				block list or shard list of a WRITEREQ message received
+//				over TCP and answer the writer
+// Input:   msgContent string: the content of the WRITEREQ message
+//			senderID int: the node id of the writer
+// Output:  None
+func handleCommitParts(msgContent string, senderID int) {
+	fields := make(map[string]string)
+	err := json.Unmarshal([]byte(msgContent), &fields)
+	ErrorHandler("Unmarshal error commit parts", err, false)
+	if err != nil {
+		return
+	}
+	fileSize, _ := strconv.ParseInt(fields[SDFSSIZE], 10, 64)
+	version, err := commitParts(fields[SDFSNAME], fields[PUTPOLICY], fields[CHECKSUM], fileSize, fields)
+	sendPutResponse(senderID, fields[PUTID], fields[SDFSNAME], version, err)
+}
+
+
+// func commitParts(sdfsFileName string, policy string, checksum string, fileSize int64, fields map[string]string) (int, error)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to commit a
+//				sdfs file whose blocks or shards are all committed. The
+//				blocks or shards are deleted if the conflict policy rejects
+//				the put
+// Input:   sdfsFileName string: the sdfs file to be written
+//			policy string: conflict policy of the put
+//			checksum string: the checksum of the whole file
+//			fileSize int64: the size of the whole file
+//			fields map[string]string: the block list, or the shard list
+//									  with the erasure scheme and put group
+// Output:  the version number of the new file and the rejection reason
+func commitParts(sdfsFileName string, policy string, checksum string, fileSize int64, fields map[string]string) (int, error) {
+	listKey, kind := BLOCKLIST, "blocks"
+	if fields[SHARDLIST] != "" {
+		listKey, kind = SHARDLIST, "shards"
+		defer releaseShardGroup(fields[PUTGROUP])
+	}
+	var parts []string
+	if err := json.Unmarshal([]byte(fields[listKey]), &parts); err != nil || len(parts) == 0 {
+		return 0, errors.New("invalid list of " + kind)
+	}
+
+	lockSDFSFile(sdfsFileName)
+	defer unlockSDFSFile(sdfsFileName)
+	conflictLock.Lock()
+	defer conflictLock.Unlock()
+
+	fileLock.RLock()
+	for _, part := range parts {
+		if _, ok := replicateList[part]; !ok {
+			fileLock.RUnlock()
+			return 0, fmt.Errorf("%v is not committed", part)
+		}
+	}
+	fileLock.RUnlock()
+
+	err := checkErasureScheme(sdfsFileName, fields[ECSCHEME])
+	version := 0
+	if err == nil {
+		version, err = resolveConflict(sdfsFileName, getConflictPolicy(sdfsFileName, policy))
+	}
+	if err != nil {
+		for _, part := range parts {
+			deleteSDFS(part)
+		}
+		return 0, err
+	}
+
+	newFile := make(map[string]string)
+	newFile[LASTUPDATE] = time.Now().Format("2006-01-02T15:04:05.000Z")
+	newFile[CHECKSUM] = checksum
+	newFile[SDFSSIZE] = strconv.FormatInt(fileSize, 10)
+	newFile[FILEVERSION] = strconv.Itoa(version)
+	newFile[listKey] = fields[listKey]
+	if fields[ECSCHEME] != "" {
+		newFile[ECSCHEME] = fields[ECSCHEME]
+	}
+
+	fileLock.Lock()
+	replicateList[sdfsFileName] = newFile
+	fileLock.Unlock()
+	publishReplicaDelta(sdfsFileName)
+
+	logMsg := fmt.Sprintf("SDFS file %v is stored as %d %v\n", sdfsFileName, len(parts), kind)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+	return version, nil
+}
+
+
+// func fileParts(sdfsFileName string) []string
+// ------------------------------------------------------------------
+// Description: A helper function that lists the blocks or the shards of
+//				a sdfs file
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  the names of the blocks or shards, empty if the file is stored
+//			as a whole
+func fileParts(sdfsFileName string) []string {
+	if shards := fileShards(sdfsFileName); len(shards) > 0 {
+		return shards
+	}
+	return fileBlocks(sdfsFileName)
+}
+
+
+// func getBlocks(localFileName string, sdfsFileName string, blocks []string, level string, quorum int)
+// ------------------------------------------------------------------
+// Description: This function handles the get of a sdfs file stored as
+//				blocks. All blocks are fetched at the same time with the
+//				consistency level of the get, then concatenated and checked
+//				against the checksum of the whole file
+// Input:   localFileName string: local file name in the get instruction
+// 			sdfsFileName string: the name of the sdfs file
+//			blocks []string: the names of the blocks
+//			level string: the consistency level, ONE, QUORUM or LATEST
+//			quorum int: the read quorum of QUORUM, 0 for a majority
+// Output:  None
+func getBlocks(localFileName string, sdfsFileName string, blocks []string, level string, quorum int) {
+	tempNames := make([]string, len(blocks))
+	for i, block := range blocks {
+		tempNames[i] = localFileName + VERSIONSEP + BLOCKTAG + strconv.Itoa(i)
+		_ = os.Remove(LOCALFILEPATH + tempNames[i])
+		handleGet(tempNames[i], block, false, level, quorum)
+	}
+	defer func() {
+		for _, tempName := range tempNames {
+			_ = os.Remove(LOCALFILEPATH + tempName)
+		}
+	}()
+
+	// the file is assembled aside and only moved in place when complete
+	partialPath := LOCALFILEPATH + localFileName + PARTIALSUFFIX
+	out, err := os.Create(partialPath)
+	if err != nil {
+		ErrorHandler("Can't create local file " + localFileName, err, false)
+		return
+	}
+	for i, tempName := range tempNames {
+		if !waitForLocalFile(LOCALFILEPATH + tempName, GETTIMEOUT) {
+			fmt.Printf("Block %d of SDFS file %v is not received in time, get failed\n", i, sdfsFileName)
+			_ = out.Close()
+			_ = os.Remove(partialPath)
+			return
+		}
+		in, err := os.Open(LOCALFILEPATH + tempName)
+		if err != nil {
+			ErrorHandler("Can't open block of " + sdfsFileName, err, false)
+			_ = out.Close()
+			_ = os.Remove(partialPath)
+			return
+		}
+		_, err = io.Copy(out, in)
+		ErrorHandler("Can't copy block of " + sdfsFileName, err, false)
+		_ = in.Close()
+	}
+	_ = out.Close()
+
+	if !verifyChecksum(partialPath, sdfsFileName) {
+		fmt.Printf("Reassembled SDFS file %v does not match its checksum, get failed\n", sdfsFileName)
+		_ = os.Remove(partialPath)
+		return
+	}
+	err = os.Rename(partialPath, LOCALFILEPATH + localFileName)
+	ErrorHandler("Can't move reassembled file " + localFileName, err, false)
+
+	logMsg := fmt.Sprintf("SDFS file %v is reassembled from %d blocks as %v\n", sdfsFileName, len(blocks), localFileName)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// This portion of code implements the write-conflict policies of SDFS.
+// When a put targets a sdfs file that already exists, the master node
+// decides what happens according to the policy of the put request, or
+// the policy of the longest matching sdfs prefix, or new-version:
+// 		1. reject: the put fails
+//		2. overwrite: the current version is replaced and not retained
+//		3. new-version: the current version is kept as an older version
+//		4. cas:<version>: the put only succeeds if the latest version equals
+//		   the expected version (0 means the file must not exist), and then
+//		   behaves like new-version
+// The policy is checked when the put starts and evaluated again when the
+// put is committed. The master node always answers a put request with a
+// PUTRESP message.
+
+// prefix policies kept by the master node and copied with the replica list,
+// maps sdfs prefix to policy
+var conflictPolicies = make(map[string]string)
+var policyLock sync.RWMutex
+
+// serializes conflict evaluation and replica list changes of puts
+var conflictLock sync.Mutex
+
+
+// func parseConflictPolicy(policy string) (string, int, error)
+// ------------------------------------------------------------------
+// Description: A helper function that parses a conflict policy
+// Input:   policy string: reject, overwrite, new-version or cas:<version>
+// Output:  the policy name, the expected version for cas and the parse error
+func parseConflictPolicy(policy string) (string, int, error) {
+	switch policy {
+	case CONFLICTREJECT, CONFLICTOVERWRITE, CONFLICTVERSION:
+		return policy, 0, nil
+	}
+	if strings.HasPrefix(policy, CONFLICTCAS + ":") {
+		expected, err := strconv.Atoi(strings.TrimPrefix(policy, CONFLICTCAS + ":"))
+		if err == nil && expected >= 0 {
+			return CONFLICTCAS, expected, nil
+		}
+	}
+	return "", 0, errors.New("unknown conflict policy " + policy)
+}
+
+
+// func getConflictPolicy(sdfsFileName string, policy string) string
+// ------------------------------------------------------------------
+// Description: A helper function that decides the policy of a put
+//				request on the master node
+// Input:   sdfsFileName string: the sdfs file to be written
+//			policy string: the policy sent with the request, may be empty
+// Output:  the policy applied to the put request
+func getConflictPolicy(sdfsFileName string, policy string) string {
+	if policy != "" {
+		return policy
+	}
+
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	matched := ""
+	policy = CONFLICTVERSION
+	for prefix, prefixPolicy := range conflictPolicies {
+		if strings.HasPrefix(sdfsFileName, prefix) && len(prefix) >= len(matched) {
+			matched = prefix
+			policy = prefixPolicy
+		}
+	}
+	return policy
+}
+
+
+// func checkConflict(sdfsFileName string, policy string) error
+// ------------------------------------------------------------------
+// Description: This function checks whether a put request violates its
+//				conflict policy. The caller must hold conflictLock
+// Input:   sdfsFileName string: the sdfs file to be written
+//			policy string: the policy applied to the put request
+// Output:  the rejection reason, nil if the put may proceed
+func checkConflict(sdfsFileName string, policy string) error {
+	name, expected, err := parseConflictPolicy(policy)
+	if err != nil {
+		return err
+	}
+
+	current := getVersion(sdfsFileName)
+	if name == CONFLICTCAS && current != expected {
+		return fmt.Errorf("expected version %d, latest version is %d", expected, current)
+	}
+	if name == CONFLICTREJECT && current != 0 {
+		return fmt.Errorf("SDFS file already exists with version %d", current)
+	}
+	return nil
+}
+
+
+// func resolveConflict(sdfsFileName string, policy string) (int, error)
+// ------------------------------------------------------------------
+// Description: This function evaluates the conflict policy of a put
+//				request and prepares the replica list for the new version.
+//				The caller must hold conflictLock
+// Input:   sdfsFileName string: the sdfs file to be written
+//			policy string: the policy applied to the put request
+// Output:  the version number of the new file and the rejection reason
+func resolveConflict(sdfsFileName string, policy string) (int, error) {
+	err := checkConflict(sdfsFileName, policy)
+	if err != nil {
+		return 0, err
+	}
+	current := getVersion(sdfsFileName)
+	if current == 0 {
+		return 1, nil
+	}
+
+	if policy == CONFLICTOVERWRITE {
+		logMsg := fmt.Sprintf("Overwriting SDFS file: %v\n", sdfsFileName)
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		// moved aside first so that the delete never hits the new version
+		renameSDFS(sdfsFileName, versionName(sdfsFileName, current))
+		deleteSDFS(versionName(sdfsFileName, current))
+		return current + 1, nil
+	}
+	return archiveFile(sdfsFileName), nil
+}
+
+
+// func sendPutResponse(nodeID int, putID string, sdfsFileName string, version int, err error)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to answer a
+//				put request
+// Input:   nodeID int: the node id of the node that sent the put request
+//			putID string: the id of the put request
+//			sdfsFileName string: the sdfs file to be written
+//			version int: the version number of the new file
+//			err error: the rejection reason, nil if the put is accepted
+// Output:  None
+func sendPutResponse(nodeID int, putID string, sdfsFileName string, version int, err error) {
+	sentMap := make(map[string]string)
+	sentMap[PUTID] = putID
+	sentMap[SDFSNAME] = sdfsFileName
+	sentMap[FILEVERSION] = strconv.Itoa(version)
+	sentMap[PUTSTATUS] = TRUE
+	if err != nil {
+		sentMap[PUTSTATUS] = FALSE
+		sentMap[PUTREASON] = err.Error()
+	}
+	msgContent, _ := json.Marshal(sentMap)
+	msgSent := MakeMessage(PUTRESP, string(msgContent), strconv.Itoa(selfID))
+	sendRequest(nodeID, msgSent)
+}
+
+
+// func waitPutResponse(putID string) error
+// ------------------------------------------------------------------
+// Description: This function waits for the response of a put request
+// Input:   putID string: the id of the put request
+// Output:  nil if the master node accepted the put request
+func waitPutResponse(putID string) error {
+	responseMap, ok := waitReply(putID, PUTTIMEOUT)
+	if !ok {
+		return errors.New("no response from master node")
+	}
+	if responseMap[PUTSTATUS] != TRUE {
+		return errors.New(responseMap[PUTREASON])
+	}
+	logMsg := fmt.Sprintf("Put SDFS file %v committed as version %v\n", responseMap[SDFSNAME], responseMap[FILEVERSION])
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+	return nil
+}
+
+
+// func handleConflictPolicy(sdfsPrefix string, policy string)
+// ------------------------------------------------------------------
+// Description: This function handles the conflict instruction which sets
+//				the policy of all sdfs files with a prefix. The policy
+//				none removes the policy of the prefix
+// Input:   sdfsPrefix string: the sdfs prefix
+//			policy string: the conflict policy
+// Output:  None
+func handleConflictPolicy(sdfsPrefix string, policy string) {
+	if _, _, err := parseConflictPolicy(policy); err != nil && policy != CONFLICTNONE {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if isMaster {
+		policyLock.Lock()
+		if policy == CONFLICTNONE {
+			delete(conflictPolicies, sdfsPrefix)
+		} else {
+			conflictPolicies[sdfsPrefix] = policy
+		}
+		policyLock.Unlock()
+		publishReplicaDelta()
+
+		logMsg := fmt.Sprintf("Conflict policy of SDFS prefix %v set to %v\n", sdfsPrefix, policy)
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		return
+	}
+
+	sentMap := make(map[string]string)
+	sentMap[SDFSNAME] = sdfsPrefix
+	sentMap[PUTPOLICY] = policy
+	msgContent, _ := json.Marshal(sentMap)
+	msgSent := MakeMessage(CONFLICTPOLICY, string(msgContent), strconv.Itoa(selfID))
+	sendRequest(masterID, msgSent)
+}
+
+
+// func printConflictPolicies()
+// ------------------------------------------------------------------
+// Description: This function prints the prefix policies on the master node
+// Input:   None
+// Output:  None
+func printConflictPolicies() {
+	if !isMaster {
+		fmt.Printf("Conflict policies are kept by the master node: %v\n", memberHost[masterID])
+		return
+	}
+
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	prefixes := make([]string, 0, len(conflictPolicies))
+	for prefix := range conflictPolicies {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	fmt.Printf("-->> Default conflict policy: %v\n", CONFLICTVERSION)
+	for _, prefix := range prefixes {
+		fmt.Printf("->-> %v*: %v\n", prefix, conflictPolicies[prefix])
+	}
+}
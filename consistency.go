@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// This portion of code implements the read consistency levels of get:
+// 		1. ONE: the file is fetched directly from any replica in the local
+//		   replica list, without going through the master node
+//		2. QUORUM: R replicas are asked for the version they store and the
+//		   file is fetched from the replica with the newest version. Replicas
+//		   found with an older version are repaired by the newest replica
+//		3. LATEST: the request goes through the master node, which sends the
+//		   committed checksum along so that only the committed version is
+//		   accepted
+// R defaults to a majority of the replicas.
+
+
+// func parseConsistency(level string) error
+// ------------------------------------------------------------------
+// Description: A helper function that validates a read consistency level
+// Input:   level string: the consistency level
+// Output:  nil if the level is ONE, QUORUM or LATEST
+func parseConsistency(level string) error {
+	if level == READONE || level == READQUORUM || level == READLATEST {
+		return nil
+	}
+	return errors.New("unknown consistency level " + level)
+}
+
+
+// func liveReplicas(sdfsFileName string) []int
+// ------------------------------------------------------------------
+// Description: A helper function that lists the replicas of a sdfs file
+//				in the local replica list that are still members
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  the node ids of the replicas
+func liveReplicas(sdfsFileName string) []int {
+	fileLock.RLock()
+	sdfsMap := replicateList[sdfsFileName]
+	slots := fileSlots(sdfsMap)
+	nodes := make([]int, 0, len(slots))
+	for _, key := range slots {
+		if sdfsMap[key] == "" {
+			continue
+		}
+		nodeID, _ := strconv.Atoi(sdfsMap[key])
+		if _, ok := memberHost[nodeID]; ok || nodeID == selfID {
+			nodes = append(nodes, nodeID)
+		}
+	}
+	fileLock.RUnlock()
+	return nodes
+}
+
+
+// func requestTransfer(senderID int, sdfsFileName string, receiverName string, receiverType string, checksum string, receiverID int)
+// ------------------------------------------------------------------
+// Description: This function asks a replica to send its copy of a sdfs file
+// Input:   senderID int: the node id of the replica
+//			sdfsFileName string: the name of the sdfs file
+//			receiverName string: the name the file is stored as
+//			receiverType string: LOCALNAME or SDFSNAME, where the file is stored
+//			checksum string: the checksum the copy must have, empty for the
+//							 checksum in the replica list of the sender
+//			receiverID int: the node id of the node that receives the file
+// Output:  None
+func requestTransfer(senderID int, sdfsFileName string, receiverName string, receiverType string, checksum string, receiverID int) {
+	if senderID == selfID {
+		WriteToNode(sdfsFileName, SDFSNAME, receiverName, receiverType, receiverID, checksum)
+		return
+	}
+
+	receiverMap := make(map[string]string)
+	receiverMap[SENDERNAME] = sdfsFileName
+	receiverMap[RECEIVERNAME] = receiverName
+	receiverMap[SENDERTYPE] = SDFSNAME
+	receiverMap[RECEIVERTYPE] = receiverType
+	receiverMap[REPLICAONE] = strconv.Itoa(receiverID)
+	receiverMap[CHECKSUM] = checksum
+	msgContent, _ := json.Marshal(receiverMap)
+	msgSent := MakeMessage(WRITE, string(msgContent), strconv.Itoa(selfID))
+	sendRequest(senderID, msgSent)
+}
+
+
+// func getFromOne(localFileName string, sdfsFileName string)
+// ------------------------------------------------------------------
+// Description: This function handles a get with consistency level ONE.
+//				The replica is picked by locality and load, a local
+//				replica first
+// Input:   localFileName string: local file name in the get instruction
+// 			sdfsFileName string: sdfs file name in the get instruction
+// Output:  None
+func getFromOne(localFileName string, sdfsFileName string) {
+	sdfsFileName = resolveVersionName(sdfsFileName)
+	nodes := liveReplicas(sdfsFileName)
+	if len(nodes) == 0 {
+		fmt.Printf("SDFS File: %v doesn't exist\n", sdfsFileName)
+		removePendingGet(localFileName)
+		return
+	}
+
+	senderID := pickLocalRead(nodes, Exist(SDFSFILEPATH + sdfsFileName))
+	requestTransfer(senderID, sdfsFileName, localFileName, LOCALNAME, "", selfID)
+}
+
+
+// func getFromQuorum(localFileName string, sdfsFileName string, quorum int)
+// ------------------------------------------------------------------
+// Description: This function handles a get with consistency level QUORUM.
+//				The replicas are asked for their version and the file is
+//				fetched from the newest of the first R replies
+// Input:   localFileName string: local file name in the get instruction
+// 			sdfsFileName string: sdfs file name in the get instruction
+//			quorum int: the read quorum, 0 for a majority of the replicas
+// Output:  None
+func getFromQuorum(localFileName string, sdfsFileName string, quorum int) {
+	sdfsFileName = resolveVersionName(sdfsFileName)
+	nodes := liveReplicas(sdfsFileName)
+	if len(nodes) == 0 {
+		fmt.Printf("SDFS File: %v doesn't exist\n", sdfsFileName)
+		removePendingGet(localFileName)
+		return
+	}
+	if quorum == 0 {
+		quorum = len(nodes) / 2 + 1
+	}
+	if quorum > len(nodes) {
+		fmt.Printf("Read quorum %d exceeds the %d live replicas of SDFS file %v\n", quorum, len(nodes), sdfsFileName)
+		removePendingGet(localFileName)
+		return
+	}
+
+	replies, err := queryVersions(sdfsFileName, nodes, quorum)
+	if err != nil {
+		fmt.Printf("Can't read SDFS file %v: %v\n", sdfsFileName, err.Error())
+		removePendingGet(localFileName)
+		return
+	}
+
+	newest := replies[0]
+	for _, reply := range replies {
+		if reply.version > newest.version {
+			newest = reply
+		}
+	}
+	if newest.checksum == "" {
+		fmt.Printf("SDFS File: %v doesn't exist on any of %d replicas\n", sdfsFileName, quorum)
+		removePendingGet(localFileName)
+		return
+	}
+
+	logMsg := fmt.Sprintf("Reading version %v of SDFS file %v from node %v\n", newest.version, sdfsFileName, newest.nodeID)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+	requestTransfer(newest.nodeID, sdfsFileName, localFileName, LOCALNAME, newest.checksum, selfID)
+
+	// read-repair replicas with an older version
+	for _, reply := range replies {
+		if reply.version >= newest.version || reply.checksum == newest.checksum {
+			continue
+		}
+		logMsg := fmt.Sprintf("Read repair: node %v stores version %v of SDFS file %v, sending version %v\n", reply.nodeID, reply.version, sdfsFileName, newest.version)
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		requestTransfer(newest.nodeID, sdfsFileName, sdfsFileName, SDFSNAME, newest.checksum, reply.nodeID)
+	}
+}
+
+
+// one reply to a version query
+type versionReply struct {
+	nodeID int
+	version int
+	checksum string
+}
+
+
+// func queryVersions(sdfsFileName string, nodes []int, quorum int) ([]versionReply, error)
+// ------------------------------------------------------------------
+// Description: This function asks replicas which version of a sdfs file
+//				they store and waits for the first quorum replies
+// Input:   sdfsFileName string: the name of the sdfs file
+//			nodes []int: the node ids of the replicas
+//			quorum int: the number of replies to wait for
+// Output:  the replies and the error if not enough replicas replied
+func queryVersions(sdfsFileName string, nodes []int, quorum int) ([]versionReply, error) {
+	readID, response := newWaiter(len(nodes))
+	defer removeWaiter(readID)
+
+	queryMap := make(map[string]string)
+	queryMap[READID] = readID
+	queryMap[SDFSNAME] = sdfsFileName
+	msgContent, _ := json.Marshal(queryMap)
+	msgSent := MakeMessage(VERSIONQUERY, string(msgContent), strconv.Itoa(selfID))
+	for _, nodeID := range nodes {
+		if nodeID == selfID {
+			response <- storedVersionMap(readID, sdfsFileName)
+			continue
+		}
+		sendRequest(nodeID, msgSent)
+	}
+
+	replies := make([]versionReply, 0, quorum)
+	timeout := time.After(READTIMEOUT)
+	for len(replies) < quorum {
+		select {
+		case replyMap := <-response:
+			nodeID, _ := strconv.Atoi(replyMap[RECEIVERID])
+			version, _ := strconv.Atoi(replyMap[FILEVERSION])
+			replies = append(replies, versionReply{nodeID, version, replyMap[CHECKSUM]})
+		case <-timeout:
+			return replies, fmt.Errorf("only %d of %d replicas answered within %v", len(replies), quorum, READTIMEOUT)
+		}
+	}
+	return replies, nil
+}
+
+
+// func waitStored(sdfsFileName string, nodeID int, checksum string) bool
+// ------------------------------------------------------------------
+// Description: This function asks a node for its copy of a sdfs file until
+//				the copy has a checksum or STORETIMEOUT passes
+// Input:   sdfsFileName string: the name of the sdfs file
+//			nodeID int: the node id of the node
+//			checksum string: the checksum the copy must have
+// Output:  true if the node stores the copy in time
+func waitStored(sdfsFileName string, nodeID int, checksum string) bool {
+	deadline := time.Now().Add(STORETIMEOUT)
+	for time.Now().Before(deadline) {
+		time.Sleep(READTIMEOUT)
+		replies, _ := queryVersions(sdfsFileName, []int{nodeID}, 1)
+		if len(replies) == 1 && replies[0].checksum == checksum {
+			return true
+		}
+	}
+	return false
+}
+
+
+// func storedVersionMap(readID string, sdfsFileName string) map[string]string
+// ------------------------------------------------------------------
+// Description: A helper function that builds the reply to a version query
+//				from the local store index
+// Input:   readID string: the id of the version query
+//			sdfsFileName string: the name of the sdfs file
+// Output:  the content of the VERSIONREPLY message
+func storedVersionMap(readID string, sdfsFileName string) map[string]string {
+	replyMap := make(map[string]string)
+	replyMap[READID] = readID
+	replyMap[SDFSNAME] = sdfsFileName
+	replyMap[RECEIVERID] = strconv.Itoa(selfID)
+	replyMap[FILEVERSION] = "0"
+	if stored, ok := lookupStored(sdfsFileName); ok {
+		replyMap[FILEVERSION] = strconv.Itoa(stored.version)
+		replyMap[CHECKSUM] = stored.checksum
+	}
+	return replyMap
+}
+
+
+// func handleVersionQuery(msgContent string, senderID int)
+// ------------------------------------------------------------------
+// Description: This function answers a version query with the version
+//				of the replica this node stores
+// Input:   msgContent string: the content of the VERSIONQUERY message
+//			senderID int: the node id of the reader
+// Output:  None
+func handleVersionQuery(msgContent string, senderID int) {
+	queryMap := make(map[string]string)
+	err := json.Unmarshal([]byte(msgContent), &queryMap)
+	ErrorHandler("Unmarshal error version query", err, false)
+
+	replyMap := storedVersionMap(queryMap[READID], queryMap[SDFSNAME])
+	replyContent, _ := json.Marshal(replyMap)
+	msgSent := MakeMessage(VERSIONREPLY, string(replyContent), strconv.Itoa(selfID))
+	sendRequest(senderID, msgSent)
+}
+
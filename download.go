@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// This portion of code implements parallel gets of large sdfs files. A
+// file of at least PARALLELSIZE bytes is split into chunks of PARALLELCHUNK
+// bytes that are read with range reads from all live replicas at once:
+// 		1. every replica reads one chunk at a time, the next chunk goes to
+//		   the first idle replica that stores it
+//		2. a replica that fails is dropped and its chunk goes to another
+//		   replica
+//		3. a chunk that takes STRAGGLERFACTOR times as long as the average
+//		   chunk is read again from an idle replica, the first copy wins and
+//		   the slow replica gets no further chunks
+//		4. once all chunks of the file, or of one of its blocks, are read,
+//		   they are checked against the checksum of the file or the block.
+//		   On a mismatch the chunks are read again from the other replicas
+// A get with consistency level LATEST checks with the master node that the
+// local replica list knows the committed version. If the parallel get
+// fails, the file is fetched as usual.
+
+// a file, or a block of a file, that is read in chunks
+type getEntry struct {
+	name string
+	checksum string
+	size int64
+	// where the entry starts in the local file
+	outOffset int64
+	nodes []int
+	excluded map[int]bool
+	chunks []*getChunk
+	remaining int
+}
+
+// a range of an entry that is read from one replica
+type getChunk struct {
+	entry *getEntry
+	offset int64
+	length int64
+	done bool
+	servedBy int
+	// the replicas that are reading the chunk and since when
+	running map[int]time.Time
+}
+
+// the bytes of a chunk read by a replica
+type chunkResult struct {
+	chunk *getChunk
+	nodeID int
+	data []byte
+	err error
+}
+
+
+// func parallelGet(localFileName string, sdfsFileName string, level string) error
+// ------------------------------------------------------------------
+// Description: This function reads a sdfs file in chunks from all its
+//				live replicas at once and stores it in the local directory
+// Input:   localFileName string: local file name in the get instruction
+// 			sdfsFileName string: the name of the sdfs file
+//			level string: the consistency level, ONE or LATEST
+// Output:  nil if the file is stored
+func parallelGet(localFileName string, sdfsFileName string, level string) error {
+	entries, err := getEntries(sdfsFileName, level)
+	if err != nil {
+		return err
+	}
+	var total int64
+	pending := make([]*getChunk, 0)
+	for _, entry := range entries {
+		total += entry.size
+		pending = append(pending, entry.chunks...)
+	}
+	left := len(pending)
+
+	// the file is assembled aside and only moved in place when complete
+	partialPath := LOCALFILEPATH + localFileName + PARTIALSUFFIX
+	out, err := os.Create(partialPath)
+	if err == nil {
+		err = out.Truncate(total)
+	}
+	if err != nil {
+		return err
+	}
+	succeeded := false
+	defer func() {
+		_ = out.Close()
+		if !succeeded {
+			_ = os.Remove(partialPath)
+		}
+	}()
+
+	results := make(chan chunkResult)
+	done := make(chan struct{})
+	defer close(done)
+	ticker := time.NewTicker(CHECKTIME)
+	defer ticker.Stop()
+	busy := make(map[int]*getChunk)
+	dropped := make(map[int]bool)
+	used := make(map[int]bool)
+	var chunkTime time.Duration
+	chunksRead := 0
+	start := time.Now()
+
+	for left > 0 {
+		// hand the pending chunks to idle replicas
+		waiting := pending[:0]
+		for _, chunk := range pending {
+			nodeID := idleReplica(chunk, busy, dropped)
+			if nodeID < 0 {
+				waiting = append(waiting, chunk)
+				continue
+			}
+			startChunk(chunk, nodeID, busy, results, done)
+		}
+		pending = waiting
+		if len(busy) == 0 {
+			return fmt.Errorf("no replica can send %v", pending[0].entry.name)
+		}
+
+		// read the chunks of slow replicas again
+		if chunksRead > 0 {
+			threshold := STRAGGLERFACTOR * chunkTime / time.Duration(chunksRead)
+			if threshold < STRAGGLERMIN {
+				threshold = STRAGGLERMIN
+			}
+			for nodeID, chunk := range busy {
+				if time.Since(chunk.running[nodeID]) < threshold || len(chunk.running) > 1 {
+					continue
+				}
+				dropped[nodeID] = true
+				if other := idleReplica(chunk, busy, dropped); other >= 0 {
+					logMsg := fmt.Sprintf("Node %v is slow to send %v, reading the chunk from node %v\n", nodeID, chunk.entry.name, other)
+					WriteLog(logFile, logMsg, false)
+					startChunk(chunk, other, busy, results, done)
+				}
+			}
+		}
+
+		select {
+		case result := <-results:
+			chunk := result.chunk
+			delete(busy, result.nodeID)
+			elapsed := time.Since(chunk.running[result.nodeID])
+			delete(chunk.running, result.nodeID)
+			if chunk.done {
+				continue
+			}
+			if result.err != nil {
+				dropped[result.nodeID] = true
+				chunk.entry.excluded[result.nodeID] = true
+				logMsg := fmt.Sprintf("Node %v failed to send %v: %v\n", result.nodeID, chunk.entry.name, result.err.Error())
+				WriteLog(logFile, logMsg, false)
+				if len(chunk.running) == 0 {
+					pending = append(pending, chunk)
+				}
+				continue
+			}
+
+			_, err = out.WriteAt(result.data, chunk.entry.outOffset + chunk.offset)
+			if err != nil {
+				return err
+			}
+			chunk.done = true
+			chunk.servedBy = result.nodeID
+			used[result.nodeID] = true
+			chunkTime += elapsed
+			chunksRead++
+			left--
+			chunk.entry.remaining--
+			if chunk.entry.remaining == 0 && !verifyEntry(out, chunk.entry) {
+				// the chunks are read again from the other replicas
+				logMsg := fmt.Sprintf("%v read in parallel does not match its checksum, reading it again\n", chunk.entry.name)
+				WriteLog(logFile, logMsg, false)
+				for _, retry := range chunk.entry.chunks {
+					chunk.entry.excluded[retry.servedBy] = true
+					retry.done = false
+					pending = append(pending, retry)
+				}
+				chunk.entry.remaining = len(chunk.entry.chunks)
+				left += len(chunk.entry.chunks)
+			}
+		case <-ticker.C:
+		}
+	}
+
+	err = out.Close()
+	if err == nil {
+		err = os.Rename(partialPath, LOCALFILEPATH + localFileName)
+	}
+	if err != nil {
+		return err
+	}
+	succeeded = true
+
+	logMsg := fmt.Sprintf("SDFS file %v is read in %d chunks from %d replicas in %v as %v\n", sdfsFileName, chunksRead, len(used), time.Since(start).Round(time.Millisecond), localFileName)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+	return nil
+}
+
+
+// func getEntries(sdfsFileName string, level string) ([]*getEntry, error)
+// ------------------------------------------------------------------
+// Description: A helper function that splits a sdfs file, or each of its
+//				blocks, into chunks
+// Input:   sdfsFileName string: the name of the sdfs file
+//			level string: the consistency level, ONE or LATEST
+// Output:  the entries in the order of the file and the error if the file
+//			can't be read in parallel
+func getEntries(sdfsFileName string, level string) ([]*getEntry, error) {
+	fileLock.RLock()
+	sdfsMap, ok := replicateList[sdfsFileName]
+	checksum := sdfsMap[CHECKSUM]
+	fileLock.RUnlock()
+	if !ok {
+		return nil, errors.New("sdfs file does not exist")
+	}
+	// older versions do not change, the latest version is known by the master
+	if level == READLATEST && !isInternalName(sdfsFileName) {
+		listing, err := queryListing(sdfsFileName)
+		if err != nil {
+			return nil, err
+		}
+		committed := ""
+		for _, file := range listing {
+			if file.Name == sdfsFileName {
+				committed = file.Checksum
+			}
+		}
+		if committed == "" || committed != checksum {
+			return nil, errors.New("the local replica list does not know the committed version")
+		}
+	}
+
+	names := fileBlocks(sdfsFileName)
+	if len(names) == 0 {
+		names = []string{sdfsFileName}
+	}
+	entries := make([]*getEntry, 0, len(names))
+	var outOffset int64
+	for _, name := range names {
+		fileLock.RLock()
+		entry := &getEntry{
+			name: name,
+			checksum: replicateList[name][CHECKSUM],
+			outOffset: outOffset,
+			excluded: make(map[int]bool),
+		}
+		fileLock.RUnlock()
+		entry.size = sdfsFileSize(name)
+		entry.nodes = liveReplicas(name)
+		if len(entry.nodes) == 0 {
+			return nil, errors.New("no live replica of " + name)
+		}
+		for offset := int64(0); offset < entry.size; offset += PARALLELCHUNK {
+			length := PARALLELCHUNK
+			if offset + length > entry.size {
+				length = entry.size - offset
+			}
+			chunk := &getChunk{entry: entry, offset: offset, length: length, running: make(map[int]time.Time)}
+			entry.chunks = append(entry.chunks, chunk)
+		}
+		entry.remaining = len(entry.chunks)
+		entries = append(entries, entry)
+		outOffset += entry.size
+	}
+	return entries, nil
+}
+
+
+// func idleReplica(chunk *getChunk, busy map[int]*getChunk, dropped map[int]bool) int
+// ------------------------------------------------------------------
+// Description: A helper function that picks a replica that can read a
+//				chunk now, by locality and load
+// Input:   chunk *getChunk: the chunk
+//			busy map[int]*getChunk: the chunk every busy replica reads
+//			dropped map[int]bool: the replicas that get no further chunks
+// Output:  the node id of the replica, -1 if no replica is idle
+func idleReplica(chunk *getChunk, busy map[int]*getChunk, dropped map[int]bool) int {
+	idle := make([]int, 0, len(chunk.entry.nodes))
+	for _, nodeID := range chunk.entry.nodes {
+		if _, ok := busy[nodeID]; ok || dropped[nodeID] || chunk.entry.excluded[nodeID] {
+			continue
+		}
+		if _, ok := chunk.running[nodeID]; ok {
+			continue
+		}
+		idle = append(idle, nodeID)
+	}
+	if len(idle) == 0 {
+		return -1
+	}
+	return pickLocalRead(idle, true)
+}
+
+
+// func startChunk(chunk *getChunk, nodeID int, busy map[int]*getChunk, results chan chunkResult, done chan struct{})
+// ------------------------------------------------------------------
+// Description: A helper function that lets a replica read a chunk
+// Input:   chunk *getChunk: the chunk
+//			nodeID int: the node id of the replica
+//			busy map[int]*getChunk: the chunk every busy replica reads
+//			results chan chunkResult: where the bytes are sent
+//			done chan struct{}: closed when the get ends
+// Output:  None
+func startChunk(chunk *getChunk, nodeID int, busy map[int]*getChunk, results chan chunkResult, done chan struct{}) {
+	busy[nodeID] = chunk
+	chunk.running[nodeID] = time.Now()
+	name, offset, length, checksum := chunk.entry.name, chunk.offset, chunk.length, chunk.entry.checksum
+	go func() {
+		data, err := fetchChunk(nodeID, name, offset, length, checksum)
+		select {
+		case results <- chunkResult{chunk, nodeID, data, err}:
+		case <-done:
+		}
+	}()
+}
+
+
+// func fetchChunk(nodeID int, fileName string, offset int64, length int64, checksum string) ([]byte, error)
+// ------------------------------------------------------------------
+// Description: A helper function that reads a range of a replica
+// Input:   nodeID int: the node id of the replica
+//			fileName string: the name of the replica
+//			offset int64: the first byte
+//			length int64: the number of bytes
+//			checksum string: the checksum the copy must have
+// Output:  the bytes and the error if the replica can't send them
+func fetchChunk(nodeID int, fileName string, offset int64, length int64, checksum string) ([]byte, error) {
+	var reader io.ReadCloser
+	var stored string
+	var err error
+	if nodeID == selfID {
+		reader, _, stored, err = openLocalRange(fileName, offset, length)
+	} else {
+		reader, stored, err = dialRange(nodeID, fileName, offset, length)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if checksum != "" && stored != checksum {
+		return nil, errors.New("replica stores another version")
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(reader, data)
+	return data, err
+}
+
+
+// func verifyEntry(out *os.File, entry *getEntry) bool
+// ------------------------------------------------------------------
+// Description: A helper function that checks the bytes of an entry in
+//				the local file against its checksum
+// Input:   out *os.File: the local file
+//			entry *getEntry: the entry
+// Output:  true if the checksum matches or is unknown
+func verifyEntry(out *os.File, entry *getEntry) bool {
+	if entry.checksum == "" {
+		return true
+	}
+	hash := sha256.New()
+	_, err := io.Copy(hash, io.NewSectionReader(out, entry.outOffset, entry.size))
+	return err == nil && hex.EncodeToString(hash.Sum(nil)) == entry.checksum
+}
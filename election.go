@@ -118,7 +118,10 @@ func coordinator(failNodeID int) {
 	// current node becomes the master node
 	isMaster = true
 	masterID = selfID
+	resetPublishedDelta()
 	updateReplicaList(strconv.Itoa(failNodeID))
+	// the repair queue of the old master node is lost
+	go rebuildRepairQueue()
 	msgSent := MakeMessage(COORDINATOR, "", strconv.Itoa(selfID))
 
 	time.Sleep(100 * time.Millisecond)
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// This portion of code implements the erasure-coded storage class of SDFS.
+// A file put with an erasure scheme <k>+<m>, or under a prefix with an
+// erasure rule on the master node, is encoded by the writer into k data
+// shards and m parity shards (see reedsolomon.go). Every shard is put as an
+// internal sdfs file <sdfs name>@ec-<put id>-<index> with a single replica,
+// and the master node places the shards of one put on distinct nodes. The
+// file itself is committed like a file stored as blocks, as an entry that
+// lists its shards and its scheme. Gets fetch any k shards and rebuild the
+// missing data shards. When a node fails, the master node rebuilds only the
+// shards that node stored from k other shards.
+
+// prefix erasure schemes kept by the master node and copied with the
+// replica list, guarded by policyLock
+var erasurePolicies = make(map[string]string)
+
+// nodes that already store a shard of a put, maps put id to node ids
+var shardGroups = make(map[string]map[string]bool)
+var groupLock sync.Mutex
+
+
+// func shardName(sdfsFileName string, putID string, index int) string
+// ------------------------------------------------------------------
+// Description: A helper function that gives the name a shard of an
+//				erasure-coded sdfs file is stored as
+// Input:   sdfsFileName string: the name of the sdfs file
+//			putID string: the id of the put that wrote the shard
+//			index int: the index of the shard, data shards first
+// Output:  the name of the shard in the replica list
+func shardName(sdfsFileName string, putID string, index int) string {
+	return sdfsFileName + VERSIONSEP + ECTAG + putID + "-" + strconv.Itoa(index)
+}
+
+
+// func isShardName(sdfsFileName string) bool
+// ------------------------------------------------------------------
+// Description: A helper function that checks whether an entry of the
+//				replica list is a shard of an erasure-coded file
+// Input:   sdfsFileName string: the name of the entry
+// Output:  true if the entry is a shard
+func isShardName(sdfsFileName string) bool {
+	return strings.Contains(sdfsFileName, VERSIONSEP + ECTAG)
+}
+
+
+// func fileShards(sdfsFileName string) []string
+// ------------------------------------------------------------------
+// Description: A helper function that lists the shards of a sdfs file
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  the names of the shards in order, empty if the file is not
+//			erasure coded
+func fileShards(sdfsFileName string) []string {
+	fileLock.RLock()
+	shardList := replicateList[sdfsFileName][SHARDLIST]
+	fileLock.RUnlock()
+	if shardList == "" {
+		return nil
+	}
+
+	var shards []string
+	err := json.Unmarshal([]byte(shardList), &shards)
+	ErrorHandler("Unmarshal error shard list", err, false)
+	return shards
+}
+
+
+// func shardParent(shard string) (string, int)
+// ------------------------------------------------------------------
+// Description: A helper function that finds the erasure-coded file a
+//				shard belongs to
+// Input:   shard string: the name of the shard
+// Output:  the name of the file and the index of the shard, an empty
+//			name if no file lists the shard
+func shardParent(shard string) (string, int) {
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+	for sdfsFileName, sdfsMap := range replicateList {
+		if sdfsMap[SHARDLIST] == "" || !strings.HasPrefix(shard, sdfsFileName + VERSIONSEP) {
+			continue
+		}
+		var shards []string
+		_ = json.Unmarshal([]byte(sdfsMap[SHARDLIST]), &shards)
+		for index, name := range shards {
+			if name == shard {
+				return sdfsFileName, index
+			}
+		}
+	}
+	return "", 0
+}
+
+
+// func getErasureScheme(sdfsFileName string, scheme string) string
+// ------------------------------------------------------------------
+// Description: A helper function that decides the erasure scheme of a put
+//				request on the master node. Internal names are never
+//				erasure coded
+// Input:   sdfsFileName string: the sdfs file to be written
+//			scheme string: the scheme given with the put, may be empty
+// Output:  the erasure scheme, empty for a replicated file
+func getErasureScheme(sdfsFileName string, scheme string) string {
+	if scheme != "" || isInternalName(sdfsFileName) {
+		return scheme
+	}
+
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	matched := ""
+	for prefix, prefixScheme := range erasurePolicies {
+		if strings.HasPrefix(sdfsFileName, prefix) && len(prefix) >= len(matched) {
+			matched = prefix
+			scheme = prefixScheme
+		}
+	}
+	return scheme
+}
+
+
+// func checkErasureScheme(sdfsFileName string, scheme string) error
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to check that a
+//				put without an erasure scheme is not under a prefix with an
+//				erasure rule the writer did not know yet
+// Input:   sdfsFileName string: the sdfs file to be written
+//			scheme string: the erasure scheme of the put, empty for a
+//						   replicated file
+// Output:  the rejection reason, nil if the put may go on
+func checkErasureScheme(sdfsFileName string, scheme string) error {
+	if scheme != "" {
+		return nil
+	}
+	if expected := getErasureScheme(sdfsFileName, ""); expected != "" {
+		return fmt.Errorf("SDFS prefix of %v is erasure coded with %v", sdfsFileName, expected)
+	}
+	return nil
+}
+
+
+// func pickNode(exclude map[string]bool, size int64) string
+// ------------------------------------------------------------------
+// Description: A helper function that picks a live node that is not
+//				excluded with the placement policy, so the shards of a file
+//				are spread over failure domains. The caller must hold fileLock
+// Input:   exclude map[string]bool: the node ids that store the other shards
+//			size int64: the size of the shard
+// Output:  the node id, empty if every live node is excluded or full
+func pickNode(exclude map[string]bool, size int64) string {
+	existing := make([]string, 0, len(exclude))
+	for nodeIDStr := range exclude {
+		if nodeIDStr != "" {
+			existing = append(existing, nodeIDStr)
+		}
+	}
+	picked := placeReplicas(existing, 1, size)
+	if len(picked) == 0 {
+		return ""
+	}
+	return picked[0]
+}
+
+
+// func placeShard(group string, size int64) (map[string]string, error)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to pick the
+//				node of a shard, apart from the other shards of the put
+// Input:   group string: the id of the put that writes the shards
+//			size int64: the size of the shard
+// Output:  the replica slot of the shard and the error if every live node
+//			with room for the shard already stores a shard of the put
+func placeShard(group string, size int64) (map[string]string, error) {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	if _, ok := shardGroups[group]; !ok {
+		shardGroups[group] = make(map[string]bool)
+	}
+
+	fileLock.Lock()
+	nodeID := pickNode(shardGroups[group], size)
+	if nodeID != "" {
+		replicateCounter[nodeID]++
+	}
+	fileLock.Unlock()
+	if nodeID == "" {
+		return nil, fmt.Errorf("only %d live nodes with %d bytes free for the shards", len(shardGroups[group]), size)
+	}
+
+	shardGroups[group][nodeID] = true
+	replicas := make(map[string]string)
+	replicas[REPLICAONE] = nodeID
+	return replicas, nil
+}
+
+
+// func releaseShardGroup(group string)
+// ------------------------------------------------------------------
+// Description: A helper function that forgets the shard placement of a put
+// Input:   group string: the id of the put that wrote the shards
+// Output:  None
+func releaseShardGroup(group string) {
+	groupLock.Lock()
+	delete(shardGroups, group)
+	groupLock.Unlock()
+}
+
+
+// func putShards(localFileName string, sdfsFileName string, policy string, scheme string, checksum string, fileSize int64) error
+// ------------------------------------------------------------------
+// Description: This function puts a local file as an erasure-coded file.
+//				Every shard is put with a single replica, then the master
+//				node commits the list of shards under the conflict policy
+// Input:   localFileName string: local file name in the put instruction
+// 			sdfsFileName string: sdfs file name in the put instruction
+//			policy string: conflict policy of the put
+//			scheme string: the erasure scheme <k>+<m>
+//			checksum string: the checksum of the whole local file
+//			fileSize int64: the size of the whole local file
+// Output:  nil if the put is committed
+func putShards(localFileName string, sdfsFileName string, policy string, scheme string, checksum string, fileSize int64) error {
+	k, m, err := parseScheme(scheme)
+	if err != nil {
+		fmt.Println(err.Error())
+		return err
+	}
+
+	localNames := make([]string, k + m)
+	paths := make([]string, k + m)
+	for i := range localNames {
+		localNames[i] = localFileName + VERSIONSEP + ECTAG + strconv.Itoa(i)
+		paths[i] = LOCALFILEPATH + localNames[i]
+	}
+	defer func() {
+		for _, path := range paths {
+			_ = os.Remove(path)
+		}
+	}()
+	if err = encodeFile(LOCALFILEPATH + localFileName, fileSize, k, m, paths); err != nil {
+		logMsg := fmt.Sprintf("Can't execute put instruction. Local file %v can't be encoded: %v\n", localFileName, err.Error())
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		return err
+	}
+
+	logMsg := fmt.Sprintf("Distributing local file %v as SDFS file %v in %d+%d shards\n", localFileName, sdfsFileName, k, m)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+
+	// a shard has a single replica, so its put returns once it is stored
+	putID := newRequestID()
+	shards := make([]string, 0, k + m)
+	for i := range localNames {
+		shard := shardName(sdfsFileName, putID, i)
+		shardChecksum, shardSize, err := fileChecksum(paths[i])
+		if err == nil {
+			err = putFile(localNames[i], shard, CONFLICTREJECT, 1, 1, putID, shardChecksum, shardSize)
+		}
+		if err != nil {
+			for _, committed := range shards {
+				handleDelete(committed)
+			}
+			fmt.Printf("Put SDFS file %v rejected: shard %d failed: %v\n", sdfsFileName, i, err.Error())
+			return err
+		}
+		shards = append(shards, shard)
+	}
+
+	shardList, _ := json.Marshal(shards)
+	fields := make(map[string]string)
+	fields[SHARDLIST] = string(shardList)
+	fields[ECSCHEME] = scheme
+	fields[PUTGROUP] = putID
+	return commitPartsRequest(sdfsFileName, policy, checksum, fileSize, fields)
+}
+
+
+// func fetchShards(shards []string, skip int, k int, tempPrefix string, level string, quorum int) (map[int]string, error)
+// ------------------------------------------------------------------
+// Description: This function fetches k shards of an erasure-coded file,
+//				data shards first. A shard that does not arrive in time is
+//				replaced by the next shard with a live replica
+// Input:   shards []string: the names of all shards
+//			skip int: the index of a shard that must not be fetched, -1 for none
+//			k int: the number of shards to fetch
+//			tempPrefix string: the local name the shards are stored under
+//			level string: the consistency level, ONE, QUORUM or LATEST
+//			quorum int: the read quorum of QUORUM, 0 for a majority
+// Output:  maps shard index to the local path of the fetched shard, and
+//			the error if fewer than k shards arrived
+func fetchShards(shards []string, skip int, k int, tempPrefix string, level string, quorum int) (map[int]string, error) {
+	candidates := make([]int, 0, len(shards))
+	for index, shard := range shards {
+		if index != skip && len(liveReplicas(shard)) > 0 {
+			candidates = append(candidates, index)
+		}
+	}
+
+	pending := make([]int, 0, k)
+	next := 0
+	request := func() {
+		if next >= len(candidates) {
+			return
+		}
+		index := candidates[next]
+		next++
+		tempName := tempPrefix + VERSIONSEP + ECTAG + strconv.Itoa(index)
+		_ = os.Remove(LOCALFILEPATH + tempName)
+		handleGet(tempName, shards[index], false, level, quorum)
+		pending = append(pending, index)
+	}
+	for i := 0; i < k; i++ {
+		request()
+	}
+
+	available := make(map[int]string)
+	for len(pending) > 0 && len(available) < k {
+		index := pending[0]
+		pending = pending[1:]
+		path := LOCALFILEPATH + tempPrefix + VERSIONSEP + ECTAG + strconv.Itoa(index)
+		if waitForLocalFile(path, GETTIMEOUT) {
+			available[index] = path
+		} else {
+			request()
+		}
+	}
+	if len(available) < k {
+		return available, fmt.Errorf("only %d of %d required shards arrived", len(available), k)
+	}
+	return available, nil
+}
+
+
+// func removeShardTemps(tempPrefix string, n int)
+// ------------------------------------------------------------------
+// Description: A helper function that removes the fetched shards
+// Input:   tempPrefix string: the local name the shards are stored under
+//			n int: the number of shards
+// Output:  None
+func removeShardTemps(tempPrefix string, n int) {
+	for index := 0; index < n; index++ {
+		_ = os.Remove(LOCALFILEPATH + tempPrefix + VERSIONSEP + ECTAG + strconv.Itoa(index))
+	}
+}
+
+
+// func getShards(localFileName string, sdfsFileName string, shards []string, level string, quorum int)
+// ------------------------------------------------------------------
+// Description: This function handles the get of an erasure-coded file. Any
+//				k shards are fetched, missing data shards are rebuilt and
+//				the data shards are concatenated and checked against the
+//				checksum of the whole file
+// Input:   localFileName string: local file name in the get instruction
+// 			sdfsFileName string: the name of the sdfs file
+//			shards []string: the names of the shards
+//			level string: the consistency level, ONE, QUORUM or LATEST
+//			quorum int: the read quorum of QUORUM, 0 for a majority
+// Output:  None
+func getShards(localFileName string, sdfsFileName string, shards []string, level string, quorum int) {
+	fileLock.RLock()
+	scheme := replicateList[sdfsFileName][ECSCHEME]
+	fileLock.RUnlock()
+	k, m, err := parseScheme(scheme)
+	if err != nil {
+		fmt.Printf("Can't read SDFS file %v: %v\n", sdfsFileName, err.Error())
+		return
+	}
+	fileSize := sdfsFileSize(sdfsFileName)
+	size := shardSize(fileSize, k)
+
+	defer removeShardTemps(localFileName, k + m)
+	available, err := fetchShards(shards, -1, k, localFileName, level, quorum)
+	if err != nil {
+		fmt.Printf("Can't read SDFS file %v: %v\n", sdfsFileName, err.Error())
+		return
+	}
+
+	// rebuild the data shards that were not fetched
+	targets := make(map[int]string)
+	for index := 0; index < k; index++ {
+		if _, ok := available[index]; !ok {
+			targets[index] = LOCALFILEPATH + localFileName + VERSIONSEP + ECTAG + strconv.Itoa(index)
+		}
+	}
+	if len(targets) > 0 {
+		logMsg := fmt.Sprintf("Rebuilding %d data shards of SDFS file %v\n", len(targets), sdfsFileName)
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		if err = rebuildShards(k, m, size, available, targets); err != nil {
+			fmt.Printf("Can't rebuild SDFS file %v: %v\n", sdfsFileName, err.Error())
+			return
+		}
+	}
+
+	// the file is assembled aside and only moved in place when complete
+	partialPath := LOCALFILEPATH + localFileName + PARTIALSUFFIX
+	out, err := os.Create(partialPath)
+	if err != nil {
+		ErrorHandler("Can't create local file " + localFileName, err, false)
+		return
+	}
+	for index := 0; index < k; index++ {
+		in, err := os.Open(LOCALFILEPATH + localFileName + VERSIONSEP + ECTAG + strconv.Itoa(index))
+		if err != nil {
+			ErrorHandler("Can't open shard of " + sdfsFileName, err, false)
+			_ = out.Close()
+			_ = os.Remove(partialPath)
+			return
+		}
+		_, err = out.ReadFrom(in)
+		ErrorHandler("Can't copy shard of " + sdfsFileName, err, false)
+		_ = in.Close()
+	}
+	// the last data shard is padded with zeros
+	err = out.Truncate(fileSize)
+	ErrorHandler("Can't truncate reassembled file " + localFileName, err, false)
+	_ = out.Close()
+
+	if !verifyChecksum(partialPath, sdfsFileName) {
+		fmt.Printf("Reassembled SDFS file %v does not match its checksum, get failed\n", sdfsFileName)
+		_ = os.Remove(partialPath)
+		return
+	}
+	err = os.Rename(partialPath, LOCALFILEPATH + localFileName)
+	ErrorHandler("Can't move reassembled file " + localFileName, err, false)
+
+	logMsg := fmt.Sprintf("SDFS file %v is reassembled from %d of %d shards as %v\n", sdfsFileName, k, k + m, localFileName)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+}
+
+
+// func rebuildShard(shard string, nodeID string) error
+// ------------------------------------------------------------------
+// Description: This function is called by the master node when a shard is
+//				lost or corrupted. The shard is rebuilt from k other shards
+//				of its file and stored on a node
+// Input:   shard string: the name of the shard
+//			nodeID string: the node that receives the shard, empty to
+//						   pick a node that stores no other shard of the
+//						   file and add it to the replica list
+// Output:  the error if the shard can't be rebuilt or stored
+func rebuildShard(shard string, nodeID string) error {
+	sdfsFileName, index := shardParent(shard)
+	if sdfsFileName == "" {
+		WriteLog(logFile, "No erasure-coded file lists shard " + shard + "\n", false)
+		return errors.New("no erasure-coded file lists shard " + shard)
+	}
+	fileLock.RLock()
+	scheme := replicateList[sdfsFileName][ECSCHEME]
+	checksum := replicateList[shard][CHECKSUM]
+	fileLock.RUnlock()
+	k, m, err := parseScheme(scheme)
+	if err != nil {
+		return err
+	}
+	shards := fileShards(sdfsFileName)
+
+	logMsg := fmt.Sprintf("Rebuilding shard %d of SDFS file %v\n", index, sdfsFileName)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+
+	defer removeShardTemps(shard, k + m)
+	available, err := fetchShards(shards, index, k, shard, READLATEST, 0)
+	if err == nil {
+		err = rebuildShards(k, m, shardSize(sdfsFileSize(sdfsFileName), k), available, map[int]string{index: LOCALFILEPATH + shard})
+	}
+	defer os.Remove(LOCALFILEPATH + shard)
+	if err == nil {
+		if rebuilt, _, _ := fileChecksum(LOCALFILEPATH + shard); rebuilt != checksum {
+			err = errors.New("rebuilt shard does not match its checksum")
+		}
+	}
+	if err != nil {
+		logMsg := fmt.Sprintf("Can't rebuild shard %d of SDFS file %v: %v\n", index, sdfsFileName, err.Error())
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		return err
+	}
+
+	slot := ""
+	if nodeID == "" {
+		// keep the shards of a file on distinct nodes
+		exclude := make(map[string]bool)
+		fileLock.Lock()
+		for _, name := range shards {
+			for _, key := range fileSlots(replicateList[name]) {
+				exclude[replicateList[name][key]] = true
+			}
+		}
+		nodeID = pickNode(exclude, shardSize(sdfsFileSize(sdfsFileName), k))
+		for _, key := range fileSlots(replicateList[shard]) {
+			if replicateList[shard][key] == "" {
+				slot = key
+				break
+			}
+		}
+		if nodeID != "" && slot != "" {
+			replicateCounter[nodeID]++
+		}
+		fileLock.Unlock()
+		if nodeID == "" || slot == "" {
+			WriteLog(logFile, "No node left for rebuilt shard " + shard + "\n", false)
+			return errors.New("no node left for rebuilt shard " + shard)
+		}
+	}
+
+	receiverID, _ := strconv.Atoi(nodeID)
+	WriteToNode(shard, LOCALNAME, shard, SDFSNAME, receiverID, checksum)
+	if slot != "" {
+		fileLock.Lock()
+		replicateList[shard][slot] = nodeID
+		fileLock.Unlock()
+		publishReplicaDelta(shard)
+	}
+	return nil
+}
+
+
+// func handleErasurePolicy(sdfsPrefix string, scheme string)
+// ------------------------------------------------------------------
+// Description: This function handles the erasure instruction which sets
+//				the erasure scheme of all sdfs files put with a prefix. The
+//				scheme none removes the scheme of the prefix
+// Input:   sdfsPrefix string: the sdfs prefix
+//			scheme string: the erasure scheme <k>+<m>
+// Output:  None
+func handleErasurePolicy(sdfsPrefix string, scheme string) {
+	if _, _, err := parseScheme(scheme); err != nil && scheme != ECNONE {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if isMaster {
+		policyLock.Lock()
+		if scheme == ECNONE {
+			delete(erasurePolicies, sdfsPrefix)
+		} else {
+			erasurePolicies[sdfsPrefix] = scheme
+		}
+		policyLock.Unlock()
+		publishReplicaDelta()
+
+		logMsg := fmt.Sprintf("Erasure scheme of SDFS prefix %v set to %v\n", sdfsPrefix, scheme)
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		return
+	}
+
+	sentMap := make(map[string]string)
+	sentMap[SDFSNAME] = sdfsPrefix
+	sentMap[ECSCHEME] = scheme
+	msgContent, _ := json.Marshal(sentMap)
+	msgSent := MakeMessage(ERASUREPOLICY, string(msgContent), strconv.Itoa(selfID))
+	sendRequest(masterID, msgSent)
+}
+
+
+// func printErasurePolicies()
+// ------------------------------------------------------------------
+// Description: This function prints the prefix erasure schemes on the
+//				master node
+// Input:   None
+// Output:  None
+func printErasurePolicies() {
+	if !isMaster {
+		fmt.Printf("Erasure schemes are kept by the master node: %v\n", memberHost[masterID])
+		return
+	}
+
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	prefixes := make([]string, 0, len(erasurePolicies))
+	for prefix := range erasurePolicies {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	fmt.Println("-->> Default storage class: replicated")
+	for _, prefix := range prefixes {
+		fmt.Printf("->-> %v*: %v\n", prefix, erasurePolicies[prefix])
+	}
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // This portion of code is responsible for reliable file transfer from
@@ -18,11 +26,38 @@ import (
 // The implementation is modified from Mr.Waggel's following blog:
 // 		Golang transfer a file over a TCP socket
 // Source: https://mrwaggel.be/post/golang-transfer-a-file-over-a-tcp-socket/
+// A transfer uses the following versioned, length-prefixed protocol. A frame
+// is a 4-byte big-endian length followed by a JSON map:
+// 		1. the sender writes the version byte and a header frame with the
+//		   name, size, checksum, version and mode of the file
+//		2. the receiver answers with a frame that accepts the file with the
+//		   offset it already has, or rejects it with a reason
+//		3. the sender writes the bytes from the offset to the end of the file
+//		4. the receiver verifies the checksum and answers with a completion
+//		   frame
+// An interrupted transfer keeps its partial file. The sender tries again
+// and the receiver resumes a partial file of the same checksum from its
+// end, otherwise the receiver fetches the file again after RESUMETIME.
 
 const (
 	BUFFERSIZE = 4096
+	// the version byte that starts every transfer
+	TRANSFERVERSION byte = 2
+	MAXFRAMESIZE uint32 = 1024 * 1024
+	// the reason a transfer is rejected while the file is being received
+	BUSYREASON = "file is being received"
 )
 
+// a partial file that is being received or may be resumed, guarded by partialLock
+type partialTransfer struct {
+	checksum string
+	active bool
+	updated time.Time
+}
+
+var partialTransfers = make(map[string]*partialTransfer)
+var partialLock sync.Mutex
+
 // func Exist(filename string) bool
 // ----------------------------------------------------------
 // Description: A helper function that checks whether a file exists
@@ -38,132 +73,430 @@ func Exist(filename string) bool {
 }
 
 
-// func fillString(returnString string, toLength int) string
-// ---------------------------------------------------------
-// Description: This function will append (toLength - len(returnString)) ":"
-//				Characters to a given string and return the modified string
-//				in order to facilitate the data transfer
-// Input: 		returnString (string): The original string
-// 				toLength (int): The length of the string we want to get
-// Output:		returnString (string)
-func fillString(returnString string, toLength int) string {
-	for {
-		lengthString := len(returnString)
-		if lengthString < toLength {
-			returnString = returnString + ":"
-			continue
-		}
-		break
-	}
-	return returnString
-}
-
-
-// func SendFileToServer(connection net.Conn, filename string, filename2 string)
+// func SendFileToServer(connection net.Conn, filename string, filename2 string, checksum string, version int) (bool, error)
 // -----------------------------------------------------------------------------
-// Description: This function will send the local file with path filename1 given
-//				to another process that the connection given is connecting to
+// Description: This function will send the local file with path filename given
+//				to another process that the connection given is connecting to. The
+//				receiving process answers with the offset it already has, only the
+//				rest of the file is sent, and acknowledges the complete file
 // Input: 		connection (net.Conn): The TCP connection that passed by FileTransferClient
 // 				filename (string): The path of the file we want to send
 //				filename2 (string): The path where the file will be stored in the receiving process
-// Output:		None
-func SendFileToServer(connection net.Conn, filename string, filename2 string) {
-	//fmt.Printf("Connected to file transfer server!\n")
+//				checksum (string): The sha256 the receiving process verifies the file against
+//				version (int): The version of the file, 0 if unknown
+// Output:		(bool): whether the transfer may be tried again
+//				(error): nil if the receiving process acknowledged the file
+func SendFileToServer(connection net.Conn, filename string, filename2 string, checksum string, version int) (bool, error) {
 	defer connection.Close()
-	//fmt.Printf(filename + "\n")
+	startTransfer()
+	defer endTransfer()
 	file, err := os.Open(filename)
 	if err != nil {
-		fmt.Printf("Fail to open the file!\n")
-		return
+		return false, err
 	}
-	fileInfo, _ := file.Stat()
-	fileSize := fillString(strconv.FormatInt(fileInfo.Size(), 10), 10)
-	fileName2 := fillString(filename2, 64)
-	//fmt.Println("Sending fileName and fileSize! ")
-	_, _ = connection.Write([]byte(fileSize))
-	_, _ = connection.Write([]byte(fileName2))
-	sendBuffer := make([]byte, BUFFERSIZE)
-	//fmt.Println("Start sending file! ")
-	for {
-		_, err = file.Read(sendBuffer)
-		if err == io.EOF {
-			break
-		}
-		_, _ = connection.Write(sendBuffer)
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	header := make(map[string]string)
+	header[RECEIVERNAME] = filename2
+	header[SDFSSIZE] = strconv.FormatInt(fileInfo.Size(), 10)
+	header[CHECKSUM] = checksum
+	header[FILEVERSION] = strconv.Itoa(version)
+	header[FILEMODE] = strconv.FormatUint(uint64(fileInfo.Mode().Perm()), 8)
+	_, err = connection.Write([]byte{TRANSFERVERSION})
+	if err == nil {
+		err = writeFrame(connection, header)
+	}
+	reply, err := readReplyFrame(connection, err)
+	if err != nil {
+		return true, err
+	}
+	if reply[PUTSTATUS] != TRUE {
+		return reply[PUTREASON] == BUSYREASON, errors.New(reply[PUTREASON])
+	}
+
+	// the receiving process may already have the beginning of the file
+	offset, _ := strconv.ParseInt(reply[TRANSFEROFFSET], 10, 64)
+	_, err = file.Seek(offset, io.SeekStart)
+	if err == nil {
+		_, err = io.CopyN(connection, file, fileInfo.Size() - offset)
+	}
+	ack, err := readReplyFrame(connection, err)
+	if err != nil {
+		return true, err
 	}
-	//fmt.Println("File has been sent, closing connection!")
-	return
+	if ack[PUTSTATUS] != TRUE {
+		return false, errors.New(ack[PUTREASON])
+	}
+	return false, nil
 }
 
-// func FileTransferClient(ip string, type1 string, filename string, type2 string, filename2 string)
+// func FileTransferClient(ip string, type1 string, filename string, type2 string, filename2 string, checksum string)
 // -----------------------------------------------------------------------------
 // Description: This function will try to establish a connection with another process
 //				given an ip address. Then, it will send the file we want to transfer
-//				to the corresponding receiving thread running in the receiving process
+//				to the corresponding receiving thread running in the receiving process.
+//				An interrupted transfer is tried again up to TRANSFERRETRIES times and
+//				resumes where the receiving process stopped
 // Input: 		ip (string): The ip address of the receiving process
 // 				type1 (string): "local/" or "sdfs/", which is the directory where the file is located
 //				filename (string): The file that we want to send
 // 				type2 (string): "local/" or "sdfs/", which is the directory where the file will received by the receiving process
 //				filename2 (string): The name that the file will be saved as
+//				checksum (string): The checksum the receiver must verify, empty for the default one
 // Output:		None
-func FileTransferClient(ip string, type1 string, filename string, type2 string, filename2 string) {
+func FileTransferClient(ip string, type1 string, filename string, type2 string, filename2 string, checksum string) {
+	if checksum == "" {
+		checksum = transferChecksum(type1, filename)
+	}
+	port := SDFSPORT
 	if type2 == LOCALFILEPATH {
-		connection, err := net.Dial("tcp", ip + ":" + LOCALPORT)
-		if err != nil {
-			fmt.Printf("LOCAL File Cannot dial to server with error: %v\n", err.Error())
+		port = LOCALPORT
+	}
+	// a replica keeps its version when it is copied under the same name
+	version := 0
+	if type1 == SDFSFILEPATH && type2 == SDFSFILEPATH && filename == filename2 {
+		if stored, ok := lookupStored(filename); ok && stored.checksum == checksum {
+			version = stored.version
+		}
+	}
+
+	for attempt := 1; attempt <= TRANSFERRETRIES; attempt++ {
+		connection, err := net.Dial("tcp", ip + ":" + port)
+		retry := true
+		if err == nil {
+			retry, err = SendFileToServer(connection, type1 + filename, filename2, checksum, version)
+		}
+		if err == nil {
 			return
 		}
-		SendFileToServer(connection, type1 + filename, filename2)
-	} else if type2 == SDFSFILEPATH {
-		connection, err := net.Dial("tcp", ip + ":" + SDFSPORT)
-		if err != nil {
-			fmt.Printf("SDFS File Cannot dial to server with error: %v\n", err.Error())
+		logMsg := fmt.Sprintf("Transfer of file <%v> to %v failed (attempt %d of %d): %v\n", filename2, ip, attempt, TRANSFERRETRIES, err.Error())
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		if !retry {
 			return
 		}
-		SendFileToServer(connection, type1 + filename, filename2)
+		time.Sleep(RESUMEWAIT)
 	}
+}
+
+// func writeFrame(connection net.Conn, frame map[string]string) error
+// -----------------------------------------------------------------------------
+// Description: A helper function that writes a frame of the transfer protocol,
+//				a 4-byte big-endian length followed by a JSON map
+// Input: 		connection (net.Conn): The TCP connection
+//				frame (map[string]string): The fields of the frame
+// Output:		(error): the error of the write
+func writeFrame(connection net.Conn, frame map[string]string) error {
+	content, _ := json.Marshal(frame)
+	buffer := make([]byte, 4, 4 + len(content))
+	binary.BigEndian.PutUint32(buffer, uint32(len(content)))
+	_, err := connection.Write(append(buffer, content...))
+	return err
+}
 
+// func readFrame(connection net.Conn) (map[string]string, error)
+// -----------------------------------------------------------------------------
+// Description: A helper function that reads a frame of the transfer protocol
+// Input: 		connection (net.Conn): The TCP connection
+// Output:		(map[string]string): The fields of the frame
+//				(error): the error if the frame can't be read
+func readFrame(connection net.Conn) (map[string]string, error) {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(connection, length); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length)
+	if size > MAXFRAMESIZE {
+		return nil, fmt.Errorf("frame of %d bytes is too large", size)
+	}
+	content := make([]byte, size)
+	if _, err := io.ReadFull(connection, content); err != nil {
+		return nil, err
+	}
+	frame := make(map[string]string)
+	err := json.Unmarshal(content, &frame)
+	return frame, err
+}
+
+// func readReplyFrame(connection net.Conn, err error) (map[string]string, error)
+// -----------------------------------------------------------------------------
+// Description: A helper function that reads the answer of the receiving process
+//				unless the previous write failed
+// Input: 		connection (net.Conn): The TCP connection
+//				err (error): the error of the previous write
+// Output:		(map[string]string): The fields of the frame
+//				(error): the error of the write or the read
+func readReplyFrame(connection net.Conn, err error) (map[string]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	return readFrame(connection)
+}
+
+// func transferChecksum(filetype string, filename string) string
+// -----------------------------------------------------------------------------
+// Description: A helper function that decides which checksum is sent along with
+//				a file. SDFS replicas are sent with the checksum recorded by the master
+//				node so that a corrupted replica is never accepted as a good copy
+// Input: 		filetype (string): "local/" or "sdfs/", which is the directory where the file is located
+//				filename (string): The file that we want to send
+// Output:		(string): the hex encoded sha256 of the file
+func transferChecksum(filetype string, filename string) string {
+	if filetype == SDFSFILEPATH {
+		fileLock.RLock()
+		checksum := replicateList[filename][CHECKSUM]
+		fileLock.RUnlock()
+		if checksum != "" {
+			return checksum
+		}
+	}
+	checksum, _, err := fileChecksum(filetype + filename)
+	ErrorHandler("Fail to compute checksum of file " + filetype + filename, err, false)
+	return checksum
 }
 
 // func ReceiveFileFromClient(connection net.Conn, filetype string)
 // -----------------------------------------------------------------------------
 // Description: A helper routine that will retrieve the file from the connection buffer and store
-//				the file to the corresponding directory
+//				the file to the corresponding directory. The file is received into a partial
+//				file and only moved in place once its size and checksum are verified. A partial
+//				file of the same checksum is resumed from its end
 // Input: 		connection (net.Conn): The TCP connection that passed by one of the receiving server
 //				filetype (string): "local/" or "sdfs/", which is the directory where the file is going to be stored
 // Output:		None
 func ReceiveFileFromClient(connection net.Conn, filetype string) {
 	defer connection.Close()
 
-	bufferFileName := make([]byte, 64)
-	bufferFileSize := make([]byte, 10)
-	_, _ = connection.Read(bufferFileSize)
-	fileSize, _ := strconv.ParseInt(strings.Trim(string(bufferFileSize), ":"), 10, 64)
+	protocol := make([]byte, 1)
+	_, err := io.ReadFull(connection, protocol)
+	if err != nil {
+		ErrorHandler("Fail to read file transfer version", err, false)
+		return
+	}
+	if protocol[0] != TRANSFERVERSION {
+		rejectTransfer(connection, fmt.Sprintf("unsupported transfer protocol version %d", protocol[0]))
+		return
+	}
+	header, err := readFrame(connection)
+	if err != nil {
+		ErrorHandler("Fail to read file transfer header", err, false)
+		return
+	}
+	fileSize, err := strconv.ParseInt(header[SDFSSIZE], 10, 64)
+	fileName2 := header[RECEIVERNAME]
+	if err != nil || fileSize < 0 || fileName2 == "" || strings.Contains(fileName2, "..") {
+		rejectTransfer(connection, "invalid file transfer header")
+		return
+	}
+	checksum := header[CHECKSUM]
+	version, _ := strconv.Atoi(header[FILEVERSION])
+	senderID := nodeIDByAddr(connection.RemoteAddr())
 
-	_, _ = connection.Read(bufferFileName)
-	fileName2 := strings.Trim(string(bufferFileName), ":")
+	partialPath := filetype + fileName2 + PARTIALSUFFIX
+	offset, ok := beginReceive(partialPath, checksum, fileSize)
+	if !ok {
+		rejectTransfer(connection, BUSYREASON)
+		return
+	}
+	newFile, fileHash, err := openPartial(partialPath, offset)
+	if err != nil {
+		endReceive(partialPath, true)
+		ErrorHandler("Fail to create file " + partialPath, err, false)
+		rejectTransfer(connection, "can't create file")
+		return
+	}
+	reply := make(map[string]string)
+	reply[PUTSTATUS] = TRUE
+	reply[TRANSFEROFFSET] = strconv.FormatInt(offset, 10)
+	err = writeFrame(connection, reply)
 
-	if Exist(filetype + fileName2) {
-		_ = os.Remove(filetype + fileName2)
+	if offset > 0 {
+		fmt.Print("Resume file <" + fileName2 + "> at byte " + strconv.FormatInt(offset, 10) + " in path <" + filetype + ">\n")
+	} else {
+		fmt.Print("Receive file <" + fileName2 + "> stores in path <" + filetype + ">\n")
 	}
 
-	newFile, _ := os.Create(filetype + fileName2)
+	// hash the file while it is written to disk
+	if err == nil {
+		_, err = io.CopyN(io.MultiWriter(newFile, fileHash), connection, fileSize - offset)
+	}
+	closeErr := newFile.Close()
+	if err == nil {
+		err = closeErr
+	}
 
-	fmt.Print("Receive file <" + fileName2 + "> stores in path <" + filetype + ">\n")
+	if err != nil {
+		// the partial file is kept for the sender to resume
+		endReceive(partialPath, false)
+		logMsg := fmt.Sprintf("Transfer of file <%v> from node %v is incomplete: %v\n", fileName2, senderID, err.Error())
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		go waitResume(partialPath, fileName2, filetype, senderID)
+		return
+	}
 
-	defer newFile.Close()
+	received := hex.EncodeToString(fileHash.Sum(nil))
+	if checksum != "" && received != checksum {
+		_ = os.Remove(partialPath)
+		endReceive(partialPath, true)
+		rejectTransfer(connection, "checksum mismatch")
+		logMsg := fmt.Sprintf("Checksum mismatch of file <%v> from node %v: expect %v, got %v\n", fileName2, senderID, checksum, received)
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		refetchFile(fileName2, filetype, senderID)
+		return
+	}
 
-	var receivedBytes int64
+	if mode, err := strconv.ParseUint(header[FILEMODE], 8, 32); err == nil && mode != 0 {
+		_ = os.Chmod(partialPath, os.FileMode(mode))
+	}
+	err = os.Rename(partialPath, filetype + fileName2)
+	endReceive(partialPath, true)
+	ErrorHandler("Fail to move received file in place", err, false)
+	if err != nil {
+		if filetype == LOCALFILEPATH {
+			removePendingGet(fileName2)
+		}
+		rejectTransfer(connection, "can't move file in place")
+		return
+	}
 
-	for {
-		if (fileSize - receivedBytes) < BUFFERSIZE {
-			_, _ = io.CopyN(newFile, connection, fileSize - receivedBytes)
-			_, _ = connection.Read(make([]byte, (receivedBytes+BUFFERSIZE)-fileSize))
-			break
+	if filetype == SDFSFILEPATH {
+		recordStored(fileName2, received, version)
+		storeReceived(fileName2, received)
+	}
+	if filetype == LOCALFILEPATH {
+		removePendingGet(fileName2)
+	}
+	ack := make(map[string]string)
+	ack[PUTSTATUS] = TRUE
+	ack[CHECKSUM] = received
+	_ = writeFrame(connection, ack)
+}
+
+// func rejectTransfer(connection net.Conn, reason string)
+// -----------------------------------------------------------------------------
+// Description: A helper function that tells the sender why a file is not accepted
+// Input: 		connection (net.Conn): The TCP connection of the sender
+//				reason (string): The reason
+// Output:		None
+func rejectTransfer(connection net.Conn, reason string) {
+	reply := make(map[string]string)
+	reply[PUTSTATUS] = FALSE
+	reply[PUTREASON] = reason
+	_ = writeFrame(connection, reply)
+}
+
+// func beginReceive(partialPath string, checksum string, fileSize int64) (int64, bool)
+// -----------------------------------------------------------------------------
+// Description: A helper function that marks a partial file as being received and
+//				finds the offset a transfer of the same file resumes at
+// Input: 		partialPath (string): The path of the partial file
+//				checksum (string): The checksum of the file
+//				fileSize (int64): The size of the file
+// Output:		(int64): the number of bytes already received
+//				(bool): false if the partial file is being received by another transfer
+func beginReceive(partialPath string, checksum string, fileSize int64) (int64, bool) {
+	partialLock.Lock()
+	defer partialLock.Unlock()
+	state, ok := partialTransfers[partialPath]
+	if ok && state.active {
+		return 0, false
+	}
+
+	var offset int64
+	if ok && checksum != "" && state.checksum == checksum {
+		if fileInfo, err := os.Stat(partialPath); err == nil && fileInfo.Size() <= fileSize {
+			offset = fileInfo.Size()
+		}
+	}
+	partialTransfers[partialPath] = &partialTransfer{checksum: checksum, active: true, updated: time.Now()}
+	return offset, true
+}
+
+// func endReceive(partialPath string, finished bool)
+// -----------------------------------------------------------------------------
+// Description: A helper function that marks the end of a transfer into a partial file
+// Input: 		partialPath (string): The path of the partial file
+//				finished (bool): false if the partial file is kept to be resumed
+// Output:		None
+func endReceive(partialPath string, finished bool) {
+	partialLock.Lock()
+	defer partialLock.Unlock()
+	if finished {
+		delete(partialTransfers, partialPath)
+		return
+	}
+	if state, ok := partialTransfers[partialPath]; ok {
+		state.active = false
+		state.updated = time.Now()
+	}
+}
+
+// func openPartial(partialPath string, offset int64) (*os.File, hash.Hash, error)
+// -----------------------------------------------------------------------------
+// Description: A helper function that opens a partial file to be written from an
+//				offset, with the hash of the bytes before the offset
+// Input: 		partialPath (string): The path of the partial file
+//				offset (int64): The number of bytes kept
+// Output:		(*os.File): the partial file
+//				(hash.Hash): the sha256 of the kept bytes
+//				(error): the error if the file can't be opened
+func openPartial(partialPath string, offset int64) (*os.File, hash.Hash, error) {
+	fileHash := sha256.New()
+	if offset == 0 {
+		if err := makeParentDir(partialPath); err != nil {
+			return nil, nil, err
 		}
-		_, _ = io.CopyN(newFile, connection, BUFFERSIZE)
-		receivedBytes += BUFFERSIZE
+		file, err := os.Create(partialPath)
+		return file, fileHash, err
+	}
+	file, err := os.OpenFile(partialPath, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = io.CopyN(fileHash, file, offset)
+	if err == nil {
+		err = file.Truncate(offset)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+	return file, fileHash, nil
+}
+
+// func waitResume(partialPath string, fileName string, filetype string, senderID int)
+// -----------------------------------------------------------------------------
+// Description: A helper routine that fetches a file again if the interrupted transfer
+//				is not resumed within RESUMETIME. The new transfer resumes the partial file
+//				if it sends the same checksum
+// Input: 		partialPath (string): The path of the partial file
+//				fileName (string): The name the file is stored as
+//				filetype (string): "local/" or "sdfs/", where the file is stored
+//				senderID (int): The node id of the node that sent the file
+// Output:		None
+func waitResume(partialPath string, fileName string, filetype string, senderID int) {
+	time.Sleep(RESUMETIME)
+	partialLock.Lock()
+	state, ok := partialTransfers[partialPath]
+	resumed := !ok || state.active || time.Since(state.updated) < RESUMETIME
+	partialLock.Unlock()
+	if resumed {
+		return
+	}
+
+	// a staged copy is never fetched again, the put fails without its ack
+	if stagingPutID(fileName) != "" {
+		_ = os.Remove(partialPath)
+		endReceive(partialPath, true)
+		return
 	}
+	refetchFile(fileName, filetype, senderID)
 }
 
 // func FileTransferServerLocal()
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This portion of code implements the fsck instruction on the master node.
+// The master node asks every live node for the files in its sdfs directory
+// and their checksums with a STORELIST message, and compares the answers
+// with the replica list:
+// 		1. missing: a file without any replica, or a file stored as blocks
+//		   or shards that lost a block or more shards than it has parity
+//		2. under-replicated: a file with an empty replica slot
+//		3. over-replicated: a copy of a file on a node that is not one of
+//		   its replicas
+//		4. checksum mismatch: a replica whose copy differs from the checksum
+//		   in the replica list, or that does not store the file at all
+//		5. orphan: a file in a sdfs directory that the replica list does not
+//		   know, staged and partial files excluded
+// With --repair, under-replicated files are queued for repair, mismatched
+// replicas are copied again and extra copies and orphans are deleted.
+// Missing files can't be repaired. Files that are being repaired or moved
+// are left alone.
+
+// the findings of one fsck run
+type fsckReport struct {
+	missing []string
+	underReplicated []string
+	overReplicated map[string][]string
+	mismatched map[string][]string
+	orphans map[string][]string
+	silent []int
+}
+
+
+// func localStoreList() map[string]string
+// ------------------------------------------------------------------
+// Description: A helper function that lists the files in the sdfs
+//				directory of this node with their checksums. The files are
+//				read again, so that a copy that rotted since it was stored
+//				is found
+// Input:   None
+// Output:  maps file name to checksum
+func localStoreList() map[string]string {
+	stored := make(map[string]string)
+	for _, fileName := range sdfsDirFiles() {
+		if strings.HasSuffix(fileName, PARTIALSUFFIX) {
+			continue
+		}
+		if _, ok := lookupStored(fileName); !ok {
+			continue
+		}
+		checksum, _, err := fileChecksum(SDFSFILEPATH + fileName)
+		if err != nil {
+			ErrorHandler("fsck can't read " + fileName, err, false)
+			continue
+		}
+		stored[fileName] = checksum
+	}
+	return stored
+}
+
+
+// func handleStoreList(msgContent string, senderID int)
+// ------------------------------------------------------------------
+// Description: This function answers a STORELIST message with the files
+//				in the sdfs directory of this node
+// Input:   msgContent string: the content of the STORELIST message
+//			senderID int: the node id of the master node
+// Output:  None
+func handleStoreList(msgContent string, senderID int) {
+	queryMap := make(map[string]string)
+	err := json.Unmarshal([]byte(msgContent), &queryMap)
+	ErrorHandler("Unmarshal error store list", err, false)
+
+	storedFiles, _ := json.Marshal(localStoreList())
+	replyMap := make(map[string]string)
+	replyMap[READID] = queryMap[READID]
+	replyMap[RECEIVERID] = strconv.Itoa(selfID)
+	replyMap[STOREDFILES] = string(storedFiles)
+	replyContent, _ := json.Marshal(replyMap)
+	msgSent := MakeMessage(STORELISTREPLY, string(replyContent), strconv.Itoa(selfID))
+	sendTCPRequest(senderID, msgSent)
+}
+
+
+// func queryStoreLists(nodes []int) map[int]map[string]string
+// ------------------------------------------------------------------
+// Description: This function asks nodes for the files in their sdfs
+//				directories and waits up to FSCKTIMEOUT for the answers
+// Input:   nodes []int: the node ids
+// Output:  maps node id to the files of the node and their checksums,
+//			nodes that did not answer in time are left out
+func queryStoreLists(nodes []int) map[int]map[string]string {
+	readID, response := newWaiter(len(nodes))
+	defer removeWaiter(readID)
+
+	queryMap := make(map[string]string)
+	queryMap[READID] = readID
+	msgContent, _ := json.Marshal(queryMap)
+	msgSent := MakeMessage(STORELIST, string(msgContent), strconv.Itoa(selfID))
+	lists := make(map[int]map[string]string)
+	waiting := 0
+	for _, nodeID := range nodes {
+		if nodeID == selfID {
+			lists[selfID] = localStoreList()
+			continue
+		}
+		sendTCPRequest(nodeID, msgSent)
+		waiting++
+	}
+
+	timeout := time.After(FSCKTIMEOUT)
+	for waiting > 0 {
+		select {
+		case replyMap := <-response:
+			nodeID, _ := strconv.Atoi(replyMap[RECEIVERID])
+			stored := make(map[string]string)
+			_ = json.Unmarshal([]byte(replyMap[STOREDFILES]), &stored)
+			lists[nodeID] = stored
+			waiting--
+		case <-timeout:
+			return lists
+		}
+	}
+	return lists
+}
+
+
+// func inTransfer(sdfsFileName string) bool
+// ------------------------------------------------------------------
+// Description: A helper function that checks whether a file is being
+//				repaired or moved, so its copies may not be listed yet
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  true if a repair or a migration of the file is running
+func inTransfer(sdfsFileName string) bool {
+	repairLock.Lock()
+	repairing := repairs.running[sdfsFileName]
+	repairLock.Unlock()
+	balanceLock.Lock()
+	moving := balance.moving[sdfsFileName]
+	balanceLock.Unlock()
+	return repairing || moving
+}
+
+
+// func checkNamespace(prefix string) fsckReport
+// ------------------------------------------------------------------
+// Description: This function compares the replica list with the files the
+//				live nodes store
+// Input:   prefix string: only files with the prefix are checked
+// Output:  the findings
+func checkNamespace(prefix string) fsckReport {
+	report := fsckReport{
+		overReplicated: make(map[string][]string),
+		mismatched: make(map[string][]string),
+		orphans: make(map[string][]string),
+	}
+
+	nodes := []int{selfID}
+	for nodeID := range memberHost {
+		if nodeID != selfID {
+			nodes = append(nodes, nodeID)
+		}
+	}
+	lists := queryStoreLists(nodes)
+	for _, nodeID := range nodes {
+		if _, ok := lists[nodeID]; !ok {
+			report.silent = append(report.silent, nodeID)
+		}
+	}
+
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+	for sdfsFileName, sdfsMap := range replicateList {
+		if !strings.HasPrefix(sdfsFileName, prefix) {
+			continue
+		}
+
+		// a file stored as blocks or shards is checked through its parts
+		if sdfsMap[BLOCKLIST] != "" || sdfsMap[SHARDLIST] != "" {
+			partList := sdfsMap[BLOCKLIST]
+			if partList == "" {
+				partList = sdfsMap[SHARDLIST]
+			}
+			var parts []string
+			_ = json.Unmarshal([]byte(partList), &parts)
+			lost := 0
+			for _, part := range parts {
+				if _, ok := replicateList[part]; !ok || !hasReplica(replicateList[part]) {
+					lost++
+				}
+			}
+			// a file stored as blocks has no parity
+			_, m, _ := parseScheme(sdfsMap[ECSCHEME])
+			if lost > m {
+				report.missing = append(report.missing, sdfsFileName)
+			}
+			continue
+		}
+
+		if !hasReplica(sdfsMap) {
+			report.missing = append(report.missing, sdfsFileName)
+			continue
+		}
+		holders := make(map[string]bool)
+		empty := false
+		for _, key := range fileSlots(sdfsMap) {
+			nodeIDStr := sdfsMap[key]
+			if nodeIDStr == "" {
+				empty = true
+				continue
+			}
+			holders[nodeIDStr] = true
+			nodeID, _ := strconv.Atoi(nodeIDStr)
+			stored, ok := lists[nodeID]
+			if !ok {
+				continue
+			}
+			if checksum, ok := stored[sdfsFileName]; !ok || (sdfsMap[CHECKSUM] != "" && checksum != sdfsMap[CHECKSUM]) {
+				report.mismatched[sdfsFileName] = append(report.mismatched[sdfsFileName], nodeIDStr)
+			}
+		}
+		if empty {
+			report.underReplicated = append(report.underReplicated, sdfsFileName)
+		}
+		for nodeID, stored := range lists {
+			nodeIDStr := strconv.Itoa(nodeID)
+			if _, ok := stored[sdfsFileName]; ok && !holders[nodeIDStr] {
+				report.overReplicated[sdfsFileName] = append(report.overReplicated[sdfsFileName], nodeIDStr)
+			}
+		}
+	}
+
+	for nodeID, stored := range lists {
+		for fileName := range stored {
+			if _, ok := replicateList[fileName]; ok || !strings.HasPrefix(fileName, prefix) || stagingPutID(fileName) != "" {
+				continue
+			}
+			report.orphans[fileName] = append(report.orphans[fileName], strconv.Itoa(nodeID))
+		}
+	}
+	return report
+}
+
+
+// func hasReplica(sdfsMap map[string]string) bool
+// ------------------------------------------------------------------
+// Description: A helper function that checks whether an entry in the
+//				replica list has any replica
+// Input:   sdfsMap map[string]string: the entry of the sdfs file
+// Output:  true if a replica slot is filled
+func hasReplica(sdfsMap map[string]string) bool {
+	for _, key := range fileSlots(sdfsMap) {
+		if sdfsMap[key] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+
+// func repairNamespace(report fsckReport)
+// ------------------------------------------------------------------
+// Description: This function fixes what fsck found, except missing files
+// Input:   report fsckReport: the findings
+// Output:  None
+func repairNamespace(report fsckReport) {
+	for _, sdfsFileName := range report.underReplicated {
+		queueRepair(sdfsFileName)
+	}
+	for sdfsFileName, nodes := range report.mismatched {
+		for _, nodeID := range nodes {
+			repairCorruptReplica(sdfsFileName, nodeID)
+		}
+	}
+	for _, copies := range []map[string][]string{report.overReplicated, report.orphans} {
+		for fileName, nodes := range copies {
+			if inTransfer(fileName) || stagingPutID(fileName) != "" {
+				continue
+			}
+			// the report may be FSCKTIMEOUT old, a copy that became a
+			// replica since is kept
+			fileLock.RLock()
+			for _, nodeIDStr := range nodes {
+				if isExtraCopy(fileName, nodeIDStr) {
+					nodeID, _ := strconv.Atoi(nodeIDStr)
+					deleteReplica(fileName, nodeID)
+				}
+			}
+			fileLock.RUnlock()
+		}
+	}
+}
+
+
+// func isExtraCopy(fileName string, nodeIDStr string) bool
+// ------------------------------------------------------------------
+// Description: A helper function that checks whether a copy on a node is
+//				neither a replica nor a part of a file in the replica list.
+//				The caller holds fileLock
+// Input:   fileName string: the name of the copy
+//			nodeIDStr string: the node id of the node with the copy
+// Output:  true if the copy can be deleted
+func isExtraCopy(fileName string, nodeIDStr string) bool {
+	sdfsMap, ok := replicateList[fileName]
+	if !ok {
+		return true
+	}
+	for _, key := range fileSlots(sdfsMap) {
+		if sdfsMap[key] == nodeIDStr {
+			return false
+		}
+	}
+	return true
+}
+
+
+// func printFindings(title string, findings map[string][]string)
+// ------------------------------------------------------------------
+// Description: A helper function that prints files and the nodes they
+//				were found on in order
+// Input:   title string: the kind of the findings
+//			findings map[string][]string: maps file name to node ids
+// Output:  None
+func printFindings(title string, findings map[string][]string) {
+	fileNames := make([]string, 0, len(findings))
+	for fileName := range findings {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+	fmt.Printf("-->> %v: %d\n", title, len(fileNames))
+	for _, fileName := range fileNames {
+		sort.Strings(findings[fileName])
+		fmt.Printf("->-> %v on node %v\n", fileName, strings.Join(findings[fileName], ", "))
+	}
+}
+
+
+// func handleFsck(prefix string, repair bool)
+// ------------------------------------------------------------------
+// Description: This function handles the fsck instruction on the master
+//				node
+// Input:   prefix string: only files with the prefix are checked
+//			repair bool: whether the findings are fixed
+// Output:  None
+func handleFsck(prefix string, repair bool) {
+	if !isMaster {
+		fmt.Printf("fsck runs on the master node: %v\n", memberHost[masterID])
+		return
+	}
+
+	report := checkNamespace(prefix)
+	sort.Strings(report.missing)
+	sort.Strings(report.underReplicated)
+	fmt.Printf("-->> Missing: %d\n", len(report.missing))
+	for _, sdfsFileName := range report.missing {
+		fmt.Printf("->-> %v\n", sdfsFileName)
+	}
+	fmt.Printf("-->> Under-replicated: %d\n", len(report.underReplicated))
+	for _, sdfsFileName := range report.underReplicated {
+		fmt.Printf("->-> %v\n", sdfsFileName)
+	}
+	printFindings("Over-replicated", report.overReplicated)
+	printFindings("Checksum mismatch", report.mismatched)
+	printFindings("Orphans", report.orphans)
+	for _, nodeID := range report.silent {
+		fmt.Printf("-->> Node %v did not answer within %v, its files were not checked\n", memberHost[nodeID], FSCKTIMEOUT)
+	}
+
+	if repair {
+		repairNamespace(report)
+		logMsg := fmt.Sprintf("fsck repaired SDFS prefix %q, %d missing files can't be repaired\n", prefix, len(report.missing))
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// This portion of code implements the garbage collection of orphan files.
+// A DELETE message may be lost, a node may be down while a file is deleted
+// or the master node may change in the middle of an operation, so files
+// can stay in a sdfs directory although no entry of the replica list names
+// the node as one of their replicas. Every GCTIME every node compares its
+// sdfs directory with its copy of the replica list:
+// 		1. an unreferenced file is remembered with the time it was first seen
+//		2. a file that stays unreferenced for GCGRACE, and was not written
+//		   during GCGRACE, is deleted
+//		3. the master node confirms that its replica list does not store
+//		   the due files on the node, only confirmed files are deleted
+//		4. a file that is referenced again is forgotten
+// Nothing is collected while the local replica list is behind the one of
+// the master node.
+// The grace period covers staged copies of running puts, partial files of
+// running transfers and copies that are being repaired or moved. In dry-run
+// mode the files that would be deleted are only logged.
+
+// whether orphan files are only logged, set with -gc-dry-run
+var gcDryRun bool
+
+// unreferenced files and when they were first seen, guarded by gcLock
+type gcCandidate struct {
+	since time.Time
+	logged bool
+}
+
+var gcCandidates = make(map[string]*gcCandidate)
+var gcLock sync.Mutex
+
+
+// func gcRoutine()
+// ------------------------------------------------------------------
+// Description: This routine collects orphan files every GCTIME
+// Input:   None
+// Output:  None
+func gcRoutine() {
+	for {
+		time.Sleep(GCTIME)
+		// the replica list may be incomplete during an election
+		electionLock.Lock()
+		electing := isElecting
+		electionLock.Unlock()
+		if !electing {
+			collectOrphans()
+		}
+	}
+}
+
+
+// func collectOrphans()
+// ------------------------------------------------------------------
+// Description: This function compares the sdfs directory of this node
+//				with the replica list and deletes the files that stayed
+//				unreferenced for GCGRACE and that the master node confirms
+//				as unreferenced
+// Input:   None
+// Output:  None
+func collectOrphans() {
+	// a list that missed deltas may not know the newest files
+	if !isMaster && replicaListBehind() {
+		WriteLog(logFile, "Replica list is behind the master node, skipping garbage collection\n", false)
+		return
+	}
+
+	selfIDStr := strconv.Itoa(selfID)
+	present := make(map[string]bool)
+	due := make([]string, 0)
+	gcLock.Lock()
+	for _, fileName := range sdfsDirFiles() {
+		present[fileName] = true
+		if isReplicaNode(fileName, selfIDStr) {
+			delete(gcCandidates, fileName)
+			continue
+		}
+
+		candidate, ok := gcCandidates[fileName]
+		if !ok {
+			gcCandidates[fileName] = &gcCandidate{since: time.Now()}
+			continue
+		}
+		if time.Since(candidate.since) < GCGRACE {
+			continue
+		}
+		file, err := os.Stat(SDFSFILEPATH + fileName)
+		if err != nil || time.Since(file.ModTime()) < GCGRACE {
+			continue
+		}
+		due = append(due, fileName)
+	}
+
+	// files deleted by other means are forgotten
+	for fileName := range gcCandidates {
+		if !present[fileName] {
+			delete(gcCandidates, fileName)
+		}
+	}
+	gcLock.Unlock()
+
+	if len(due) > 0 {
+		deleteOrphans(confirmOrphans(due))
+	}
+	pruneSDFSDirs()
+}
+
+
+// func deleteOrphans(fileNames []string)
+// ------------------------------------------------------------------
+// Description: A helper function that deletes the orphan files the master
+//				node confirmed, or logs them in dry-run mode
+// Input:   fileNames []string: the confirmed orphan files
+// Output:  None
+func deleteOrphans(fileNames []string) {
+	selfIDStr := strconv.Itoa(selfID)
+	gcLock.Lock()
+	defer gcLock.Unlock()
+	for _, fileName := range fileNames {
+		candidate, ok := gcCandidates[fileName]
+		// the file may have become a replica during the confirmation
+		if !ok || isReplicaNode(fileName, selfIDStr) {
+			continue
+		}
+
+		if gcDryRun {
+			if !candidate.logged {
+				logMsg := fmt.Sprintf("Orphan file %v would be deleted (dry run)\n", fileName)
+				fmt.Print(logMsg)
+				WriteLog(logFile, logMsg, false)
+				candidate.logged = true
+			}
+			continue
+		}
+		err := os.Remove(SDFSFILEPATH + fileName)
+		if err != nil {
+			ErrorHandler("Can't delete orphan file " + fileName, err, false)
+			continue
+		}
+		delete(gcCandidates, fileName)
+		logMsg := fmt.Sprintf("Orphan file %v deleted, unreferenced since %v\n", fileName, candidate.since.Format("15:04:05"))
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+	}
+}
+
+
+// func confirmOrphans(fileNames []string) []string
+// ------------------------------------------------------------------
+// Description: This function asks the master node which of the files are
+//				unreferenced in its replica list and waits up to LISTTIMEOUT
+//				for the answer
+// Input:   fileNames []string: the files unreferenced in the local list
+// Output:  the files the master node confirms, none if it did not answer
+func confirmOrphans(fileNames []string) []string {
+	if isMaster {
+		return unreferencedFiles(fileNames, strconv.Itoa(selfID))
+	}
+
+	readID, _ := newWaiter(1)
+
+	candidates, _ := json.Marshal(fileNames)
+	queryMap := make(map[string]string)
+	queryMap[READID] = readID
+	queryMap[GCFILES] = string(candidates)
+	msgContent, _ := json.Marshal(queryMap)
+	msgSent := MakeMessage(GCCHECK, string(msgContent), strconv.Itoa(selfID))
+	// the names of many orphans do not fit into a datagram
+	sendTCPRequest(masterID, msgSent)
+
+	replyMap, ok := waitReply(readID, LISTTIMEOUT)
+	if !ok {
+		WriteLog(logFile, "No garbage collection confirmation from master node\n", false)
+		return nil
+	}
+	confirmed := make([]string, 0)
+	err := json.Unmarshal([]byte(replyMap[GCFILES]), &confirmed)
+	ErrorHandler("Unmarshal error gc confirm", err, false)
+	return confirmed
+}
+
+
+// func unreferencedFiles(fileNames []string, nodeIDStr string) []string
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to pick the
+//				files that its replica list does not store on a node.
+//				Staged copies of running puts and appends and files that
+//				are being repaired or moved are kept
+// Input:   fileNames []string: the files the node wants to delete
+//			nodeIDStr string: the node id of the node
+// Output:  the files that may be deleted
+func unreferencedFiles(fileNames []string, nodeIDStr string) []string {
+	confirmed := make([]string, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		if isReplicaNode(fileName, nodeIDStr) || inTransfer(fileName) {
+			continue
+		}
+		if putID := stagingPutID(fileName); putID != "" {
+			storeLock.Lock()
+			_, putRunning := pendingPuts[putID]
+			_, appendRunning := pendingAppends[putID]
+			storeLock.Unlock()
+			if putRunning || appendRunning {
+				continue
+			}
+		}
+		confirmed = append(confirmed, fileName)
+	}
+	return confirmed
+}
+
+
+// func handleGCCheck(msgContent string, senderID int)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to answer a
+//				GCCHECK message
+// Input:   msgContent string: the content of the GCCHECK message
+//			senderID int: the node id of the node that collects orphans
+// Output:  None
+func handleGCCheck(msgContent string, senderID int) {
+	queryMap := make(map[string]string)
+	err := json.Unmarshal([]byte(msgContent), &queryMap)
+	ErrorHandler("Unmarshal error gc check", err, false)
+	candidates := make([]string, 0)
+	_ = json.Unmarshal([]byte(queryMap[GCFILES]), &candidates)
+
+	confirmed, _ := json.Marshal(unreferencedFiles(candidates, strconv.Itoa(senderID)))
+	replyMap := make(map[string]string)
+	replyMap[READID] = queryMap[READID]
+	replyMap[GCFILES] = string(confirmed)
+	replyContent, _ := json.Marshal(replyMap)
+	msgSent := MakeMessage(GCCONFIRM, string(replyContent), strconv.Itoa(selfID))
+	sendTCPRequest(senderID, msgSent)
+}
+
+
+// func handleGC(mode string)
+// ------------------------------------------------------------------
+// Description: This function handles the gc instruction which switches
+//				the dry-run mode of the garbage collection
+// Input:   mode string: "on" to only log orphans, "off" to delete them
+// Output:  None
+func handleGC(mode string) {
+	gcLock.Lock()
+	gcDryRun = mode == "on"
+	for _, candidate := range gcCandidates {
+		candidate.logged = false
+	}
+	gcLock.Unlock()
+
+	logMsg := fmt.Sprintf("Garbage collection dry run: %v\n", mode)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+}
+
+
+// func printGCStatus()
+// ------------------------------------------------------------------
+// Description: This function prints the unreferenced files of this node
+//				and how long they have been unreferenced
+// Input:   None
+// Output:  None
+func printGCStatus() {
+	gcLock.Lock()
+	defer gcLock.Unlock()
+	fileNames := make([]string, 0, len(gcCandidates))
+	for fileName := range gcCandidates {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	fmt.Printf("-->> Garbage collection dry run: %v, grace period: %v, %d unreferenced files\n", gcDryRun, GCGRACE, len(fileNames))
+	for _, fileName := range fileNames {
+		fmt.Printf("->-> %v: unreferenced for %v\n", fileName, time.Since(gcCandidates[fileName].since).Round(time.Second))
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -17,6 +19,12 @@ import (
 /////////                     /////////////////////
 ///////////////////////////////////////////////////
 
+// requests waiting for the replies of other nodes, maps the request id to
+// the channel of the replies
+var replyWaiters = make(map[string]chan map[string]string)
+var waiterCounter int
+var waiterLock sync.Mutex
+
 
 // func geneUniqueID() string
 // ------------------------------------------------------------------
@@ -195,10 +203,123 @@ func CheckHostName() bool {
 	return false
 }
 
+// func nodeIDByAddr(addr net.Addr) int
+// ------------------------------------------------------------------
+// Description: A helper function that finds the node id of a remote address
+// Input:   addr net.Addr: the remote address of a connection
+// Output:  the node id, -1 if the address does not belong to any member
+func nodeIDByAddr(addr net.Addr) int {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return -1
+	}
+	if host == localAddr {
+		return selfID
+	}
+	for nodeID, memberIP := range memberAddr {
+		if memberIP == host {
+			return nodeID
+		}
+	}
+	return -1
+}
+
 func isDir(fileName string) bool {
 	fileInfo, err := os.Stat(fileName)
 	if err != nil {
 		return false
 	}
 	return fileInfo.IsDir()
-}
\ No newline at end of file
+}
+
+// func newRequestID() string
+// ------------------------------------------------------------------
+// Description: A helper function that gives a request a unique id
+// Input:   None
+// Output:  the id of the request
+func newRequestID() string {
+	waiterLock.Lock()
+	defer waiterLock.Unlock()
+	waiterCounter++
+	return strconv.Itoa(selfID) + "-" + strconv.Itoa(waiterCounter)
+}
+
+
+// func newWaiter(size int) (string, chan map[string]string)
+// ------------------------------------------------------------------
+// Description: A helper function that registers a request waiting for the
+//				replies of other nodes. The caller removes it with
+//				removeWaiter, or waits for one reply with waitReply
+// Input:   size int: the number of replies expected
+// Output:  the id of the request and the channel of the replies
+func newWaiter(size int) (string, chan map[string]string) {
+	readID := newRequestID()
+	response := make(chan map[string]string, size)
+	waiterLock.Lock()
+	replyWaiters[readID] = response
+	waiterLock.Unlock()
+	return readID, response
+}
+
+
+// func removeWaiter(readID string)
+// ------------------------------------------------------------------
+// Description: A helper function that stops waiting for a request, later
+//				replies are dropped
+// Input:   readID string: the id of the request
+// Output:  None
+func removeWaiter(readID string) {
+	waiterLock.Lock()
+	delete(replyWaiters, readID)
+	waiterLock.Unlock()
+}
+
+
+// func waitReply(readID string, timeout time.Duration) (map[string]string, bool)
+// ------------------------------------------------------------------
+// Description: A helper function that waits for the reply of a request and
+//				then removes the request
+// Input:   readID string: the id of the request
+//			timeout time.Duration: how long to wait for the reply
+// Output:  the content of the reply, false if it did not arrive in time
+func waitReply(readID string, timeout time.Duration) (map[string]string, bool) {
+	defer removeWaiter(readID)
+	waiterLock.Lock()
+	response, ok := replyWaiters[readID]
+	waiterLock.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	select {
+	case replyMap := <-response:
+		return replyMap, true
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+
+// func deliverReply(msgContent string, idKey string)
+// ------------------------------------------------------------------
+// Description: A helper function that passes a reply to the waiting
+//				request, a reply nobody waits for is dropped
+// Input:   msgContent string: the content of the reply message
+//			idKey string: the key of the request id in the content
+// Output:  None
+func deliverReply(msgContent string, idKey string) {
+	replyMap := make(map[string]string)
+	err := json.Unmarshal([]byte(msgContent), &replyMap)
+	ErrorHandler("Unmarshal error reply", err, false)
+
+	waiterLock.Lock()
+	defer waiterLock.Unlock()
+	response, ok := replyWaiters[replyMap[idKey]]
+	if !ok {
+		return
+	}
+	select {
+	case response <- replyMap:
+	default:
+	}
+}
@@ -168,11 +168,9 @@ func JuiceMaster(descriptor JobDescriptor) {
 
 	// 1. find all the files with the prefix given and append them to taskMapJuice
 	i := 0
-	for fileName := range replicateList {
-		if strings.HasPrefix(fileName, prefix) {
-			fileMapJuice[i] = fileName
-			i += 1
-		}
+	for _, fileName := range listPrefix(prefix) {
+		fileMapJuice[i] = fileName
+		i += 1
 	}
 
 	if len(fileMapJuice) == 0 {
@@ -384,7 +382,7 @@ func FinalizeOutputJuice(destFile string) {
 	}
 	_ = f.Close()
 
-	handlePut(destFile, destFile, true)
+	_ = handlePut(destFile, destFile, CONFLICTOVERWRITE, 0, 0, "")
 }
 
 // func hashPartitionJuice()
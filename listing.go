@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// This portion of code implements the cluster-wide listing of sdfs files.
+// The copy of the replica list a node keeps may miss the latest deltas, so
+// a listing is answered by the master node:
+// 		1. the node sends a LISTREQ message with the prefix to the master
+//		   node
+//		2. the master node looks up the files with the prefix in its
+//		   directory tree and answers with a LISTREPLY message that carries
+//		   the size, version, last update, replication factor and replica
+//		   hosts of every file
+// Older versions, blocks and shards are not listed, the hosts of a file
+// stored as blocks or shards are the hosts of its parts.
+
+// one file of a listing
+type fileListing struct {
+	Name string			`json:"name"`
+	Size int64			`json:"size"`
+	Version int			`json:"version"`
+	Checksum string		`json:"checksum"`
+	LastUpdate string	`json:"last_update"`
+	Factor int			`json:"replication_factor"`
+	Replicas []string	`json:"replicas"`
+	Blocks int			`json:"blocks,omitempty"`
+	Shards int			`json:"shards,omitempty"`
+	Scheme string		`json:"erasure_scheme,omitempty"`
+}
+
+
+// func handleList(prefix string, asJSON bool)
+// ------------------------------------------------------------------
+// Description: This function handles the ls instruction and prints the
+//				files with a prefix
+// Input:   prefix string: the prefix of the sdfs names, empty for all files
+//			asJSON bool: whether the listing is printed as JSON
+// Output:  None
+func handleList(prefix string, asJSON bool) {
+	listing, err := queryListing(prefix)
+	if err != nil {
+		fmt.Printf("Can't list SDFS prefix %q: %v\n", prefix, err.Error())
+		return
+	}
+
+	if asJSON {
+		content, _ := json.MarshalIndent(listing, "", "  ")
+		fmt.Println(string(content))
+		return
+	}
+	fmt.Printf("-->> SDFS prefix %q: %d files\n", prefix, len(listing))
+	for _, file := range listing {
+		fmt.Printf("->-> %v: %d bytes, version %d, updated %v, replication factor %d\n", file.Name, file.Size, file.Version, file.LastUpdate, file.Factor)
+		if file.Blocks > 0 {
+			fmt.Printf("     %d blocks\n", file.Blocks)
+		}
+		if file.Shards > 0 {
+			fmt.Printf("     %d shards of %v\n", file.Shards, file.Scheme)
+		}
+		fmt.Printf("     replicas: %v\n", file.Replicas)
+	}
+}
+
+
+// func queryListing(prefix string) ([]fileListing, error)
+// ------------------------------------------------------------------
+// Description: This function asks the master node for the files with a
+//				prefix and waits up to LISTTIMEOUT for the answer
+// Input:   prefix string: the prefix of the sdfs names
+// Output:  the files in order and the error if the master did not answer
+func queryListing(prefix string) ([]fileListing, error) {
+	if isMaster {
+		return listFiles(prefix), nil
+	}
+
+	readID, _ := newWaiter(1)
+
+	queryMap := make(map[string]string)
+	queryMap[READID] = readID
+	queryMap[SDFSNAME] = prefix
+	msgContent, _ := json.Marshal(queryMap)
+	msgSent := MakeMessage(LISTREQ, string(msgContent), strconv.Itoa(selfID))
+	sendRequest(masterID, msgSent)
+
+	replyMap, ok := waitReply(readID, LISTTIMEOUT)
+	if !ok {
+		return nil, errors.New("no response from master node")
+	}
+	var listing []fileListing
+	err := json.Unmarshal([]byte(replyMap[FILELISTING]), &listing)
+	return listing, err
+}
+
+
+// func handleListRequest(msgContent string, senderID int)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to answer a
+//				LISTREQ message
+// Input:   msgContent string: the content of the LISTREQ message
+//			senderID int: the node id of the requester
+// Output:  None
+func handleListRequest(msgContent string, senderID int) {
+	queryMap := make(map[string]string)
+	err := json.Unmarshal([]byte(msgContent), &queryMap)
+	ErrorHandler("Unmarshal error list request", err, false)
+
+	listing, _ := json.Marshal(listFiles(queryMap[SDFSNAME]))
+	replyMap := make(map[string]string)
+	replyMap[READID] = queryMap[READID]
+	replyMap[FILELISTING] = string(listing)
+	replyContent, _ := json.Marshal(replyMap)
+	msgSent := MakeMessage(LISTREPLY, string(replyContent), strconv.Itoa(selfID))
+	sendTCPRequest(senderID, msgSent)
+}
+
+
+// func listFiles(prefix string) []fileListing
+// ------------------------------------------------------------------
+// Description: This function builds the listing of the files with a
+//				prefix from the replica list of this node
+// Input:   prefix string: the prefix of the sdfs names
+// Output:  the files in order
+func listFiles(prefix string) []fileListing {
+	fileNames := listPrefix(prefix)
+	listing := make([]fileListing, 0, len(fileNames))
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+	for _, sdfsFileName := range fileNames {
+		sdfsMap, ok := replicateList[sdfsFileName]
+		if !ok {
+			continue
+		}
+		file := fileListing{
+			Name: sdfsFileName,
+			Checksum: sdfsMap[CHECKSUM],
+			LastUpdate: sdfsMap[LASTUPDATE],
+			Factor: replicaFactor(sdfsMap),
+			Scheme: sdfsMap[ECSCHEME],
+		}
+		file.Size, _ = strconv.ParseInt(sdfsMap[SDFSSIZE], 10, 64)
+		file.Version, _ = strconv.Atoi(sdfsMap[FILEVERSION])
+
+		var blocks, shards []string
+		if sdfsMap[BLOCKLIST] != "" {
+			_ = json.Unmarshal([]byte(sdfsMap[BLOCKLIST]), &blocks)
+		}
+		if sdfsMap[SHARDLIST] != "" {
+			_ = json.Unmarshal([]byte(sdfsMap[SHARDLIST]), &shards)
+		} else {
+			file.Scheme = ""
+		}
+		file.Blocks = len(blocks)
+		file.Shards = len(shards)
+
+		parts := append(blocks, shards...)
+		if len(parts) == 0 {
+			parts = []string{sdfsFileName}
+		}
+		file.Replicas = replicaHosts(parts)
+		listing = append(listing, file)
+	}
+	return listing
+}
+
+
+// func replicaHosts(names []string) []string
+// ------------------------------------------------------------------
+// Description: A helper function that gives the hosts that store any of
+//				the entries. The caller holds fileLock
+// Input:   names []string: the names in the replica list
+// Output:  the host names in order
+func replicaHosts(names []string) []string {
+	found := make(map[string]bool)
+	for _, name := range names {
+		sdfsMap := replicateList[name]
+		for _, key := range fileSlots(sdfsMap) {
+			if sdfsMap[key] == "" {
+				continue
+			}
+			nodeID, _ := strconv.Atoi(sdfsMap[key])
+			host := memberHost[nodeID]
+			if nodeID == selfID {
+				host = localHost
+			}
+			found[host] = true
+		}
+	}
+	hosts := make([]string, 0, len(found))
+	for host := range found {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
@@ -19,6 +19,7 @@ const(
 	LOCALPORT			= "8000"
 	SDFSPORT			= "9000"
 	TCPPORT				= "10001"
+	RANGEPORT			= "10002"
 
 	// Markers for message type
 	// membership messages
@@ -36,8 +37,41 @@ const(
 	ERRORREAD string	= "10"
 	DELETEREQ string 	= "11"
 	DELETE string 		= "12"
-	OVERWRITE string	= "13"
 	REPLICALIST string 	= "14"
+	REPLICADELTA string	= "27"
+	REPLICADIGEST string= "28"
+	REPLICASYNC string	= "29"
+	SCRUBREPORT string	= "30"
+	RENAME string		= "31"
+	RETENTION string	= "32"
+	CONFLICTPOLICY string = "33"
+	STOREACK string		= "34"
+	QUORUMPOLICY string	= "35"
+	VERSIONQUERY string	= "36"
+	VERSIONREPLY string	= "37"
+	REPLICATIONPOLICY string = "38"
+	ERASUREPOLICY string= "40"
+	NODEREPORT string	= "41"
+	STORELIST string	= "42"
+	STORELISTREPLY string = "43"
+	STOREREPORT string	= "44"
+	APPENDREQ string	= "45"
+	APPENDAPPLY string	= "46"
+	APPENDREPLY string	= "47"
+	MOVEREQ string		= "48"
+	MOVELINK string		= "49"
+	MOVEUNLINK string	= "50"
+	MKDIR string		= "51"
+	RMDIR string		= "52"
+	LISTREQ string		= "53"
+	LISTREPLY string	= "54"
+	GCCHECK string		= "55"
+	GCCONFIRM string	= "56"
+	APPENDFINISH string	= "57"
+	MOVEACK string		= "58"
+	PUTRESP string		= "59"
+	STOREREPORTACK string = "60"
+	SCRUBREMOVE string	= "61"
 	// master election messages
 	ELECTION string 	= "15"
 	OK string 			= "16"
@@ -69,6 +103,15 @@ const(
 	REPLICATHREE string = "3"
 	REPLICAFOUR string	= "4"
 	LASTUPDATE string	= "6"
+	CHECKSUM string		= "15"
+	SDFSSIZE string		= "16"
+	FILEVERSION string	= "18"
+	BLOCKLIST string	= "25"
+	REPLICAFACTOR string= "26"
+	SHARDLIST string	= "27"
+	ECSCHEME string		= "28"
+	PUTGROUP string		= "29"
+	HASHSTATE string	= "35"
 
 	// Keys in receiverMap
 	SENDERTYPE string	= "7"
@@ -79,10 +122,50 @@ const(
 	SENDERDIR string 	= "12"
 	RECEIVERDIR string 	= "13"
 	LOCALEXIST string   = "14"
+	EXCLUDEID string	= "17"
+	PUTPOLICY string	= "19"
+	PUTID string		= "20"
+	PUTSTATUS string	= "21"
+	PUTREASON string	= "22"
+	PUTQUORUM string	= "23"
+	READID string		= "24"
+
+	// Keys in node reports
+	NODEZONE string		= "30"
+	NODERACK string		= "31"
+	NODEUSED string		= "32"
+	NODEFREE string		= "33"
+	NODELOAD string		= "41"
+
+	// Keys in store lists
+	STOREDFILES string	= "34"
+
+	// Keys in move requests
+	MOVEPREFIX string	= "36"
+	MOVEFORCE string	= "37"
+
+	// Keys in listings
+	FILELISTING string	= "38"
+
+	// Keys in range reads
+	RANGEOFFSET string	= "39"
+	RANGELENGTH string	= "40"
+
+	// Keys in file transfer frames
+	FILEMODE string		= "42"
+	TRANSFEROFFSET string = "43"
+
+	// Keys in garbage collection
+	GCFILES string		= "44"
 
 	// Keys in replica list map
 	SDFSLIST string 	= "0"
 	SDFSCOUNT string 	= "1"
+	SDFSVERSION string	= "2"
+	SDFSPREV string		= "3"
+	SDFSDIGEST string	= "4"
+	SDFSDIRS string		= "5"
+	SDFSPOLICIES string	= "6"
 
 	// global boolean value
 	TRUE string			= "true"
@@ -90,6 +173,8 @@ const(
 
 	// Size of global arrays
 	SIZERECENTMSG int	= 60
+	SIZEDELTAQUEUE int	= 1024
+	SIZESCRUBFINDINGS int = 100
 
 	// Log name
 	logFile string 		= "service.log"
@@ -99,6 +184,43 @@ const(
 	// file distribution
 	SDFSFILEPATH string = "sdfs/"
 	LOCALFILEPATH string= "local/"
+	PARTIALSUFFIX string= ".partial"
+
+	// sdfs file versions are stored as <sdfs name>@<version>
+	VERSIONSEP string	= "@"
+	VERSIONRETAIN int	= 5
+	// files are staged as <sdfs name>@put-<put id> until the put is committed
+	STAGINGTAG string	= "put-"
+	// large files are stored as blocks <sdfs name>@blk-<put id>-<index>
+	BLOCKTAG string		= "blk-"
+	BLOCKSIZE int64		= 64 * 1024 * 1024
+	// a block ends on the first line break within this many bytes
+	LINEWINDOW int64	= 1024 * 1024
+	// erasure-coded files are stored as shards <sdfs name>@ec-<put id>-<index>
+	ECTAG string		= "ec-"
+	ECNONE string		= "none"
+	ECCHUNK int64		= 64 * 1024
+	// files of at least PARALLELSIZE bytes are read in chunks from all replicas
+	PARALLELSIZE int64	= 32 * 1024 * 1024
+	PARALLELCHUNK int64	= 8 * 1024 * 1024
+	// a chunk is read again if it takes this many times the average chunk
+	STRAGGLERFACTOR		= 3
+
+	// replicas beyond the fourth are kept in the slots r5, r6, ...
+	REPLICAEXTRA string	= "r"
+	DEFAULTFACTOR int	= 4
+
+	// write-conflict policies
+	CONFLICTREJECT string	= "reject"
+	CONFLICTOVERWRITE string= "overwrite"
+	CONFLICTVERSION string	= "new-version"
+	CONFLICTCAS string		= "cas"
+	CONFLICTNONE string		= "none"
+
+	// read consistency levels
+	READONE string		= "ONE"
+	READQUORUM string	= "QUORUM"
+	READLATEST string	= "LATEST"
 
 	// time constants
 	FAILTIME  			= 2 * time.Second
@@ -107,6 +229,35 @@ const(
 	OKWAITTIME			= 2 * time.Second
 	COWAITTIME			= 5 * time.Second
 	CHECKTIME 			= 100 * time.Millisecond
+	SCRUBTIME			= 10 * time.Minute
+	GETTIMEOUT			= 30 * time.Second
+	STORETIMEOUT		= 60 * time.Second
+	PUTTIMEOUT			= STORETIMEOUT + 10 * time.Second
+	READTIMEOUT			= 2 * time.Second
+	REPORTTIME			= 5 * time.Second
+	BALANCETIME			= 10 * time.Second
+	REPAIRTIME			= 1 * time.Second
+	REPAIRBACKOFF		= 1 * time.Minute
+	REPAIRSCAN			= 1 * time.Minute
+	FSCKTIMEOUT			= 60 * time.Second
+	LISTTIMEOUT			= 5 * time.Second
+	MOVETIMEOUT			= 5 * time.Second
+	UNLINKDELAY			= 3 * UPDATETIME
+	GCTIME				= 1 * time.Minute
+	GCGRACE				= 10 * time.Minute
+	STRAGGLERMIN		= 2 * time.Second
+	RESUMEWAIT			= 1 * time.Second
+	RESUMETIME			= 10 * time.Second
+
+	// scrubber reads at most this many bytes per second
+	SCRUBRATE int64		= 8 * 1024 * 1024
+
+	// repairs a node takes part in at the same time, and attempts per repair
+	// before it waits REPAIRBACKOFF
+	REPAIRLIMIT int		= 2
+	REPAIRRETRIES int	= 3
+	// attempts of an interrupted file transfer
+	TRANSFERRETRIES int	= 3
 )
 
 ///////////////////////////////////////////////////
@@ -134,6 +285,19 @@ var targetAddr = make(map[int]string)
 var replicateList = make(map[string]map[string]string)
 var replicateCounter = make(map[string]int)
 
+// number of versions the master keeps for every sdfs file, guarded by
+// policyLock
+var versionRetain = VERSIONRETAIN
+
+// a local file being fetched by this node
+type pendingGet struct {
+	sdfsFileName string
+	started time.Time
+}
+
+// local files being fetched by this node, maps local name to the get
+var pendingGets = make(map[string]pendingGet)
+
 // Arrays of all members
 var memberHost = make(map[int]string)
 var memberAddr = make(map[int]string)
@@ -161,6 +325,7 @@ var memberLock sync.RWMutex
 var fileLock sync.RWMutex
 var electionLock sync.Mutex
 var chanLock sync.Mutex
+var pendingLock sync.Mutex
 
 var fLog *os.File
 
@@ -178,13 +343,39 @@ var helperMap = map[string]string {
 	ERRORREAD : "ERRREAD",
 	DELETEREQ : "DELETEREQ",
 	DELETE : "DELETE",
-	OVERWRITE : "OVERWRITE",
 	REPLICALIST : "REPLICALIST",
+	REPLICADELTA : "REPLICADELTA",
+	REPLICADIGEST : "REPLICADIGEST",
+	REPLICASYNC : "REPLICASYNC",
+	SCRUBREPORT : "SCRUBREPORT",
+	RENAME : "RENAME",
+	RETENTION : "RETENTION",
+	CONFLICTPOLICY : "CONFLICTPOLICY",
+	STOREACK : "STOREACK",
+	QUORUMPOLICY : "QUORUMPOLICY",
+	VERSIONQUERY : "VERSIONQUERY",
+	VERSIONREPLY : "VERSIONREPLY",
+	REPLICATIONPOLICY : "REPLICATIONPOLICY",
+	ERASUREPOLICY : "ERASUREPOLICY",
+	NODEREPORT : "NODEREPORT",
+	STORELIST : "STORELIST",
+	STORELISTREPLY : "STORELISTREPLY",
+	STOREREPORT : "STOREREPORT",
+	APPENDREQ : "APPENDREQ",
+	APPENDAPPLY : "APPENDAPPLY",
+	APPENDREPLY : "APPENDREPLY",
+	MOVEREQ : "MOVEREQ",
+	MOVELINK : "MOVELINK",
+	MOVEUNLINK : "MOVEUNLINK",
+	MKDIR : "MKDIR",
+	RMDIR : "RMDIR",
+	LISTREQ : "LISTREQ",
+	LISTREPLY : "LISTREPLY",
+	GCCHECK : "GCCHECK",
+	GCCONFIRM : "GCCONFIRM",
+	APPENDFINISH : "APPENDFINISH",
+	MOVEACK : "MOVEACK",
+	PUTRESP : "PUTRESP",
+	STOREREPORTACK : "STOREREPORTACK",
+	SCRUBREMOVE : "SCRUBREMOVE",
 }
-
-var replicaMap = map[string]string{
-	REPLICAONE : REPLICAONE,
-	REPLICATWO : REPLICATWO,
-	REPLICATHREE : REPLICATHREE,
-	REPLICAFOUR : REPLICAFOUR,
-}
\ No newline at end of file
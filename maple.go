@@ -133,11 +133,13 @@ func MapleMaster(descriptor JobDescriptor) {
 	fmt.Printf("*Number of tasks:  %d\n", numTasksMaple)
 	fmt.Printf("-----------------------------------\n")
 
-	// 1. find all the files with the prefix of srcDir given and append them to fileMapMaple
+	// 1. find all the files in the directory srcDir and its subdirectories and append them to fileMapMaple
 	i := 0
-	for fileName := range replicateList {
-		if strings.HasPrefix(fileName, srcDir) {
-			fileMapMaple[i] = fileName
+	srcFiles, _ := listDir(srcDir, true)
+	for _, fileName := range srcFiles {
+		// the blocks of a large file are separate input splits
+		for _, splitName := range inputSplits(fileName) {
+			fileMapMaple[i] = splitName
 			i += 1
 		}
 	}
@@ -213,8 +215,9 @@ func sendBatch(fileList []string, senderType string, receiverType string, receiv
 		minNum := 1000000
 		minNode := -1
 
-		for key, replica := range replicateList[fileName] {
-			if key != LASTUPDATE && replicateList[fileName][key] != "" {
+		for _, key := range fileSlots(replicateList[fileName]) {
+			replica := replicateList[fileName][key]
+			if replica != "" {
 				replicaNode, _ := strconv.Atoi(replica)
 				if replicaNode == receiverID {
 					// local copy possible
@@ -255,7 +258,7 @@ func sendBatch(fileList []string, senderType string, receiverType string, receiv
 		time.Sleep(5 * time.Millisecond)
 		if nodeID == selfID {
 			for _, fileName := range fileMap {
-				WriteToNode(fileName, senderType, localTempFilePrefix + fileName, receiverType, receiverID)
+				WriteToNode(fileName, senderType, localTempFilePrefix + fileName, receiverType, receiverID, "")
 			}
 		} else {
 			fileName, _ := json.Marshal(fileMap)
@@ -270,7 +273,7 @@ func sendBatch(fileList []string, senderType string, receiverType string, receiv
 	if receiverID == selfID {
 		// send file to master node (self node: local copying)
 		for _, fileName := range local {
-			WriteToNode(fileName, senderType, localTempFilePrefix + fileName, receiverType, receiverID)
+			WriteToNode(fileName, senderType, localTempFilePrefix + fileName, receiverType, receiverID, "")
 		}
 	} else {
 		fileName, _ := json.Marshal(local)
@@ -323,7 +326,13 @@ func checkFile(fileName string, fileSize int64) {
 				// check if file size match
 				file, _ := os.Stat(LOCALFILEPATH + localTempFilePrefix + fileName)
 				if file.Size() == fileSize {
-					return
+					// check if file content match
+					if verifyChecksum(LOCALFILEPATH + localTempFilePrefix + fileName, fileName) {
+						return
+					}
+					fmt.Printf("File %v has inconsistent checksum. Getting copies...\n", fileName)
+					_ = os.Remove(LOCALFILEPATH + localTempFilePrefix + fileName)
+					break
 				}
 				// fmt.Printf("File %v has inconsistent size: %v != %v\n", fileName, file.Size(), fileSize)
 			}
@@ -333,7 +342,7 @@ func checkFile(fileName string, fileSize int64) {
 
 		// file does not exist, request it
 		fmt.Printf("File %v does not exist. Getting copies...\n", LOCALFILEPATH+localTempFilePrefix+fileName)
-		handleGet(localTempFilePrefix+fileName, fileName, false)
+		handleGet(localTempFilePrefix+fileName, fileName, false, READLATEST, 0)
 	}
 }
 
@@ -498,7 +507,7 @@ func FinalizeOutputMaple(destFilePrefix string) {
 				}
 			}
 			_ = fd.Close()
-			handlePut(destFilePrefix + curKey, destFilePrefix + curKey, true)
+			_ = handlePut(destFilePrefix + curKey, destFilePrefix + curKey, CONFLICTOVERWRITE, 0, 0, "")
 			_ = os.Remove(filePath)
 			curKey = nextKey
 		} else {
@@ -515,8 +524,7 @@ func FinalizeOutputMaple(destFilePrefix string) {
 func hashPartitionMaple(numTasksMaple int) {
 	for fileKey, fileName := range fileMapMaple {
 		eachTaskFiles[fileKey % numTasksMaple] = append(eachTaskFiles[fileKey % numTasksMaple], fileName)
-		file, _ := os.Stat(SDFSFILEPATH + fileName)
-		eachTaskFileSize[fileKey % numTasksMaple] = append(eachTaskFileSize[fileKey % numTasksMaple], file.Size())
+		eachTaskFileSize[fileKey % numTasksMaple] = append(eachTaskFileSize[fileKey % numTasksMaple], sdfsFileSize(fileName))
 	}
 }
 
@@ -538,9 +546,8 @@ func rangePartitionMaple(numTasksMaple int) {
 				break
 			} else {
 				fileName := fileNames[i * numFilesEachTask + j]
-				file, _ := os.Stat(SDFSFILEPATH + fileName)
 				eachTaskFiles[i] = append(eachTaskFiles[i], fileName)
-				eachTaskFileSize[i] = append(eachTaskFileSize[i], file.Size())
+				eachTaskFileSize[i] = append(eachTaskFileSize[i], sdfsFileSize(fileName))
 			}
 		}
 	}
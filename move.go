@@ -0,0 +1,461 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This portion of code implements renames within SDFS. A rename only
+// changes metadata on the master node and the names of the replica files,
+// no data is copied:
+// 		1. every node that stores the file, its older versions or its blocks
+//		   or shards links its copies under the new names with a MOVELINK
+//		   message and answers with the copies it linked in a MOVEACK message
+//		2. the master node moves the entries in the replica list at once and
+//		   publishes the change. A node that did not link a copy in time is
+//		   dropped from its entry and the entry is queued for repair
+//		3. once the change had UNLINKDELAY to reach every node, the nodes
+//		   remove the old names with a MOVEUNLINK message
+// A reader sees the file either under the old or under the new name, the
+// copies exist under both names while the replica list changes. The
+// rename fails if the destination exists, unless it is forced, in which
+// case the destination and its versions are deleted first. mvdir checks
+// every file in a directory and its subdirectories first, and then renames
+// them one file at a time.
+
+// func handleMove(srcName string, dstName string, isPrefix bool, force bool) error
+// ------------------------------------------------------------------
+// Description: This function handles the mv and mvdir instructions
+// Input:   srcName string: the sdfs file or prefix to be renamed
+//			dstName string: the new name or prefix
+//			isPrefix bool: whether every file with the prefix is renamed
+//			force bool: whether an existing destination is replaced
+// Output:  nil if the rename is done
+func handleMove(srcName string, dstName string, isPrefix bool, force bool) error {
+	logMsg := fmt.Sprintf("Renaming SDFS file %v to %v\n", srcName, dstName)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+
+	var err error
+	if isMaster {
+		if isPrefix {
+			err = moveDir(srcName, dstName, force)
+		} else {
+			err = moveSDFS(srcName, dstName, force)
+		}
+		if err != nil {
+			fmt.Printf("Rename of SDFS file %v rejected: %v\n", srcName, err.Error())
+		}
+		return err
+	}
+
+	putID, _ := newWaiter(1)
+	sentMap := make(map[string]string)
+	sentMap[SENDERNAME] = srcName
+	sentMap[RECEIVERNAME] = dstName
+	sentMap[PUTID] = putID
+	sentMap[MOVEPREFIX] = strconv.FormatBool(isPrefix)
+	sentMap[MOVEFORCE] = strconv.FormatBool(force)
+	msgContent, _ := json.Marshal(sentMap)
+	msgSent := MakeMessage(MOVEREQ, string(msgContent), strconv.Itoa(selfID))
+	sendRequest(masterID, msgSent)
+
+	responseMap, ok := waitReply(putID, PUTTIMEOUT)
+	if !ok {
+		err = errors.New("no response from master node")
+	} else if responseMap[PUTSTATUS] != TRUE {
+		err = errors.New(responseMap[PUTREASON])
+	}
+	if err != nil {
+		fmt.Printf("Rename of SDFS file %v rejected: %v\n", srcName, err.Error())
+		return err
+	}
+	logMsg = fmt.Sprintf("SDFS file %v renamed to %v\n", srcName, dstName)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+	return nil
+}
+
+
+// func moveSDFS(srcName string, dstName string, force bool) error
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to rename a
+//				sdfs file
+// Input:   srcName string: the sdfs file to be renamed
+//			dstName string: the new name
+//			force bool: whether an existing destination is replaced
+// Output:  the rejection reason
+func moveSDFS(srcName string, dstName string, force bool) error {
+	// appends are applied and puts committed before or after the rename,
+	// the locks are taken in order of the names
+	first, second := srcName, dstName
+	if second < first {
+		first, second = second, first
+	}
+	lockSDFSFile(first)
+	defer unlockSDFSFile(first)
+	if second != first {
+		lockSDFSFile(second)
+		defer unlockSDFSFile(second)
+	}
+	conflictLock.Lock()
+	defer conflictLock.Unlock()
+	return moveFile(srcName, dstName, force)
+}
+
+
+// func moveDir(srcDir string, dstDir string, force bool) error
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to rename a
+//				sdfs directory with its files and subdirectories. Every file
+//				is checked first, nothing is renamed if any of them can't
+//				be, otherwise the files are renamed one at a time
+// Input:   srcDir string: the directory to be renamed
+//			dstDir string: the new directory path
+//			force bool: whether existing destinations are replaced
+// Output:  the rejection reason
+func moveDir(srcDir string, dstDir string, force bool) error {
+	srcDir = cleanDir(srcDir)
+	dstDir = cleanDir(dstDir)
+	if srcDir == "" || dstDir == srcDir || strings.HasPrefix(dstDir, srcDir + "/") {
+		return errors.New("destination directory is inside the source directory")
+	}
+	srcNames, ok := listDir(srcDir, true)
+	if !ok {
+		return errors.New("sdfs directory " + srcDir + " does not exist")
+	}
+
+	for _, sdfsFileName := range srcNames {
+		_, _, err := checkMove(sdfsFileName, dstDir + strings.TrimPrefix(sdfsFileName, srcDir), force)
+		if err != nil {
+			return fmt.Errorf("%v: %v", sdfsFileName, err.Error())
+		}
+	}
+
+	for _, sdfsFileName := range srcNames {
+		err := moveSDFS(sdfsFileName, dstDir + strings.TrimPrefix(sdfsFileName, srcDir), force)
+		if err != nil {
+			return fmt.Errorf("%v: %v", sdfsFileName, err.Error())
+		}
+	}
+	moveExplicitDirs(srcDir, dstDir)
+	return nil
+}
+
+
+// func moveFile(srcName string, dstName string, force bool) error
+// ------------------------------------------------------------------
+// Description: This function renames a sdfs file with its older versions
+//				and its blocks or shards. The caller holds conflictLock
+// Input:   srcName string: the sdfs file to be renamed
+//			dstName string: the new name
+//			force bool: whether an existing destination is replaced
+// Output:  the rejection reason
+func moveFile(srcName string, dstName string, force bool) error {
+	renames, exists, err := checkMove(srcName, dstName, force)
+	if err != nil {
+		return err
+	}
+	if exists {
+		deleteWithVersions(dstName)
+	}
+
+	holders := moveHolders(renames)
+	linked := linkCopies(holders)
+
+	fileLock.Lock()
+	changed := make([]string, 0, 2 * len(renames))
+	unlinked := make([]string, 0)
+	for oldName, newName := range renames {
+		sdfsMap, ok := replicateList[oldName]
+		if !ok {
+			continue
+		}
+		// a copy that was not linked is not found under the new name
+		for _, key := range fileSlots(sdfsMap) {
+			nodeID, err := strconv.Atoi(sdfsMap[key])
+			if err != nil {
+				continue
+			}
+			if _, ok := holders[nodeID][oldName]; ok && !linked[nodeID][oldName] {
+				sdfsMap[key] = ""
+				replicateCounter[strconv.Itoa(nodeID)]--
+				unlinked = append(unlinked, newName)
+			}
+		}
+		for _, key := range []string{BLOCKLIST, SHARDLIST} {
+			if sdfsMap[key] == "" {
+				continue
+			}
+			var parts []string
+			_ = json.Unmarshal([]byte(sdfsMap[key]), &parts)
+			for i, part := range parts {
+				if newPart, ok := renames[part]; ok {
+					parts[i] = newPart
+				}
+			}
+			partList, _ := json.Marshal(parts)
+			sdfsMap[key] = string(partList)
+		}
+		delete(replicateList, oldName)
+		replicateList[newName] = sdfsMap
+		changed = append(changed, oldName, newName)
+	}
+	fileLock.Unlock()
+	publishReplicaDelta(changed...)
+	pruneLock.Lock()
+	if mark, ok := prunedVersions[srcName]; ok {
+		prunedVersions[dstName] = mark
+		delete(prunedVersions, srcName)
+	}
+	pruneLock.Unlock()
+	for _, sdfsFileName := range unlinked {
+		queueRepair(sdfsFileName)
+	}
+
+	// readers with an older replica list still use the old names
+	go func() {
+		time.Sleep(UNLINKDELAY)
+		sendMoveMessage(MOVEUNLINK, "", holders)
+	}()
+
+	logMsg := fmt.Sprintf("SDFS file %v renamed to %v with %d entries\n", srcName, dstName, len(renames))
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+	return nil
+}
+
+
+// func checkMove(srcName string, dstName string, force bool) (map[string]string, bool, error)
+// ------------------------------------------------------------------
+// Description: A helper function that checks whether a sdfs file can be
+//				renamed and lists the entries that are renamed with it
+// Input:   srcName string: the sdfs file to be renamed
+//			dstName string: the new name
+//			force bool: whether an existing destination is replaced
+// Output:  maps the old name of every entry to its new name, whether the
+//			destination exists, and the rejection reason
+func checkMove(srcName string, dstName string, force bool) (map[string]string, bool, error) {
+	if isInternalName(srcName) || isInternalName(dstName) {
+		return nil, false, errors.New("sdfs file names can't contain " + VERSIONSEP)
+	}
+	if srcName == dstName {
+		return nil, false, errors.New("source and destination are the same")
+	}
+
+	fileLock.RLock()
+	_, ok := replicateList[srcName]
+	_, exists := replicateList[dstName]
+	renames := moveEntries(srcName, dstName)
+	fileLock.RUnlock()
+	if !ok {
+		return nil, false, errors.New("sdfs file does not exist")
+	}
+	for sdfsFileName := range renames {
+		if inTransfer(sdfsFileName) {
+			return nil, false, errors.New("sdfs file is being repaired or moved")
+		}
+	}
+	if exists && !force {
+		return nil, false, errors.New("sdfs file " + dstName + " exists")
+	}
+	return renames, exists, nil
+}
+
+
+// func moveEntries(srcName string, dstName string) map[string]string
+// ------------------------------------------------------------------
+// Description: A helper function that finds the entries of a sdfs file,
+//				its kept versions and the blocks or shards of both, from
+//				the metadata of the file. The caller holds fileLock
+// Input:   srcName string: the sdfs file to be renamed
+//			dstName string: the new name
+// Output:  maps the old name of every entry to its new name
+func moveEntries(srcName string, dstName string) map[string]string {
+	renames := make(map[string]string)
+	// the file, its versions and its parts are all named <sdfs name>@...
+	entries := append([]string{srcName}, keptVersions(srcName)...)
+	for len(entries) > 0 {
+		sdfsFileName := entries[0]
+		entries = entries[1:]
+		sdfsMap, ok := replicateList[sdfsFileName]
+		if !ok {
+			continue
+		}
+		renames[sdfsFileName] = dstName + strings.TrimPrefix(sdfsFileName, srcName)
+		for _, key := range []string{BLOCKLIST, SHARDLIST} {
+			var parts []string
+			_ = json.Unmarshal([]byte(sdfsMap[key]), &parts)
+			for _, part := range parts {
+				if _, ok := renames[part]; !ok && strings.HasPrefix(part, srcName + VERSIONSEP) {
+					entries = append(entries, part)
+				}
+			}
+		}
+	}
+	return renames
+}
+
+
+// func moveHolders(renames map[string]string) map[int]map[string]string
+// ------------------------------------------------------------------
+// Description: A helper function that groups the renamed entries by the
+//				live nodes that store them
+// Input:   renames map[string]string: maps old name to new name
+// Output:  maps node id to the old and new names of its copies
+func moveHolders(renames map[string]string) map[int]map[string]string {
+	holders := make(map[int]map[string]string)
+	for oldName, newName := range renames {
+		for _, nodeID := range liveReplicas(oldName) {
+			if _, ok := holders[nodeID]; !ok {
+				holders[nodeID] = make(map[string]string)
+			}
+			holders[nodeID][oldName] = newName
+		}
+	}
+	return holders
+}
+
+
+// func linkCopies(holders map[int]map[string]string) map[int]map[string]bool
+// ------------------------------------------------------------------
+// Description: This function asks the nodes to link their copies under
+//				the new names and waits up to MOVETIMEOUT for their answers
+// Input:   holders map[int]map[string]string: maps node id to the old and
+//											   new names of its copies
+// Output:  maps node id to the old names of the copies it linked
+func linkCopies(holders map[int]map[string]string) map[int]map[string]bool {
+	readID, response := newWaiter(len(holders))
+	defer removeWaiter(readID)
+
+	linked := make(map[int]map[string]bool)
+	waiting := sendMoveMessage(MOVELINK, readID, holders)
+	if renames, ok := holders[selfID]; ok {
+		linked[selfID] = moveLocalReplicas(MOVELINK, renames)
+	}
+
+	timeout := time.After(MOVETIMEOUT)
+	for waiting > 0 {
+		select {
+		case replyMap := <-response:
+			nodeID, _ := strconv.Atoi(replyMap[RECEIVERID])
+			done := make(map[string]bool)
+			_ = json.Unmarshal([]byte(replyMap[STOREDFILES]), &done)
+			linked[nodeID] = done
+			waiting--
+		case <-timeout:
+			return linked
+		}
+	}
+	return linked
+}
+
+
+// func sendMoveMessage(msgType string, readID string, holders map[int]map[string]string) int
+// ------------------------------------------------------------------
+// Description: A helper function that asks the nodes to link or unlink
+//				the copies of renamed entries. The copies of this node are
+//				unlinked here, but linked by the caller
+// Input:   msgType string: MOVELINK or MOVEUNLINK
+//			readID string: the id the links are acknowledged with
+//			holders map[int]map[string]string: maps node id to the old and
+//											   new names of its copies
+// Output:  the number of other nodes the message was sent to
+func sendMoveMessage(msgType string, readID string, holders map[int]map[string]string) int {
+	sent := 0
+	for nodeID, renames := range holders {
+		if nodeID == selfID {
+			if msgType == MOVEUNLINK {
+				moveLocalReplicas(msgType, renames)
+			}
+			continue
+		}
+		renameList, _ := json.Marshal(renames)
+		moveMap := make(map[string]string)
+		moveMap[READID] = readID
+		moveMap[STOREDFILES] = string(renameList)
+		msgContent, _ := json.Marshal(moveMap)
+		msgSent := MakeMessage(msgType, string(msgContent), strconv.Itoa(selfID))
+		sendTCPRequest(nodeID, msgSent)
+		sent++
+	}
+	return sent
+}
+
+
+// func handleMoveMessage(msgType string, msgContent string, senderID int)
+// ------------------------------------------------------------------
+// Description: This function answers a MOVELINK message with the copies
+//				that were linked, or handles a MOVEUNLINK message
+// Input:   msgType string: MOVELINK or MOVEUNLINK
+//			msgContent string: the content of the message
+//			senderID int: the node id of the master node
+// Output:  None
+func handleMoveMessage(msgType string, msgContent string, senderID int) {
+	moveMap := make(map[string]string)
+	renames := make(map[string]string)
+	err := json.Unmarshal([]byte(msgContent), &moveMap)
+	if err == nil {
+		err = json.Unmarshal([]byte(moveMap[STOREDFILES]), &renames)
+	}
+	ErrorHandler("Unmarshal move error", err, false)
+	linked := moveLocalReplicas(msgType, renames)
+	if msgType == MOVEUNLINK {
+		return
+	}
+
+	linkedList, _ := json.Marshal(linked)
+	replyMap := make(map[string]string)
+	replyMap[READID] = moveMap[READID]
+	replyMap[RECEIVERID] = strconv.Itoa(selfID)
+	replyMap[STOREDFILES] = string(linkedList)
+	replyContent, _ := json.Marshal(replyMap)
+	msgSent := MakeMessage(MOVEACK, string(replyContent), strconv.Itoa(selfID))
+	sendTCPRequest(senderID, msgSent)
+}
+
+
+// func moveLocalReplicas(msgType string, renames map[string]string) map[string]bool
+// ------------------------------------------------------------------
+// Description: This function links replicas in the sdfs directory under
+//				their new names, or removes their old names once the
+//				replica list moved them
+// Input:   msgType string: MOVELINK or MOVEUNLINK
+//			renames map[string]string: maps old name to new name
+// Output:  the old names of the replicas that were linked
+func moveLocalReplicas(msgType string, renames map[string]string) map[string]bool {
+	linked := make(map[string]bool)
+	selfIDStr := strconv.Itoa(selfID)
+	for oldName, newName := range renames {
+		if msgType == MOVEUNLINK {
+			// the old name is kept if the link failed or was used again
+			oldInfo, err := os.Stat(SDFSFILEPATH + oldName)
+			if err != nil || isReplicaNode(oldName, selfIDStr) {
+				continue
+			}
+			if newInfo, err := os.Stat(SDFSFILEPATH + newName); err == nil && os.SameFile(oldInfo, newInfo) {
+				err = os.Remove(SDFSFILEPATH + oldName)
+				ErrorHandler("Can't remove renamed replica " + oldName, err, false)
+			}
+			continue
+		}
+
+		_ = os.Remove(SDFSFILEPATH + newName)
+		err := makeParentDir(SDFSFILEPATH + newName)
+		if err == nil {
+			err = os.Link(SDFSFILEPATH + oldName, SDFSFILEPATH + newName)
+		}
+		errMsg := fmt.Sprintf("Can't link sdfs file %v as %v", oldName, newName)
+		ErrorHandler(errMsg, err, false)
+		if err == nil {
+			copyStored(oldName, newName)
+			linked[oldName] = true
+		}
+	}
+	return linked
+}
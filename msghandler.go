@@ -262,54 +262,26 @@ func ListeningToMessages() {
 				fmt.Print(logMsg)
 				WriteLog(logFile, logMsg, false)
 
-				// check if file already exists
-				fileLock.RLock()
-				_, ok := replicateList[sdfsFileName]
-				if ok {
-					receivedTime, err := time.Parse("2006-01-02T15:04:05.000Z", replicateList[sdfsFileName][LASTUPDATE])
-					fileLock.RUnlock()
-					ErrorHandler("Decoding last update time of replica list error: ", err, false)
-					currentTimeString := time.Now().Format("2006-01-02T15:04:05.000Z")
-					currentTime, _ := time.Parse("2006-01-02T15:04:05.000Z", currentTimeString)
-
-					// if last update is within one minute
-					if currentTime.Before(receivedTime.Add(time.Minute)) {
-						overwrite := fileNames[OVERWRITE]
-						if overwrite == FALSE {
-							// send overwrite request back to user
-							sentMap := make(map[string]string)
-							sentMap[LOCALNAME] = localFileName
-							sentMap[SDFSNAME] = sdfsFileName
-
-							msgContent, _ := json.Marshal(sentMap)
-							msgSent := MakeMessage(OVERWRITE, string(msgContent), strconv.Itoa(selfID))
-
-							senderID, _ := strconv.Atoi(msgMap[SENDER])
-							sendRequest(senderID, msgSent)
-
-							logMsg := fmt.Sprintf("Pending overwrite SDFS File %v request from sender: %s\n", sdfsFileName, domain)
-							fmt.Print(logMsg)
-							WriteLog(logFile, logMsg, false)
-
-							return
-						}
-						// overwrite file
-						logMsg := fmt.Sprintf("Overwriting SDFS file: %v\n", sdfsFileName)
-						fmt.Print(logMsg)
-						WriteLog(logFile, logMsg, false)
-					}
-					deleteSDFS(sdfsFileName)
-				}
-				if !ok {
-					fileLock.RUnlock()
+				// the conflict policy is checked before anything is written
+				sender := (*msgPointer)[SENDER]
+				senderID, _ := strconv.Atoi(sender)
+				fileSize, _ := strconv.ParseInt(fileNames[SDFSSIZE], 10, 64)
+				quorum, _ := strconv.Atoi(fileNames[PUTQUORUM])
+				factor, _ := strconv.Atoi(fileNames[REPLICAFACTOR])
+				pp, err := startPut(sdfsFileName, fileNames[PUTPOLICY], quorum, factor, fileNames[PUTGROUP], sender, fileNames[CHECKSUM], fileSize, fileNames[PUTID])
+				if err != nil {
+					sendPutResponse(senderID, fileNames[PUTID], sdfsFileName, 0, err)
+					return
 				}
 
+				// the file is staged on the replicas until the quorum is reached
 				receiverMap := make(map[string]string)
-				sender := (*msgPointer)[SENDER]
-				addNewFile(sdfsFileName, sender, &receiverMap)
-
+				for key, idStr := range pp.replicas {
+					receiverMap[key] = idStr
+				}
 				receiverMap[SENDERNAME] = localFileName
-				receiverMap[RECEIVERNAME] = sdfsFileName
+				receiverMap[RECEIVERNAME] = pp.stagingName
+				receiverMap[CHECKSUM] = pp.checksum
 				receiverMap[SENDERTYPE] = LOCALNAME
 				receiverMap[RECEIVERTYPE] = SDFSNAME
 				if localFileName == SDFSNAME {
@@ -320,51 +292,172 @@ func ListeningToMessages() {
 				// send replica id back to sender
 				msgContent, _ := json.Marshal(receiverMap)
 				msgSent := MakeMessage(WRITE, string(msgContent), strconv.Itoa(selfID))
-
-				senderID, _ := strconv.Atoi(msgMap[SENDER])
 				sendRequest(senderID, msgSent)
 
 				logMsg = fmt.Sprintf("Send replica information back to node: %s\n", domain)
 				fmt.Print(logMsg)
 				WriteLog(logFile, logMsg, false)
+
+				version, err := waitPut(pp)
+				sendPutResponse(senderID, fileNames[PUTID], sdfsFileName, version, err)
 			}(&msgMap)
 
 			///////////////////////////////
-			// OVERWRITE message handler //
+			// APPENDREQ message handler //
 			///////////////////////////////
-		} else if msgMap[MSGTYPE] == OVERWRITE {
-			// user confirm whether to overwrite the file
+		} else if msgMap[MSGTYPE] == APPENDREQ {
+			if !isMaster {
+				WriteLog(logFile, "Trying to send append request to non master node\n", false)
+				continue
+			}
+
 			go func(msgPointer *map[int]string) {
 				fileNames := make(map[string]string)
 				err = json.Unmarshal([]byte((*msgPointer)[CONTENT]), &fileNames)
 				ErrorHandler("Unmarshal error", err, false)
 				sdfsFileName := fileNames[SDFSNAME]
-				localFileName := fileNames[LOCALNAME]
 
-				logMsg := fmt.Sprintf("Receive overwrite SDFS File %v request from: %s\n", sdfsFileName, domain)
+				logMsg := fmt.Sprintf("Receive append SDFS File %v request from: %s\n", sdfsFileName, domain)
 				fmt.Print(logMsg)
 				WriteLog(logFile, logMsg, false)
 
-				cmd := getInput(sdfsFileName)
-				if cmd == "y" {
-					// user want to overwrite the file
-					sentMap := make(map[string]string)
-					sentMap[LOCALNAME] = localFileName
-					sentMap[SDFSNAME] = sdfsFileName
-					sentMap[OVERWRITE] = TRUE
+				sender := (*msgPointer)[SENDER]
+				senderID, _ := strconv.Atoi(sender)
+				fileSize, _ := strconv.ParseInt(fileNames[SDFSSIZE], 10, 64)
+				version, err := appendFile(sdfsFileName, fileNames[LOCALNAME], sender, fileNames[CHECKSUM], fileSize, fileNames[PUTID])
+				sendPutResponse(senderID, fileNames[PUTID], sdfsFileName, version, err)
+			}(&msgMap)
 
-					msgContent, _ := json.Marshal(sentMap)
-					msgSent := MakeMessage(WRITEREQ, string(msgContent), strconv.Itoa(selfID))
+			/////////////////////////////
+			// MOVEREQ message handler //
+			/////////////////////////////
+		} else if msgMap[MSGTYPE] == MOVEREQ {
+			if !isMaster {
+				WriteLog(logFile, "Trying to send move request to non master node\n", false)
+				continue
+			}
 
-					senderID, _ := strconv.Atoi(msgMap[SENDER])
-					sendRequest(senderID, msgSent)
+			go func(msgPointer *map[int]string) {
+				moveMap := make(map[string]string)
+				err = json.Unmarshal([]byte((*msgPointer)[CONTENT]), &moveMap)
+				ErrorHandler("Unmarshal error", err, false)
+				srcName := moveMap[SENDERNAME]
+				dstName := moveMap[RECEIVERNAME]
 
-					logMsg := fmt.Sprintf("Sending overwrite SDFS File %v request to master node: %s\n", sdfsFileName, domain)
-					fmt.Print(logMsg)
-					WriteLog(logFile, logMsg, false)
+				logMsg := fmt.Sprintf("Receive rename SDFS File %v to %v request from: %s\n", srcName, dstName, domain)
+				fmt.Print(logMsg)
+				WriteLog(logFile, logMsg, false)
+
+				force := moveMap[MOVEFORCE] == TRUE
+				if moveMap[MOVEPREFIX] == TRUE {
+					err = moveDir(srcName, dstName, force)
+				} else {
+					err = moveSDFS(srcName, dstName, force)
 				}
+				senderID, _ := strconv.Atoi((*msgPointer)[SENDER])
+				sendPutResponse(senderID, moveMap[PUTID], dstName, 0, err)
 			}(&msgMap)
 
+			/////////////////////////////////////
+			// MKDIR and RMDIR message handler //
+			/////////////////////////////////////
+		} else if msgMap[MSGTYPE] == MKDIR || msgMap[MSGTYPE] == RMDIR {
+			if !isMaster {
+				WriteLog(logFile, "Trying to send directory request to non master node\n", false)
+				continue
+			}
+
+			logMsg := fmt.Sprintf("Receive %v SDFS directory %v request from: %s\n", helperMap[msgMap[MSGTYPE]], msgMap[CONTENT], domain)
+			fmt.Print(logMsg)
+			WriteLog(logFile, logMsg, false)
+			handleDirRequest(msgMap[MSGTYPE], msgMap[CONTENT])
+
+			/////////////////////////////
+			// LISTREQ message handler //
+			/////////////////////////////
+		} else if msgMap[MSGTYPE] == LISTREQ {
+			if !isMaster {
+				WriteLog(logFile, "Trying to send list request to non master node\n", false)
+				continue
+			}
+
+			senderID, _ := strconv.Atoi(msgMap[SENDER])
+			go handleListRequest(msgMap[CONTENT], senderID)
+
+			/////////////////////////////
+			// PUTRESP message handler //
+			/////////////////////////////
+		} else if msgMap[MSGTYPE] == PUTRESP {
+			deliverReply(msgMap[CONTENT], PUTID)
+
+			////////////////////////////////////
+			// CONFLICTPOLICY message handler //
+			////////////////////////////////////
+		} else if msgMap[MSGTYPE] == CONFLICTPOLICY {
+			if !isMaster {
+				WriteLog(logFile, "Trying to send conflict policy to non master node\n", false)
+				continue
+			}
+
+			policyMap := make(map[string]string)
+			_ = json.Unmarshal([]byte(msgMap[CONTENT]), &policyMap)
+			handleConflictPolicy(policyMap[SDFSNAME], policyMap[PUTPOLICY])
+
+			//////////////////////////////////
+			// QUORUMPOLICY message handler //
+			//////////////////////////////////
+		} else if msgMap[MSGTYPE] == QUORUMPOLICY {
+			if !isMaster {
+				WriteLog(logFile, "Trying to send write quorum to non master node\n", false)
+				continue
+			}
+
+			policyMap := make(map[string]string)
+			_ = json.Unmarshal([]byte(msgMap[CONTENT]), &policyMap)
+			quorum, err := strconv.Atoi(policyMap[PUTQUORUM])
+			if err != nil || quorum < 0 {
+				continue
+			}
+			handleQuorumPolicy(policyMap[SDFSNAME], quorum)
+
+			///////////////////////////////////
+			// ERASUREPOLICY message handler //
+			///////////////////////////////////
+		} else if msgMap[MSGTYPE] == ERASUREPOLICY {
+			if !isMaster {
+				WriteLog(logFile, "Trying to send erasure scheme to non master node\n", false)
+				continue
+			}
+
+			policyMap := make(map[string]string)
+			_ = json.Unmarshal([]byte(msgMap[CONTENT]), &policyMap)
+			handleErasurePolicy(policyMap[SDFSNAME], policyMap[ECSCHEME])
+
+			////////////////////////////////
+			// NODEREPORT message handler //
+			////////////////////////////////
+		} else if msgMap[MSGTYPE] == NODEREPORT {
+			reportMap := make(map[string]string)
+			_ = json.Unmarshal([]byte(msgMap[CONTENT]), &reportMap)
+			recordNodeReport(msgMap[SENDER], reportMap)
+
+			///////////////////////////////////////
+			// REPLICATIONPOLICY message handler //
+			///////////////////////////////////////
+		} else if msgMap[MSGTYPE] == REPLICATIONPOLICY {
+			if !isMaster {
+				WriteLog(logFile, "Trying to send replication factor to non master node\n", false)
+				continue
+			}
+
+			policyMap := make(map[string]string)
+			_ = json.Unmarshal([]byte(msgMap[CONTENT]), &policyMap)
+			factor, err := strconv.Atoi(policyMap[REPLICAFACTOR])
+			if err != nil || factor < 0 {
+				continue
+			}
+			handleReplicationPolicy(policyMap[SDFSNAME], factor)
+
 			///////////////////////////
 			// WRITE message handler //
 			///////////////////////////
@@ -383,12 +476,12 @@ func ListeningToMessages() {
 				WriteLog(logFile, logMsg, false)
 
 				for key, idStr := range receiverMap {
-					if key != REPLICAONE && key != REPLICATWO && key != REPLICATHREE && key != REPLICAFOUR {
+					if !isReplicaKey(key) {
 						continue
 					}
 					id, _ := strconv.Atoi(idStr)
 					// if current node does not have local replica, then senderName and receiverName are the same
-					go WriteToNode(senderName, senderType, receiverName, receiverType, id)
+					go WriteToNode(senderName, senderType, receiverName, receiverType, id, receiverMap[CHECKSUM])
 				}
 			}(&msgMap)
 
@@ -421,15 +514,99 @@ func ListeningToMessages() {
 				fmt.Print(logMsg)
 				WriteLog(logFile, logMsg, false)
 
-				get(localFileName, sdfsFileName, receiverID, receiverType, localExist)
+				get(localFileName, sdfsFileName, receiverID, receiverType, localExist, fileNames[EXCLUDEID])
 
 			}(&msgMap)
 
+			//////////////////////////////////
+			// VERSIONQUERY message handler //
+			//////////////////////////////////
+		} else if msgMap[MSGTYPE] == VERSIONQUERY {
+			senderID, _ := strconv.Atoi(msgMap[SENDER])
+			go handleVersionQuery(msgMap[CONTENT], senderID)
+
+			//////////////////////////////////
+			// VERSIONREPLY message handler //
+			//////////////////////////////////
+		} else if msgMap[MSGTYPE] == VERSIONREPLY {
+			deliverReply(msgMap[CONTENT], READID)
+
 			///////////////////////////////
 			// ERRORREAD message handler //
 			///////////////////////////////
 		} else if msgMap[MSGTYPE] == ERRORREAD {
 			fmt.Printf("SDFS File: %v doesn't exist\n", msgMap[CONTENT])
+			failPendingGets(msgMap[CONTENT])
+
+			///////////////////////////////////
+			// REPLICADIGEST message handler //
+			///////////////////////////////////
+		} else if msgMap[MSGTYPE] == REPLICADIGEST {
+			senderID, _ := strconv.Atoi(msgMap[SENDER])
+			if senderID == selfID {
+				continue
+			}
+			masterID = senderID
+			isMaster = false
+			go compareReplicaDigest(msgMap[CONTENT])
+
+			/////////////////////////////////
+			// REPLICASYNC message handler //
+			/////////////////////////////////
+		} else if msgMap[MSGTYPE] == REPLICASYNC {
+			if !isMaster {
+				WriteLog(logFile, "Trying to send replica sync request to non master node\n", false)
+				continue
+			}
+			senderID, _ := strconv.Atoi(msgMap[SENDER])
+			go sendReplicaList(senderID)
+
+			/////////////////////////////////
+			// SCRUBREPORT message handler //
+			/////////////////////////////////
+		} else if msgMap[MSGTYPE] == SCRUBREPORT {
+			if !isMaster {
+				WriteLog(logFile, "Trying to send scrub report to non master node\n", false)
+				continue
+			}
+
+			go func(msgPointer *map[int]string) {
+				fileNames := make(map[string]string)
+				err = json.Unmarshal([]byte((*msgPointer)[CONTENT]), &fileNames)
+				ErrorHandler("Unmarshal error", err, false)
+
+				logMsg := fmt.Sprintf("Receive corrupted replica report of SDFS File %v from: %s\n", fileNames[SDFSNAME], domain)
+				fmt.Print(logMsg)
+				WriteLog(logFile, logMsg, false)
+
+				checkCorruptReplica(fileNames[SDFSNAME], fileNames[CHECKSUM], (*msgPointer)[SENDER])
+			}(&msgMap)
+
+			/////////////////////////////////
+			// SCRUBREMOVE message handler //
+			/////////////////////////////////
+		} else if msgMap[MSGTYPE] == SCRUBREMOVE {
+			fileNames := make(map[string]string)
+			err = json.Unmarshal([]byte(msgMap[CONTENT]), &fileNames)
+			ErrorHandler("Unmarshal error", err, false)
+			go removeScrubbedReplica(fileNames[SDFSNAME])
+
+			///////////////////////////////
+			// RETENTION message handler //
+			///////////////////////////////
+		} else if msgMap[MSGTYPE] == RETENTION {
+			if !isMaster {
+				WriteLog(logFile, "Trying to send retention request to non master node\n", false)
+				continue
+			}
+
+			retentionMap := make(map[string]string)
+			_ = json.Unmarshal([]byte(msgMap[CONTENT]), &retentionMap)
+			num, err := strconv.Atoi(retentionMap[FILEVERSION])
+			if err != nil || num <= 0 {
+				continue
+			}
+			handleRetention(num)
 
 			///////////////////////////////
 			// DELETEREQ message handler //
@@ -447,7 +624,7 @@ func ListeningToMessages() {
 				fmt.Print(logMsg)
 				WriteLog(logFile, logMsg, false)
 
-				if !deleteSDFS(sdfsFileName) {
+				if !deleteWithVersions(sdfsFileName) {
 					msgSent := MakeMessage(ERRORREAD, sdfsFileName, strconv.Itoa(selfID))
 					senderID, _ := strconv.Atoi((*msgPointer)[SENDER])
 					sendRequest(senderID, msgSent)
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// This portion of code implements the directory tree of SDFS. A sdfs name
+// is a path of directories separated by "/" and a file name, e.g. the file
+// data/2019/log.txt is in the directory data/2019. Every node keeps the
+// tree next to its replica list and changes it with the same deltas:
+// 		1. a directory exists while it contains a file or a directory, or
+//		   if it was made with mkdir
+//		2. directories made with mkdir are kept by the master node and sent
+//		   along with every replica list delta, they stay until rmdir
+//		3. older versions, blocks and shards are not part of the tree
+// Directory operations (putdir, deletedir, mvdir, maple's source directory,
+// ls -R and du) look up the directory and walk its children instead of
+// comparing every name in the replica list with a prefix.
+
+// one directory of the tree
+type dirNode struct {
+	dirs map[string]*dirNode
+	files map[string]bool
+	// made with mkdir, kept when it is empty
+	explicit bool
+}
+
+// the root directory, guarded by nsLock. Take fileLock before nsLock
+var namespace = newDirNode()
+var nsLock sync.RWMutex
+
+
+// func newDirNode() *dirNode
+// ------------------------------------------------------------------
+// Description: A helper function that makes an empty directory
+// Input:   None
+// Output:  the directory
+func newDirNode() *dirNode {
+	return &dirNode{dirs: make(map[string]*dirNode), files: make(map[string]bool)}
+}
+
+
+// func cleanDir(dirPath string) string
+// ------------------------------------------------------------------
+// Description: A helper function that normalizes a directory path, the
+//				root directory is the empty path
+// Input:   dirPath string: the directory path, e.g. "/data/2019/"
+// Output:  the normalized path, e.g. "data/2019"
+func cleanDir(dirPath string) string {
+	return strings.Trim(path.Clean("/" + dirPath), "/")
+}
+
+
+// func joinPath(dirPath string, name string) string
+// ------------------------------------------------------------------
+// Description: A helper function that gives the sdfs name of a file or a
+//				directory in a directory
+// Input:   dirPath string: the normalized directory path
+//			name string: the name in the directory
+// Output:  the sdfs name
+func joinPath(dirPath string, name string) string {
+	if dirPath == "" {
+		return name
+	}
+	return dirPath + "/" + name
+}
+
+
+// func splitPath(sdfsFileName string) ([]string, string)
+// ------------------------------------------------------------------
+// Description: A helper function that splits a sdfs name into its
+//				directories and its file name
+// Input:   sdfsFileName string: the sdfs name
+// Output:  the directory names from the root and the file name
+func splitPath(sdfsFileName string) ([]string, string) {
+	parts := strings.Split(cleanDir(sdfsFileName), "/")
+	return parts[:len(parts) - 1], parts[len(parts) - 1]
+}
+
+
+// func lookupDir(dirPath string) *dirNode
+// ------------------------------------------------------------------
+// Description: A helper function that finds a directory in the tree. The
+//				caller holds nsLock
+// Input:   dirPath string: the directory path
+// Output:  the directory, nil if it does not exist
+func lookupDir(dirPath string) *dirNode {
+	dir := namespace
+	dirPath = cleanDir(dirPath)
+	if dirPath == "" {
+		return dir
+	}
+	for _, name := range strings.Split(dirPath, "/") {
+		dir = dir.dirs[name]
+		if dir == nil {
+			return nil
+		}
+	}
+	return dir
+}
+
+
+// func makeDirs(dirs []string) *dirNode
+// ------------------------------------------------------------------
+// Description: A helper function that finds a directory in the tree and
+//				makes the directories on its path that do not exist. The
+//				caller holds the write lock of nsLock
+// Input:   dirs []string: the directory names from the root
+// Output:  the directory
+func makeDirs(dirs []string) *dirNode {
+	dir := namespace
+	for _, name := range dirs {
+		child, ok := dir.dirs[name]
+		if !ok {
+			child = newDirNode()
+			dir.dirs[name] = child
+		}
+		dir = child
+	}
+	return dir
+}
+
+
+// func pruneDirs(dirs []string)
+// ------------------------------------------------------------------
+// Description: A helper function that removes the empty directories on a
+//				path that were not made with mkdir, deepest first. The
+//				caller holds the write lock of nsLock
+// Input:   dirs []string: the directory names from the root
+// Output:  None
+func pruneDirs(dirs []string) {
+	for depth := len(dirs); depth > 0; depth-- {
+		parent := lookupDir(strings.Join(dirs[:depth - 1], "/"))
+		if parent == nil {
+			continue
+		}
+		dir := parent.dirs[dirs[depth - 1]]
+		if dir == nil || dir.explicit || len(dir.dirs) > 0 || len(dir.files) > 0 {
+			return
+		}
+		delete(parent.dirs, dirs[depth - 1])
+	}
+}
+
+
+// func indexNamespace(entries map[string]map[string]string, explicitDirs []string)
+// ------------------------------------------------------------------
+// Description: This function applies changed entries of the replica list
+//				to the tree. It is called with the replica list deltas
+// Input:   entries map[string]map[string]string: the changed entries, a
+//													deleted entry is nil
+//			explicitDirs []string: the directories made with mkdir, nil
+//								   if they are not known
+// Output:  None
+func indexNamespace(entries map[string]map[string]string, explicitDirs []string) {
+	nsLock.Lock()
+	defer nsLock.Unlock()
+	if explicitDirs != nil {
+		setExplicitDirs(explicitDirs)
+	}
+	for sdfsFileName, sdfsMap := range entries {
+		if isInternalName(sdfsFileName) {
+			continue
+		}
+		dirs, name := splitPath(sdfsFileName)
+		if sdfsMap != nil {
+			makeDirs(dirs).files[name] = true
+			continue
+		}
+		if dir := lookupDir(strings.Join(dirs, "/")); dir != nil {
+			delete(dir.files, name)
+			pruneDirs(dirs)
+		}
+	}
+}
+
+
+// func rebuildNamespace(explicitDirs []string)
+// ------------------------------------------------------------------
+// Description: This function builds the tree from the whole replica list,
+//				e.g. when a full replica list is received. The caller holds
+//				fileLock
+// Input:   explicitDirs []string: the directories made with mkdir
+// Output:  None
+func rebuildNamespace(explicitDirs []string) {
+	nsLock.Lock()
+	namespace = newDirNode()
+	nsLock.Unlock()
+	indexNamespace(replicateList, explicitDirs)
+}
+
+
+// func setExplicitDirs(explicitDirs []string)
+// ------------------------------------------------------------------
+// Description: A helper function that marks the directories made with
+//				mkdir and unmarks the others. The caller holds the write
+//				lock of nsLock
+// Input:   explicitDirs []string: the directories made with mkdir
+// Output:  None
+func setExplicitDirs(explicitDirs []string) {
+	keep := make(map[string]bool)
+	for _, dirPath := range explicitDirs {
+		keep[dirPath] = true
+		if dirPath != "" {
+			makeDirs(strings.Split(dirPath, "/")).explicit = true
+		}
+	}
+	for _, dirPath := range listExplicitDirs() {
+		dir := lookupDir(dirPath)
+		if keep[dirPath] || dir == nil {
+			continue
+		}
+		dir.explicit = false
+		pruneDirs(strings.Split(dirPath, "/"))
+	}
+}
+
+
+// func listExplicitDirs() []string
+// ------------------------------------------------------------------
+// Description: A helper function that lists the directories made with
+//				mkdir. The caller holds nsLock
+// Input:   None
+// Output:  the directory paths
+func listExplicitDirs() []string {
+	explicitDirs := make([]string, 0)
+	var walk func(dirPath string, dir *dirNode)
+	walk = func(dirPath string, dir *dirNode) {
+		if dir.explicit {
+			explicitDirs = append(explicitDirs, dirPath)
+		}
+		for name, child := range dir.dirs {
+			walk(joinPath(dirPath, name), child)
+		}
+	}
+	walk("", namespace)
+	return explicitDirs
+}
+
+
+// func encodeExplicitDirs() string
+// ------------------------------------------------------------------
+// Description: A helper function that encodes the directories made with
+//				mkdir for the replica list messages
+// Input:   None
+// Output:  the json list of the directory paths
+func encodeExplicitDirs() string {
+	nsLock.RLock()
+	explicitDirs := listExplicitDirs()
+	nsLock.RUnlock()
+	sort.Strings(explicitDirs)
+	dirList, _ := json.Marshal(explicitDirs)
+	return string(dirList)
+}
+
+
+// func decodeExplicitDirs(dirList string) []string
+// ------------------------------------------------------------------
+// Description: A helper function that decodes the directories made with
+//				mkdir from a replica list message
+// Input:   dirList string: the json list of the directory paths
+// Output:  the directory paths, nil if the message has none
+func decodeExplicitDirs(dirList string) []string {
+	if dirList == "" {
+		return nil
+	}
+	explicitDirs := make([]string, 0)
+	err := json.Unmarshal([]byte(dirList), &explicitDirs)
+	ErrorHandler("Unmarshal error directories", err, false)
+	return explicitDirs
+}
+
+
+// func listDir(dirPath string, recursive bool) ([]string, bool)
+// ------------------------------------------------------------------
+// Description: This function lists the files in a directory
+// Input:   dirPath string: the directory path
+//			recursive bool: whether the files in subdirectories are listed
+// Output:  the sdfs names of the files in order, false if the directory
+//			does not exist
+func listDir(dirPath string, recursive bool) ([]string, bool) {
+	nsLock.RLock()
+	defer nsLock.RUnlock()
+	dirPath = cleanDir(dirPath)
+	dir := lookupDir(dirPath)
+	if dir == nil {
+		return nil, false
+	}
+
+	fileNames := make([]string, 0)
+	var walk func(dirPath string, dir *dirNode)
+	walk = func(dirPath string, dir *dirNode) {
+		for name := range dir.files {
+			fileNames = append(fileNames, joinPath(dirPath, name))
+		}
+		if !recursive {
+			return
+		}
+		for name, child := range dir.dirs {
+			walk(joinPath(dirPath, name), child)
+		}
+	}
+	walk(dirPath, dir)
+	sort.Strings(fileNames)
+	return fileNames, true
+}
+
+
+// func listPrefix(prefix string) []string
+// ------------------------------------------------------------------
+// Description: This function lists the files whose sdfs names start with
+//				a prefix, e.g. "data/20" matches data/2019/log.txt and
+//				data/20.txt
+// Input:   prefix string: the prefix, empty for all files
+// Output:  the sdfs names of the files in order
+func listPrefix(prefix string) []string {
+	nsLock.RLock()
+	defer nsLock.RUnlock()
+	dirPath, namePrefix := "", prefix
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dirPath, namePrefix = cleanDir(prefix[:i]), prefix[i + 1:]
+	}
+	fileNames := make([]string, 0)
+	dir := lookupDir(dirPath)
+	if dir == nil {
+		return fileNames
+	}
+
+	var walk func(dirPath string, dir *dirNode)
+	walk = func(dirPath string, dir *dirNode) {
+		for name := range dir.files {
+			fileNames = append(fileNames, joinPath(dirPath, name))
+		}
+		for name, child := range dir.dirs {
+			walk(joinPath(dirPath, name), child)
+		}
+	}
+	// only the children of the last directory are compared with the prefix
+	for name := range dir.files {
+		if strings.HasPrefix(name, namePrefix) {
+			fileNames = append(fileNames, joinPath(dirPath, name))
+		}
+	}
+	for name, child := range dir.dirs {
+		if strings.HasPrefix(name, namePrefix) {
+			walk(joinPath(dirPath, name), child)
+		}
+	}
+	sort.Strings(fileNames)
+	return fileNames
+}
+
+
+// func listSubdirs(dirPath string) []string
+// ------------------------------------------------------------------
+// Description: This function lists the directories in a directory and all
+//				their subdirectories
+// Input:   dirPath string: the directory path
+// Output:  the paths of the subdirectories in order
+func listSubdirs(dirPath string) []string {
+	nsLock.RLock()
+	defer nsLock.RUnlock()
+	dirPath = cleanDir(dirPath)
+	subdirs := make([]string, 0)
+	var walk func(dirPath string, dir *dirNode)
+	walk = func(dirPath string, dir *dirNode) {
+		for name, child := range dir.dirs {
+			subdirs = append(subdirs, joinPath(dirPath, name))
+			walk(joinPath(dirPath, name), child)
+		}
+	}
+	if dir := lookupDir(dirPath); dir != nil {
+		walk(dirPath, dir)
+	}
+	sort.Strings(subdirs)
+	return subdirs
+}
+
+
+// func handleDirRequest(msgType string, dirPath string)
+// ------------------------------------------------------------------
+// Description: This function handles the mkdir and rmdir instructions.
+//				Directories are made and removed by the master node
+// Input:   msgType string: MKDIR or RMDIR
+//			dirPath string: the directory path
+// Output:  None
+func handleDirRequest(msgType string, dirPath string) {
+	dirPath = cleanDir(dirPath)
+	if dirPath == "" || isInternalName(dirPath) {
+		fmt.Printf("Invalid SDFS directory %q\n", dirPath)
+		return
+	}
+	if !isMaster {
+		msgSent := MakeMessage(msgType, dirPath, strconv.Itoa(selfID))
+		sendRequest(masterID, msgSent)
+		return
+	}
+
+	var err error
+	if msgType == MKDIR {
+		err = makeDir(dirPath)
+	} else {
+		err = removeDir(dirPath)
+	}
+	if err != nil {
+		logMsg := fmt.Sprintf("Can't %v SDFS directory %v: %v\n", strings.ToLower(helperMap[msgType]), dirPath, err.Error())
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+	}
+}
+
+
+// func makeDir(dirPath string) error
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to make a
+//				directory and the directories on its path
+// Input:   dirPath string: the normalized directory path
+// Output:  the error if a file has the name of the directory
+func makeDir(dirPath string) error {
+	fileLock.RLock()
+	nsLock.Lock()
+	dirs, name := splitPath(dirPath)
+	for depth := range dirs {
+		if _, ok := replicateList[strings.Join(dirs[:depth + 1], "/")]; ok {
+			nsLock.Unlock()
+			fileLock.RUnlock()
+			return errors.New("a file has the name of a directory on the path")
+		}
+	}
+	if _, ok := replicateList[dirPath]; ok {
+		nsLock.Unlock()
+		fileLock.RUnlock()
+		return errors.New("a file has the name of the directory")
+	}
+	makeDirs(append(dirs, name)).explicit = true
+	nsLock.Unlock()
+	fileLock.RUnlock()
+
+	publishReplicaDelta()
+	logMsg := fmt.Sprintf("SDFS directory %v made\n", dirPath)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+	return nil
+}
+
+
+// func removeDir(dirPath string) error
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to remove an
+//				empty directory
+// Input:   dirPath string: the normalized directory path
+// Output:  the error if the directory does not exist or is not empty
+func removeDir(dirPath string) error {
+	nsLock.Lock()
+	dir := lookupDir(dirPath)
+	if dir == nil {
+		nsLock.Unlock()
+		return errors.New("directory does not exist")
+	}
+	if len(dir.dirs) > 0 || len(dir.files) > 0 {
+		nsLock.Unlock()
+		return errors.New("directory is not empty")
+	}
+	dir.explicit = false
+	pruneDirs(strings.Split(dirPath, "/"))
+	nsLock.Unlock()
+
+	publishReplicaDelta()
+	logMsg := fmt.Sprintf("SDFS directory %v removed\n", dirPath)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+	return nil
+}
+
+
+// func moveExplicitDirs(srcDir string, dstDir string)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node after mvdir to
+//				move the directories made with mkdir along with the files
+// Input:   srcDir string: the normalized source directory
+//			dstDir string: the normalized destination directory
+// Output:  None
+func moveExplicitDirs(srcDir string, dstDir string) {
+	nsLock.Lock()
+	explicitDirs := listExplicitDirs()
+	for i, dirPath := range explicitDirs {
+		if dirPath == srcDir || strings.HasPrefix(dirPath, srcDir + "/") {
+			explicitDirs[i] = dstDir + strings.TrimPrefix(dirPath, srcDir)
+		}
+	}
+	setExplicitDirs(explicitDirs)
+	nsLock.Unlock()
+	publishReplicaDelta()
+}
+
+
+// func printTree(dirPath string)
+// ------------------------------------------------------------------
+// Description: This function prints a directory and everything in it
+// Input:   dirPath string: the directory path
+// Output:  None
+func printTree(dirPath string) {
+	nsLock.RLock()
+	defer nsLock.RUnlock()
+	dirPath = cleanDir(dirPath)
+	dir := lookupDir(dirPath)
+	if dir == nil {
+		fmt.Printf("SDFS directory %v does not exist.\n", dirPath)
+		return
+	}
+
+	fmt.Printf("-->> /%v\n", dirPath)
+	var walk func(dir *dirNode, indent string)
+	walk = func(dir *dirNode, indent string) {
+		names := make([]string, 0, len(dir.dirs) + len(dir.files))
+		for name := range dir.dirs {
+			names = append(names, name + "/")
+		}
+		for name := range dir.files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("->-> %v%v\n", indent, name)
+			if child, ok := dir.dirs[strings.TrimSuffix(name, "/")]; ok && strings.HasSuffix(name, "/") {
+				walk(child, indent + "    ")
+			}
+		}
+	}
+	walk(dir, "")
+}
+
+
+// func printDiskUsage(dirPath string)
+// ------------------------------------------------------------------
+// Description: This function prints the number of files in a directory,
+//				their size and the bytes their replicas take on the nodes
+// Input:   dirPath string: the directory path
+// Output:  None
+func printDiskUsage(dirPath string) {
+	dirPath = cleanDir(dirPath)
+	fileNames, ok := listDir(dirPath, true)
+	if !ok {
+		fmt.Printf("SDFS directory %v does not exist.\n", dirPath)
+		return
+	}
+
+	var size, stored int64
+	fileLock.RLock()
+	for _, sdfsFileName := range fileNames {
+		fileSize, _ := strconv.ParseInt(replicateList[sdfsFileName][SDFSSIZE], 10, 64)
+		size += fileSize
+	}
+	fileLock.RUnlock()
+	for _, sdfsFileName := range fileNames {
+		stored += storedBytes(sdfsFileName)
+	}
+	fmt.Printf("-->> /%v: %d files, %d bytes, %d bytes stored on the nodes\n", dirPath, len(fileNames), size, stored)
+}
+
+
+// func storedBytes(sdfsFileName string) int64
+// ------------------------------------------------------------------
+// Description: A helper function that gives the bytes the replicas of a
+//				sdfs file, or of its blocks or shards, take on the nodes
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  the number of bytes
+func storedBytes(sdfsFileName string) int64 {
+	names := fileParts(sdfsFileName)
+	if len(names) == 0 {
+		names = []string{sdfsFileName}
+	}
+	var stored int64
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+	for _, name := range names {
+		sdfsMap := replicateList[name]
+		fileSize, _ := strconv.ParseInt(sdfsMap[SDFSSIZE], 10, 64)
+		for _, key := range fileSlots(sdfsMap) {
+			if sdfsMap[key] != "" {
+				stored += fileSize
+			}
+		}
+	}
+	return stored
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// This portion of code implements durable node-local storage. A node that
+// is started with -persist keeps its sdfs directory across restarts
+// instead of removing it. Once it has joined, the node hashes every file
+// it kept and sends the list to the master node with a STOREREPORT
+// message until the master node answers with a STOREREPORTACK message.
+// The master node admits a kept copy as a replica again if its checksum is
+// the one of the current version of the file and the file has an empty
+// replica slot, e.g. because the node was declared failed. Such a file
+// then leaves the repair queue. A copy that finds no empty slot yet, e.g.
+// because the old node id of the restarted node is not declared failed
+// yet, is remembered, and the repair of the file admits it instead of
+// copying the file to another node. Copies of older or deleted files are
+// not admitted and are removed by the garbage collection.
+
+// whether the sdfs directory is kept across restarts, set with -persist
+var persistStorage bool
+
+// copies reported by restarted nodes that found no empty slot, maps node
+// id to file name to checksum, guarded by reportedLock
+var reportedFiles = make(map[string]map[string]string)
+var reportedLock sync.Mutex
+
+
+// func reportStoredFiles()
+// ------------------------------------------------------------------
+// Description: This function sends the files this node kept from before
+//				its restart to the master node, once the node has joined,
+//				until the master node acknowledges them
+// Input:   None
+// Output:  None
+func reportStoredFiles() {
+	time.Sleep(REPORTTIME)
+	stored := localStoreList()
+	if len(stored) == 0 {
+		return
+	}
+
+	logMsg := fmt.Sprintf("Reporting %d SDFS files kept from before the restart\n", len(stored))
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+
+	storedFiles, _ := json.Marshal(stored)
+	for !sendStoreReport(stored, string(storedFiles)) {
+		WriteLog(logFile, "No acknowledgement of the store report from master node, sending it again\n", false)
+		time.Sleep(REPORTTIME)
+	}
+}
+
+
+// func sendStoreReport(stored map[string]string, storedFiles string) bool
+// ------------------------------------------------------------------
+// Description: A helper function that sends the store report to the
+//				current master node and waits up to LISTTIMEOUT for its
+//				acknowledgement
+// Input:   stored map[string]string: maps file name to checksum
+//			storedFiles string: the json of the stored files
+// Output:  true if the master node admitted the files
+func sendStoreReport(stored map[string]string, storedFiles string) bool {
+	if isMaster {
+		admitStoredFiles(strconv.Itoa(selfID), stored)
+		return true
+	}
+
+	readID, _ := newWaiter(1)
+
+	reportMap := make(map[string]string)
+	reportMap[READID] = readID
+	reportMap[STOREDFILES] = storedFiles
+	msgContent, _ := json.Marshal(reportMap)
+	msgSent := MakeMessage(STOREREPORT, string(msgContent), strconv.Itoa(selfID))
+	sendTCPRequest(masterID, msgSent)
+
+	_, ok := waitReply(readID, LISTTIMEOUT)
+	return ok
+}
+
+
+// func handleStoreReport(msgContent string, senderID int)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to admit the
+//				files of a STOREREPORT message and acknowledge them
+// Input:   msgContent string: the content of the STOREREPORT message
+//			senderID int: the node id of the restarted node
+// Output:  None
+func handleStoreReport(msgContent string, senderID int) {
+	reportMap := make(map[string]string)
+	stored := make(map[string]string)
+	err := json.Unmarshal([]byte(msgContent), &reportMap)
+	ErrorHandler("Unmarshal store report error", err, false)
+	_ = json.Unmarshal([]byte(reportMap[STOREDFILES]), &stored)
+	admitStoredFiles(strconv.Itoa(senderID), stored)
+
+	replyMap := make(map[string]string)
+	replyMap[READID] = reportMap[READID]
+	replyContent, _ := json.Marshal(replyMap)
+	msgSent := MakeMessage(STOREREPORTACK, string(replyContent), strconv.Itoa(selfID))
+	sendTCPRequest(senderID, msgSent)
+}
+
+
+// func admitStoredFiles(nodeID string, stored map[string]string)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to admit the
+//				files a restarted node kept as replicas again
+// Input:   nodeID string: the node id of the restarted node
+//			stored map[string]string: maps file name to the checksum the
+//									  node computed
+// Output:  None
+func admitStoredFiles(nodeID string, stored map[string]string) {
+	admitted := make([]string, 0)
+	waiting := make(map[string]string)
+	fileLock.Lock()
+	for fileName, checksum := range stored {
+		sdfsMap, ok := replicateList[fileName]
+		if !ok || sdfsMap[CHECKSUM] == "" || sdfsMap[CHECKSUM] != checksum {
+			continue
+		}
+		ok, held := admitCopy(fileName, nodeID)
+		if ok {
+			admitted = append(admitted, fileName)
+		} else if !held {
+			waiting[fileName] = checksum
+		}
+	}
+	fileLock.Unlock()
+
+	// the copies are admitted by the repair once a slot is empty
+	reportedLock.Lock()
+	if len(waiting) > 0 {
+		reportedFiles[nodeID] = waiting
+	} else {
+		delete(reportedFiles, nodeID)
+	}
+	reportedLock.Unlock()
+
+	if len(admitted) > 0 {
+		publishReplicaDelta(admitted...)
+	}
+	id, _ := strconv.Atoi(nodeID)
+	logMsg := fmt.Sprintf("Admitted %d of %d SDFS files kept by node %v\n", len(admitted), len(stored), memberHost[id])
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+}
+
+
+// func admitCopy(fileName string, nodeID string) (bool, bool)
+// ------------------------------------------------------------------
+// Description: A helper function that fills an empty replica slot of a
+//				file with the copy a restarted node kept. The caller holds
+//				fileLock
+// Input:   fileName string: the name of the file
+//			nodeID string: the node id of the restarted node
+// Output:  true if the copy is admitted, and true if the node already is
+//			a replica of the file
+func admitCopy(fileName string, nodeID string) (bool, bool) {
+	sdfsMap := replicateList[fileName]
+	slot := ""
+	for _, key := range fileSlots(sdfsMap) {
+		if sdfsMap[key] == nodeID {
+			return false, true
+		}
+		if sdfsMap[key] == "" && slot == "" {
+			slot = key
+		}
+	}
+	if slot == "" {
+		return false, false
+	}
+	sdfsMap[slot] = nodeID
+	replicateCounter[nodeID]++
+	return true, false
+}
+
+
+// func admitReportedCopy(fileName string) bool
+// ------------------------------------------------------------------
+// Description: This function is called by the master node before it
+//				repairs a file. It admits a copy of the file a live
+//				restarted node reported instead of copying the file
+// Input:   fileName string: the name of the file
+// Output:  true if a reported copy is admitted
+func admitReportedCopy(fileName string) bool {
+	fileLock.Lock()
+	reportedLock.Lock()
+	admitted := false
+	for nodeID, files := range reportedFiles {
+		id, _ := strconv.Atoi(nodeID)
+		if _, ok := memberHost[id]; !ok && id != selfID {
+			delete(reportedFiles, nodeID)
+			continue
+		}
+		checksum, ok := files[fileName]
+		if !ok {
+			continue
+		}
+		delete(files, fileName)
+		if len(files) == 0 {
+			delete(reportedFiles, nodeID)
+		}
+		if replicateList[fileName][CHECKSUM] != checksum {
+			continue
+		}
+		if admitted, _ = admitCopy(fileName, nodeID); admitted {
+			break
+		}
+	}
+	reportedLock.Unlock()
+	fileLock.Unlock()
+
+	if admitted {
+		publishReplicaDelta(fileName)
+		logMsg := fmt.Sprintf("Admitted the reported copy of SDFS file %v instead of repairing it\n", fileName)
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+	}
+	return admitted
+}
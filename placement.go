@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// This portion of code implements failure-domain and capacity aware
+// replica placement. Every node is started with an optional zone and rack
+// label and reports its labels, together with the bytes used by and free
+// for its sdfs directory, to all nodes with a NODEREPORT message every
+// REPORTTIME. The master node picks replica nodes with a
+// PlacementPolicy:
+// 		1. load: the nodes that store the fewest replicas
+//		2. capacity: the nodes with the most free bytes
+//		3. zone (default): replicas are spread over as many zones, and then
+//		   racks, as possible. Among nodes of equally used domains the ones
+//		   with the most free bytes are preferred
+// A node whose report shows less free space than the file is never picked,
+// and the bytes of every placed replica are reserved on its node until
+// the node reports again. The writer of a put stores the first replica if
+// the file fits on it.
+
+// the labels of this node, set with the -zone and -rack flags
+var nodeZone string
+var nodeRack string
+
+// the latest report of every node, kept by every node
+type nodeReport struct {
+	zone string
+	rack string
+	used int64
+	free int64
+	// outstanding transfers, counted up by the master node until the next report
+	transfers int
+	time time.Time
+}
+
+var nodeReports = make(map[string]nodeReport)
+var reportLock sync.RWMutex
+
+// a live node that may store a replica, free is -1 until the node reports
+type placementNode struct {
+	id string
+	files int
+	zone string
+	rack string
+	used int64
+	free int64
+	transfers int
+}
+
+// PlacementPolicy decides which nodes store the replicas of a file
+type PlacementPolicy interface {
+	// Name returns the name the policy is selected by
+	Name() string
+	// Place picks up to num nodes out of the candidates. The existing nodes
+	// already store a replica of the file and are never candidates
+	Place(existing []placementNode, candidates []placementNode, num int) []string
+}
+
+// the placement policies that can be selected with the -placement flag
+var placementPolicies = map[string]PlacementPolicy{
+	"load": loadPlacement{},
+	"capacity": capacityPlacement{},
+	"zone": domainPlacement{},
+}
+
+// the placement policy of the master node
+var placementPolicy PlacementPolicy = domainPlacement{}
+
+
+// loadPlacement picks the nodes that store the fewest replicas
+type loadPlacement struct{}
+
+
+// func (loadPlacement) Name() string
+// ------------------------------------------------------------------
+// Description: The name of the load placement policy
+// Input:   None
+// Output:  "load"
+func (loadPlacement) Name() string {
+	return "load"
+}
+
+
+// func (loadPlacement) Place(existing []placementNode, candidates []placementNode, num int) []string
+// ------------------------------------------------------------------
+// Description: This function picks the candidates with the fewest replicas
+// Input:   existing []placementNode: the nodes that store the file
+//			candidates []placementNode: the nodes that may store the file
+//			num int: the number of nodes to pick
+// Output:  the node ids of the picked nodes
+func (loadPlacement) Place(existing []placementNode, candidates []placementNode, num int) []string {
+	sorted := append([]placementNode(nil), candidates...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].files != sorted[j].files {
+			return sorted[i].files < sorted[j].files
+		}
+		return sorted[i].id < sorted[j].id
+	})
+
+	picked := make([]string, 0, num)
+	for i := 0; i < len(sorted) && len(picked) < num; i++ {
+		picked = append(picked, sorted[i].id)
+	}
+	return picked
+}
+
+
+// capacityPlacement picks the nodes with the most free bytes
+type capacityPlacement struct{}
+
+
+// func (capacityPlacement) Name() string
+// ------------------------------------------------------------------
+// Description: The name of the capacity placement policy
+// Input:   None
+// Output:  "capacity"
+func (capacityPlacement) Name() string {
+	return "capacity"
+}
+
+
+// func (capacityPlacement) Place(existing []placementNode, candidates []placementNode, num int) []string
+// ------------------------------------------------------------------
+// Description: This function picks the candidates with the most free bytes,
+//				nodes that have not reported yet come last
+// Input:   existing []placementNode: the nodes that store the file
+//			candidates []placementNode: the nodes that may store the file
+//			num int: the number of nodes to pick
+// Output:  the node ids of the picked nodes
+func (capacityPlacement) Place(existing []placementNode, candidates []placementNode, num int) []string {
+	sorted := append([]placementNode(nil), candidates...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].free != sorted[j].free {
+			return sorted[i].free > sorted[j].free
+		}
+		return sorted[i].id < sorted[j].id
+	})
+
+	picked := make([]string, 0, num)
+	for i := 0; i < len(sorted) && len(picked) < num; i++ {
+		picked = append(picked, sorted[i].id)
+	}
+	return picked
+}
+
+
+// domainPlacement spreads the replicas over zones and racks
+type domainPlacement struct{}
+
+
+// func (domainPlacement) Name() string
+// ------------------------------------------------------------------
+// Description: The name of the zone placement policy
+// Input:   None
+// Output:  "zone"
+func (domainPlacement) Name() string {
+	return "zone"
+}
+
+
+// func (domainPlacement) Place(existing []placementNode, candidates []placementNode, num int) []string
+// ------------------------------------------------------------------
+// Description: This function picks one node at a time, the one whose zone
+//				and then rack store the fewest replicas of the file so far
+// Input:   existing []placementNode: the nodes that store the file
+//			candidates []placementNode: the nodes that may store the file
+//			num int: the number of nodes to pick
+// Output:  the node ids of the picked nodes
+func (domainPlacement) Place(existing []placementNode, candidates []placementNode, num int) []string {
+	zoneUsed := make(map[string]int)
+	rackUsed := make(map[string]int)
+	for _, node := range existing {
+		zoneUsed[node.zone]++
+		rackUsed[node.zone + "/" + node.rack]++
+	}
+
+	picked := make([]string, 0, num)
+	taken := make(map[string]bool)
+	for len(picked) < num {
+		best := -1
+		for i, node := range candidates {
+			if taken[node.id] {
+				continue
+			}
+			if best < 0 || lessUsed(node, candidates[best], zoneUsed, rackUsed) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		node := candidates[best]
+		taken[node.id] = true
+		zoneUsed[node.zone]++
+		rackUsed[node.zone + "/" + node.rack]++
+		picked = append(picked, node.id)
+	}
+	return picked
+}
+
+
+// func lessUsed(a placementNode, b placementNode, zoneUsed map[string]int, rackUsed map[string]int) bool
+// ------------------------------------------------------------------
+// Description: A helper function that compares two candidates by the
+//				replicas in their zone and in their rack, then by their free
+//				bytes and the replicas on the node
+// Input:   a placementNode, b placementNode: the candidates
+//			zoneUsed map[string]int: replicas of the file per zone
+//			rackUsed map[string]int: replicas of the file per zone/rack
+// Output:  true if a should be picked before b
+func lessUsed(a placementNode, b placementNode, zoneUsed map[string]int, rackUsed map[string]int) bool {
+	if zoneUsed[a.zone] != zoneUsed[b.zone] {
+		return zoneUsed[a.zone] < zoneUsed[b.zone]
+	}
+	rackA, rackB := rackUsed[a.zone + "/" + a.rack], rackUsed[b.zone + "/" + b.rack]
+	if rackA != rackB {
+		return rackA < rackB
+	}
+	if a.free != b.free {
+		return a.free > b.free
+	}
+	if a.files != b.files {
+		return a.files < b.files
+	}
+	return a.id < b.id
+}
+
+
+// func placementInfo(nodeID string) placementNode
+// ------------------------------------------------------------------
+// Description: A helper function that collects what the placement policy
+//				knows about a node. The caller must hold fileLock
+// Input:   nodeID string: the node id
+// Output:  the replica count, labels and capacity of the node
+func placementInfo(nodeID string) placementNode {
+	reportLock.RLock()
+	report, ok := nodeReports[nodeID]
+	reportLock.RUnlock()
+	if !ok {
+		report.free = -1
+	}
+	return placementNode{nodeID, replicateCounter[nodeID], report.zone, report.rack, report.used, report.free, report.transfers}
+}
+
+
+// func reserveSpace(nodeID string, size int64) bool
+// ------------------------------------------------------------------
+// Description: A helper function that reserves the bytes of a new replica
+//				on a node until the node reports again
+// Input:   nodeID string: the node id
+//			size int64: the size of the replica
+// Output:  false if the last report of the node shows less free space
+func reserveSpace(nodeID string, size int64) bool {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	report, ok := nodeReports[nodeID]
+	if !ok {
+		return true
+	}
+	if report.free < size {
+		return false
+	}
+	report.free -= size
+	report.used += size
+	nodeReports[nodeID] = report
+	return true
+}
+
+
+// func releaseSpace(nodeID string, size int64)
+// ------------------------------------------------------------------
+// Description: A helper function that gives back the bytes reserved for
+//				a replica that is not written after all
+// Input:   nodeID string: the node id
+//			size int64: the size of the replica
+// Output:  None
+func releaseSpace(nodeID string, size int64) {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	report, ok := nodeReports[nodeID]
+	if !ok {
+		return
+	}
+	report.free += size
+	report.used -= size
+	nodeReports[nodeID] = report
+}
+
+
+// func placeReplicas(existing []string, num int, size int64) []string
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to pick nodes
+//				for new replicas of a file with the placement policy. The
+//				caller must hold fileLock
+// Input:   existing []string: the node ids that store the file
+//			num int: the number of nodes to pick
+//			size int64: the size of the file
+// Output:  the node ids of the picked nodes
+func placeReplicas(existing []string, num int, size int64) []string {
+	return placeReplicasExcept(existing, nil, num, size)
+}
+
+
+// func placeReplicasExcept(existing []string, exclude map[string]bool, num int, size int64) []string
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to pick nodes
+//				for new replicas of a file with the placement policy. Only
+//				live nodes that do not store the file and have room for it
+//				are picked, and the space is reserved on them. The caller
+//				must hold fileLock
+// Input:   existing []string: the node ids that store the file
+//			exclude map[string]bool: the node ids that must not be picked
+//			num int: the number of nodes to pick
+//			size int64: the size of the file
+// Output:  the node ids of the picked nodes, fewer than num if there are
+//			not enough live nodes with room for the file
+func placeReplicasExcept(existing []string, exclude map[string]bool, num int, size int64) []string {
+	if num <= 0 {
+		return nil
+	}
+	holders := make([]placementNode, 0, len(existing))
+	excluded := make(map[string]bool)
+	for _, nodeID := range existing {
+		holders = append(holders, placementInfo(nodeID))
+		excluded[nodeID] = true
+	}
+
+	candidates := make([]placementNode, 0, len(replicateCounter))
+	for nodeIDStr := range replicateCounter {
+		nodeID, _ := strconv.Atoi(nodeIDStr)
+		if _, ok := memberHost[nodeID]; (!ok && nodeID != selfID) || excluded[nodeIDStr] || exclude[nodeIDStr] {
+			continue
+		}
+		node := placementInfo(nodeIDStr)
+		if node.free >= 0 && node.free < size {
+			continue
+		}
+		candidates = append(candidates, node)
+	}
+
+	picked := placementPolicy.Place(holders, candidates, num)
+	for _, nodeID := range picked {
+		reserveSpace(nodeID, size)
+	}
+	return picked
+}
+
+
+// func sdfsUsage() (int64, int64)
+// ------------------------------------------------------------------
+// Description: A helper function that measures the bytes stored in the
+//				sdfs directory and the bytes free on its volume
+// Input:   None
+// Output:  the used bytes and the free bytes
+func sdfsUsage() (int64, int64) {
+	var used int64
+	_ = filepath.Walk(SDFSFILEPATH, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			used += info.Size()
+		}
+		return nil
+	})
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(SDFSFILEPATH, &stat); err != nil {
+		ErrorHandler("Can't read free space of sdfs directory: ", err, false)
+		return used, 0
+	}
+	return used, int64(stat.Bavail) * int64(stat.Bsize)
+}
+
+
+// func reportRoutine()
+// ------------------------------------------------------------------
+// Description: This routine sends the labels and the capacity of this
+//				node to all nodes every REPORTTIME
+// Input:   None
+// Output:  None
+func reportRoutine() {
+	for {
+		reportMap := make(map[string]string)
+		reportMap[NODEZONE] = nodeZone
+		reportMap[NODERACK] = nodeRack
+		used, free := sdfsUsage()
+		reportMap[NODEUSED] = strconv.FormatInt(used, 10)
+		reportMap[NODEFREE] = strconv.FormatInt(free, 10)
+		reportMap[NODELOAD] = transferCount()
+		recordNodeReport(strconv.Itoa(selfID), reportMap)
+		// every node picks the replicas it reads from by zone and load
+		msgContent, _ := json.Marshal(reportMap)
+		msgSent := MakeMessage(NODEREPORT, string(msgContent), strconv.Itoa(selfID))
+		for nodeID := range memberHost {
+			sendRequest(nodeID, msgSent)
+		}
+		time.Sleep(REPORTTIME)
+	}
+}
+
+
+// func recordNodeReport(nodeID string, reportMap map[string]string)
+// ------------------------------------------------------------------
+// Description: This function records the report of a node
+// Input:   nodeID string: the node id of the node
+//			reportMap map[string]string: the content of the NODEREPORT message
+// Output:  None
+func recordNodeReport(nodeID string, reportMap map[string]string) {
+	used, _ := strconv.ParseInt(reportMap[NODEUSED], 10, 64)
+	free, _ := strconv.ParseInt(reportMap[NODEFREE], 10, 64)
+	transfers, _ := strconv.Atoi(reportMap[NODELOAD])
+	reportLock.Lock()
+	nodeReports[nodeID] = nodeReport{reportMap[NODEZONE], reportMap[NODERACK], used, free, transfers, time.Now()}
+	reportLock.Unlock()
+}
+
+
+// func printPlacement()
+// ------------------------------------------------------------------
+// Description: This function prints the placement policy and the labels
+//				and capacity of the live nodes known to the master node
+// Input:   None
+// Output:  None
+func printPlacement() {
+	if !isMaster {
+		fmt.Printf("Node labels are kept by the master node: %v\n", memberHost[masterID])
+		fmt.Printf("-->> This node: zone %q, rack %q\n", nodeZone, nodeRack)
+		return
+	}
+
+	fileLock.RLock()
+	nodes := make([]placementNode, 0, len(replicateCounter))
+	for nodeID := range replicateCounter {
+		nodes = append(nodes, placementInfo(nodeID))
+	}
+	fileLock.RUnlock()
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].id < nodes[j].id
+	})
+
+	fmt.Printf("-->> Placement policy: %v\n", placementPolicy.Name())
+	for _, node := range nodes {
+		nodeID, _ := strconv.Atoi(node.id)
+		domain := memberHost[nodeID]
+		if nodeID == selfID {
+			domain = localHost
+		}
+		if node.free < 0 {
+			fmt.Printf("->-> node %v (%v): zone %q, rack %q, %d replicas, capacity not reported\n", node.id, domain, node.zone, node.rack, node.files)
+			continue
+		}
+		fmt.Printf("->-> node %v (%v): zone %q, rack %q, %d replicas, %d bytes used, %d bytes free, %d transfers\n", node.id, domain, node.zone, node.rack, node.files, node.used, node.free, node.transfers)
+	}
+}
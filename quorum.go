@@ -0,0 +1,575 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This portion of code implements acknowledged writes. A put is no longer
+// recorded in the replica list before the file is stored. Instead:
+// 		1. the master node picks the replicas and the writer sends the file
+//		   to every replica under a staging name <sdfs name>@put-<put id>
+//		2. every replica verifies the checksum of the received file and
+//		   sends a STOREACK message to the master node
+//		3. once W replicas confirmed the write, the master node evaluates the
+//		   conflict policy, renames the staged copies to the sdfs name and
+//		   commits the file to the replica list
+//		4. the master node answers the put with a PUTRESP message
+// Replicas that confirm the write after the commit are added to the replica
+// list. If the quorum is not reached within STORETIMEOUT, the put fails and
+// the staged copies are deleted. W is taken from the put request, otherwise
+// from the longest matching sdfs prefix, otherwise a majority of the replicas.
+
+// one put request waiting for the replicas to confirm the write
+type pendingPut struct {
+	putID string
+	sdfsFileName string
+	stagingName string
+	policy string
+	checksum string
+	fileSize int64
+	quorum int
+	factor int
+	// replica slot to node id
+	replicas map[string]string
+	// node ids that confirmed the write, and the ones renamed after commit
+	acked map[string]bool
+	placed map[string]bool
+	committed bool
+	version int
+	ackChan chan bool
+	result chan error
+}
+
+// put requests waiting for store acknowledgements, maps put id to request
+var pendingPuts = make(map[string]*pendingPut)
+var storeLock sync.Mutex
+
+// prefix write quorums kept by the master node and copied with the replica
+// list, guarded by policyLock
+var quorumPolicies = make(map[string]int)
+
+
+// func stagingName(sdfsFileName string, putID string) string
+// ------------------------------------------------------------------
+// Description: A helper function that gives the name a file is stored as
+//				before its put is committed
+// Input:   sdfsFileName string: the name of the sdfs file
+//			putID string: the id of the put request
+// Output:  the staging name
+func stagingName(sdfsFileName string, putID string) string {
+	return sdfsFileName + VERSIONSEP + STAGINGTAG + putID
+}
+
+
+// func stagingPutID(fileName string) string
+// ------------------------------------------------------------------
+// Description: A helper function that gets the put id from a staging name
+// Input:   fileName string: the name of the received file
+// Output:  the put id, empty if the file is not staged
+func stagingPutID(fileName string) string {
+	idx := strings.LastIndex(fileName, VERSIONSEP + STAGINGTAG)
+	if idx < 0 {
+		return ""
+	}
+	return fileName[idx + len(VERSIONSEP + STAGINGTAG):]
+}
+
+
+// func getWriteQuorum(sdfsFileName string, quorum int) int
+// ------------------------------------------------------------------
+// Description: A helper function that decides the write quorum of a put
+//				request on the master node
+// Input:   sdfsFileName string: the sdfs file to be written
+//			quorum int: the quorum sent with the request, 0 if not given
+// Output:  the write quorum, 0 for a majority of the replicas
+func getWriteQuorum(sdfsFileName string, quorum int) int {
+	if quorum > 0 {
+		return quorum
+	}
+
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	matched := ""
+	for prefix, prefixQuorum := range quorumPolicies {
+		if strings.HasPrefix(sdfsFileName, prefix) && len(prefix) >= len(matched) {
+			matched = prefix
+			quorum = prefixQuorum
+		}
+	}
+	return quorum
+}
+
+
+// func startPut(sdfsFileName string, policy string, quorum int, factor int, group string, writerID string, checksum string, fileSize int64, putID string) (*pendingPut, error)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node for every put
+//				request. It rejects puts that violate the conflict policy
+//				and picks the replicas the file is staged on
+// Input:   sdfsFileName string: the sdfs file to be written
+//			policy string: the policy sent with the request, may be empty
+//			quorum int: the write quorum sent with the request, may be 0
+//			factor int: the replication factor sent with the request, may be 0
+//			group string: the put id of the erasure-coded file the request
+//						  writes a shard of, empty for other puts
+//			writerID string: node id of which the local file is present
+// 			checksum string: sha256 of the local file
+// 			fileSize int64: size of the local file
+//			putID string: the id of the put request
+// Output:  the pending put and the rejection reason
+func startPut(sdfsFileName string, policy string, quorum int, factor int, group string, writerID string, checksum string, fileSize int64, putID string) (*pendingPut, error) {
+	conflictLock.Lock()
+	policy = getConflictPolicy(sdfsFileName, policy)
+	err := checkConflict(sdfsFileName, policy)
+	conflictLock.Unlock()
+	if err != nil {
+		logMsg := fmt.Sprintf("Put SDFS file %v rejected by policy %v: %v\n", sdfsFileName, policy, err.Error())
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		return nil, err
+	}
+
+	replicas := make(map[string]string)
+	quorum = getWriteQuorum(sdfsFileName, quorum)
+	if group != "" {
+		// a shard has one replica, apart from the other shards of its file
+		factor = 1
+		replicas, err = placeShard(group, fileSize)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// the writer may not know the erasure rule of the prefix yet
+		err = checkErasureScheme(sdfsFileName, "")
+		if err != nil {
+			return nil, err
+		}
+		factor = getReplicationFactor(sdfsFileName, factor)
+		if quorum == 0 {
+			// a majority of the replicas the live nodes can hold
+			quorum = factor
+			if online := len(memberHost) + 1; online < quorum {
+				quorum = online
+			}
+			quorum = quorum / 2 + 1
+		}
+		err = setReplicaID(writerID, &replicas, factor, quorum, fileSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if quorum == 0 {
+		quorum = len(replicas) / 2 + 1
+	}
+	if quorum > len(replicas) {
+		releaseReplicas(replicas, nil)
+		return nil, fmt.Errorf("write quorum %d exceeds the %d available replicas", quorum, len(replicas))
+	}
+
+	pp := &pendingPut{
+		putID: putID,
+		sdfsFileName: sdfsFileName,
+		stagingName: stagingName(sdfsFileName, putID),
+		policy: policy,
+		checksum: checksum,
+		fileSize: fileSize,
+		quorum: quorum,
+		factor: factor,
+		replicas: replicas,
+		acked: make(map[string]bool),
+		placed: make(map[string]bool),
+		ackChan: make(chan bool, len(replicas)),
+		result: make(chan error, 1),
+	}
+	storeLock.Lock()
+	pendingPuts[putID] = pp
+	storeLock.Unlock()
+
+	logMsg := fmt.Sprintf("Staging SDFS file %v on %d of %d replicas, waiting for %d of them\n", sdfsFileName, len(replicas), factor, quorum)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+
+	go trackPut(pp)
+	return pp, nil
+}
+
+
+// func waitPut(pp *pendingPut) (int, error)
+// ------------------------------------------------------------------
+// Description: This function blocks until the put is committed or failed
+// Input:   pp *pendingPut: the pending put
+// Output:  the committed version and the error of the put
+func waitPut(pp *pendingPut) (int, error) {
+	err := <-pp.result
+	return pp.version, err
+}
+
+
+// func trackPut(pp *pendingPut)
+// ------------------------------------------------------------------
+// Description: A routine that collects the store acknowledgements of a
+//				put, commits it once the quorum is reached and finishes
+//				it when all replicas confirmed or STORETIMEOUT passed
+// Input:   pp *pendingPut: the pending put
+// Output:  None
+func trackPut(pp *pendingPut) {
+	deadline := time.After(STORETIMEOUT)
+	for {
+		select {
+		case <-pp.ackChan:
+		case <-deadline:
+			finishPut(pp, nil)
+			return
+		}
+
+		storeLock.Lock()
+		acked := make([]string, 0, len(pp.acked))
+		for nodeID := range pp.acked {
+			if !pp.placed[nodeID] {
+				acked = append(acked, nodeID)
+			}
+		}
+		numAcked := len(pp.acked)
+		storeLock.Unlock()
+
+		if !pp.committed {
+			if numAcked < pp.quorum {
+				continue
+			}
+			err := commitPut(pp)
+			if err != nil {
+				finishPut(pp, err)
+				return
+			}
+			pp.result <- nil
+		} else {
+			// replicas confirming the write after the commit
+			for _, nodeID := range acked {
+				placeReplica(pp, nodeID)
+			}
+		}
+
+		if numAcked == len(pp.replicas) {
+			finishPut(pp, nil)
+			return
+		}
+	}
+}
+
+
+// func recordStoreAck(putID string, nodeID string, fileName string, checksum string)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node when a replica
+//				confirms that a staged file is stored
+// Input:   putID string: the id of the put request
+//			nodeID string: the node id of the replica
+//			fileName string: the staging name of the file
+//			checksum string: the checksum of the stored file
+// Output:  None
+func recordStoreAck(putID string, nodeID string, fileName string, checksum string) {
+	if recordAppendAck(putID, nodeID, checksum) {
+		return
+	}
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	pp, ok := pendingPuts[putID]
+	if !ok {
+		// the put has failed or finished, the staged copy is useless
+		id, _ := strconv.Atoi(nodeID)
+		deleteReplica(fileName, id)
+		return
+	}
+	if checksum != pp.checksum || !isPutReplica(pp, nodeID) {
+		logMsg := fmt.Sprintf("Ignoring store ack of SDFS file %v from node %v\n", pp.sdfsFileName, nodeID)
+		WriteLog(logFile, logMsg, false)
+		return
+	}
+
+	pp.acked[nodeID] = true
+	select {
+	case pp.ackChan <- true:
+	default:
+	}
+}
+
+
+// func storeReceived(fileName string, checksum string)
+// ------------------------------------------------------------------
+// Description: This function is called when a file is stored in the sdfs
+//				directory. If the file is staged, the write is confirmed
+//				to the master node
+// Input:   fileName string: the name of the stored file
+//			checksum string: the verified checksum of the stored file
+// Output:  None
+func storeReceived(fileName string, checksum string) {
+	putID := stagingPutID(fileName)
+	if putID == "" {
+		return
+	}
+
+	if isMaster {
+		recordStoreAck(putID, strconv.Itoa(selfID), fileName, checksum)
+		return
+	}
+
+	sentMap := make(map[string]string)
+	sentMap[PUTID] = putID
+	sentMap[SDFSNAME] = fileName
+	sentMap[CHECKSUM] = checksum
+	msgContent, _ := json.Marshal(sentMap)
+	msgSent := MakeMessage(STOREACK, string(msgContent), strconv.Itoa(selfID))
+	sendTCPRequest(masterID, msgSent)
+}
+
+
+// func commitPut(pp *pendingPut) error
+// ------------------------------------------------------------------
+// Description: This function commits a put once the quorum is reached. The
+//				conflict policy is evaluated again because other puts may
+//				have been committed since the put started
+// Input:   pp *pendingPut: the pending put
+// Output:  the rejection reason
+func commitPut(pp *pendingPut) error {
+	// appends and renames of the file are applied before or after the put
+	lockSDFSFile(pp.sdfsFileName)
+	defer unlockSDFSFile(pp.sdfsFileName)
+	conflictLock.Lock()
+	defer conflictLock.Unlock()
+
+	version, err := resolveConflict(pp.sdfsFileName, pp.policy)
+	if err != nil {
+		return err
+	}
+
+	storeLock.Lock()
+	placed := make(map[string]string)
+	for key, nodeID := range pp.replicas {
+		if pp.acked[nodeID] {
+			placed[key] = nodeID
+			pp.placed[nodeID] = true
+		}
+	}
+	pp.version = version
+	pp.committed = true
+	storeLock.Unlock()
+
+	// the staged copies take the sdfs name before other nodes learn the new entry
+	for _, nodeID := range placed {
+		id, _ := strconv.Atoi(nodeID)
+		renameStaged(pp, id)
+	}
+	addNewFile(pp.sdfsFileName, pp.checksum, pp.fileSize, version, pp.factor, &placed)
+	return nil
+}
+
+
+// func placeReplica(pp *pendingPut, nodeID string)
+// ------------------------------------------------------------------
+// Description: This function adds a replica that confirmed the write after
+//				the put was committed to the replica list
+// Input:   pp *pendingPut: the committed put
+//			nodeID string: the node id of the replica
+// Output:  None
+func placeReplica(pp *pendingPut, nodeID string) {
+	storeLock.Lock()
+	pp.placed[nodeID] = true
+	storeLock.Unlock()
+
+	id, _ := strconv.Atoi(nodeID)
+	fileLock.Lock()
+	sdfsMap, ok := replicateList[pp.sdfsFileName]
+	// the file may have been written again or deleted since the commit
+	if !ok || sdfsMap[CHECKSUM] != pp.checksum || sdfsMap[FILEVERSION] != strconv.Itoa(pp.version) {
+		fileLock.Unlock()
+		deleteReplica(pp.stagingName, id)
+		return
+	}
+	for key, replicaID := range pp.replicas {
+		if replicaID == nodeID {
+			sdfsMap[key] = nodeID
+		}
+	}
+	fileLock.Unlock()
+
+	renameStaged(pp, id)
+	publishReplicaDelta(pp.sdfsFileName)
+}
+
+
+// func finishPut(pp *pendingPut, err error)
+// ------------------------------------------------------------------
+// Description: This function removes a put from the pending puts. If the
+//				put was not committed, it fails and the staged copies are
+//				deleted
+// Input:   pp *pendingPut: the pending put
+//			err error: the reason the commit failed, nil if it timed out
+// Output:  None
+func finishPut(pp *pendingPut, err error) {
+	storeLock.Lock()
+	delete(pendingPuts, pp.putID)
+	numAcked := len(pp.acked)
+	storeLock.Unlock()
+
+	if !pp.committed {
+		for nodeID := range pp.acked {
+			id, _ := strconv.Atoi(nodeID)
+			deleteReplica(pp.stagingName, id)
+		}
+		releaseReplicas(pp.replicas, nil)
+		if err == nil {
+			err = fmt.Errorf("only %d of %d required replicas confirmed the write within %v", numAcked, pp.quorum, STORETIMEOUT)
+		}
+		pp.result <- err
+		return
+	}
+
+	releaseReplicas(pp.replicas, pp.placed)
+	logMsg := fmt.Sprintf("SDFS file %v version %v is stored on %d of %d replicas\n", pp.sdfsFileName, pp.version, len(pp.placed), len(pp.replicas))
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+}
+
+
+// func releaseReplicas(replicas map[string]string, placed map[string]bool)
+// ------------------------------------------------------------------
+// Description: A helper function that gives back the replica counts of
+//				the nodes that were picked but do not store the file
+// Input:   replicas map[string]string: the picked replicas
+//			placed map[string]bool: the replicas that store the file
+// Output:  None
+func releaseReplicas(replicas map[string]string, placed map[string]bool) {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	for _, nodeID := range replicas {
+		if !placed[nodeID] {
+			replicateCounter[nodeID]--
+		}
+	}
+}
+
+
+// func isPutReplica(pp *pendingPut, nodeID string) bool
+// ------------------------------------------------------------------
+// Description: A helper function that checks whether a node was picked
+//				as a replica of a put
+// Input:   pp *pendingPut: the pending put
+//			nodeID string: the node id
+// Output:  true if the node is a replica of the put
+func isPutReplica(pp *pendingPut, nodeID string) bool {
+	for _, replicaID := range pp.replicas {
+		if replicaID == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+
+// func renameStaged(pp *pendingPut, nodeID int)
+// ------------------------------------------------------------------
+// Description: A helper function that renames a staged copy to the sdfs
+//				name on a replica
+// Input:   pp *pendingPut: the committed put
+//			nodeID int: the node id of the replica
+// Output:  None
+func renameStaged(pp *pendingPut, nodeID int) {
+	if nodeID == selfID {
+		renameLocalReplica(pp.stagingName, pp.sdfsFileName)
+		setStoredVersion(pp.sdfsFileName, pp.version)
+		return
+	}
+
+	renameMap := make(map[string]string)
+	renameMap[SENDERNAME] = pp.stagingName
+	renameMap[RECEIVERNAME] = pp.sdfsFileName
+	renameMap[FILEVERSION] = strconv.Itoa(pp.version)
+	msgContent, _ := json.Marshal(renameMap)
+	msgSent := MakeMessage(RENAME, string(msgContent), strconv.Itoa(selfID))
+	sendTCPRequest(nodeID, msgSent)
+}
+
+
+// func deleteReplica(fileName string, nodeID int)
+// ------------------------------------------------------------------
+// Description: A helper function that deletes a staged copy or a moved
+//				replica on a node
+// Input:   fileName string: the name of the file in the sdfs directory
+//			nodeID int: the node id of the node
+// Output:  None
+func deleteReplica(fileName string, nodeID int) {
+	if nodeID == selfID {
+		err := os.Remove(SDFSFILEPATH + fileName)
+		ErrorHandler("Can't delete replica " + fileName, err, false)
+		return
+	}
+	msgSent := MakeMessage(DELETE, fileName, strconv.Itoa(selfID))
+	sendRequest(nodeID, msgSent)
+}
+
+
+// func handleQuorumPolicy(sdfsPrefix string, quorum int)
+// ------------------------------------------------------------------
+// Description: This function handles the quorum instruction which sets
+//				the write quorum of all sdfs files with a prefix. The
+//				quorum 0 removes the quorum of the prefix
+// Input:   sdfsPrefix string: the sdfs prefix
+//			quorum int: the number of replicas that must confirm a write
+// Output:  None
+func handleQuorumPolicy(sdfsPrefix string, quorum int) {
+	if isMaster {
+		policyLock.Lock()
+		if quorum == 0 {
+			delete(quorumPolicies, sdfsPrefix)
+		} else {
+			quorumPolicies[sdfsPrefix] = quorum
+		}
+		policyLock.Unlock()
+		publishReplicaDelta()
+
+		logMsg := fmt.Sprintf("Write quorum of SDFS prefix %v set to %v\n", sdfsPrefix, quorum)
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		return
+	}
+
+	sentMap := make(map[string]string)
+	sentMap[SDFSNAME] = sdfsPrefix
+	sentMap[PUTQUORUM] = strconv.Itoa(quorum)
+	msgContent, _ := json.Marshal(sentMap)
+	msgSent := MakeMessage(QUORUMPOLICY, string(msgContent), strconv.Itoa(selfID))
+	sendRequest(masterID, msgSent)
+}
+
+
+// func printQuorumPolicies()
+// ------------------------------------------------------------------
+// Description: This function prints the prefix write quorums on the
+//				master node
+// Input:   None
+// Output:  None
+func printQuorumPolicies() {
+	if !isMaster {
+		fmt.Printf("Write quorums are kept by the master node: %v\n", memberHost[masterID])
+		return
+	}
+
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	prefixes := make([]string, 0, len(quorumPolicies))
+	for prefix := range quorumPolicies {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	fmt.Println("-->> Default write quorum: majority of the replicas")
+	for _, prefix := range prefixes {
+		fmt.Printf("->-> %v*: %v\n", prefix, quorumPolicies[prefix])
+	}
+}
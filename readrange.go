@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// This portion of code implements range reads of sdfs files. A range read
+// streams bytes of a sdfs file directly from a replica, nothing is written
+// to the local directory:
+// 		1. the reader connects to the range server of a live replica in its
+//		   replica list, a local replica is read from disk
+//		2. it sends one line with the name, the offset and the length
+//		3. the replica answers with one line with its checksum and the
+//		   number of bytes, then the bytes follow
+// A replica whose checksum is not the one in the replica list of the
+// reader is skipped. A file stored as blocks is read block by block, only
+// the blocks that overlap the range are fetched. A negative offset counts
+// from the end of the file, a negative length reads to the end.
+
+// a range of bytes that ends early with io.ErrUnexpectedEOF
+type rangeReader struct {
+	reader io.Reader
+	closer io.Closer
+	remaining int64
+}
+
+// a range of a file stored as blocks
+type blockRangeReader struct {
+	parts []blockRange
+	current io.ReadCloser
+}
+
+// the range of one block
+type blockRange struct {
+	name string
+	offset int64
+	length int64
+}
+
+
+// func (r *rangeReader) Read(p []byte) (int, error)
+// ------------------------------------------------------------------
+// Description: This function reads the next bytes of the range
+// Input:   p []byte: the buffer
+// Output:  the number of bytes read, io.ErrUnexpectedEOF if the range
+//			ends before all its bytes arrived
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+
+// func (r *rangeReader) Close() error
+// ------------------------------------------------------------------
+// Description: This function closes the file or connection of the range
+// Input:   None
+// Output:  the error of the close
+func (r *rangeReader) Close() error {
+	return r.closer.Close()
+}
+
+
+// func (r *blockRangeReader) Read(p []byte) (int, error)
+// ------------------------------------------------------------------
+// Description: This function reads the next bytes of the range, the next
+//				block is opened once a block is read
+// Input:   p []byte: the buffer
+// Output:  the number of bytes read and the error of the block
+func (r *blockRangeReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			part := r.parts[0]
+			r.parts = r.parts[1:]
+			reader, err := readReplicaRange(part.name, part.offset, part.length)
+			if err != nil {
+				return 0, err
+			}
+			r.current = reader
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			_ = r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+
+// func (r *blockRangeReader) Close() error
+// ------------------------------------------------------------------
+// Description: This function closes the block that is being read
+// Input:   None
+// Output:  the error of the close
+func (r *blockRangeReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+
+// func ReadRange(sdfsFileName string, offset int64, length int64) (io.ReadCloser, error)
+// ------------------------------------------------------------------
+// Description: This function opens a range of a sdfs file for reading
+// Input:   sdfsFileName string: the name of the sdfs file, or
+//								 <sdfs name>@<version>
+//			offset int64: the first byte, negative to count from the end
+//			length int64: the number of bytes, negative to read to the end
+// Output:  the bytes of the range and the error if no replica can send it
+func ReadRange(sdfsFileName string, offset int64, length int64) (io.ReadCloser, error) {
+	sdfsFileName = resolveVersionName(sdfsFileName)
+	if len(fileShards(sdfsFileName)) > 0 {
+		return nil, errors.New("sdfs file is stored as shards, use get")
+	}
+	blocks := fileBlocks(sdfsFileName)
+	if len(blocks) == 0 {
+		return readReplicaRange(sdfsFileName, offset, length)
+	}
+
+	offset, length = clampRange(sdfsFileSize(sdfsFileName), offset, length)
+	parts := make([]blockRange, 0)
+	var start int64
+	for _, blockName := range blocks {
+		blockSize := sdfsFileSize(blockName)
+		end := start + blockSize
+		if length > 0 && end > offset && start < offset + length {
+			partOffset := offset - start
+			if partOffset < 0 {
+				partOffset = 0
+			}
+			partEnd := offset + length - start
+			if partEnd > blockSize {
+				partEnd = blockSize
+			}
+			parts = append(parts, blockRange{blockName, partOffset, partEnd - partOffset})
+		}
+		start = end
+	}
+	return &blockRangeReader{parts: parts}, nil
+}
+
+
+// func clampRange(size int64, offset int64, length int64) (int64, int64)
+// ------------------------------------------------------------------
+// Description: A helper function that fits a range into a file
+// Input:   size int64: the size of the file
+//			offset int64: the first byte, negative to count from the end
+//			length int64: the number of bytes, negative to read to the end
+// Output:  the offset and the length within the file
+func clampRange(size int64, offset int64, length int64) (int64, int64) {
+	if offset < 0 {
+		offset += size
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > size {
+		offset = size
+	}
+	if length < 0 || offset + length > size {
+		length = size - offset
+	}
+	return offset, length
+}
+
+
+// func readReplicaRange(fileName string, offset int64, length int64) (io.ReadCloser, error)
+// ------------------------------------------------------------------
+// Description: This function reads a range of an entry of the replica
+//				list from a live replica that stores the committed copy,
+//				picked by locality and load, and the other replicas if it
+//				fails
+// Input:   fileName string: the name in the replica list
+//			offset int64: the first byte, negative to count from the end
+//			length int64: the number of bytes, negative to read to the end
+// Output:  the bytes of the range and the error of the last replica
+func readReplicaRange(fileName string, offset int64, length int64) (io.ReadCloser, error) {
+	fileLock.RLock()
+	checksum := replicateList[fileName][CHECKSUM]
+	fileLock.RUnlock()
+	nodes := liveReplicas(fileName)
+	if len(nodes) == 0 {
+		return nil, errors.New("sdfs file " + fileName + " does not exist")
+	}
+	picked := pickLocalRead(nodes, true)
+	for i, nodeID := range nodes {
+		if nodeID == picked {
+			nodes[0], nodes[i] = nodes[i], nodes[0]
+		}
+	}
+
+	var err error
+	for _, nodeID := range nodes {
+		var reader io.ReadCloser
+		var stored string
+		if nodeID == selfID {
+			reader, _, stored, err = openLocalRange(fileName, offset, length)
+		} else {
+			reader, stored, err = dialRange(nodeID, fileName, offset, length)
+		}
+		if err == nil && checksum != "" && stored != checksum {
+			_ = reader.Close()
+			err = fmt.Errorf("node %v stores another version", nodeID)
+		}
+		if err == nil {
+			return reader, nil
+		}
+		WriteLog(logFile, fmt.Sprintf("Can't read range of SDFS file %v: %v\n", fileName, err.Error()), false)
+	}
+	return nil, err
+}
+
+
+// func openLocalRange(fileName string, offset int64, length int64) (io.ReadCloser, int64, string, error)
+// ------------------------------------------------------------------
+// Description: A helper function that opens a range of a replica in the
+//				sdfs directory of this node
+// Input:   fileName string: the name of the replica
+//			offset int64: the first byte, negative to count from the end
+//			length int64: the number of bytes, negative to read to the end
+// Output:  the bytes of the range, their number, the checksum of the
+//			replica and the error if the replica can't be read
+func openLocalRange(fileName string, offset int64, length int64) (io.ReadCloser, int64, string, error) {
+	stored, ok := lookupStored(fileName)
+	if !ok {
+		return nil, 0, "", errors.New("no replica of " + fileName + " on this node")
+	}
+	file, err := os.Open(SDFSFILEPATH + fileName)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, 0, "", err
+	}
+	offset, length = clampRange(fileInfo.Size(), offset, length)
+	reader := &rangeReader{io.NewSectionReader(file, offset, length), file, length}
+	return reader, length, stored.checksum, nil
+}
+
+
+// func dialRange(nodeID int, fileName string, offset int64, length int64) (io.ReadCloser, string, error)
+// ------------------------------------------------------------------
+// Description: A helper function that asks the range server of a replica
+//				for a range of its copy
+// Input:   nodeID int: the node id of the replica
+//			fileName string: the name of the replica
+//			offset int64: the first byte, negative to count from the end
+//			length int64: the number of bytes, negative to read to the end
+// Output:  the bytes of the range, the checksum of the replica and the
+//			error if the replica can't send the range
+func dialRange(nodeID int, fileName string, offset int64, length int64) (io.ReadCloser, string, error) {
+	connection, err := net.DialTimeout("tcp", memberAddr[nodeID] + ":" + RANGEPORT, READTIMEOUT)
+	if err != nil {
+		return nil, "", err
+	}
+
+	requestMap := make(map[string]string)
+	requestMap[SDFSNAME] = fileName
+	requestMap[RANGEOFFSET] = strconv.FormatInt(offset, 10)
+	requestMap[RANGELENGTH] = strconv.FormatInt(length, 10)
+	request, _ := json.Marshal(requestMap)
+	_, err = connection.Write(append(request, '\n'))
+	if err != nil {
+		_ = connection.Close()
+		return nil, "", err
+	}
+
+	buffered := bufio.NewReader(connection)
+	header, err := buffered.ReadBytes('\n')
+	replyMap := make(map[string]string)
+	if err == nil {
+		err = json.Unmarshal(header, &replyMap)
+	}
+	if err == nil && replyMap[PUTSTATUS] != TRUE {
+		err = errors.New(replyMap[PUTREASON])
+	}
+	if err != nil {
+		_ = connection.Close()
+		return nil, "", err
+	}
+	size, _ := strconv.ParseInt(replyMap[RANGELENGTH], 10, 64)
+	return &rangeReader{buffered, connection, size}, replyMap[CHECKSUM], nil
+}
+
+
+// func checkRangeName(fileName string) error
+// ------------------------------------------------------------------
+// Description: A helper function that checks that a range request names
+//				a replica this node stores. Any host can connect to the
+//				range server, so names outside the sdfs directory are
+//				refused
+// Input:   fileName string: the name in the range request
+// Output:  the error if the name can't be served
+func checkRangeName(fileName string) error {
+	if fileName == "" || path.IsAbs(fileName) || strings.Contains(fileName, "..") {
+		return errors.New("invalid sdfs name " + fileName)
+	}
+	if !isReplicaNode(fileName, strconv.Itoa(selfID)) {
+		return errors.New("no replica of " + fileName + " on this node")
+	}
+	return nil
+}
+
+
+// func serveRange(connection net.Conn)
+// ------------------------------------------------------------------
+// Description: This function answers one range request with the bytes of
+//				a replica in the sdfs directory of this node
+// Input:   connection net.Conn: the connection of the reader
+// Output:  None
+func serveRange(connection net.Conn) {
+	defer connection.Close()
+	requestMap := make(map[string]string)
+	request, err := bufio.NewReader(io.LimitReader(connection, int64(MAXFRAMESIZE))).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(request, &requestMap)
+	}
+	if err != nil {
+		ErrorHandler("Fail to read range request", err, false)
+		return
+	}
+	offset, _ := strconv.ParseInt(requestMap[RANGEOFFSET], 10, 64)
+	length, _ := strconv.ParseInt(requestMap[RANGELENGTH], 10, 64)
+
+	replyMap := make(map[string]string)
+	var reader io.ReadCloser
+	var checksum string
+	err = checkRangeName(requestMap[SDFSNAME])
+	if err == nil {
+		reader, length, checksum, err = openLocalRange(requestMap[SDFSNAME], offset, length)
+	}
+	if err != nil {
+		replyMap[PUTSTATUS] = FALSE
+		replyMap[PUTREASON] = err.Error()
+		reply, _ := json.Marshal(replyMap)
+		_, _ = connection.Write(append(reply, '\n'))
+		return
+	}
+	defer reader.Close()
+	startTransfer()
+	defer endTransfer()
+	replyMap[PUTSTATUS] = TRUE
+	replyMap[CHECKSUM] = checksum
+	replyMap[RANGELENGTH] = strconv.FormatInt(length, 10)
+	reply, _ := json.Marshal(replyMap)
+	_, err = connection.Write(append(reply, '\n'))
+	if err == nil {
+		_, err = io.Copy(connection, reader)
+	}
+	ErrorHandler("Fail to send range of " + requestMap[SDFSNAME], err, false)
+}
+
+
+// func RangeServer()
+// ------------------------------------------------------------------
+// Description: One of the routine that will be running in the backend.
+//				Receiving connections that read ranges of replicas
+// Input:   None
+// Output:  None
+func RangeServer() {
+	serverConn, err := net.Listen("tcp", ":" + RANGEPORT)
+	if err != nil {
+		fmt.Printf("Cannot listen for range reads: %v\n", err.Error())
+		return
+	}
+	for {
+		conn, err := serverConn.Accept()
+		if err != nil {
+			fmt.Printf("Cannot accept connection")
+			return
+		}
+		go serveRange(conn)
+	}
+}
+
+
+// func handleCat(sdfsFileName string, offset int64, length int64)
+// ------------------------------------------------------------------
+// Description: This function handles the cat instruction and prints a
+//				range of a sdfs file
+// Input:   sdfsFileName string: the name of the sdfs file
+//			offset int64: the first byte, negative to count from the end
+//			length int64: the number of bytes, negative to read to the end
+// Output:  None
+func handleCat(sdfsFileName string, offset int64, length int64) {
+	reader, err := ReadRange(sdfsFileName, offset, length)
+	if err != nil {
+		fmt.Printf("Can't read SDFS file %v: %v\n", sdfsFileName, err.Error())
+		return
+	}
+	defer reader.Close()
+	_, err = io.Copy(os.Stdout, reader)
+	if err != nil {
+		fmt.Printf("\nRead of SDFS file %v stopped: %v\n", sdfsFileName, err.Error())
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This portion of code implements a systematic Reed-Solomon code over
+// GF(2^8) for erasure-coded sdfs files. A file is cut into k data shards
+// of equal size, the last one padded with zeros, and m parity shards are
+// computed with a Cauchy matrix. The encoding matrix is the k x k identity
+// on top of the m x k Cauchy matrix, so every k of its k+m rows are
+// invertible and any k shards are enough to rebuild all others. Shards are
+// processed in chunks of ECCHUNK bytes so files never have to fit in memory.
+
+// log and exponent tables of GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1
+var gfExp, gfLog = gfTables()
+
+// gfMulTable[a][b] is the product of a and b in GF(2^8)
+var gfMulTable = gfProducts()
+
+
+// func gfTables() ([512]byte, [256]byte)
+// ------------------------------------------------------------------
+// Description: A helper function that builds the exponent and log tables
+//				of GF(2^8). The exponent table is doubled so that sums of
+//				two logs can be looked up without a modulo
+// Input:   None
+// Output:  the exponent table and the log table
+func gfTables() ([512]byte, [256]byte) {
+	var exp [512]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x & 0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i - 255]
+	}
+	return exp, log
+}
+
+
+// func gfProducts() [256][256]byte
+// ------------------------------------------------------------------
+// Description: A helper function that builds the multiplication table of
+//				GF(2^8)
+// Input:   None
+// Output:  the multiplication table
+func gfProducts() [256][256]byte {
+	var table [256][256]byte
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			table[a][b] = gfExp[int(gfLog[a]) + int(gfLog[b])]
+		}
+	}
+	return table
+}
+
+
+// func gfInverse(a byte) byte
+// ------------------------------------------------------------------
+// Description: A helper function that inverts a non-zero element of GF(2^8)
+// Input:   a byte: the element
+// Output:  the inverse of a
+func gfInverse(a byte) byte {
+	return gfExp[255 - int(gfLog[a])]
+}
+
+
+// func parseScheme(scheme string) (int, int, error)
+// ------------------------------------------------------------------
+// Description: A helper function that parses an erasure scheme <k>+<m>
+// Input:   scheme string: the erasure scheme
+// Output:  the number of data shards, the number of parity shards and the
+//			parse error
+func parseScheme(scheme string) (int, int, error) {
+	parts := strings.Split(scheme, "+")
+	if len(parts) == 2 {
+		k, errK := strconv.Atoi(parts[0])
+		m, errM := strconv.Atoi(parts[1])
+		if errK == nil && errM == nil && k > 0 && m > 0 && k + m <= 256 {
+			return k, m, nil
+		}
+	}
+	return 0, 0, errors.New("unknown erasure scheme " + scheme)
+}
+
+
+// func shardSize(fileSize int64, k int) int64
+// ------------------------------------------------------------------
+// Description: A helper function that gives the size of every shard
+// Input:   fileSize int64: the size of the file
+//			k int: the number of data shards
+// Output:  the size of a shard in bytes
+func shardSize(fileSize int64, k int) int64 {
+	return (fileSize + int64(k) - 1) / int64(k)
+}
+
+
+// func encodingMatrix(k int, m int) [][]byte
+// ------------------------------------------------------------------
+// Description: A helper function that builds the (k+m) x k encoding matrix.
+//				Row k+i of the Cauchy part is 1 / ((k+i) xor j)
+// Input:   k int: the number of data shards
+//			m int: the number of parity shards
+// Output:  the encoding matrix
+func encodingMatrix(k int, m int) [][]byte {
+	matrix := make([][]byte, k + m)
+	for i := range matrix {
+		matrix[i] = make([]byte, k)
+		if i < k {
+			matrix[i][i] = 1
+			continue
+		}
+		for j := 0; j < k; j++ {
+			matrix[i][j] = gfInverse(byte(i ^ j))
+		}
+	}
+	return matrix
+}
+
+
+// func invertMatrix(matrix [][]byte) ([][]byte, error)
+// ------------------------------------------------------------------
+// Description: A helper function that inverts a square matrix over GF(2^8)
+//				with Gauss-Jordan elimination
+// Input:   matrix [][]byte: the matrix, left unchanged
+// Output:  the inverse and the error if the matrix is singular
+func invertMatrix(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	inverse := make([][]byte, n)
+	for i := range matrix {
+		work[i] = append([]byte(nil), matrix[i]...)
+		inverse[i] = make([]byte, n)
+		inverse[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		inverse[col], inverse[pivot] = inverse[pivot], inverse[col]
+
+		scale := gfInverse(work[col][col])
+		for j := 0; j < n; j++ {
+			work[col][j] = gfMulTable[scale][work[col][j]]
+			inverse[col][j] = gfMulTable[scale][inverse[col][j]]
+		}
+		for row := 0; row < n; row++ {
+			factor := work[row][col]
+			if row == col || factor == 0 {
+				continue
+			}
+			for j := 0; j < n; j++ {
+				work[row][j] ^= gfMulTable[factor][work[col][j]]
+				inverse[row][j] ^= gfMulTable[factor][inverse[col][j]]
+			}
+		}
+	}
+	return inverse, nil
+}
+
+
+// func mulAdd(dst []byte, src []byte, coefficient byte)
+// ------------------------------------------------------------------
+// Description: A helper function that adds coefficient * src to dst
+// Input:   dst []byte: the destination
+//			src []byte: the source, at least as long as dst
+//			coefficient byte: the coefficient
+// Output:  None
+func mulAdd(dst []byte, src []byte, coefficient byte) {
+	if coefficient == 0 {
+		return
+	}
+	row := &gfMulTable[coefficient]
+	for i := range dst {
+		dst[i] ^= row[src[i]]
+	}
+}
+
+
+// func readChunk(f *os.File, buf []byte, offset int64, limit int64) error
+// ------------------------------------------------------------------
+// Description: A helper function that reads a chunk at an offset. Bytes
+//				at or beyond the limit are read as zeros
+// Input:   f *os.File: the file
+//			buf []byte: the chunk to be filled
+//			offset int64: the offset of the chunk in the file
+//			limit int64: the number of bytes of the file that may be read
+// Output:  the read error
+func readChunk(f *os.File, buf []byte, offset int64, limit int64) error {
+	for i := range buf {
+		buf[i] = 0
+	}
+	if offset >= limit {
+		return nil
+	}
+	n := int64(len(buf))
+	if offset + n > limit {
+		n = limit - offset
+	}
+	_, err := f.ReadAt(buf[:n], offset)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+
+// func encodeFile(path string, fileSize int64, k int, m int, shardPaths []string) error
+// ------------------------------------------------------------------
+// Description: This function encodes a file into k data shards and m
+//				parity shards
+// Input:   path string: path to the file
+//			fileSize int64: the size of the file
+//			k int: the number of data shards
+//			m int: the number of parity shards
+//			shardPaths []string: the k+m paths the shards are written to
+// Output:  the error if the file can't be encoded
+func encodeFile(path string, fileSize int64, k int, m int, shardPaths []string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	outs := make([]*os.File, k + m)
+	defer func() {
+		for _, out := range outs {
+			if out != nil {
+				_ = out.Close()
+			}
+		}
+	}()
+	for i := range outs {
+		outs[i], err = os.Create(shardPaths[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	matrix := encodingMatrix(k, m)
+	size := shardSize(fileSize, k)
+	buffers := make([][]byte, k + m)
+	for i := range buffers {
+		buffers[i] = make([]byte, ECCHUNK)
+	}
+	for offset := int64(0); offset < size; offset += ECCHUNK {
+		n := int64(ECCHUNK)
+		if offset + n > size {
+			n = size - offset
+		}
+		for j := 0; j < k; j++ {
+			// data shard j covers bytes [j*size, (j+1)*size) of the file
+			err = readChunk(in, buffers[j][:n], int64(j) * size + offset, fileSize)
+			if err != nil {
+				return err
+			}
+		}
+		for i := k; i < k + m; i++ {
+			parity := buffers[i][:n]
+			for b := range parity {
+				parity[b] = 0
+			}
+			for j := 0; j < k; j++ {
+				mulAdd(parity, buffers[j][:n], matrix[i][j])
+			}
+		}
+		for i, out := range outs {
+			if _, err = out.Write(buffers[i][:n]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+
+// func rebuildShards(k int, m int, size int64, available map[int]string, targets map[int]string) error
+// ------------------------------------------------------------------
+// Description: This function rebuilds shards from any k other shards
+// Input:   k int: the number of data shards
+//			m int: the number of parity shards
+//			size int64: the size of every shard
+//			available map[int]string: maps shard index to the path of a
+//									  shard that is present
+//			targets map[int]string: maps shard index to the path the
+//									rebuilt shard is written to
+// Output:  the error if the shards can't be rebuilt
+func rebuildShards(k int, m int, size int64, available map[int]string, targets map[int]string) error {
+	indices := make([]int, 0, len(available))
+	for index := range available {
+		indices = append(indices, index)
+	}
+	if len(indices) < k {
+		return fmt.Errorf("only %d of %d required shards are available", len(indices), k)
+	}
+	sort.Ints(indices)
+	indices = indices[:k]
+
+	// data = inverse(rows of the available shards) * available shards
+	matrix := encodingMatrix(k, m)
+	rows := make([][]byte, k)
+	for i, index := range indices {
+		rows[i] = matrix[index]
+	}
+	decode, err := invertMatrix(rows)
+	if err != nil {
+		return err
+	}
+
+	ins := make([]*os.File, k)
+	outs := make(map[int]*os.File)
+	coefficients := make(map[int][]byte)
+	defer func() {
+		for _, in := range ins {
+			if in != nil {
+				_ = in.Close()
+			}
+		}
+		for _, out := range outs {
+			_ = out.Close()
+		}
+	}()
+	for i, index := range indices {
+		if ins[i], err = os.Open(available[index]); err != nil {
+			return err
+		}
+	}
+	for index, path := range targets {
+		if outs[index], err = os.Create(path); err != nil {
+			return err
+		}
+		// target row of the encoding matrix times the decode matrix
+		coefficient := make([]byte, k)
+		for j := 0; j < k; j++ {
+			for l := 0; l < k; l++ {
+				coefficient[j] ^= gfMulTable[matrix[index][l]][decode[l][j]]
+			}
+		}
+		coefficients[index] = coefficient
+	}
+
+	buffers := make([][]byte, k)
+	for i := range buffers {
+		buffers[i] = make([]byte, ECCHUNK)
+	}
+	output := make([]byte, ECCHUNK)
+	for offset := int64(0); offset < size; offset += ECCHUNK {
+		n := int64(ECCHUNK)
+		if offset + n > size {
+			n = size - offset
+		}
+		for i := range ins {
+			if err = readChunk(ins[i], buffers[i][:n], offset, size); err != nil {
+				return err
+			}
+		}
+		for index, out := range outs {
+			chunk := output[:n]
+			for b := range chunk {
+				chunk[b] = 0
+			}
+			for j := 0; j < k; j++ {
+				mulAdd(chunk, buffers[j][:n], coefficients[index][j])
+			}
+			if _, err = out.Write(chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
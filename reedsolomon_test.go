@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// This portion of code tests the Reed-Solomon code. Random files are
+// encoded, every possible set of m shards is dropped and rebuilt from the
+// remaining k shards, and the rebuilt shards and the reassembled file must
+// be byte-identical to the originals.
+
+
+// func dropSets(n int, m int) [][]int
+// ------------------------------------------------------------------
+// Description: A helper function that lists every set of m shard indices
+//				out of n shards
+// Input:   n int: the number of shards
+//			m int: the number of shards dropped
+// Output:  the sets of shard indices in increasing order
+func dropSets(n int, m int) [][]int {
+	if m == 0 {
+		return [][]int{{}}
+	}
+	sets := make([][]int, 0)
+	for first := m - 1; first < n; first++ {
+		for _, set := range dropSets(first, m - 1) {
+			sets = append(sets, append(append([]int{}, set...), first))
+		}
+	}
+	return sets
+}
+
+
+// func TestReedSolomonRebuild(t *testing.T)
+// ------------------------------------------------------------------
+// Description: This test drops every possible set of m shards of random
+//				files and checks that the shards and the file are rebuilt
+//				byte-identical
+// Input:   t *testing.T: the test state
+// Output:  None
+func TestReedSolomonRebuild(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for _, scheme := range []string{"2+1", "4+2", "6+3"} {
+		k, m, err := parseScheme(scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// sizes that pad the last data shard and that span several chunks
+		for _, fileSize := range []int64{1, 1000, int64(k) * ECCHUNK, 3 * ECCHUNK + 17} {
+			name := scheme + "-" + strconv.FormatInt(fileSize, 10)
+			dir := t.TempDir()
+			data := make([]byte, fileSize)
+			random.Read(data)
+			path := filepath.Join(dir, "file")
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			shardPaths := make([]string, k + m)
+			for i := range shardPaths {
+				shardPaths[i] = filepath.Join(dir, "shard" + strconv.Itoa(i))
+			}
+			if err := encodeFile(path, fileSize, k, m, shardPaths); err != nil {
+				t.Fatalf("%v: encode: %v", name, err)
+			}
+			shards := make([][]byte, k + m)
+			for i, shardPath := range shardPaths {
+				if shards[i], err = os.ReadFile(shardPath); err != nil {
+					t.Fatal(err)
+				}
+			}
+			size := shardSize(fileSize, k)
+
+			for _, dropped := range dropSets(k + m, m) {
+				available := make(map[int]string)
+				for i, shardPath := range shardPaths {
+					available[i] = shardPath
+				}
+				targets := make(map[int]string)
+				for _, index := range dropped {
+					delete(available, index)
+					targets[index] = filepath.Join(dir, "rebuilt" + strconv.Itoa(index))
+				}
+				if err := rebuildShards(k, m, size, available, targets); err != nil {
+					t.Fatalf("%v: drop %v: rebuild: %v", name, dropped, err)
+				}
+
+				// the data shards in order, the last one padded with zeros
+				assembled := make([]byte, 0, int64(k) * size)
+				for index := 0; index < k + m; index++ {
+					shard := shards[index]
+					if target, ok := targets[index]; ok {
+						if shard, err = os.ReadFile(target); err != nil {
+							t.Fatal(err)
+						}
+						if !bytes.Equal(shard, shards[index]) {
+							t.Fatalf("%v: drop %v: shard %d differs after rebuild", name, dropped, index)
+						}
+					}
+					if index < k {
+						assembled = append(assembled, shard...)
+					}
+				}
+				if !bytes.Equal(assembled[:fileSize], data) {
+					t.Fatalf("%v: drop %v: reassembled file differs", name, dropped)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// This portion of code implements the repair queue of the master node.
+// When a node fails or leaves, every file it stored is queued instead of
+// being copied at once. Every REPAIRTIME the master node starts the
+// repairs in the order of their risk:
+// 		1. files with fewer remaining replicas come first, a shard counts as
+//		   one more replica than the shards its file can still lose
+//		2. a node sends or receives at most REPAIRLIMIT repairs at a time
+//		3. a repair copies the file from its least busy replica to a node
+//		   picked by the placement policy, and waits until the new replica
+//		   stores the file before it fills the empty slot
+//		4. a failed repair is retried up to REPAIRRETRIES times, then again
+//		   after REPAIRBACKOFF, until the file is repaired or deleted
+// The queue only lives in the memory of the master node, so a new master
+// node and every REPAIRSCAN the master node queue every file of the
+// replica list that has an empty slot.
+// The estimated time to full redundancy is the bytes still queued divided
+// by the bytes repaired per second since the queue was last empty.
+
+// a file with an empty replica slot
+type repairTask struct {
+	sdfsFileName string
+	remaining int
+	size int64
+	attempts int
+	queued time.Time
+	retryAt time.Time
+}
+
+// the state of the repair queue on the master node, guarded by repairLock
+type repairState struct {
+	queue map[string]*repairTask
+	running map[string]bool
+	busy map[string]int
+	since time.Time
+	scanned time.Time
+	done int
+	failed int
+	bytesDone int64
+}
+
+var repairs = repairState{queue: make(map[string]*repairTask), running: make(map[string]bool), busy: make(map[string]int)}
+var repairLock sync.Mutex
+
+
+// func remainingCopies(sdfsFileName string) (int, int64)
+// ------------------------------------------------------------------
+// Description: A helper function that counts the remaining replicas of a
+//				file. A shard counts as one more than the shards its file
+//				can still lose, like a replica that is one of r copies
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  the remaining replicas and the size of the file
+func remainingCopies(sdfsFileName string) (int, int64) {
+	if isShardName(sdfsFileName) {
+		parent, _ := shardParent(sdfsFileName)
+		fileLock.RLock()
+		k, _, _ := parseScheme(replicateList[parent][ECSCHEME])
+		var shards []string
+		_ = json.Unmarshal([]byte(replicateList[parent][SHARDLIST]), &shards)
+		surviving := 0
+		for _, shard := range shards {
+			if hasReplica(replicateList[shard]) {
+				surviving++
+			}
+		}
+		fileLock.RUnlock()
+		return surviving - k + 1, sdfsFileSize(sdfsFileName)
+	}
+
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+	sdfsMap := replicateList[sdfsFileName]
+	remaining := 0
+	for _, key := range fileSlots(sdfsMap) {
+		if sdfsMap[key] != "" {
+			remaining++
+		}
+	}
+	fileSize, _ := strconv.ParseInt(sdfsMap[SDFSSIZE], 10, 64)
+	return remaining, fileSize
+}
+
+
+// func missingReplica(sdfsFileName string) bool
+// ------------------------------------------------------------------
+// Description: A helper function that checks whether a file still has an
+//				empty replica slot
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  true if the file exists and misses a replica
+func missingReplica(sdfsFileName string) bool {
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+	sdfsMap, ok := replicateList[sdfsFileName]
+	if !ok {
+		return false
+	}
+	for _, key := range fileSlots(sdfsMap) {
+		if sdfsMap[key] == "" {
+			return true
+		}
+	}
+	return false
+}
+
+
+// func queueRepair(sdfsFileName string)
+// ------------------------------------------------------------------
+// Description: This function queues a file that lost a replica on the
+//				master node
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  None
+func queueRepair(sdfsFileName string) {
+	remaining, fileSize := remainingCopies(sdfsFileName)
+	if remaining <= 0 {
+		logMsg := fmt.Sprintf("SDFS file %v lost its last replica or too many shards\n", sdfsFileName)
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		return
+	}
+
+	repairLock.Lock()
+	defer repairLock.Unlock()
+	if len(repairs.queue) == 0 && len(repairs.running) == 0 {
+		repairs.since = time.Now()
+		repairs.bytesDone = 0
+	}
+	if task, ok := repairs.queue[sdfsFileName]; ok {
+		task.remaining = remaining
+		return
+	}
+	repairs.queue[sdfsFileName] = &repairTask{sdfsFileName, remaining, fileSize, 0, time.Now(), time.Time{}}
+}
+
+
+// func rebuildRepairQueue()
+// ------------------------------------------------------------------
+// Description: This function queues every file of the replica list that
+//				has an empty replica slot, e.g. when this node becomes the
+//				master node
+// Input:   None
+// Output:  None
+func rebuildRepairQueue() {
+	fileLock.RLock()
+	missing := make([]string, 0)
+	for sdfsFileName, sdfsMap := range replicateList {
+		// a file stored as blocks or shards is repaired through its parts,
+		// a file without replica can't be repaired
+		if sdfsMap[BLOCKLIST] != "" || sdfsMap[SHARDLIST] != "" || (!hasReplica(sdfsMap) && !isShardName(sdfsFileName)) {
+			continue
+		}
+		for _, key := range fileSlots(sdfsMap) {
+			if sdfsMap[key] == "" {
+				missing = append(missing, sdfsFileName)
+				break
+			}
+		}
+	}
+	fileLock.RUnlock()
+
+	repairLock.Lock()
+	repairs.scanned = time.Now()
+	repairLock.Unlock()
+	for _, sdfsFileName := range missing {
+		queueRepair(sdfsFileName)
+	}
+}
+
+
+// func repairRoutine()
+// ------------------------------------------------------------------
+// Description: This routine starts the queued repairs on the master node
+//				every REPAIRTIME, most at risk first
+// Input:   None
+// Output:  None
+func repairRoutine() {
+	for {
+		time.Sleep(REPAIRTIME)
+		if !isMaster {
+			continue
+		}
+		repairLock.Lock()
+		scanned := repairs.scanned
+		repairLock.Unlock()
+		if time.Since(scanned) >= REPAIRSCAN {
+			rebuildRepairQueue()
+		}
+
+		repairLock.Lock()
+		tasks := make([]*repairTask, 0, len(repairs.queue))
+		for sdfsFileName, task := range repairs.queue {
+			if repairs.running[sdfsFileName] || time.Now().Before(task.retryAt) {
+				continue
+			}
+			// the file was deleted or refilled since it was queued
+			if !missingReplica(sdfsFileName) {
+				delete(repairs.queue, sdfsFileName)
+				continue
+			}
+			tasks = append(tasks, task)
+		}
+		repairLock.Unlock()
+		sort.Slice(tasks, func(i, j int) bool {
+			if tasks[i].remaining != tasks[j].remaining {
+				return tasks[i].remaining < tasks[j].remaining
+			}
+			return tasks[i].queued.Before(tasks[j].queued)
+		})
+
+		for _, task := range tasks {
+			if isShardName(task.sdfsFileName) {
+				// the master node rebuilds shards itself
+				selfIDStr := strconv.Itoa(selfID)
+				if !reserveRepair(task.sdfsFileName, selfIDStr, "") {
+					continue
+				}
+				go runRepair(task, selfIDStr, "")
+				continue
+			}
+
+			// a copy a restarted node kept is admitted instead
+			if admitReportedCopy(task.sdfsFileName) {
+				continue
+			}
+			source, destination := pickRepair(task)
+			if source == "" || destination == "" || !reserveRepair(task.sdfsFileName, source, destination) {
+				continue
+			}
+			go runRepair(task, source, destination)
+		}
+	}
+}
+
+
+// func pickRepair(task *repairTask) (string, string)
+// ------------------------------------------------------------------
+// Description: A helper function that picks the source and the destination
+//				of a repair among the nodes that are below REPAIRLIMIT
+// Input:   task *repairTask: the repair
+// Output:  the node ids of the source and the destination, empty if every
+//			replica or every fitting node is busy
+func pickRepair(task *repairTask) (string, string) {
+	repairLock.Lock()
+	busy := make(map[string]bool)
+	load := make(map[string]int)
+	for nodeID, count := range repairs.busy {
+		load[nodeID] = count
+		busy[nodeID] = count >= REPAIRLIMIT
+	}
+	repairLock.Unlock()
+
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	holders := make([]string, 0)
+	source := ""
+	for _, key := range fileSlots(replicateList[task.sdfsFileName]) {
+		nodeID := replicateList[task.sdfsFileName][key]
+		if nodeID == "" {
+			continue
+		}
+		holders = append(holders, nodeID)
+		if !busy[nodeID] && (source == "" || load[nodeID] < load[source]) {
+			source = nodeID
+		}
+	}
+	if source == "" {
+		return "", ""
+	}
+	picked := placeReplicasExcept(holders, busy, 1, task.size)
+	if len(picked) == 0 {
+		return "", ""
+	}
+	return source, picked[0]
+}
+
+
+// func reserveRepair(sdfsFileName string, source string, destination string) bool
+// ------------------------------------------------------------------
+// Description: A helper function that counts a repair against the limits
+//				of its nodes
+// Input:   sdfsFileName string: the name of the sdfs file
+//			source string: the node id of the source
+//			destination string: the node id of the destination, empty if
+//								the destination is picked later
+// Output:  false if either node is at REPAIRLIMIT
+func reserveRepair(sdfsFileName string, source string, destination string) bool {
+	repairLock.Lock()
+	defer repairLock.Unlock()
+	if repairs.busy[source] >= REPAIRLIMIT || (destination != "" && repairs.busy[destination] >= REPAIRLIMIT) {
+		return false
+	}
+	repairs.running[sdfsFileName] = true
+	repairs.busy[source]++
+	if destination != "" {
+		repairs.busy[destination]++
+	}
+	return true
+}
+
+
+// func runRepair(task *repairTask, source string, destination string)
+// ------------------------------------------------------------------
+// Description: This function runs one repair and requeues it if it fails
+// Input:   task *repairTask: the repair
+//			source string: the node id of the source
+//			destination string: the node id of the destination, empty for
+//								a shard
+// Output:  None
+func runRepair(task *repairTask, source string, destination string) {
+	var err error
+	if destination == "" {
+		err = rebuildShard(task.sdfsFileName, "")
+	} else {
+		err = copyReplica(task.sdfsFileName, source, destination)
+	}
+
+	repairLock.Lock()
+	defer repairLock.Unlock()
+	delete(repairs.running, task.sdfsFileName)
+	repairs.busy[source]--
+	if destination != "" {
+		repairs.busy[destination]--
+	}
+	if err == nil {
+		delete(repairs.queue, task.sdfsFileName)
+		repairs.done++
+		repairs.bytesDone += task.size
+		return
+	}
+
+	task.attempts++
+	repairs.failed++
+	logMsg := fmt.Sprintf("Repair %d of SDFS file %v failed: %v\n", task.attempts, task.sdfsFileName, err.Error())
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+	// the file stays queued, it is retried after a while
+	if task.attempts % REPAIRRETRIES == 0 {
+		task.retryAt = time.Now().Add(REPAIRBACKOFF)
+	}
+}
+
+
+// func copyReplica(sdfsFileName string, source string, destination string) error
+// ------------------------------------------------------------------
+// Description: This function copies a file to a new replica and fills an
+//				empty replica slot with it once the replica stores the file
+// Input:   sdfsFileName string: the name of the sdfs file
+//			source string: the node id of a replica
+//			destination string: the node id of the new replica
+// Output:  the error if the new replica did not store the file
+func copyReplica(sdfsFileName string, source string, destination string) error {
+	fileLock.RLock()
+	checksum := replicateList[sdfsFileName][CHECKSUM]
+	fileLock.RUnlock()
+
+	logMsg := fmt.Sprintf("Repairing SDFS file %v from node %v to node %v\n", sdfsFileName, source, destination)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+
+	sourceID, _ := strconv.Atoi(source)
+	destinationID, _ := strconv.Atoi(destination)
+	requestTransfer(sourceID, sdfsFileName, sdfsFileName, SDFSNAME, checksum, destinationID)
+	if !waitStored(sdfsFileName, destinationID, checksum) {
+		deleteReplica(sdfsFileName, destinationID)
+		return fmt.Errorf("node %v did not store the file within %v", destination, STORETIMEOUT)
+	}
+
+	fileLock.Lock()
+	sdfsMap, ok := replicateList[sdfsFileName]
+	slot := ""
+	holds := false
+	for _, key := range fileSlots(sdfsMap) {
+		if sdfsMap[key] == destination {
+			holds = true
+		} else if sdfsMap[key] == "" && slot == "" {
+			slot = key
+		}
+	}
+	// the file may have been written again, deleted or repaired meanwhile
+	if !ok || sdfsMap[CHECKSUM] != checksum || holds || slot == "" {
+		fileLock.Unlock()
+		if !holds {
+			deleteReplica(sdfsFileName, destinationID)
+		}
+		return nil
+	}
+	sdfsMap[slot] = destination
+	replicateCounter[destination]++
+	fileLock.Unlock()
+
+	publishReplicaDelta(sdfsFileName)
+	return nil
+}
+
+
+// func printRepairStatus()
+// ------------------------------------------------------------------
+// Description: This function prints the length of the repair queue, the
+//				repairs in progress and the estimated time to full redundancy
+// Input:   None
+// Output:  None
+func printRepairStatus() {
+	if !isMaster {
+		fmt.Printf("The repair queue is kept by the master node: %v\n", memberHost[masterID])
+		return
+	}
+
+	repairLock.Lock()
+	defer repairLock.Unlock()
+	tasks := make([]*repairTask, 0, len(repairs.queue))
+	var queuedBytes int64
+	for _, task := range repairs.queue {
+		tasks = append(tasks, task)
+		queuedBytes += task.size
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].remaining != tasks[j].remaining {
+			return tasks[i].remaining < tasks[j].remaining
+		}
+		return tasks[i].queued.Before(tasks[j].queued)
+	})
+
+	eta := "unknown"
+	if len(tasks) == 0 {
+		eta = "0s"
+	} else if elapsed := time.Since(repairs.since).Seconds(); repairs.bytesDone > 0 && elapsed > 0 {
+		rate := float64(repairs.bytesDone) / elapsed
+		eta = (time.Duration(float64(queuedBytes) / rate) * time.Second).Round(time.Second).String()
+	}
+	fmt.Printf("-->> %d files queued (%d bytes), %d in progress, estimated time to full redundancy: %v\n", len(tasks), queuedBytes, len(repairs.running), eta)
+	fmt.Printf("-->> Repaired %d files (%d bytes since the queue was empty), %d failed attempts\n", repairs.done, repairs.bytesDone, repairs.failed)
+	for _, task := range tasks {
+		state := "queued"
+		if repairs.running[task.sdfsFileName] {
+			state = "in progress"
+		} else if time.Now().Before(task.retryAt) {
+			state = "retried at " + task.retryAt.Format("15:04:05")
+		}
+		fmt.Printf("->-> %v: %d replicas left, %d attempts, %v\n", task.sdfsFileName, task.remaining, task.attempts, state)
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// This portion of code keeps the replica list of every node consistent
+// with the replica list of the master node. Instead of broadcasting the
+// whole list periodically, the master node:
+// 		1. bumps the version of its replica list on every change and pushes
+//		   the changed entries (a delta) to all other nodes
+//		2. broadcasts a small digest (version and hash of the list) every
+//		   UPDATETIME
+// A node that misses a delta or holds a list whose digest disagrees with
+// the master's digest requests a full copy of the replica list. The prefix
+// policies and the retention of the master node are sent along with every
+// full list, and with a delta when they changed, so that a new master node
+// keeps them. A delta only carries the counters of the nodes that changed.
+
+// version of the local replica list
+var replicaVersion int
+
+// whether the local replica list missed deltas or disagrees with the
+// digest of the master node, guarded by fileLock
+var replicaBehind bool
+
+// cached digest of the local replica list and the version it belongs to
+var replicaDigest string
+var replicaDigestVersion = -1
+
+// last time this node requested a full replica list
+var lastSyncRequest time.Time
+
+// deltas waiting to be pushed to other nodes, in version order
+var replicaDeltaQueue = make(chan string, SIZEDELTAQUEUE)
+
+// what the deltas of the master node sent so far, guarded by fileLock
+type deltaState struct {
+	dirs string
+	policies string
+	counter map[string]int
+}
+var publishedDelta deltaState
+
+// the prefix policies and the retention sent with the replica list
+type policySet struct {
+	Retain int						`json:"retain"`
+	Conflict map[string]string		`json:"conflict"`
+	Quorum map[string]int			`json:"quorum"`
+	Replication map[string]int		`json:"replication"`
+	Erasure map[string]string		`json:"erasure"`
+}
+
+
+// func publishReplicaDelta(sdfsFileNames ...string)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node after it
+//				changes the replica list. It bumps the replica list
+//				version and queues the changed entries to be pushed to
+//				all other nodes
+// Input:   sdfsFileNames ...string: the sdfs files whose entries changed
+// Output:  None
+func publishReplicaDelta(sdfsFileNames ...string) {
+	if !isMaster {
+		return
+	}
+
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	// a deleted entry is sent as null
+	deltaList := make(map[string]map[string]string)
+	for _, sdfsFileName := range sdfsFileNames {
+		deltaList[sdfsFileName] = replicateList[sdfsFileName]
+	}
+	replicaList, _ := json.Marshal(deltaList)
+	indexNamespace(deltaList, nil)
+
+	// only the counters of the nodes that changed since the last delta
+	changedCounter := make(map[string]int)
+	for nodeID, count := range replicateCounter {
+		if last, ok := publishedDelta.counter[nodeID]; !ok || last != count {
+			changedCounter[nodeID] = count
+		}
+	}
+	replicaCounter, _ := json.Marshal(changedCounter)
+	publishedDelta.counter = make(map[string]int, len(replicateCounter))
+	for nodeID, count := range replicateCounter {
+		publishedDelta.counter[nodeID] = count
+	}
+
+	prevVersion := replicaVersion
+	replicaVersion++
+
+	sendMap := make(map[string]string)
+	sendMap[SDFSLIST] = string(replicaList)
+	sendMap[SDFSCOUNT] = string(replicaCounter)
+	sendMap[SDFSPREV] = strconv.Itoa(prevVersion)
+	sendMap[SDFSVERSION] = strconv.Itoa(replicaVersion)
+	// the directories and policies are only sent when they changed
+	if dirs := encodeExplicitDirs(); dirs != publishedDelta.dirs {
+		sendMap[SDFSDIRS] = dirs
+		publishedDelta.dirs = dirs
+	}
+	if policies := encodePolicies(); policies != publishedDelta.policies {
+		sendMap[SDFSPOLICIES] = policies
+		publishedDelta.policies = policies
+	}
+	msgContent, _ := json.Marshal(sendMap)
+	msgSent := MakeMessage(REPLICADELTA, string(msgContent), strconv.Itoa(selfID))
+
+	// queue while holding the lock so that deltas are pushed in version order
+	select {
+	case replicaDeltaQueue <- msgSent:
+	default:
+		// other nodes will catch up through the digest
+		WriteLog(logFile, "Replica delta queue is full, dropping delta\n", false)
+	}
+}
+
+
+// func resetPublishedDelta()
+// ------------------------------------------------------------------
+// Description: This function is called when the current node becomes the
+//				master node, so that its first delta carries the directories,
+//				the policies and all counters
+// Input:   None
+// Output:  None
+func resetPublishedDelta() {
+	fileLock.Lock()
+	publishedDelta = deltaState{}
+	fileLock.Unlock()
+}
+
+
+// func pushReplicaDelta()
+// ------------------------------------------------------------------
+// Description: A routine that sends the queued replica list deltas to
+//				all other nodes
+// Input:   None
+// Output:  None
+func pushReplicaDelta() {
+	for msgSent := range replicaDeltaQueue {
+		if !isMaster {
+			continue
+		}
+		for nodeID := range memberHost {
+			sendTCPRequest(nodeID, msgSent)
+		}
+	}
+}
+
+
+// func applyReplicaDelta(msgContent string)
+// ------------------------------------------------------------------
+// Description: This function applies a delta received from the master
+//				node to the local replica list. If the delta does not
+//				follow the local version, a full replica list is requested
+// Input:   msgContent string: the content of the REPLICADELTA message
+// Output:  None
+func applyReplicaDelta(msgContent string) {
+	receiverMap := make(map[string]string)
+	err := json.Unmarshal([]byte(msgContent), &receiverMap)
+	ErrorHandler("Unmarshal error delta", err, false)
+	if err != nil {
+		return
+	}
+	prevVersion, _ := strconv.Atoi(receiverMap[SDFSPREV])
+	newVersion, _ := strconv.Atoi(receiverMap[SDFSVERSION])
+
+	fileLock.Lock()
+	if prevVersion != replicaVersion {
+		fileLock.Unlock()
+		// deltas older than the local list are simply dropped
+		if newVersion > replicaVersion {
+			fileLock.Lock()
+			replicaBehind = true
+			fileLock.Unlock()
+			requestReplicaList()
+		}
+		return
+	}
+
+	deltaList := make(map[string]map[string]string)
+	err = json.Unmarshal([]byte(receiverMap[SDFSLIST]), &deltaList)
+	ErrorHandler("Unmarshal error delta list", err, false)
+	newCounter := make(map[string]int)
+	err = json.Unmarshal([]byte(receiverMap[SDFSCOUNT]), &newCounter)
+	ErrorHandler("Unmarshal error delta count", err, false)
+
+	changed := make([]string, 0, len(deltaList))
+	for sdfsFileName, sdfsMap := range deltaList {
+		if sdfsMap == nil {
+			delete(replicateList, sdfsFileName)
+			continue
+		}
+		replicateList[sdfsFileName] = sdfsMap
+		changed = append(changed, sdfsFileName)
+	}
+	for nodeID, count := range newCounter {
+		replicateCounter[nodeID] = count
+	}
+	replicaVersion = newVersion
+	replicaDigestVersion = -1
+	indexNamespace(deltaList, decodeExplicitDirs(receiverMap[SDFSDIRS]))
+	fileLock.Unlock()
+	applyPolicies(receiverMap[SDFSPOLICIES])
+
+	go checkList(changed)
+}
+
+
+// func applyReplicaList(msgContent string)
+// ------------------------------------------------------------------
+// Description: This function replaces the local replica list by the
+//				full replica list received from the master node
+// Input:   msgContent string: the content of the REPLICALIST message
+// Output:  None
+func applyReplicaList(msgContent string) {
+	receiverMap := make(map[string]string)
+	err := json.Unmarshal([]byte(msgContent), &receiverMap)
+	ErrorHandler("Unmarshal error all", err, false)
+	newCounter := make(map[string]int)
+	err = json.Unmarshal([]byte(receiverMap[SDFSCOUNT]), &newCounter)
+	ErrorHandler("Unmarshal error count", err, false)
+	newList := make(map[string]map[string]string)
+	err = json.Unmarshal([]byte(receiverMap[SDFSLIST]), &newList)
+	ErrorHandler("Unmarshal error list", err, false)
+	if err != nil {
+		return
+	}
+
+	fileLock.Lock()
+	replicateList = newList
+	replicateCounter = newCounter
+	replicaVersion, _ = strconv.Atoi(receiverMap[SDFSVERSION])
+	replicaDigestVersion = -1
+	replicaBehind = false
+	rebuildNamespace(decodeExplicitDirs(receiverMap[SDFSDIRS]))
+	sdfsFileNames := make([]string, 0, len(replicateList))
+	for sdfsFileName := range replicateList {
+		sdfsFileNames = append(sdfsFileNames, sdfsFileName)
+	}
+	fileLock.Unlock()
+	applyPolicies(receiverMap[SDFSPOLICIES])
+
+	logMsg := fmt.Sprintf("Full replica list received, version %v with %v files\n", replicaVersion, len(sdfsFileNames))
+	WriteLog(logFile, logMsg, false)
+
+	go checkList(sdfsFileNames)
+}
+
+
+// func replicaListBehind() bool
+// ------------------------------------------------------------------
+// Description: A helper function that checks whether the local replica
+//				list is known to be behind the one of the master node
+// Input:   None
+// Output:  true if the list missed deltas or disagrees with the digest
+func replicaListBehind() bool {
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+	return replicaBehind
+}
+
+
+// func requestReplicaList()
+// ------------------------------------------------------------------
+// Description: This function asks the master node for a full copy of
+//				the replica list. Requests are sent at most once every
+//				UPDATETIME
+// Input:   None
+// Output:  None
+func requestReplicaList() {
+	if isMaster || time.Now().Before(lastSyncRequest.Add(UPDATETIME)) {
+		return
+	}
+	lastSyncRequest = time.Now()
+
+	WriteLog(logFile, "Replica list out of sync, requesting full replica list\n", false)
+	msgSent := MakeMessage(REPLICASYNC, "", strconv.Itoa(selfID))
+	sendRequest(masterID, msgSent)
+}
+
+
+// func sendReplicaList(nodeID int)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to send the
+//				full replica list to a node that is out of sync
+// Input:   nodeID int: the node id of the node that requests the list
+// Output:  None
+func sendReplicaList(nodeID int) {
+	if !isMaster {
+		return
+	}
+
+	fileLock.RLock()
+	replicaList, _ := json.Marshal(replicateList)
+	replicaCounter, _ := json.Marshal(replicateCounter)
+	version := replicaVersion
+	fileLock.RUnlock()
+
+	sendMap := make(map[string]string)
+	sendMap[SDFSLIST] = string(replicaList)
+	sendMap[SDFSCOUNT] = string(replicaCounter)
+	sendMap[SDFSVERSION] = strconv.Itoa(version)
+	sendMap[SDFSDIRS] = encodeExplicitDirs()
+	sendMap[SDFSPOLICIES] = encodePolicies()
+	msgContent, _ := json.Marshal(sendMap)
+	msgSent := MakeMessage(REPLICALIST, string(msgContent), strconv.Itoa(selfID))
+
+	logMsg := fmt.Sprintf("Sending full replica list version %v to node: %v\n", version, memberHost[nodeID])
+	WriteLog(logFile, logMsg, false)
+	sendTCPRequest(nodeID, msgSent)
+}
+
+
+// func encodePolicies() string
+// ------------------------------------------------------------------
+// Description: A helper function that encodes the prefix policies and the
+//				retention for the replica list messages
+// Input:   None
+// Output:  the json of the policies
+func encodePolicies() string {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	policies := policySet{
+		Retain: versionRetain,
+		Conflict: conflictPolicies,
+		Quorum: quorumPolicies,
+		Replication: replicationPolicies,
+		Erasure: erasurePolicies,
+	}
+	policyList, _ := json.Marshal(policies)
+	return string(policyList)
+}
+
+
+// func applyPolicies(policyList string)
+// ------------------------------------------------------------------
+// Description: A helper function that replaces the local prefix policies
+//				and retention by the ones of the master node
+// Input:   policyList string: the json of the policies, empty if the
+//							   message has none
+// Output:  None
+func applyPolicies(policyList string) {
+	if policyList == "" || isMaster {
+		return
+	}
+	var policies policySet
+	err := json.Unmarshal([]byte(policyList), &policies)
+	ErrorHandler("Unmarshal error policies", err, false)
+	if err != nil {
+		return
+	}
+
+	policyLock.Lock()
+	defer policyLock.Unlock()
+	if policies.Retain > 0 {
+		versionRetain = policies.Retain
+	}
+	conflictPolicies = make(map[string]string)
+	for prefix, policy := range policies.Conflict {
+		conflictPolicies[prefix] = policy
+	}
+	quorumPolicies = make(map[string]int)
+	for prefix, quorum := range policies.Quorum {
+		quorumPolicies[prefix] = quorum
+	}
+	replicationPolicies = make(map[string]int)
+	for prefix, factor := range policies.Replication {
+		replicationPolicies[prefix] = factor
+	}
+	erasurePolicies = make(map[string]string)
+	for prefix, scheme := range policies.Erasure {
+		erasurePolicies[prefix] = scheme
+	}
+}
+
+
+// func getReplicaDigest() string
+// ------------------------------------------------------------------
+// Description: A helper function that returns the digest of the local
+//				replica list. The digest is only recomputed when the list
+//				changed. The caller must hold the write lock of fileLock
+// Input:   None
+// Output:  the hex encoded sha256 of the replica list
+func getReplicaDigest() string {
+	if replicaDigestVersion == replicaVersion {
+		return replicaDigest
+	}
+
+	// json encodes map keys in sorted order, so equal lists give equal digests
+	replicaList, _ := json.Marshal(replicateList)
+	sum := sha256.Sum256(replicaList)
+	replicaDigest = hex.EncodeToString(sum[:])
+	replicaDigestVersion = replicaVersion
+	return replicaDigest
+}
+
+
+// func compareReplicaDigest(msgContent string)
+// ------------------------------------------------------------------
+// Description: This function compares the digest sent by the master node
+//				with the digest of the local replica list and requests
+//				a full replica list if they disagree
+// Input:   msgContent string: the content of the REPLICADIGEST message
+// Output:  None
+func compareReplicaDigest(msgContent string) {
+	receiverMap := make(map[string]string)
+	err := json.Unmarshal([]byte(msgContent), &receiverMap)
+	ErrorHandler("Unmarshal error digest", err, false)
+	if err != nil {
+		return
+	}
+	version, _ := strconv.Atoi(receiverMap[SDFSVERSION])
+
+	fileLock.Lock()
+	inSync := version == replicaVersion && receiverMap[SDFSDIGEST] == getReplicaDigest()
+	replicaBehind = !inSync
+	fileLock.Unlock()
+
+	if !inSync {
+		requestReplicaList()
+	}
+}
+
+
+// func sendReplicaDigest()
+// ------------------------------------------------------------------
+// Description: This routine is only executed by the master node which
+//				sends the digest of its replica list periodically
+// Input:   None
+// Output:  None
+func sendReplicaDigest() {
+	for {
+		// wait until it becomes the master node
+		time.Sleep(UPDATETIME)
+
+		if isMaster {
+			fileLock.Lock()
+			sendMap := make(map[string]string)
+			sendMap[SDFSVERSION] = strconv.Itoa(replicaVersion)
+			sendMap[SDFSDIGEST] = getReplicaDigest()
+			fileLock.Unlock()
+			msgContent, _ := json.Marshal(sendMap)
+			msgSent := MakeMessage(REPLICADIGEST, string(msgContent), strconv.Itoa(selfID))
+
+			for nodeID := range memberHost {
+				sendRequest(nodeID, msgSent)
+				time.Sleep(time.Duration(5) * time.Millisecond)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This portion of code implements the replication factor of sdfs files.
+// Every file in the replica list declares how many replicas it should have.
+// The factor is taken from the put request, otherwise from the longest
+// matching sdfs prefix, otherwise DEFAULTFACTOR. The first four replicas
+// are kept in the slots REPLICAONE to REPLICAFOUR, further replicas in the
+// slots r5, r6, ... Entries without a factor have the default factor. When
+// a replica fails, or a node joins while a file has fewer replicas than it
+// declares, the missing replicas are created again.
+
+// prefix replication factors kept by the master node and copied with the
+// replica list, guarded by policyLock
+var replicationPolicies = make(map[string]int)
+
+
+// func replicaSlots(factor int) []string
+// ------------------------------------------------------------------
+// Description: A helper function that lists the replica slots of a file
+// Input:   factor int: the replication factor of the file
+// Output:  the keys of the replica slots in order
+func replicaSlots(factor int) []string {
+	fixed := []string{REPLICAONE, REPLICATWO, REPLICATHREE, REPLICAFOUR}
+	slots := make([]string, 0, factor)
+	for i := 0; i < factor; i++ {
+		if i < len(fixed) {
+			slots = append(slots, fixed[i])
+		} else {
+			slots = append(slots, REPLICAEXTRA + strconv.Itoa(i + 1))
+		}
+	}
+	return slots
+}
+
+
+// func isReplicaKey(key string) bool
+// ------------------------------------------------------------------
+// Description: A helper function that checks whether a key of an entry or
+//				a message is a replica slot
+// Input:   key string: the key
+// Output:  true if the key is a replica slot
+func isReplicaKey(key string) bool {
+	if key == REPLICAONE || key == REPLICATWO || key == REPLICATHREE || key == REPLICAFOUR {
+		return true
+	}
+	_, err := strconv.Atoi(strings.TrimPrefix(key, REPLICAEXTRA))
+	return strings.HasPrefix(key, REPLICAEXTRA) && err == nil
+}
+
+
+// func replicaFactor(sdfsMap map[string]string) int
+// ------------------------------------------------------------------
+// Description: A helper function that gets the replication factor of an
+//				entry in the replica list
+// Input:   sdfsMap map[string]string: the entry of the sdfs file
+// Output:  the replication factor, DEFAULTFACTOR if none is recorded
+func replicaFactor(sdfsMap map[string]string) int {
+	factor, err := strconv.Atoi(sdfsMap[REPLICAFACTOR])
+	if err != nil || factor <= 0 {
+		return DEFAULTFACTOR
+	}
+	return factor
+}
+
+
+// func fileSlots(sdfsMap map[string]string) []string
+// ------------------------------------------------------------------
+// Description: A helper function that lists the replica slots an entry
+//				in the replica list declares
+// Input:   sdfsMap map[string]string: the entry of the sdfs file
+// Output:  the keys of the replica slots in order
+func fileSlots(sdfsMap map[string]string) []string {
+	return replicaSlots(replicaFactor(sdfsMap))
+}
+
+
+// func getReplicationFactor(sdfsFileName string, factor int) int
+// ------------------------------------------------------------------
+// Description: A helper function that decides the replication factor of
+//				a put request on the master node
+// Input:   sdfsFileName string: the sdfs file to be written
+//			factor int: the factor sent with the request, 0 if not given
+// Output:  the replication factor
+func getReplicationFactor(sdfsFileName string, factor int) int {
+	if factor > 0 {
+		return factor
+	}
+
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	matched := ""
+	factor = DEFAULTFACTOR
+	for prefix, prefixFactor := range replicationPolicies {
+		if strings.HasPrefix(sdfsFileName, prefix) && len(prefix) >= len(matched) {
+			matched = prefix
+			factor = prefixFactor
+		}
+	}
+	return factor
+}
+
+
+// func handleReplicationPolicy(sdfsPrefix string, factor int)
+// ------------------------------------------------------------------
+// Description: This function handles the replication instruction which
+//				sets the replication factor of all sdfs files put with a
+//				prefix. The factor 0 removes the factor of the prefix
+// Input:   sdfsPrefix string: the sdfs prefix
+//			factor int: the number of replicas of every file
+// Output:  None
+func handleReplicationPolicy(sdfsPrefix string, factor int) {
+	if isMaster {
+		policyLock.Lock()
+		if factor == 0 {
+			delete(replicationPolicies, sdfsPrefix)
+		} else {
+			replicationPolicies[sdfsPrefix] = factor
+		}
+		policyLock.Unlock()
+		publishReplicaDelta()
+
+		logMsg := fmt.Sprintf("Replication factor of SDFS prefix %v set to %v\n", sdfsPrefix, factor)
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		return
+	}
+
+	sentMap := make(map[string]string)
+	sentMap[SDFSNAME] = sdfsPrefix
+	sentMap[REPLICAFACTOR] = strconv.Itoa(factor)
+	msgContent, _ := json.Marshal(sentMap)
+	msgSent := MakeMessage(REPLICATIONPOLICY, string(msgContent), strconv.Itoa(selfID))
+	sendRequest(masterID, msgSent)
+}
+
+
+// func printReplicationPolicies()
+// ------------------------------------------------------------------
+// Description: This function prints the prefix replication factors on the
+//				master node
+// Input:   None
+// Output:  None
+func printReplicationPolicies() {
+	if !isMaster {
+		fmt.Printf("Replication factors are kept by the master node: %v\n", memberHost[masterID])
+		return
+	}
+
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	prefixes := make([]string, 0, len(replicationPolicies))
+	for prefix := range replicationPolicies {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	fmt.Printf("-->> Default replication factor: %v\n", DEFAULTFACTOR)
+	for _, prefix := range prefixes {
+		fmt.Printf("->-> %v*: %v\n", prefix, replicationPolicies[prefix])
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This portion of code implements the background scrubber. Every node
+// periodically re-reads the replicas in its sdfs directory at a limited
+// rate and compares them with the checksum recorded by the master node.
+// A mismatching replica is reported to the master node, which checks the
+// checksum against its own replica list, because the list of this node may
+// lag. Only then the replica is removed and re-replicated to this node
+// from a healthy copy.
+
+// one corrupted replica found by the scrubber
+type scrubFinding struct {
+	sdfsFileName string
+	expected string
+	found string
+	time time.Time
+}
+
+// progress of the scrubber on this node
+var scrubPass int
+var scrubScanned int
+var scrubTotal int
+var scrubBytes int64
+var scrubCurrent string
+var scrubLastPass time.Time
+var scrubCorrupted int
+// the last SIZESCRUBFINDINGS corrupted replicas
+var scrubFindings = make([]scrubFinding, 0)
+// modification time of each reported replica when it was read
+var scrubSuspects = make(map[string]time.Time)
+var scrubLock sync.Mutex
+
+
+// func scrubRoutine()
+// ------------------------------------------------------------------
+// Description: A routine that keeps running at backend and verifies
+//				all local replicas every SCRUBTIME
+// Input:   None
+// Output:  None
+func scrubRoutine() {
+	for {
+		time.Sleep(SCRUBTIME)
+		scrubLocalFiles()
+	}
+}
+
+
+// func scrubLocalFiles()
+// ------------------------------------------------------------------
+// Description: This function runs one pass of the scrubber over the
+//				sdfs directory
+// Input:   None
+// Output:  None
+func scrubLocalFiles() {
+	sdfsFiles := sdfsDirFiles()
+
+	scrubLock.Lock()
+	scrubPass++
+	scrubScanned = 0
+	scrubTotal = len(sdfsFiles)
+	scrubBytes = 0
+	scrubLock.Unlock()
+
+	for _, fileName := range sdfsFiles {
+		scrubLock.Lock()
+		scrubScanned++
+		scrubCurrent = fileName
+		scrubLock.Unlock()
+
+		if strings.HasSuffix(fileName, PARTIALSUFFIX) {
+			continue
+		}
+		scrubFile(fileName)
+	}
+
+	scrubLock.Lock()
+	scrubCurrent = ""
+	scrubLastPass = time.Now()
+	scrubLock.Unlock()
+}
+
+
+// func scrubFile(sdfsFileName string)
+// ------------------------------------------------------------------
+// Description: This function verifies one local replica against the
+//				checksum in the replica list
+// Input:   sdfsFileName string: the name of the local replica
+// Output:  None
+func scrubFile(sdfsFileName string) {
+	scrubLock.Lock()
+	delete(scrubSuspects, sdfsFileName)
+	scrubLock.Unlock()
+
+	fileLock.RLock()
+	expected := replicateList[sdfsFileName][CHECKSUM]
+	fileLock.RUnlock()
+	// files without recorded checksum can't be verified
+	if expected == "" {
+		return
+	}
+
+	info, err := os.Stat(SDFSFILEPATH + sdfsFileName)
+	if err != nil {
+		return
+	}
+	found, err := throttledChecksum(SDFSFILEPATH + sdfsFileName)
+	if err != nil {
+		ErrorHandler("Scrubber can't read " + sdfsFileName, err, false)
+		return
+	}
+
+	// the file may have been overwritten while it was being read
+	fileLock.RLock()
+	current := replicateList[sdfsFileName][CHECKSUM]
+	fileLock.RUnlock()
+	if found == expected || current != expected {
+		return
+	}
+
+	logMsg := fmt.Sprintf("Scrubber found mismatching replica of SDFS file %v: expect %v, got %v\n", sdfsFileName, expected, found)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+
+	scrubLock.Lock()
+	scrubCorrupted++
+	scrubFindings = append(scrubFindings, scrubFinding{sdfsFileName, expected, found, time.Now()})
+	if len(scrubFindings) > SIZESCRUBFINDINGS {
+		scrubFindings = scrubFindings[len(scrubFindings) - SIZESCRUBFINDINGS:]
+	}
+	// the master node decides whether the copy is removed
+	scrubSuspects[sdfsFileName] = info.ModTime()
+	scrubLock.Unlock()
+
+	reportCorruptReplica(sdfsFileName, found)
+}
+
+
+// func removeScrubbedReplica(sdfsFileName string)
+// ------------------------------------------------------------------
+// Description: This function removes a reported replica once the master
+//				node confirmed it is corrupted. A replica that was written
+//				again since it was read is kept, it may already be the
+//				repaired copy
+// Input:   sdfsFileName string: the name of the corrupted replica
+// Output:  None
+func removeScrubbedReplica(sdfsFileName string) {
+	scrubLock.Lock()
+	modTime, ok := scrubSuspects[sdfsFileName]
+	delete(scrubSuspects, sdfsFileName)
+	scrubLock.Unlock()
+	if !ok {
+		return
+	}
+
+	info, err := os.Stat(SDFSFILEPATH + sdfsFileName)
+	if err != nil || !info.ModTime().Equal(modTime) {
+		return
+	}
+	// never serve the corrupted copy again
+	err = os.Remove(SDFSFILEPATH + sdfsFileName)
+	ErrorHandler("Can't remove corrupted replica " + sdfsFileName, err, false)
+}
+
+
+// func throttledChecksum(path string) (string, error)
+// ------------------------------------------------------------------
+// Description: A helper function that computes the checksum of a file
+//				while reading at most SCRUBRATE bytes per second
+// Input:   path string: path to the file
+// Output:  the hex encoded sha256 of the file and the read error
+func throttledChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	buffer := make([]byte, BUFFERSIZE)
+	start := time.Now()
+	var total int64
+	for {
+		n, err := f.Read(buffer)
+		hash.Write(buffer[:n])
+		total += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		// sleep until the read rate drops below SCRUBRATE
+		expected := time.Duration(total * int64(time.Second) / SCRUBRATE)
+		if elapsed := time.Since(start); elapsed < expected {
+			time.Sleep(expected - elapsed)
+		}
+	}
+
+	scrubLock.Lock()
+	scrubBytes += total
+	scrubLock.Unlock()
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+
+// func reportCorruptReplica(sdfsFileName string, found string)
+// ------------------------------------------------------------------
+// Description: This function reports a corrupted replica on this node
+//				to the master node
+// Input:   sdfsFileName string: the name of the corrupted replica
+//			found string: the checksum of the corrupted replica
+// Output:  None
+func reportCorruptReplica(sdfsFileName string, found string) {
+	if isMaster {
+		checkCorruptReplica(sdfsFileName, found, strconv.Itoa(selfID))
+		return
+	}
+
+	sentMap := make(map[string]string)
+	sentMap[SDFSNAME] = sdfsFileName
+	sentMap[CHECKSUM] = found
+	msgContent, _ := json.Marshal(sentMap)
+	msgSent := MakeMessage(SCRUBREPORT, string(msgContent), strconv.Itoa(selfID))
+	sendRequest(masterID, msgSent)
+}
+
+
+// func checkCorruptReplica(sdfsFileName string, found string, nodeID string)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node when a node
+//				reports a mismatching replica. The copy is only removed and
+//				repaired if the current checksum of the master node also
+//				disagrees, the replica list of the node may lag behind
+// Input:   sdfsFileName string: the name of the reported replica
+//			found string: the checksum of the reported replica
+//			nodeID string: the node id of the node with the reported replica
+// Output:  None
+func checkCorruptReplica(sdfsFileName string, found string, nodeID string) {
+	fileLock.RLock()
+	current := replicateList[sdfsFileName][CHECKSUM]
+	fileLock.RUnlock()
+	if current == "" || current == found {
+		logMsg := fmt.Sprintf("Replica of SDFS file %v on node %v matches the current checksum\n", sdfsFileName, nodeID)
+		WriteLog(logFile, logMsg, false)
+		return
+	}
+
+	id, _ := strconv.Atoi(nodeID)
+	if id == selfID {
+		removeScrubbedReplica(sdfsFileName)
+	} else {
+		sentMap := make(map[string]string)
+		sentMap[SDFSNAME] = sdfsFileName
+		msgContent, _ := json.Marshal(sentMap)
+		msgSent := MakeMessage(SCRUBREMOVE, string(msgContent), strconv.Itoa(selfID))
+		sendRequest(id, msgSent)
+	}
+	repairCorruptReplica(sdfsFileName, nodeID)
+}
+
+
+// func repairCorruptReplica(sdfsFileName string, nodeID string)
+// ------------------------------------------------------------------
+// Description: This function is called by the master node when a node
+//				reports a corrupted replica. The file is copied to the node
+//				again from any other replica
+// Input:   sdfsFileName string: the name of the corrupted replica
+//			nodeID string: the node id of the node with the corrupted replica
+// Output:  None
+func repairCorruptReplica(sdfsFileName string, nodeID string) {
+	// the node may hold a copy it is no longer responsible for
+	if !isReplicaNode(sdfsFileName, nodeID) {
+		return
+	}
+
+	id, _ := strconv.Atoi(nodeID)
+	domain := memberHost[id]
+	if id == selfID {
+		domain = localHost
+	}
+	logMsg := fmt.Sprintf("Replica of SDFS file %v on node %v is corrupted. Re-replicating...\n", sdfsFileName, domain)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+
+	// a shard has no other replica, it is rebuilt from the other shards
+	if isShardName(sdfsFileName) {
+		rebuildShard(sdfsFileName, nodeID)
+		return
+	}
+	get(sdfsFileName, sdfsFileName, nodeID, SDFSNAME, false, nodeID)
+}
+
+
+// func printScrubStatus()
+// ------------------------------------------------------------------
+// Description: This function prints the progress and findings of the
+//				scrubber on this node
+// Input:   None
+// Output:  None
+func printScrubStatus() {
+	scrubLock.Lock()
+	defer scrubLock.Unlock()
+
+	fmt.Printf("\n%c[%d;%d;%dm%s----->>>>>Scrubber Status<<<<<-----%c[0m \n", 0x1B, 37, 46, 1, "", 0x1B)
+	if scrubPass == 0 {
+		fmt.Printf("-->> First pass starts in at most %v\n", SCRUBTIME)
+	} else if scrubCurrent != "" {
+		fmt.Printf("-->> Pass %d: %d/%d files scanned, %d bytes read, verifying %v\n", scrubPass, scrubScanned, scrubTotal, scrubBytes, scrubCurrent)
+	} else {
+		fmt.Printf("-->> Pass %d finished at %v: %d files scanned, %d bytes read\n", scrubPass, scrubLastPass.Format("2006-01-02T15:04:05.000Z"), scrubScanned, scrubBytes)
+	}
+	fmt.Printf("-->> Corrupted replicas found: %d, the last %d:\n", scrubCorrupted, len(scrubFindings))
+	for _, finding := range scrubFindings {
+		fmt.Printf("->-> %v at %v: expect %v, got %v\n", finding.sdfsFileName, finding.time.Format("2006-01-02T15:04:05.000Z"), finding.expected, finding.found)
+	}
+	fmt.Printf("%c[%d;%d;%dm%s----->>>>>  End Scrubber  <<<<<-----%c[0m \n", 0x1B, 37, 46, 1, "", 0x1B)
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"sort"
+	"path/filepath"
 	"strconv"
 	"time"
 )
@@ -24,9 +25,16 @@ func localCopy(src string, dest string) {
 		return
 	}
 
+	err = makeParentDir(dest)
+	if err != nil {
+		ErrorHandler("Error in creating directory: ", err, false)
+		_ = in.Close()
+		return
+	}
 	out, err := os.Create(dest)
 	if err != nil {
 		ErrorHandler("Error in creating new file: ", err, false)
+		_ = in.Close()
 		return
 	}
 
@@ -44,6 +52,190 @@ func localCopy(src string, dest string) {
 }
 
 
+// func fileChecksum(path string) (string, int64, error)
+// ------------------------------------------------------------------
+// Description: A helper function that computes the checksum of a file
+// Input:   path string: path to the file
+// Output:  the hex encoded sha256 of the file, the size of the file
+//			and the error if the file can't be read
+func fileChecksum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), n, nil
+}
+
+
+// func verifyChecksum(path string, sdfsFileName string) bool
+// ------------------------------------------------------------------
+// Description: A helper function that checks a copy of a sdfs file
+//				against the checksum recorded in the replica list
+// Input:   path string: path to the copy of the sdfs file
+//			sdfsFileName string: the name of the sdfs file
+// Output:  true if the checksum matches or no checksum is recorded
+func verifyChecksum(path string, sdfsFileName string) bool {
+	fileLock.RLock()
+	expected := replicateList[sdfsFileName][CHECKSUM]
+	fileLock.RUnlock()
+	if expected == "" {
+		return true
+	}
+
+	checksum, _, err := fileChecksum(path)
+	if err != nil {
+		ErrorHandler("Can't compute checksum of " + path, err, false)
+		return false
+	}
+	return checksum == expected
+}
+
+
+// func refetchFile(fileName string, fileType string, senderID int)
+// ------------------------------------------------------------------
+// Description: This function is called when a received file is corrupted
+//				or truncated. It asks the master node to send the file
+//				again from a replica other than the sender
+// Input:   fileName string: the name the file is stored as
+//			fileType string: "local/" or "sdfs/", where the file is stored
+//			senderID int: the node id of the node that sent the bad copy
+// Output:  None
+func refetchFile(fileName string, fileType string, senderID int) {
+	// a staged copy is never refetched, the put fails without its ack
+	if stagingPutID(fileName) != "" {
+		return
+	}
+
+	sdfsFileName := fileName
+	receiverType := SDFSNAME
+	if fileType == LOCALFILEPATH {
+		pendingLock.Lock()
+		pending, ok := pendingGets[fileName]
+		pendingLock.Unlock()
+		// the node that waits for the file will fetch it again
+		if !ok {
+			return
+		}
+		sdfsFileName = pending.sdfsFileName
+		receiverType = LOCALNAME
+	}
+
+	logMsg := fmt.Sprintf("Fetching SDFS file %v again from a replica other than node %v\n", sdfsFileName, senderID)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+
+	if isMaster {
+		get(fileName, sdfsFileName, strconv.Itoa(selfID), receiverType, false, strconv.Itoa(senderID))
+		return
+	}
+
+	sentMap := make(map[string]string)
+	sentMap[LOCALNAME] = fileName
+	sentMap[SDFSNAME] = sdfsFileName
+	sentMap[RECEIVERTYPE] = receiverType
+	sentMap[RECEIVERID] = strconv.Itoa(selfID)
+	sentMap[LOCALEXIST] = FALSE
+	sentMap[EXCLUDEID] = strconv.Itoa(senderID)
+	msgContent, _ := json.Marshal(sentMap)
+	msgSent := MakeMessage(READREQ, string(msgContent), strconv.Itoa(selfID))
+
+	sendRequest(masterID, msgSent)
+}
+
+
+// func addPendingGet(localFileName string, sdfsFileName string)
+// ------------------------------------------------------------------
+// Description: A helper function that remembers which sdfs file a local
+//				file is fetched from, so that a bad copy can be fetched
+//				again. The entry is removed after GETTIMEOUT
+// Input:   localFileName string: the local file name
+//			sdfsFileName string: the name of the sdfs file
+// Output:  None
+func addPendingGet(localFileName string, sdfsFileName string) {
+	started := time.Now()
+	pendingLock.Lock()
+	pendingGets[localFileName] = pendingGet{sdfsFileName, started}
+	pendingLock.Unlock()
+
+	time.AfterFunc(GETTIMEOUT, func() {
+		pendingLock.Lock()
+		defer pendingLock.Unlock()
+		if pending, ok := pendingGets[localFileName]; ok && pending.started == started {
+			delete(pendingGets, localFileName)
+		}
+	})
+}
+
+
+// func removePendingGet(localFileName string)
+// ------------------------------------------------------------------
+// Description: A helper function that forgets a get that ended
+// Input:   localFileName string: the local file name
+// Output:  None
+func removePendingGet(localFileName string) {
+	pendingLock.Lock()
+	delete(pendingGets, localFileName)
+	pendingLock.Unlock()
+}
+
+
+// func failPendingGets(sdfsFileName string)
+// ------------------------------------------------------------------
+// Description: A helper function that forgets the gets of a sdfs file
+//				that no replica can send
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  None
+func failPendingGets(sdfsFileName string) {
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	for localFileName, pending := range pendingGets {
+		if pending.sdfsFileName == sdfsFileName || resolveVersionName(pending.sdfsFileName) == sdfsFileName {
+			delete(pendingGets, localFileName)
+		}
+	}
+}
+
+
+// func isReplicaNode(sdfsFileName string, nodeID string) bool
+// ------------------------------------------------------------------
+// Description: A helper function that checks whether a node is one of
+//				the replicas of a sdfs file in the replica list
+// Input:   sdfsFileName string: the name of the sdfs file
+//			nodeID string: the node id to look for
+// Output:  true if the node stores a replica of the file
+func isReplicaNode(sdfsFileName string, nodeID string) bool {
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+	for _, key := range fileSlots(replicateList[sdfsFileName]) {
+		if replicateList[sdfsFileName][key] == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+
+// func sdfsFileSize(sdfsFileName string) int64
+// ------------------------------------------------------------------
+// Description: A helper function that gets the size of a sdfs file from
+//				the replica list
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  the size of the file in bytes, 0 if it is unknown
+func sdfsFileSize(sdfsFileName string) int64 {
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+	fileSize, _ := strconv.ParseInt(replicateList[sdfsFileName][SDFSSIZE], 10, 64)
+	return fileSize
+}
+
+
 // func printSDFSFile(sdfsFileName string)
 // ------------------------------------------------------------------
 // Description: This function prints the replica list
@@ -57,8 +249,16 @@ func printSDFSFile(sdfsFileName string) {
 	}
 
 	fmt.Printf("\n%c[%d;%d;%dm%s>>>>>>SDFS File %v Location<<<<<%c[0m \n", 0x1B, 37, 46, 1, "",sdfsFileName, 0x1B)
-	for key, nodeIDStr := range replicateList[sdfsFileName] {
-		if key != LASTUPDATE && replicateList[sdfsFileName][key] != "" {
+	fmt.Printf("%c[%d;%d;%dm%s--->>Version: %v, size: %v bytes, replication factor: %v, checksum: %v%c[0m\n",0x1B, 32, 40, 1, "", replicateList[sdfsFileName][FILEVERSION], replicateList[sdfsFileName][SDFSSIZE], replicaFactor(replicateList[sdfsFileName]), replicateList[sdfsFileName][CHECKSUM], 0x1B)
+	for i, blockName := range fileBlocks(sdfsFileName) {
+		fmt.Printf("%c[%d;%d;%dm%s--->>Block %d is stored as SDFS file: %v%c[0m\n",0x1B, 32, 40, 1, "", i, blockName, 0x1B)
+	}
+	for i, shard := range fileShards(sdfsFileName) {
+		fmt.Printf("%c[%d;%d;%dm%s--->>Shard %d of %v is stored as SDFS file: %v%c[0m\n",0x1B, 32, 40, 1, "", i, replicateList[sdfsFileName][ECSCHEME], shard, 0x1B)
+	}
+	for _, key := range fileSlots(replicateList[sdfsFileName]) {
+		nodeIDStr := replicateList[sdfsFileName][key]
+		if nodeIDStr != "" {
 			nodeID, err := strconv.Atoi(nodeIDStr)
 			ErrorHandler("Can't get sdfs replica node id: ", err, false)
 			domain := memberHost[nodeID]
@@ -72,6 +272,64 @@ func printSDFSFile(sdfsFileName string) {
 }
 
 
+// func makeParentDir(path string) error
+// ------------------------------------------------------------------
+// Description: A helper function that creates the directories above a
+//				path, sdfs names with "/" are stored in subdirectories
+// Input:   path string: the path of the file to be created
+// Output:  the error if a directory can't be created
+func makeParentDir(path string) error {
+	return os.MkdirAll(filepath.Dir(path), os.ModePerm)
+}
+
+
+// func sdfsDirFiles() []string
+// ------------------------------------------------------------------
+// Description: A helper function that lists the files in the sdfs
+//				directory and its subdirectories
+// Input:   None
+// Output:  the file names relative to SDFSFILEPATH, in lexical order
+func sdfsDirFiles() []string {
+	fileNames := make([]string, 0)
+	root := filepath.Clean(SDFSFILEPATH)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		fileName, err := filepath.Rel(root, path)
+		if err == nil {
+			fileNames = append(fileNames, filepath.ToSlash(fileName))
+		}
+		return nil
+	})
+	ErrorHandler("Can't get files in sdfs directory: ", err, false)
+	return fileNames
+}
+
+
+// func pruneSDFSDirs()
+// ------------------------------------------------------------------
+// Description: A helper function that removes the empty subdirectories
+//				of the sdfs directory
+// Input:   None
+// Output:  None
+func pruneSDFSDirs() {
+	dirs := make([]string, 0)
+	root := filepath.Clean(SDFSFILEPATH)
+	_ = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	// children come after their parents, a directory that is not empty
+	// is kept
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Remove(dirs[i])
+	}
+}
+
+
 // func printLocalFile()
 // ------------------------------------------------------------------
 // Description: This function prints all the files that are stored on this node
@@ -79,80 +337,69 @@ func printSDFSFile(sdfsFileName string) {
 // Output: None
 func printLocalFile() {
 	fmt.Printf("\n%c[%d;%d;%dm%s----->>>>>Current Replica List<<<<<-----%c[0m \n", 0x1B, 37, 46, 1, "", 0x1B)
-	sdfsFiles, err := ioutil.ReadDir(SDFSFILEPATH)
-	ErrorHandler("Can't get files in sdfs directory: ", err, false)
-	for _, file := range sdfsFiles {
-		fileInfo, _ := os.Stat(SDFSFILEPATH + file.Name())
-		if fileInfo.IsDir() {
-			fmt.Printf("%c[%d;%d;%dm%s-->>(SDFS Files) %v %c[0m\n", 0x1B, 32, 4, 1, "", file.Name() + "/", 0x1B)
-		} else {
-			fmt.Printf("%c[%d;%d;%dm%s-->>(SDFS Files) %v %c[0m\n", 0x1B, 32, 4, 1, "", file.Name(), 0x1B)
-		}
+	for _, fileName := range sdfsDirFiles() {
+		fmt.Printf("%c[%d;%d;%dm%s-->>(SDFS Files) %v %c[0m\n", 0x1B, 32, 4, 1, "", fileName, 0x1B)
 	}
 	fmt.Printf("%c[%d;%d;%dm%s----->>>>>  End Replica List  <<<<<-----%c[0m \n", 0x1B, 37, 46, 1, "", 0x1B)
 }
 
 
-// func setReplicaID(senderStr string, recPointer *map[string]string)
+// func setReplicaID(senderStr string, recPointer *map[string]string, factor int, quorum int, fileSize int64) error
 // ------------------------------------------------------------------
 // Description: A helper function that helps to decide where will the
-//				replicas being stored
+//				replicas being stored. The writer stores the first replica
+//				if the file fits on it and the placement policy picks the
+//				nodes of the others
 // Input:   senderStr string: the id of the node which has the local file
 // 			recPointer *map[string]string: the map to be filled in with replica node id
-// Output:  None
-func setReplicaID(senderStr string, recPointer *map[string]string) {
-	type KV struct {
-		Key 	string
-		Value 	int
-	}
+//			factor int: the number of replicas to pick
+//			quorum int: the number of replicas that must have room
+//			fileSize int64: the size of the file
+// Output:  the error if fewer than quorum nodes have room for the file,
+//			then no replica is picked
+func setReplicaID(senderStr string, recPointer *map[string]string, factor int, quorum int, fileSize int64) error {
+	slots := replicaSlots(factor)
 
-	// number of machine that is online
-	numOnline := len(replicateCounter)
-
-	keyArr := make([]KV, 0, numOnline)
-	for key, val := range replicateCounter {
-		keyArr = append(keyArr, KV{key, val})
-	}
-	sort.Slice(keyArr, func(i, j int) bool {
-		return keyArr[i].Value < keyArr[j].Value
-	})
-
-	replicaNode := make([]string, 0, numOnline - 1)
-	for _, kv := range keyArr {
-		if kv.Key == senderStr {
-			continue
-		}
-		replicaNode = append(replicaNode, kv.Key)
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	existing := []string{senderStr}
+	if _, ok := replicateCounter[senderStr]; ok && reserveSpace(senderStr, fileSize) {
+		(*recPointer)[slots[0]] = senderStr
+		replicateCounter[senderStr]++
+		slots = slots[1:]
 	}
 
-	(*recPointer)[REPLICAONE] = senderStr
-	replicateCounter[senderStr]++
-
-	// get id of the three successors
-	if numOnline >= 2 {
-		(*recPointer)[REPLICATWO] = replicaNode[0]
-		replicateCounter[replicaNode[0]]++
-	}
-	if numOnline >= 3 {
-		(*recPointer)[REPLICATHREE] = replicaNode[1]
-		replicateCounter[replicaNode[1]]++
+	// the placement policy picks the nodes of the other replicas
+	replicaNode := placeReplicas(existing, len(slots), fileSize)
+	for i, nodeIDStr := range replicaNode {
+		(*recPointer)[slots[i]] = nodeIDStr
+		replicateCounter[nodeIDStr]++
 	}
-	if numOnline >= 4 {
-		(*recPointer)[REPLICAFOUR] = replicaNode[2]
-		replicateCounter[replicaNode[2]]++
+	picked := len(*recPointer)
+	if picked == 0 || picked < quorum {
+		for key, nodeIDStr := range *recPointer {
+			replicateCounter[nodeIDStr]--
+			releaseSpace(nodeIDStr, fileSize)
+			delete(*recPointer, key)
+		}
+		return fmt.Errorf("only %d live nodes have %d bytes free for the file, the write quorum is %d", picked, fileSize, quorum)
 	}
+	return nil
 }
 
 
-// func getFileID(sdfsFileName string) (string, string)
+// func getFileID(sdfsFileName string, requester string, localExist bool, excludeID string) string
 // ------------------------------------------------------------------
-// Description: A helper function that gets where the sdfs file is stored
+// Description: A helper function that picks the replica that sends a sdfs
+//				file to a reader, by locality and load
 // Input:   sdfsFileName string: the name of the sdfs file we want to get
-// Output:  The first value specifies the stored type, and it should either
-//			be a local file or a sdfs file. The second value specifies the
-//			node id where the replica is stored
-func getFileID(sdfsFileName string, requester string, localExist bool) string {
-	requesterID, _ := strconv.Atoi(requester)
+//			requester string: the node id of the reader
+//			localExist bool: whether a replica on the reader's node may be
+//							 picked
+//			excludeID string: the node id of a replica that must not be picked
+// Output:  the node id of the picked replica, FALSE if no live replica
+//			stores the file
+func getFileID(sdfsFileName string, requester string, localExist bool, excludeID string) string {
 	fileLock.RLock()
 	// check if file exists
 	if _, ok := replicateList[sdfsFileName]; !ok {
@@ -161,22 +408,20 @@ func getFileID(sdfsFileName string, requester string, localExist bool) string {
 		return FALSE
 	}
 
-	avaiNode := ""
-	// iterate through replicas
-	for _, key := range replicaMap {
-		if replicateList[sdfsFileName][key] != "" {
-			nodeID, _ := strconv.Atoi(avaiNode)
-			if nodeID == requesterID && localExist == true {
-				fileLock.RUnlock()
-				return strconv.Itoa(nodeID)
-			}
-			avaiNode = replicateList[sdfsFileName][key]
+	candidates := make([]string, 0)
+	for _, key := range fileSlots(replicateList[sdfsFileName]) {
+		nodeIDStr := replicateList[sdfsFileName][key]
+		if nodeIDStr == "" || nodeIDStr == excludeID {
+			continue
+		}
+		nodeID, _ := strconv.Atoi(nodeIDStr)
+		if _, ok := memberHost[nodeID]; ok || nodeID == selfID {
+			candidates = append(candidates, nodeIDStr)
 		}
 	}
-
 	fileLock.RUnlock()
-	if avaiNode != "" {
-		return avaiNode
+	if len(candidates) > 0 {
+		return pickReplica(candidates, requester, localExist)
 	}
 
 	fmt.Printf("ERROR! sdfs file %v doesn't exist\n", sdfsFileName)
@@ -188,8 +433,8 @@ func getFileID(sdfsFileName string, requester string, localExist bool) string {
 // ------------------------------------------------------------------
 // Description: This is the helper function of the updateReplicaList
 //				function. This function is called when any node leave or
-//				fail, and this function finds the new node that stores the
-//				additional replicas and send the file to the other nodes.
+//				fail, and this function empties the replica slot of the
+//				node and queues the file for repair.
 // Input:   sdfsFileName string: the name of the sdfs file that is originally
 //								 on the leave/fail node
 //			nodeID string: the node id of the leave/fail node
@@ -197,24 +442,14 @@ func getFileID(sdfsFileName string, requester string, localExist bool) string {
 func setReplaceID(sdfsFileName string, nodeID string) {
 	deleteKey := ""
 
-	// create a copy of memberHost map
-	memberHostCopy := make(map[int]string)
-	for key := range memberHost {
-		memberHostCopy[key] = ""
-	}
-	memberHostCopy[selfID] = ""
-
 	fileLock.Lock()
 	// traverse the map to find the fail/leave node
-	for key := range replicateList[sdfsFileName] {
-		if key != LASTUPDATE && replicateList[sdfsFileName][key] != "" {
+	for _, key := range fileSlots(replicateList[sdfsFileName]) {
+		if replicateList[sdfsFileName][key] != "" {
 			if nodeID == replicateList[sdfsFileName][key] {
 				replicateList[sdfsFileName][key] = ""
 				deleteKey = key
-				continue
 			}
-			currID, _ := strconv.Atoi(replicateList[sdfsFileName][key])
-			delete(memberHostCopy, currID)
 		}
 	}
 	fileLock.Unlock()
@@ -223,17 +458,10 @@ func setReplaceID(sdfsFileName string, nodeID string) {
 	if deleteKey == "" {
 		return
 	}
+	publishReplicaDelta(sdfsFileName)
 
-	// pick any node in the remaining members as the new node replica
-	for newKey := range memberHostCopy {
-		newKeyStr := strconv.Itoa(newKey)
-		get(sdfsFileName, sdfsFileName, newKeyStr, SDFSNAME, false)
-		replicateCounter[newKeyStr]++
-		fileLock.Lock()
-		replicateList[sdfsFileName][deleteKey] = newKeyStr
-		fileLock.Unlock()
-		return
-	}
+	// the repair queue copies the file, or rebuilds the shard, in order of risk
+	queueRepair(sdfsFileName)
 }
 
 
@@ -244,8 +472,16 @@ func setReplaceID(sdfsFileName string, nodeID string) {
 // Input:   nodeID string: the node id of the leave/fail node
 // Output:  None
 func updateReplicaList(nodeID string) {
-	// traverse each sdfs file in the replica list
+	// copy the names, setReplaceID takes the file lock for each write
+	fileLock.RLock()
+	sdfsFileNames := make([]string, 0, len(replicateList))
 	for sdfsFileName := range replicateList {
+		sdfsFileNames = append(sdfsFileNames, sdfsFileName)
+	}
+	fileLock.RUnlock()
+
+	// traverse each sdfs file in the replica list
+	for _, sdfsFileName := range sdfsFileNames {
 		setReplaceID(sdfsFileName, nodeID)
 	}
 }
@@ -253,84 +489,76 @@ func updateReplicaList(nodeID string) {
 
 // func sendReplica(nodeID string)
 // ------------------------------------------------------------------
-// Description: This function send additional replicas to the newly joined
-//				node when the original system does not store enough replicas
+// Description: This function queues every file that has fewer replicas
+//				than its replication factor for repair when a node joins,
+//				the repair queue copies the file, throttled by
+//				REPAIRLIMIT, and only fills the slot once the copy is
+//				stored
 // Input:   nodeID string: the node id of the newly joined node
 // Output:  None
 func sendReplica(nodeID string) {
-	// check if originally there were at least 4 members
-	if len(memberHost) > 3 {
-		return
-	}
-
-	// traverse the replica list
+	// traverse the replica list under the file lock, queueRepair takes it
+	// again, so the files are queued after it is released
+	fileLock.RLock()
+	missing := make([]string, 0)
 	for sdfsFileName, sdfsMap := range replicateList {
+		// a file stored as blocks or shards has no replicas of its own,
+		// and a lost shard is rebuilt rather than copied
+		if sdfsMap[BLOCKLIST] != "" || sdfsMap[SHARDLIST] != "" || isShardName(sdfsFileName) {
+			continue
+		}
 		// check for empty spot in replica list
-		for key := range sdfsMap {
-			if key != LASTUPDATE && sdfsMap[key] == "" {
-				logMsg := fmt.Sprintf("Sending SDFS File %v replica to the newly joined node\n", sdfsFileName)
-				fmt.Print(logMsg)
-				WriteLog(logFile, logMsg, false)
-
-				// replicate the current sdfs file to the new node
-				get(sdfsFileName, sdfsFileName, nodeID, SDFSNAME, false)
-				time.Sleep(time.Duration(5) * time.Millisecond)
-
-				replicateList[sdfsFileName][key] = nodeID
+		for _, key := range fileSlots(sdfsMap) {
+			if sdfsMap[key] == "" {
+				missing = append(missing, sdfsFileName)
 				break
 			}
 		}
-		replicateCounter[nodeID]++
+	}
+	fileLock.RUnlock()
+
+	for _, sdfsFileName := range missing {
+		logMsg := fmt.Sprintf("Queueing SDFS File %v for repair after node %v joined\n", sdfsFileName, nodeID)
+		WriteLog(logFile, logMsg, false)
+		queueRepair(sdfsFileName)
 	}
 }
 
 
-// func checkList()
+// func checkList(sdfsFileNames []string)
 // ------------------------------------------------------------------
 // Description: This helper function checks whether the list received
 //				from the master node is consistent with the files that
 //				are present in the current node. This function is invoked
-//				whenever we received a replica list message.
-// Input:   None
+//				whenever we received a replica list or a replica delta,
+//				and only the entries that were received are checked.
+// Input:   sdfsFileNames []string: the sdfs files to be checked
 // Output:  None
-func checkList() {
-	localSDFSFiles, err := ioutil.ReadDir(SDFSFILEPATH)
-	ErrorHandler("Can't get files in sdfs directory: ", err, false)
-
+func checkList(sdfsFileNames []string) {
 	selfIDStr := strconv.Itoa(selfID)
-	for sdfsFileName, sdfsMap := range replicateList {
-		for key, val := range sdfsMap {
-			// we only check if sdfs file replicas are consistent
-			if key != LASTUPDATE && val == selfIDStr {
-				exist := false
-				for _, file := range localSDFSFiles {
-					if file.Name() == sdfsFileName {
-						exist = true
-						break
-					}
-				}
-
-				// check if the sdfs replica exists on the current node
-				if exist == false {
-					logMsg := fmt.Sprintf("SDFS File %v does not exist on the current node. Inconsistency found. Getting copies...\n", sdfsFileName)
-					fmt.Print(logMsg)
-					WriteLog(logFile, logMsg, false)
-
-					// send artificial read request to master node
-					sentMap := make(map[string]string)
-					sentMap[LOCALNAME] = sdfsFileName
-					sentMap[SDFSNAME] = sdfsFileName
-					sentMap[RECEIVERTYPE] = SDFSNAME
-					sentMap[RECEIVERID] = strconv.Itoa(selfID)
-					sentMap[LOCALEXIST] = FALSE
-					msgContent, _ := json.Marshal(sentMap)
-					msgSent := MakeMessage(READREQ, string(msgContent), strconv.Itoa(selfID))
-
-					sendRequest(masterID, msgSent)
-					// prevent overwhelming send request
-					time.Sleep(time.Duration(5) * time.Millisecond)
-				}
-			}
+	for _, sdfsFileName := range sdfsFileNames {
+		// we only check if sdfs file replicas are consistent
+		// check if the sdfs replica exists on the current node
+		if !isReplicaNode(sdfsFileName, selfIDStr) || Exist(SDFSFILEPATH + sdfsFileName) {
+			continue
 		}
+
+		logMsg := fmt.Sprintf("SDFS File %v does not exist on the current node. Inconsistency found. Getting copies...\n", sdfsFileName)
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+
+		// send artificial read request to master node
+		sentMap := make(map[string]string)
+		sentMap[LOCALNAME] = sdfsFileName
+		sentMap[SDFSNAME] = sdfsFileName
+		sentMap[RECEIVERTYPE] = SDFSNAME
+		sentMap[RECEIVERID] = strconv.Itoa(selfID)
+		sentMap[LOCALEXIST] = FALSE
+		msgContent, _ := json.Marshal(sentMap)
+		msgSent := MakeMessage(READREQ, string(msgContent), strconv.Itoa(selfID))
+
+		sendRequest(masterID, msgSent)
+		// prevent overwhelming send request
+		time.Sleep(time.Duration(5) * time.Millisecond)
 	}
 }
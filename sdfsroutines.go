@@ -1,14 +1,13 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -22,8 +21,9 @@ import (
 ///////////////////////////////////////////////////
 
 
-// function that send file to other node
-func WriteToNode(senderName string, senderType string, receiverName string, receiverType string, receiveID int) {
+// function that send file to other node, checksum is the checksum the copy
+// must have, empty for the checksum in the replica list of this node
+func WriteToNode(senderName string, senderType string, receiverName string, receiverType string, receiveID int, checksum string) {
 	// check if we are simply duplicating file on the same node
 	var senderPath string
 	var receiverPath string
@@ -39,32 +39,48 @@ func WriteToNode(senderName string, senderType string, receiverName string, rece
 	}
 	if receiveID == selfID {
 		localCopy(senderPath + senderName, receiverPath + receiverName)
+		if receiverType == SDFSNAME || checksum != "" {
+			received, _, err := fileChecksum(receiverPath + receiverName)
+			if err == nil && checksum != "" && received != checksum {
+				logMsg := fmt.Sprintf("Checksum mismatch of local copy <%v>: expect %v, got %v\n", senderName, checksum, received)
+				fmt.Print(logMsg)
+				WriteLog(logFile, logMsg, false)
+				_ = os.Remove(receiverPath + receiverName)
+				refetchFile(receiverName, receiverPath, selfID)
+			} else if err == nil && receiverType == SDFSNAME {
+				recordStored(receiverName, received, 0)
+				storeReceived(receiverName, received)
+			}
+		}
 		return
 	} else {
-		FileTransferClient(memberAddr[receiveID], senderPath, senderName, receiverPath, receiverName)
+		FileTransferClient(memberAddr[receiveID], senderPath, senderName, receiverPath, receiverName, checksum)
 	}
 	fmt.Printf("Send file with <%v> name <%v> as <%v> name <%v> to node: %v\n", senderType, senderName, receiverType, receiverName, memberHost[receiveID])
 }
 
-// addNewFile(localFileName string, sdfsFileName string, localID string, recPointer *map[string]string)
+// addNewFile(sdfsFileName string, checksum string, fileSize int64, version int, factor int, recPointer *map[string]string)
 // ------------------------------------------------------------------
-// Description: This function adds a new entry in the replica list. The
-// 				location of the replicas are determined by the node ID
-// Input:   localFileName string: the name of the local file
-// 			sdfsFileName string: the name of the sdfs file
-// 			localID string: node id of which the local file is present
-// 			recPointer *map[string]string: the map to be filled with replica information
+// Description: This function adds a new entry in the replica list once
+// 				the replicas confirmed that they store the file
+// Input:   sdfsFileName string: the name of the sdfs file
+// 			checksum string: sha256 of the local file
+// 			fileSize int64: size of the local file
+// 			version int: version number of the new file
+// 			factor int: replication factor of the new file
+// 			recPointer *map[string]string: the replicas that store the file
 // Output:  None
-func addNewFile(sdfsFileName string, localID string, recPointer *map[string]string) {
+func addNewFile(sdfsFileName string, checksum string, fileSize int64, version int, factor int, recPointer *map[string]string) {
 	// this function should only be called by master node
 	newFile := make(map[string]string)
-	newFile[REPLICAONE] = localID
-	newFile[REPLICATWO] = ""
-	newFile[REPLICATHREE] = ""
-	newFile[REPLICAFOUR] = ""
+	for _, key := range replicaSlots(factor) {
+		newFile[key] = ""
+	}
+	newFile[REPLICAFACTOR] = strconv.Itoa(factor)
 	newFile[LASTUPDATE] = time.Now().Format("2006-01-02T15:04:05.000Z")
-
-	setReplicaID(localID, recPointer)
+	newFile[CHECKSUM] = checksum
+	newFile[SDFSSIZE] = strconv.FormatInt(fileSize, 10)
+	newFile[FILEVERSION] = strconv.Itoa(version)
 	var replicaArr []string
 
 	// change replica list on master node
@@ -81,53 +97,13 @@ func addNewFile(sdfsFileName string, localID string, recPointer *map[string]stri
 		replicateList[sdfsFileName][key] = idStr
 	}
 	fileLock.Unlock()
+	publishReplicaDelta(sdfsFileName)
 
 	logMsg := fmt.Sprintf("SDFS file %v is replicated at the following nodes: %v", sdfsFileName, replicaArr)
 	fmt.Println(logMsg)
 	WriteLog(logFile, logMsg, false)
 }
 
-// func getInput(sdfsFileName string) string
-// ------------------------------------------------------------------
-// Description: This function gets the input from user to determine
-//				whether to overwrite an existing file
-// Input:   sdfsFileName string: the file we are going to overwrite
-// Output:  the input string from user
-func getInput(sdfsFileName string) string {
-	input := make(chan string, 1)
-	quit := make(chan bool, 1)
-	go func(input chan string) {
-		reader := bufio.NewReader(os.Stdin)
-		for {
-			fmt.Printf("Last update of SDFS file %v is within one minute. Do you want to overwrite it? [y/n]\n", sdfsFileName)
-			cmd, err := reader.ReadString('\n')
-			ErrorHandler("Input error: ", err, false)
-			select {
-			case <- quit:
-				return
-			default:
-				if cmd == "y\n" || cmd == "n\n" {
-					input <- cmd
-					return
-				}
-				fmt.Println("Please enter y for yes and n for no")
-			}
-		}
-	}(input)
-
-	cmd := "n\n"
-	select {
-	case cmd = <-input:
-		break
-	case <-time.After(30 * time.Second):
-		fmt.Println("Response timed out. Press enter to continue.")
-		quit <- true
-		break
-	}
-
-	return strings.TrimSuffix(cmd, "\n")
-}
-
 // func handleLeave()
 // ------------------------------------------------------------------
 // Description: This function handles the leave instruction
@@ -164,9 +140,10 @@ func handleLeave(){
 
 // func PutWithPrefix(localDir string, sdfsPrefix string)
 // ------------------------------------------------------------------
-// Description: Put all files under a directory in local/ to sdfs system with a prefix added to every file
+// Description: Put all files under a directory in local/ into a sdfs directory,
+//				subdirectories are put as sdfs subdirectories
 // Input:   localDir string: a directory under local directory
-// 			sdfsPrefix string: the prefix that will be added to the files
+// 			sdfsPrefix string: the sdfs directory the files are put in
 // Output:  None
 func PutWithPrefix(localDir string, sdfsPrefix string, isDir bool) {
 
@@ -189,7 +166,7 @@ func PutWithPrefix(localDir string, sdfsPrefix string, isDir bool) {
 		for _, file := range files {
 			i += 1
 			fmt.Print(strconv.Itoa(i) + ": ")
-			handlePut(localDir + file.Name(), sdfsPrefix + file.Name(), false)
+			_ = handlePut(localDir + file.Name(), joinPath(cleanDir(sdfsPrefix), file.Name()), "", 0, 0, "")
 			time.Sleep(time.Millisecond)
 		}
 
@@ -202,87 +179,132 @@ func PutWithPrefix(localDir string, sdfsPrefix string, isDir bool) {
 
 // func DeleteWithPrefix(sdfsPrefix string)
 // ------------------------------------------------------------------
-// Description: Delete all files in SDFS with the given prefix
+// Description: Delete all files in a sdfs directory and its subdirectories
 // Input:   sdfsPrefix: string
 // Output:  None
 func DeleteWithPrefix(sdfsPrefix string) {
-	var deleteList []string
-	i := 0
-	for fileName := range replicateList {
-		if strings.HasPrefix(fileName, sdfsPrefix) {
-			deleteList = append(deleteList, fileName)
-		}
+	// the files are listed by the master node, older versions are deleted
+	// along with the file
+	// the root directory is never deleted as a whole
+	prefix := cleanDir(sdfsPrefix)
+	if prefix == "" {
+		fmt.Printf("Can't delete SDFS directory %q: the root directory can't be deleted\n", sdfsPrefix)
+		return
+	}
+	deleteList, err := queryListing(prefix + "/")
+	if err != nil {
+		fmt.Printf("Can't list SDFS directory %v: %v\n", sdfsPrefix, err.Error())
+		return
 	}
-	for _, fileName := range deleteList {
+	i := 0
+	for _, file := range deleteList {
 		i += 1
 		fmt.Print(strconv.Itoa(i) + ": ")
-		handleDelete(fileName)
+		handleDelete(file.Name)
 		time.Sleep(time.Millisecond)
 	}
 	fmt.Printf("%d files deleted from sdfs system!\n", i)
 }
 
-// func handlePut(localFileName string, sdfsFileName string)
+// func handlePut(localFileName string, sdfsFileName string, policy string, quorum int, factor int, scheme string) error
 // ------------------------------------------------------------------
-// Description: This function handles the put instruction
+// Description: This function handles the put instruction. It blocks until
+//				the write quorum confirmed the write or the put failed
 // Input:   localFileName string: local file name in the put instruction
 // 			sdfsFileName string: sdfs file name in the put instruction
-// Output:  None
-func handlePut(localFileName string, sdfsFileName string, overwrite bool) {
+//			policy string: conflict policy of the put, empty for the
+//						   policy of the sdfs prefix
+//			quorum int: write quorum of the put, 0 for the quorum of the
+//						sdfs prefix
+//			factor int: replication factor of the put, 0 for the factor
+//						of the sdfs prefix
+//			scheme string: erasure scheme of the put, empty for the scheme
+//						   of the sdfs prefix
+// Output:  nil if the put is committed
+func handlePut(localFileName string, sdfsFileName string, policy string, quorum int, factor int, scheme string) error {
+	// names with version separator are reserved for older versions
+	if isInternalName(sdfsFileName) {
+		logMsg := fmt.Sprintf("Can't execute put instruction. SDFS file name %v can't contain %v\n", sdfsFileName, VERSIONSEP)
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		return errors.New("invalid sdfs file name")
+	}
+
 	// check if local file exists
 	if _, err := os.Stat(LOCALFILEPATH + localFileName); os.IsNotExist(err) {
 		logMsg := fmt.Sprintf("Can't execute put instruction. Local file %v does not exist!\n", localFileName)
 		fmt.Print(logMsg)
 		WriteLog(logFile, logMsg, false)
-		return
+		return err
 	}
 
 	if isDir(LOCALFILEPATH + localFileName) {
 		PutWithPrefix(localFileName, sdfsFileName, true)
-		return
+		return nil
+	}
+
+	// checksum is computed once here and verified on every transfer
+	checksum, fileSize, err := fileChecksum(LOCALFILEPATH + localFileName)
+	if err != nil {
+		logMsg := fmt.Sprintf("Can't execute put instruction. Local file %v can't be read: %v\n", localFileName, err.Error())
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		return err
+	}
+
+	// erasure-coded files are put as shards, the master node rejects a put
+	// under a prefix with an erasure rule this node does not know yet
+	if scheme == "" {
+		scheme = getErasureScheme(sdfsFileName, "")
+	}
+	if scheme != "" {
+		return putShards(localFileName, sdfsFileName, policy, scheme, checksum, fileSize)
 	}
 
+	// large files are split into blocks that are put one by one
+	if fileSize > BLOCKSIZE {
+		return putBlocks(localFileName, sdfsFileName, policy, quorum, factor, checksum, fileSize)
+	}
+	return putFile(localFileName, sdfsFileName, policy, quorum, factor, "", checksum, fileSize)
+}
+
+
+// func putFile(localFileName string, sdfsFileName string, policy string, quorum int, factor int, group string, checksum string, fileSize int64) error
+// ------------------------------------------------------------------
+// Description: This function puts a single local file into SDFS. It blocks
+//				until the write quorum confirmed the write or the put failed
+// Input:   localFileName string: the local file to be put
+// 			sdfsFileName string: the sdfs file to be written
+//			policy string: conflict policy of the put
+//			quorum int: write quorum of the put
+//			factor int: replication factor of the put
+//			group string: the put id of the erasure-coded file whose shard
+//						  is put, empty for other puts
+//			checksum string: the checksum of the local file
+//			fileSize int64: the size of the local file
+// Output:  nil if the put is committed
+func putFile(localFileName string, sdfsFileName string, policy string, quorum int, factor int, group string, checksum string, fileSize int64) error {
 	logMsg := fmt.Sprintf("Distributing local file %v as SDFS file %v\n", localFileName, sdfsFileName)
 	fmt.Print(logMsg)
 	WriteLog(logFile, logMsg, false)
 
 	// check if current node is master
 	if isMaster {
-		// check if the file is already been replicated
-		fileLock.RLock()
-		_, ok := replicateList[sdfsFileName]
-		if ok {
-			receivedTime, err := time.Parse("2006-01-02T15:04:05.000Z", replicateList[sdfsFileName][LASTUPDATE])
-			fileLock.RUnlock()
-			ErrorHandler("Decoding last update time of replica list error: ", err, false)
-			currentTimeString := time.Now().Format("2006-01-02T15:04:05.000Z")
-			currentTime, _ := time.Parse("2006-01-02T15:04:05.000Z", currentTimeString)
-
-			// if last update is within one minute
-			if currentTime.Before(receivedTime.Add(time.Minute)) && !overwrite {
-				cmd := getInput(sdfsFileName)
-				if cmd == "n" {
-					// reject update and do nothing
-					return
-				}
-				// overwrite file
-				logMsg := fmt.Sprintf("Overwriting SDFS file: %v\n", sdfsFileName)
-				fmt.Print(logMsg)
-				WriteLog(logFile, logMsg, false)
+		pp, err := startPut(sdfsFileName, policy, quorum, factor, group, strconv.Itoa(selfID), checksum, fileSize, newRequestID())
+		if err == nil {
+			for _, idStr := range pp.replicas {
+				id, _ := strconv.Atoi(idStr)
+				go WriteToNode(localFileName, LOCALNAME, pp.stagingName, SDFSNAME, id, pp.checksum)
+			}
+			var version int
+			version, err = waitPut(pp)
+			if err == nil {
+				fmt.Printf("Put SDFS file %v committed as version %v\n", sdfsFileName, version)
+				return nil
 			}
-			deleteSDFS(sdfsFileName)
-		}
-		if !ok {
-			fileLock.RUnlock()
-		}
-		receiverMap := make(map[string]string)
-		addNewFile(sdfsFileName, strconv.Itoa(selfID), &receiverMap)
-
-		for _, idStr := range receiverMap {
-			id, _ := strconv.Atoi(idStr)
-			WriteToNode(localFileName, LOCALNAME, sdfsFileName, SDFSNAME, id)
 		}
-		return
+		fmt.Printf("Put SDFS file %v rejected: %v\n", sdfsFileName, err.Error())
+		return err
 	}
 
 	// send request to master node
@@ -290,35 +312,101 @@ func handlePut(localFileName string, sdfsFileName string, overwrite bool) {
 	fmt.Print(logMsg)
 	WriteLog(logFile, logMsg, false)
 
+	putID, _ := newWaiter(1)
 	sentMap := make(map[string]string)
 	sentMap[LOCALNAME] = localFileName
 	sentMap[SDFSNAME] = sdfsFileName
-	sentMap[OVERWRITE] = FALSE
+	sentMap[PUTPOLICY] = policy
+	sentMap[PUTQUORUM] = strconv.Itoa(quorum)
+	sentMap[REPLICAFACTOR] = strconv.Itoa(factor)
+	sentMap[PUTGROUP] = group
+	sentMap[PUTID] = putID
+	sentMap[CHECKSUM] = checksum
+	sentMap[SDFSSIZE] = strconv.FormatInt(fileSize, 10)
 
 	msgContent, _ := json.Marshal(sentMap)
 	msgSent := MakeMessage(WRITEREQ, string(msgContent), strconv.Itoa(selfID))
 
 	sendRequest(masterID, msgSent)
+
+	// the file is staged once the master node replies with a write message
+	err := waitPutResponse(putID)
+	if err != nil {
+		fmt.Printf("Put SDFS file %v rejected: %v\n", sdfsFileName, err.Error())
+	}
+	return err
 }
 
-// func handleGet(localFileName string, sdfsFileName string)
+// func handleGet(localFileName string, sdfsFileName string, localExist bool, level string, quorum int)
 // ------------------------------------------------------------------
 // Description: This function handles the get instruction
 // Input:   localFileName string: local file name in the get instruction
 // 			sdfsFileName string: sdfs file name in the get instruction
+//			level string: the consistency level, ONE, QUORUM or LATEST
+//			quorum int: the read quorum of QUORUM, 0 for a majority
 // Output:  None
-func handleGet(localFileName string, sdfsFileName string, localExist bool) {
+func handleGet(localFileName string, sdfsFileName string, localExist bool, level string, quorum int) {
 	logMsg := fmt.Sprintf("Getting SDFS file: %v\n", sdfsFileName)
 	// fmt.Print(logMsg)
 	WriteLog(logFile, logMsg, false)
+
+	// large files are read in chunks from all replicas at once
+	name := resolveVersionName(sdfsFileName)
+	if level != READQUORUM && sdfsFileSize(name) >= PARALLELSIZE && len(fileShards(name)) == 0 {
+		go func() {
+			err := parallelGet(localFileName, name, level)
+			if err != nil {
+				logMsg := fmt.Sprintf("Parallel get of SDFS file %v failed: %v, getting it from one replica\n", sdfsFileName, err.Error())
+				fmt.Print(logMsg)
+				WriteLog(logFile, logMsg, false)
+				fetchFile(localFileName, sdfsFileName, localExist, level, quorum)
+			}
+		}()
+		return
+	}
+	fetchFile(localFileName, sdfsFileName, localExist, level, quorum)
+}
+
+
+// func fetchFile(localFileName string, sdfsFileName string, localExist bool, level string, quorum int)
+// ------------------------------------------------------------------
+// Description: This function fetches a sdfs file from one replica, or its
+//				blocks or shards at the same time
+// Input:   localFileName string: local file name in the get instruction
+// 			sdfsFileName string: sdfs file name in the get instruction
+//			level string: the consistency level, ONE, QUORUM or LATEST
+//			quorum int: the read quorum of QUORUM, 0 for a majority
+// Output:  None
+func fetchFile(localFileName string, sdfsFileName string, localExist bool, level string, quorum int) {
+	// large files are fetched block by block and reassembled locally
+	if blocks := fileBlocks(resolveVersionName(sdfsFileName)); len(blocks) > 0 {
+		go getBlocks(localFileName, resolveVersionName(sdfsFileName), blocks, level, quorum)
+		return
+	}
+	if shards := fileShards(resolveVersionName(sdfsFileName)); len(shards) > 0 {
+		go getShards(localFileName, resolveVersionName(sdfsFileName), shards, level, quorum)
+		return
+	}
+
+	// remember which sdfs file is expected so a bad copy can be fetched again
+	addPendingGet(localFileName, sdfsFileName)
+
+	if level == READONE {
+		getFromOne(localFileName, sdfsFileName)
+		return
+	} else if level == READQUORUM {
+		getFromQuorum(localFileName, sdfsFileName, quorum)
+		return
+	}
+
 	// check if current node is master
 	if isMaster {
-		get(localFileName, sdfsFileName, strconv.Itoa(selfID), LOCALNAME, localExist)
+		get(localFileName, sdfsFileName, strconv.Itoa(selfID), LOCALNAME, localExist, "")
 		return
 	}
 
 	// send request to master node
-	logMsg = fmt.Sprintf("Sending get request to master node: %v\n", memberHost[masterID])
+	logMsg := fmt.Sprintf("Sending get request to master node: %v\n", memberHost[masterID])
 	fmt.Print(logMsg)
 	WriteLog(logFile, logMsg, false)
 
@@ -351,7 +439,7 @@ func handleDelete(sdfsFileName string) {
 	
 	// check if the current node is the master node
 	if isMaster {
-		if !deleteSDFS(sdfsFileName) {
+		if !deleteWithVersions(sdfsFileName) {
 			logMsg := fmt.Sprintf("SDFS file %v does not exists!\n", sdfsFileName)
 			fmt.Print(logMsg)
 			WriteLog(logFile, logMsg, false)
@@ -364,7 +452,7 @@ func handleDelete(sdfsFileName string) {
 	sendRequest(masterID, msgSent)
 }
 
-// func get(localFileName string, sdfsFileName string, requester string)
+// func get(localFileName string, sdfsFileName string, requester string, receiverType string, localExist bool, excludeID string)
 // ------------------------------------------------------------------
 // Description: The main function that handles the get operation. This
 //				function find the replica location of the given file and
@@ -372,12 +460,14 @@ func handleDelete(sdfsFileName string) {
 // Input:   localFileName string: local file name in the get instruction
 // 			sdfsFileName string: sdfs file name in the get instruction
 //			requester string: the node id of the node that requests the file
+//			excludeID string: the node id of a replica that must not send the file
 // Output:  None
-func get(localFileName string, sdfsFileName string, requester string, receiverType string, localExist bool) {
+func get(localFileName string, sdfsFileName string, requester string, receiverType string, localExist bool, excludeID string) {
 	// this function should only be called by master node
 	var msgSent string
 	var senderID int
-	sender := getFileID(sdfsFileName, requester, localExist)
+	sdfsFileName = resolveVersionName(sdfsFileName)
+	sender := getFileID(sdfsFileName, requester, localExist, excludeID)
 
 	// if we can't find the file
 	if sender == FALSE {
@@ -387,6 +477,7 @@ func get(localFileName string, sdfsFileName string, requester string, receiverTy
 			logMsg := fmt.Sprintf("SDFS File: %v doesn't exists\n", sdfsFileName)
 			fmt.Print(logMsg)
 			WriteLog(logFile, logMsg, false)
+			failPendingGets(sdfsFileName)
 			return
 		}
 		msgSent = MakeMessage(ERRORREAD, sdfsFileName, strconv.Itoa(selfID))
@@ -397,9 +488,13 @@ func get(localFileName string, sdfsFileName string, requester string, receiverTy
 		requesterID, _ := strconv.Atoi(requester)
 		senderName := sdfsFileName
 		senderType := SDFSNAME
+		// only the committed version is accepted by the requester
+		fileLock.RLock()
+		checksum := replicateList[sdfsFileName][CHECKSUM]
+		fileLock.RUnlock()
 		// check if the master has the file to be sent
 		if senderID == selfID {
-			WriteToNode(senderName, senderType, localFileName, receiverType, requesterID)
+			WriteToNode(senderName, senderType, localFileName, receiverType, requesterID, checksum)
 			return
 		}
 		receiverMap := make(map[string]string)
@@ -408,6 +503,7 @@ func get(localFileName string, sdfsFileName string, requester string, receiverTy
 		receiverMap[SENDERTYPE] = senderType
 		receiverMap[RECEIVERTYPE] = receiverType
 		receiverMap[REPLICAONE] = requester
+		receiverMap[CHECKSUM] = checksum
 
 		// send write instruction to the sender
 		msgContent, _ := json.Marshal(receiverMap)
@@ -417,6 +513,74 @@ func get(localFileName string, sdfsFileName string, requester string, receiverTy
 	sendRequest(senderID, msgSent)
 }
 
+// func renameSDFS(oldName string, newName string) bool
+// ------------------------------------------------------------------
+// Description: This function renames an entry in the replica list and
+//				the replica files on every node that stores the file.
+//				This function should only be called by the master node
+// Input:   oldName string: the current name of the sdfs file
+//			newName string: the new name of the sdfs file
+// Output:  true if the sdfs file exists
+func renameSDFS(oldName string, newName string) bool {
+	fileLock.RLock()
+	sdfsMap, ok := replicateList[oldName]
+	slots := fileSlots(sdfsMap)
+	replicaArr := make([]int, 0, len(slots))
+	for _, key := range slots {
+		if ok && sdfsMap[key] != "" {
+			replicaID, _ := strconv.Atoi(sdfsMap[key])
+			replicaArr = append(replicaArr, replicaID)
+		}
+	}
+	fileLock.RUnlock()
+	if !ok {
+		return false
+	}
+
+	// rename replica files before other nodes learn the new name
+	renameMap := make(map[string]string)
+	renameMap[SENDERNAME] = oldName
+	renameMap[RECEIVERNAME] = newName
+	msgContent, _ := json.Marshal(renameMap)
+	msgSent := MakeMessage(RENAME, string(msgContent), strconv.Itoa(selfID))
+	for _, replicaID := range replicaArr {
+		if replicaID == selfID {
+			renameLocalReplica(oldName, newName)
+			continue
+		}
+		sendTCPRequest(replicaID, msgSent)
+	}
+
+	fileLock.Lock()
+	delete(replicateList, oldName)
+	replicateList[newName] = sdfsMap
+	fileLock.Unlock()
+	publishReplicaDelta(oldName, newName)
+
+	logMsg := fmt.Sprintf("SDFS file %v renamed to %v\n", oldName, newName)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+	return true
+}
+
+// func renameLocalReplica(oldName string, newName string)
+// ------------------------------------------------------------------
+// Description: This function renames a replica in the sdfs directory
+// Input:   oldName string: the current name of the replica
+//			newName string: the new name of the replica
+// Output:  None
+func renameLocalReplica(oldName string, newName string) {
+	err := makeParentDir(SDFSFILEPATH + newName)
+	if err == nil {
+		err = os.Rename(SDFSFILEPATH + oldName, SDFSFILEPATH + newName)
+	}
+	errMsg := fmt.Sprintf("Can't rename sdfs file %v to %v", oldName, newName)
+	ErrorHandler(errMsg, err, false)
+	if err == nil {
+		moveStored(oldName, newName)
+	}
+}
+
 // func deleteSDFS(sdfsFileName string)
 // ------------------------------------------------------------------
 // Description: The main function that handles the delete operation. This
@@ -432,9 +596,14 @@ func deleteSDFS(sdfsFileName string) bool {
 		fileLock.RUnlock()
 		return false
 	}
+	slots := fileSlots(replicateList[sdfsFileName])
 	fileLock.RUnlock()
+	// the blocks or shards of a file are deleted along with it
+	for _, partName := range fileParts(sdfsFileName) {
+		deleteSDFS(partName)
+	}
 	// this function should only be called by master
-	for _, key := range replicaMap {
+	for _, key := range slots {
 		ok := true
 		fileLock.RLock()
 		if replicateList[sdfsFileName][key] != "" {
@@ -467,6 +636,7 @@ func deleteSDFS(sdfsFileName string) bool {
 	fileLock.Lock()
 	delete(replicateList, sdfsFileName)
 	fileLock.Unlock()
+	publishReplicaDelta(sdfsFileName)
 
 	logMsg := fmt.Sprintf("Delete request of SDFS file %v handled\n", sdfsFileName)
 	fmt.Print(logMsg)
@@ -474,36 +644,3 @@ func deleteSDFS(sdfsFileName string) bool {
 
 	return true
 }
-
-// func HeartBeating()
-// ------------------------------------------------------------------
-// Description: This routine is only executed by the master node which
-//				send the updated replica list periodically
-// Input:   None
-// Output:  None
-func sendReplicaList() {
-	for {
-		// wait until it becomes the master node
-		time.Sleep(UPDATETIME)
-
-		if isMaster {
-			// master node send replicate list to all nodes periodically
-			fileLock.RLock()
-			replicaList, _ := json.Marshal(replicateList)
-			replicaCounter, _ := json.Marshal(replicateCounter)
-			fileLock.RUnlock()
-			sendMap := make(map[string]string)
-			sendMap[SDFSLIST] = string(replicaList)
-			sendMap[SDFSCOUNT] = string(replicaCounter)
-			msgContent, _ := json.Marshal(sendMap)
-			msgSent := MakeMessage(REPLICALIST, string(msgContent), strconv.Itoa(selfID))
-
-			for nodeID := range memberHost {
-				sendTCPRequest(nodeID, msgSent)
-				time.Sleep(time.Duration(5) * time.Millisecond)
-			}
-		}
-	}
-}
-
-
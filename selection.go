@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// This portion of code implements the choice of the replica that sends a
+// file to a reader. The master node, or the reader itself for gets with
+// level ONE, range reads and parallel gets, picks among the live replicas:
+// 		1. the node of the reader itself, if it stores the file
+//		2. a node in the zone of the reader
+//		3. the node with the fewest outstanding transfers
+// Every node counts the files and ranges it is sending and reports the
+// count to all nodes with its NODEREPORT message. A transfer a node
+// assigns is added to the count of the replica until the replica reports
+// again, so that reads in between are spread over the replicas.
+
+// the files and ranges this node is sending, changed with atomic
+var activeTransfers int64
+
+
+// func startTransfer()
+// ------------------------------------------------------------------
+// Description: A helper function that counts a transfer this node starts
+// Input:   None
+// Output:  None
+func startTransfer() {
+	atomic.AddInt64(&activeTransfers, 1)
+}
+
+
+// func endTransfer()
+// ------------------------------------------------------------------
+// Description: A helper function that counts a transfer this node ended
+// Input:   None
+// Output:  None
+func endTransfer() {
+	atomic.AddInt64(&activeTransfers, -1)
+}
+
+
+// func pickReplica(candidates []string, requester string, localExist bool) string
+// ------------------------------------------------------------------
+// Description: This function is called by the master node to pick the
+//				replica that sends a file to a reader, and counts the
+//				transfer on it
+// Input:   candidates []string: the node ids of the live replicas
+//			requester string: the node id of the reader
+//			localExist bool: whether a replica on the reader's node may be
+//							 picked
+// Output:  the node id of the picked replica
+func pickReplica(candidates []string, requester string, localExist bool) string {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	picked := ""
+	for _, nodeID := range candidates {
+		if nodeID == requester && localExist {
+			picked = nodeID
+		}
+	}
+
+	if picked == "" {
+		zone := nodeReports[requester].zone
+		sort.Slice(candidates, func(i, j int) bool {
+			a, b := nodeReports[candidates[i]], nodeReports[candidates[j]]
+			aLocal := zone != "" && a.zone == zone
+			bLocal := zone != "" && b.zone == zone
+			if aLocal != bLocal {
+				return aLocal
+			}
+			if a.transfers != b.transfers {
+				return a.transfers < b.transfers
+			}
+			return candidates[i] < candidates[j]
+		})
+		picked = candidates[0]
+	}
+
+	if report, ok := nodeReports[picked]; ok {
+		report.transfers++
+		nodeReports[picked] = report
+	}
+	return picked
+}
+
+
+// func pickLocalRead(nodes []int, localExist bool) int
+// ------------------------------------------------------------------
+// Description: A helper function that picks the replica this node reads
+//				from itself
+// Input:   nodes []int: the node ids of the live replicas
+//			localExist bool: whether the replica on this node may be picked
+// Output:  the node id of the picked replica
+func pickLocalRead(nodes []int, localExist bool) int {
+	candidates := make([]string, 0, len(nodes))
+	for _, nodeID := range nodes {
+		candidates = append(candidates, strconv.Itoa(nodeID))
+	}
+	picked, _ := strconv.Atoi(pickReplica(candidates, strconv.Itoa(selfID), localExist))
+	return picked
+}
+
+
+// func transferCount() string
+// ------------------------------------------------------------------
+// Description: A helper function that gives the number of transfers this
+//				node is sending for its node report
+// Input:   None
+// Output:  the number of transfers
+func transferCount() string {
+	return strconv.FormatInt(atomic.LoadInt64(&activeTransfers), 10)
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -56,16 +58,150 @@ func getCommand() {
 				fmt.Println("Please enter as: query <pattern> <flag>")
 			}
 		} else if split[0] == "put" {
-			if len(split) == 3 {
+			// optional arguments are the conflict policy, w=<write quorum>,
+			// n=<replication factor> and ec=<k>+<m>
+			policy := ""
+			quorum := 0
+			factor := 0
+			scheme := ""
+			valid := len(split) >= 3 && len(split) <= 7
+			for i := 3; valid && i < len(split); i++ {
+				if strings.HasPrefix(split[i], "w=") {
+					var err error
+					quorum, err = strconv.Atoi(strings.TrimPrefix(split[i], "w="))
+					valid = err == nil && quorum > 0
+				} else if strings.HasPrefix(split[i], "n=") {
+					var err error
+					factor, err = strconv.Atoi(strings.TrimPrefix(split[i], "n="))
+					valid = err == nil && factor > 0
+				} else if strings.HasPrefix(split[i], "ec=") {
+					scheme = strings.TrimPrefix(split[i], "ec=")
+					_, _, err := parseScheme(scheme)
+					valid = err == nil
+				} else {
+					policy = split[i]
+					_, _, err := parseConflictPolicy(policy)
+					valid = err == nil
+				}
+			}
+			if valid {
 				localFileName := split[1]
 				sdfsFileName := split[2]
 
-				logMsg := fmt.Sprintf("Executing put request: put %v %v\n", localFileName, sdfsFileName)
+				logMsg := fmt.Sprintf("Executing put request: put %v %v %v %v %v %v\n", localFileName, sdfsFileName, policy, quorum, factor, scheme)
+				WriteLog(logFile, logMsg, false)
+
+				_ = handlePut(localFileName, sdfsFileName, policy, quorum, factor, scheme)
+			} else {
+				fmt.Println("Please enter as: put <localfilename> <sdfsfilename> [reject|overwrite|new-version|cas:<version>] [w=<num_replicas>] [n=<num_replicas>] [ec=<k>+<m>]")
+			}
+		} else if split[0] == "append" {
+			if len(split) == 3 {
+				logMsg := fmt.Sprintf("Executing append request: append %v %v\n", split[1], split[2])
+				WriteLog(logFile, logMsg, false)
+
+				_ = handleAppend(split[1], split[2])
+			} else {
+				fmt.Println("Please enter as: append <localfilename> <sdfsfilename>")
+			}
+		} else if split[0] == "mv" || split[0] == "mvdir" {
+			// -f replaces existing destinations
+			force := len(split) == 4 && split[3] == "-f"
+			if len(split) == 3 || force {
+				logMsg := fmt.Sprintf("Executing rename request: %v %v %v %v\n", split[0], split[1], split[2], force)
 				WriteLog(logFile, logMsg, false)
 
-				handlePut(localFileName, sdfsFileName, false)
+				_ = handleMove(split[1], split[2], split[0] == "mvdir", force)
+			} else if split[0] == "mv" {
+				fmt.Println("Please enter as: mv <src_sdfsfilename> <dst_sdfsfilename> [-f]")
+			} else {
+				fmt.Println("Please enter as: mvdir <src_sdfsdir> <dst_sdfsdir> [-f]")
+			}
+		} else if split[0] == "quorum" {
+			quorum := -1
+			if len(split) == 3 {
+				if num, err := strconv.Atoi(split[2]); err == nil {
+					quorum = num
+				}
+			}
+			if len(split) == 1 {
+				printQuorumPolicies()
+			} else if quorum >= 0 {
+				handleQuorumPolicy(split[1], quorum)
 			} else {
-				fmt.Println("Please enter as: put <localfilename> <sdfsfilename>")
+				fmt.Println("Please enter as: quorum <sdfsprefix> <num_replicas>")
+			}
+		} else if split[0] == "replication" {
+			factor := -1
+			if len(split) == 3 {
+				if num, err := strconv.Atoi(split[2]); err == nil {
+					factor = num
+				}
+			}
+			if len(split) == 1 {
+				printReplicationPolicies()
+			} else if factor >= 0 {
+				handleReplicationPolicy(split[1], factor)
+			} else {
+				fmt.Println("Please enter as: replication <sdfsprefix> <num_replicas>")
+			}
+		} else if split[0] == "erasure" {
+			if len(split) == 1 {
+				printErasurePolicies()
+			} else if len(split) == 3 {
+				handleErasurePolicy(split[1], split[2])
+			} else {
+				fmt.Println("Please enter as: erasure <sdfsprefix> <k>+<m>|none")
+			}
+		} else if split[0] == "balance" {
+			if len(split) == 1 || (len(split) == 2 && split[1] == "status") {
+				printBalanceStatus()
+			} else if len(split) == 2 {
+				handleBalance(split[1])
+			} else {
+				fmt.Println("Please enter as: balance [status|<threshold_percent>]")
+			}
+		} else if split[0] == "fsck" {
+			prefix := ""
+			repair := false
+			valid := len(split) <= 3
+			for _, arg := range split[1:] {
+				if arg == "--repair" {
+					repair = true
+				} else if prefix == "" {
+					prefix = arg
+				} else {
+					valid = false
+				}
+			}
+			if valid {
+				handleFsck(prefix, repair)
+			} else {
+				fmt.Println("Please enter as: fsck [sdfsprefix] [--repair]")
+			}
+		} else if split[0] == "gc" {
+			if len(split) == 1 || (len(split) == 2 && split[1] == "status") {
+				printGCStatus()
+			} else if len(split) == 3 && split[1] == "dry-run" && (split[2] == "on" || split[2] == "off") {
+				handleGC(split[2])
+			} else {
+				fmt.Println("Please enter as: gc [status|dry-run <on|off>]")
+			}
+		} else if split[0] == "repair" {
+			if len(split) == 1 || (len(split) == 2 && split[1] == "status") {
+				printRepairStatus()
+			} else {
+				fmt.Println("Please enter as: repair [status]")
+			}
+		} else if split[0] == "placement" {
+			printPlacement()
+		} else if split[0] == "conflict" {
+			if len(split) == 1 {
+				printConflictPolicies()
+			} else if len(split) == 3 {
+				handleConflictPolicy(split[1], split[2])
+			} else {
+				fmt.Println("Please enter as: conflict <sdfsprefix> <reject|overwrite|new-version|cas:<version>|none>")
 			}
 		} else if split[0] == "putdir" {
 			if len(split) == 3 {
@@ -77,19 +213,77 @@ func getCommand() {
 
 				PutWithPrefix(localDir, sdfsPrefix, true)
 			} else {
-				fmt.Println("Please enter as: putdir <localDir> <sdfsPrefix>")
+				fmt.Println("Please enter as: putdir <localDir> <sdfsDir>")
 			}
 		} else if split[0] == "get"{
-			if len(split) == 3 {
+			// optional arguments are the consistency level and r=<read quorum>
+			level := READLATEST
+			quorum := 0
+			valid := len(split) >= 3 && len(split) <= 5
+			for i := 3; valid && i < len(split); i++ {
+				if strings.HasPrefix(split[i], "r=") {
+					var err error
+					quorum, err = strconv.Atoi(strings.TrimPrefix(split[i], "r="))
+					valid = err == nil && quorum > 0
+				} else {
+					level = strings.ToUpper(split[i])
+					valid = parseConsistency(level) == nil
+				}
+			}
+			if valid {
 				localFileName := split[2]
 				sdfsFileName := split[1]
 
-				logMsg := fmt.Sprintf("Executing get request: get %v %v\n", sdfsFileName, localFileName)
+				logMsg := fmt.Sprintf("Executing get request: get %v %v %v\n", sdfsFileName, localFileName, level)
+				WriteLog(logFile, logMsg, false)
+
+				handleGet(localFileName, sdfsFileName, true, level, quorum)
+			} else {
+				fmt.Println("Please enter as: get <sdfsfilename>[@<version>] <localfilename> [ONE|QUORUM|LATEST] [r=<num_replicas>]")
+			}
+		} else if split[0] == "cat" {
+			// optional arguments are the offset and the length in bytes
+			var offset, length int64 = 0, -1
+			valid := len(split) >= 2 && len(split) <= 4
+			var err error
+			if valid && len(split) >= 3 {
+				offset, err = strconv.ParseInt(split[2], 10, 64)
+				valid = err == nil
+			}
+			if valid && len(split) == 4 {
+				length, err = strconv.ParseInt(split[3], 10, 64)
+				valid = err == nil && length >= 0
+			}
+			if valid {
+				logMsg := fmt.Sprintf("Executing cat request: cat %v %d %d\n", split[1], offset, length)
 				WriteLog(logFile, logMsg, false)
 
-				handleGet(localFileName, sdfsFileName, true)
+				handleCat(split[1], offset, length)
 			} else {
-				fmt.Println("Please enter as: get <sdfsfilename> <localfilename>")
+				fmt.Println("Please enter as: cat <sdfsfilename>[@<version>] [offset] [length]")
+			}
+		} else if split[0] == "get-versions" {
+			num := 0
+			if len(split) == 4 {
+				num, _ = strconv.Atoi(split[2])
+			}
+			if num > 0 {
+				logMsg := fmt.Sprintf("Executing get-versions request: get-versions %v %v %v\n", split[1], split[2], split[3])
+				WriteLog(logFile, logMsg, false)
+
+				handleGetVersions(split[1], num, split[3])
+			} else {
+				fmt.Println("Please enter as: get-versions <sdfsfilename> <num_versions> <localfilename>")
+			}
+		} else if split[0] == "retention" {
+			num := 0
+			if len(split) == 2 {
+				num, _ = strconv.Atoi(split[1])
+			}
+			if num > 0 {
+				handleRetention(num)
+			} else {
+				fmt.Println("Please enter as: retention <num_versions>")
 			}
 		} else if split[0] == "delete" {
 			if len(split) == 2 {
@@ -114,11 +308,58 @@ func getCommand() {
 				fmt.Println("Please enter as: deletedir <sdfspre>")
 			}
 		}else if split[0] == "ls" {
+			if len(split) >= 2 && len(split) <= 3 && split[1] == "-R" {
+				dirPath := ""
+				if len(split) == 3 {
+					dirPath = split[2]
+				}
+				printTree(dirPath)
+			} else if len(split) >= 2 && len(split) <= 3 && split[1] == "-l" {
+				// the replica locations of one file from the local replica list
+				if len(split) == 3 {
+					printSDFSFile(split[2])
+				} else {
+					fmt.Println("Please enter as: ls -l <sdfsfilename>")
+				}
+			} else {
+				// the files with the prefix from the master node
+				asJSON := false
+				prefix := ""
+				for _, arg := range split[1:] {
+					if arg == "--json" {
+						asJSON = true
+					} else {
+						prefix = arg
+					}
+				}
+				if len(split) <= 3 {
+					handleList(prefix, asJSON)
+				} else {
+					fmt.Println("Please enter as: ls [sdfsprefix] [--json], ls -l <sdfsfilename> or ls -R [sdfsdir]")
+				}
+			}
+		} else if split[0] == "du" {
+			if len(split) <= 2 {
+				dirPath := ""
+				if len(split) == 2 {
+					dirPath = split[1]
+				}
+				printDiskUsage(dirPath)
+			} else {
+				fmt.Println("Please enter as: du [sdfsdir]")
+			}
+		} else if split[0] == "mkdir" || split[0] == "rmdir" {
 			if len(split) == 2 {
-				sdfsFileName := split[1]
-				printSDFSFile(sdfsFileName)
+				logMsg := fmt.Sprintf("Executing directory request: %v %v\n", split[0], split[1])
+				WriteLog(logFile, logMsg, false)
+
+				if split[0] == "mkdir" {
+					handleDirRequest(MKDIR, split[1])
+				} else {
+					handleDirRequest(RMDIR, split[1])
+				}
 			} else {
-				fmt.Println("Please enter as: ls <sdfsfilename>")
+				fmt.Printf("Please enter as: %v <sdfsdir>\n", split[0])
 			}
 		} else if split[0] == "store" {
 			if len(split) == 1 {
@@ -138,11 +379,17 @@ func getCommand() {
 			} else {
 				fmt.Println("Please enter as: juice <juice_exe> <num_juices> <sdfs_intermediate_filename_prefix> <sdfs_dest_filename> delete_input={0,1}")
 			}
+		} else if split[0] == "scrub" {
+			if len(split) == 2 && split[1] == "status" {
+				printScrubStatus()
+			} else {
+				fmt.Println("Please enter as: scrub status")
+			}
 		} else if split[0] == "count" {
 			fmt.Printf("Counter map: %v\n", replicateCounter)
 		} else {
 			fmt.Println("No such command!")
-			fmt.Println("Available commands: membership, master, leave, query, put, putdir, get, delete, deletedir, ls, store, maple, juice")
+			fmt.Println("Available commands: membership, master, leave, query, put, putdir, append, get, cat, delete, deletedir, mv, mvdir, mkdir, rmdir, ls, du, store, maple, juice, scrub, get-versions, retention, conflict, quorum, replication, erasure, placement, balance, repair, fsck, gc")
 		}
 		time.Sleep(time.Duration(50) * time.Millisecond)
 	}
@@ -170,12 +417,35 @@ func service() {
 	// Thread that send heartbeat message to heartbeat targets
 	go HeartBeating()
 
+	// Thread that verifies local replicas in the background
+	go scrubRoutine()
+
 	// scheduler for maple and juice
 	go juiceJobSchedule()
 	go MapleJobSchedule()
 
-	// Thread that master send replica list to other nodes periodically
-	sendReplicaList()
+	// Thread that master push replica list changes to other nodes
+	go pushReplicaDelta()
+
+	// Thread that reports the zone and rack of this node to the master
+	go reportRoutine()
+
+	// Thread that master moves replicas from full to empty nodes
+	go balanceRoutine()
+
+	// Thread that master repairs files that lost replicas
+	go repairRoutine()
+
+	// Thread that deletes files no replica list entry refers to
+	go gcRoutine()
+
+	// Thread that reports the files kept from before a restart to the master
+	if persistStorage {
+		go reportStoredFiles()
+	}
+
+	// Thread that master send replica list digest to other nodes periodically
+	sendReplicaDigest()
 
 	// This function should never return
 }
@@ -192,9 +462,11 @@ func start() {
 	_, _ = fLog.Write([]byte("\n\n\n\n\n.......................INITIALIZING....................\n"))
 	isElecting = false
 
-	// remove all files in sdfs file directory
-	err := os.RemoveAll(SDFSFILEPATH)
-	ErrorHandler("Fail to remove sdfs files: ", err, false)
+	// remove all files in sdfs file directory, unless they are kept across restarts
+	if !persistStorage {
+		err := os.RemoveAll(SDFSFILEPATH)
+		ErrorHandler("Fail to remove sdfs files: ", err, false)
+	}
 	_ = os.Mkdir(SDFSFILEPATH, os.ModePerm)
 
 	// Thread for receiving new files into sdfs directory
@@ -203,6 +475,9 @@ func start() {
 	// Thread for receiving new files into local file directory
 	go FileTransferServerLocal()
 
+	// Thread for serving range reads of sdfs files
+	go RangeServer()
+
 	// Initialization procedure
 	if CheckHostName() {
 
@@ -235,6 +510,22 @@ func start() {
 // Input: None
 // Output: None
 func main() {
+	// failure domain labels and the placement policy of this node
+	flag.StringVar(&nodeZone, "zone", "", "zone of this node")
+	flag.StringVar(&nodeRack, "rack", "", "rack of this node")
+	placement := flag.String("placement", placementPolicy.Name(), "replica placement policy: zone, capacity or load")
+	flag.Float64Var(&balanceThreshold, "balance", balanceThreshold * 100, "imbalance score in percent above which replicas are moved")
+	flag.BoolVar(&gcDryRun, "gc-dry-run", false, "only log orphan files instead of deleting them")
+	flag.BoolVar(&persistStorage, "persist", false, "keep the sdfs directory across restarts")
+	flag.Parse()
+	balanceThreshold /= 100
+	if policy, ok := placementPolicies[*placement]; ok {
+		placementPolicy = policy
+	} else {
+		fmt.Printf("Unknown placement policy %v\n", *placement)
+		os.Exit(1)
+	}
+
 	start()
 
 	// Prevent the service end
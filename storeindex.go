@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+// This portion of code keeps the local store index of a node: the version
+// and the checksum of every replica in the sdfs directory. Unlike the
+// replica list, which describes what every replica should store, the index
+// describes what this node actually stores, so that readers can compare
+// replicas with each other. Entries of deleted files are dropped lazily
+// when they are looked up.
+
+// one replica in the sdfs directory
+type storedFile struct {
+	version int
+	checksum string
+}
+
+// maps the name of a replica to its version and checksum
+var storeIndex = make(map[string]storedFile)
+var indexLock sync.Mutex
+
+
+// func listedVersion(fileName string, checksum string) int
+// ------------------------------------------------------------------
+// Description: A helper function that finds the version of a replica in
+//				the local replica list by its checksum
+// Input:   fileName string: the name of the replica
+//			checksum string: the checksum of the replica
+// Output:  the version, 0 if the replica list does not know the content
+func listedVersion(fileName string, checksum string) int {
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+	sdfsMap, ok := replicateList[fileName]
+	if !ok || sdfsMap[CHECKSUM] != checksum {
+		return 0
+	}
+	version, err := strconv.Atoi(sdfsMap[FILEVERSION])
+	if err != nil {
+		return 1
+	}
+	return version
+}
+
+
+// func recordStored(fileName string, checksum string, version int)
+// ------------------------------------------------------------------
+// Description: This function records a replica stored in the sdfs directory
+// Input:   fileName string: the name of the replica
+//			checksum string: the verified checksum of the replica
+//			version int: the version of the replica, 0 if unknown
+// Output:  None
+func recordStored(fileName string, checksum string, version int) {
+	if version == 0 {
+		version = listedVersion(fileName, checksum)
+	}
+	indexLock.Lock()
+	storeIndex[fileName] = storedFile{version, checksum}
+	indexLock.Unlock()
+}
+
+
+// func setStoredVersion(fileName string, version int)
+// ------------------------------------------------------------------
+// Description: This function sets the version of a replica once it is
+//				known, e.g. when a staged put is committed
+// Input:   fileName string: the name of the replica
+//			version int: the version of the replica
+// Output:  None
+func setStoredVersion(fileName string, version int) {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	if stored, ok := storeIndex[fileName]; ok {
+		stored.version = version
+		storeIndex[fileName] = stored
+	}
+}
+
+
+// func moveStored(oldName string, newName string)
+// ------------------------------------------------------------------
+// Description: This function moves the entry of a renamed replica
+// Input:   oldName string: the old name of the replica
+//			newName string: the new name of the replica
+// Output:  None
+func moveStored(oldName string, newName string) {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	if stored, ok := storeIndex[oldName]; ok {
+		storeIndex[newName] = stored
+		delete(storeIndex, oldName)
+	}
+}
+
+
+// func copyStored(oldName string, newName string)
+// ------------------------------------------------------------------
+// Description: This function copies the entry of a replica that is linked
+//				under a second name
+// Input:   oldName string: the name of the replica
+//			newName string: the second name of the replica
+// Output:  None
+func copyStored(oldName string, newName string) {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	if stored, ok := storeIndex[oldName]; ok {
+		storeIndex[newName] = stored
+	}
+}
+
+
+// func lookupStored(fileName string) (storedFile, bool)
+// ------------------------------------------------------------------
+// Description: This function looks up a replica in the store index. A
+//				replica missing in the index, e.g. after a restart, is
+//				hashed and added
+// Input:   fileName string: the name of the replica
+// Output:  the version and checksum of the replica, false if the replica
+//			is not stored on this node
+func lookupStored(fileName string) (storedFile, bool) {
+	if !Exist(SDFSFILEPATH + fileName) {
+		indexLock.Lock()
+		delete(storeIndex, fileName)
+		indexLock.Unlock()
+		return storedFile{}, false
+	}
+
+	indexLock.Lock()
+	stored, ok := storeIndex[fileName]
+	indexLock.Unlock()
+	if !ok {
+		checksum, _, err := fileChecksum(SDFSFILEPATH + fileName)
+		if err != nil {
+			return storedFile{}, false
+		}
+		stored = storedFile{listedVersion(fileName, checksum), checksum}
+		recordStored(fileName, checksum, stored.version)
+	} else if stored.version == 0 {
+		stored.version = listedVersion(fileName, stored.checksum)
+	}
+	return stored, true
+}
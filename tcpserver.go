@@ -32,7 +32,7 @@ func tcpHandler() {
 			continue
 		}
 
-		if msgMap[MSGTYPE] != REPLICALIST {
+		if msgMap[MSGTYPE] != REPLICALIST && msgMap[MSGTYPE] != REPLICADELTA && msgMap[MSGTYPE] != STOREACK {
 			fmt.Println("*********************new connect comming in")
 		}
 
@@ -113,7 +113,7 @@ func tcpHandler() {
 
 				// write batch
 				for _, fileName := range fileNameMap {
-					WriteToNode(senderDir + fileName, senderType, receiverDir + fileName, receiverType, receiverID)
+					WriteToNode(senderDir + fileName, senderType, receiverDir + fileName, receiverType, receiverID, "")
 				}
 			}(&msgMap)
 
@@ -124,18 +124,97 @@ func tcpHandler() {
 			}
 
 			isMaster = false
-			receiverMap := make(map[string]string)
-			err = json.Unmarshal([]byte(msgMap[CONTENT]), &receiverMap)
-			ErrorHandler("Unmarshal error all", err, false)
-			newCounter := make(map[string]int)
-			err = json.Unmarshal([]byte(receiverMap[SDFSCOUNT]), &newCounter)
-			ErrorHandler("Unmarshal error count", err, false)
-			newList := make(map[string]map[string]string)
-			err = json.Unmarshal([]byte(receiverMap[SDFSLIST]), &newList)
-			ErrorHandler("Unmarshal error list", err, false)
-			replicateList = newList
-			replicateCounter = newCounter
-			go checkList()
+			applyReplicaList(msgMap[CONTENT])
+
+		} else if msgMap[MSGTYPE] == RENAME {
+			// renamed before any later replica delta is applied
+			renameMap := make(map[string]string)
+			err = json.Unmarshal([]byte(msgMap[CONTENT]), &renameMap)
+			ErrorHandler("Unmarshal rename error", err, false)
+			renameLocalReplica(renameMap[SENDERNAME], renameMap[RECEIVERNAME])
+			// a committed put carries the version of the staged copy
+			if version, err := strconv.Atoi(renameMap[FILEVERSION]); err == nil {
+				setStoredVersion(renameMap[RECEIVERNAME], version)
+			}
+
+		} else if msgMap[MSGTYPE] == STOREACK {
+			if !isMaster {
+				continue
+			}
+			ackMap := make(map[string]string)
+			err = json.Unmarshal([]byte(msgMap[CONTENT]), &ackMap)
+			ErrorHandler("Unmarshal store ack error", err, false)
+			recordStoreAck(ackMap[PUTID], msgMap[SENDER], ackMap[SDFSNAME], ackMap[CHECKSUM])
+
+		} else if msgMap[MSGTYPE] == STORELIST {
+			senderID, _ := strconv.Atoi(msgMap[SENDER])
+			go handleStoreList(msgMap[CONTENT], senderID)
+
+		} else if msgMap[MSGTYPE] == STORELISTREPLY {
+			deliverReply(msgMap[CONTENT], READID)
+
+		} else if msgMap[MSGTYPE] == WRITEREQ {
+			// the block list or shard list of a file is committed over TCP
+			if !isMaster {
+				continue
+			}
+			senderID, _ := strconv.Atoi(msgMap[SENDER])
+			go handleCommitParts(msgMap[CONTENT], senderID)
+
+		} else if msgMap[MSGTYPE] == STOREREPORT {
+			if !isMaster {
+				continue
+			}
+			senderID, _ := strconv.Atoi(msgMap[SENDER])
+			go handleStoreReport(msgMap[CONTENT], senderID)
+
+		} else if msgMap[MSGTYPE] == STOREREPORTACK {
+			deliverReply(msgMap[CONTENT], READID)
+
+		} else if msgMap[MSGTYPE] == APPENDAPPLY {
+			// appends of a file are applied one at a time, in the order of the master node
+			senderID, _ := strconv.Atoi(msgMap[SENDER])
+			go handleAppendApply(msgMap[CONTENT], senderID)
+
+		} else if msgMap[MSGTYPE] == APPENDFINISH {
+			finishMap := make(map[string]string)
+			err = json.Unmarshal([]byte(msgMap[CONTENT]), &finishMap)
+			ErrorHandler("Unmarshal append finish error", err, false)
+			go finishLocalAppend(finishMap)
+
+		} else if msgMap[MSGTYPE] == APPENDREPLY {
+			deliverReply(msgMap[CONTENT], READID)
+
+		} else if msgMap[MSGTYPE] == LISTREPLY {
+			deliverReply(msgMap[CONTENT], READID)
+
+		} else if msgMap[MSGTYPE] == GCCHECK {
+			if !isMaster {
+				continue
+			}
+			senderID, _ := strconv.Atoi(msgMap[SENDER])
+			go handleGCCheck(msgMap[CONTENT], senderID)
+
+		} else if msgMap[MSGTYPE] == GCCONFIRM {
+			deliverReply(msgMap[CONTENT], READID)
+
+		} else if msgMap[MSGTYPE] == MOVELINK || msgMap[MSGTYPE] == MOVEUNLINK {
+			// linked before the replica list moves the entries, unlinked after
+			senderID, _ := strconv.Atoi(msgMap[SENDER])
+			handleMoveMessage(msgMap[MSGTYPE], msgMap[CONTENT], senderID)
+
+		} else if msgMap[MSGTYPE] == MOVEACK {
+			deliverReply(msgMap[CONTENT], READID)
+
+		} else if msgMap[MSGTYPE] == REPLICADELTA {
+			masterID, _ = strconv.Atoi(msgMap[SENDER])
+			if masterID == selfID {
+				continue
+			}
+
+			// deltas are applied in the order they arrive
+			isMaster = false
+			applyReplicaDelta(msgMap[CONTENT])
 		}
 	}
 }
\ No newline at end of file
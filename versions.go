@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This portion of code implements file versioning in SDFS. The latest
+// version of a sdfs file keeps the plain sdfs name. When the file is put
+// again, the master node renames the entry of the previous version to
+// <sdfs name>@<version> in the replica list and on every replica, and
+// then writes the new version under the plain name. The master node keeps
+// the last versionRetain versions of every file and deletes older ones.
+
+// the highest version of every sdfs file up to which all older versions
+// are deleted, only kept on the master node
+var prunedVersions = make(map[string]int)
+var pruneLock sync.Mutex
+
+
+// func versionName(sdfsFileName string, version int) string
+// ------------------------------------------------------------------
+// Description: A helper function that gives the name an older version
+//				of a sdfs file is stored as
+// Input:   sdfsFileName string: the name of the sdfs file
+//			version int: the version number
+// Output:  the name of the version in the replica list
+func versionName(sdfsFileName string, version int) string {
+	return sdfsFileName + VERSIONSEP + strconv.Itoa(version)
+}
+
+
+// func splitVersionName(sdfsFileName string) (string, int)
+// ------------------------------------------------------------------
+// Description: A helper function that splits <sdfs name>@<version>
+// Input:   sdfsFileName string: the name to be split
+// Output:  the sdfs name and the version, the version is 0 if the
+//			name does not refer to a specific version
+func splitVersionName(sdfsFileName string) (string, int) {
+	idx := strings.LastIndex(sdfsFileName, VERSIONSEP)
+	if idx < 0 {
+		return sdfsFileName, 0
+	}
+	version, err := strconv.Atoi(sdfsFileName[idx + 1:])
+	if err != nil || version <= 0 {
+		return sdfsFileName, 0
+	}
+	return sdfsFileName[:idx], version
+}
+
+
+// func isInternalName(sdfsFileName string) bool
+// ------------------------------------------------------------------
+// Description: A helper function that checks whether an entry of the
+//				replica list is managed by SDFS itself (e.g. an older
+//				version) rather than a file put by the user
+// Input:   sdfsFileName string: the name of the entry
+// Output:  true if the name is internal
+func isInternalName(sdfsFileName string) bool {
+	return strings.Contains(sdfsFileName, VERSIONSEP)
+}
+
+
+// func getVersion(sdfsFileName string) int
+// ------------------------------------------------------------------
+// Description: A helper function that gets the latest version of a
+//				sdfs file from the replica list
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  the latest version, 0 if the file does not exist
+func getVersion(sdfsFileName string) int {
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+	sdfsMap, ok := replicateList[sdfsFileName]
+	if !ok {
+		return 0
+	}
+	version, err := strconv.Atoi(sdfsMap[FILEVERSION])
+	if err != nil {
+		return 1
+	}
+	return version
+}
+
+
+// func archiveFile(sdfsFileName string) int
+// ------------------------------------------------------------------
+// Description: This function is called by the master node before a new
+//				version of a sdfs file is written. The current version is
+//				renamed to <sdfs name>@<version> and versions beyond the
+//				retention are deleted
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  the version number of the new version
+func archiveFile(sdfsFileName string) int {
+	version := getVersion(sdfsFileName)
+	if version == 0 {
+		return 1
+	}
+
+	logMsg := fmt.Sprintf("Keeping version %v of SDFS file %v\n", version, sdfsFileName)
+	fmt.Print(logMsg)
+	WriteLog(logFile, logMsg, false)
+
+	renameSDFS(sdfsFileName, versionName(sdfsFileName, version))
+	pruneVersions(sdfsFileName, version + 1)
+	return version + 1
+}
+
+
+// func pruneVersions(sdfsFileName string, latest int)
+// ------------------------------------------------------------------
+// Description: This function deletes the versions of a sdfs file that
+//				fall out of the retention
+// Input:   sdfsFileName string: the name of the sdfs file
+//			latest int: the latest version of the file
+// Output:  None
+func pruneVersions(sdfsFileName string, latest int) {
+	last := latest - retainedVersions()
+	// versions up to the mark are already deleted, so every version is
+	// only checked once
+	pruneLock.Lock()
+	first := prunedVersions[sdfsFileName] + 1
+	if last >= first {
+		prunedVersions[sdfsFileName] = last
+	}
+	pruneLock.Unlock()
+
+	for version := first; version <= last; version++ {
+		name := versionName(sdfsFileName, version)
+		fileLock.RLock()
+		_, ok := replicateList[name]
+		fileLock.RUnlock()
+		if ok {
+			deleteSDFS(name)
+		}
+	}
+}
+
+
+// func deleteWithVersions(sdfsFileName string) bool
+// ------------------------------------------------------------------
+// Description: This function deletes a sdfs file and all of its older
+//				versions. It should only be called by the master node
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  true if the sdfs file existed
+func deleteWithVersions(sdfsFileName string) bool {
+	latest := getVersion(sdfsFileName)
+	if !deleteSDFS(sdfsFileName) {
+		return false
+	}
+	// every version up to the latest one falls out of the retention
+	pruneVersions(sdfsFileName, latest + retainedVersions())
+	// a new file of the same name starts again at version 1
+	pruneLock.Lock()
+	delete(prunedVersions, sdfsFileName)
+	pruneLock.Unlock()
+	return true
+}
+
+
+// func resolveVersionName(sdfsFileName string) string
+// ------------------------------------------------------------------
+// Description: A helper function that maps <sdfs name>@<version> to the
+//				plain sdfs name when the version is the latest version
+// Input:   sdfsFileName string: the requested name
+// Output:  the name of the entry in the replica list
+func resolveVersionName(sdfsFileName string) string {
+	name, version := splitVersionName(sdfsFileName)
+	if version != 0 && getVersion(name) == version {
+		return name
+	}
+	return sdfsFileName
+}
+
+
+// func listVersions(sdfsFileName string, num int) []int
+// ------------------------------------------------------------------
+// Description: A helper function that lists the latest versions of a
+//				sdfs file that are still kept in SDFS
+// Input:   sdfsFileName string: the name of the sdfs file
+//			num int: the maximum number of versions
+// Output:  the version numbers from the latest to the oldest
+func listVersions(sdfsFileName string, num int) []int {
+	latest := getVersion(sdfsFileName)
+	versions := make([]int, 0, num)
+	if latest == 0 {
+		return versions
+	}
+	versions = append(versions, latest)
+
+	fileLock.RLock()
+	for version := latest - 1; version > 0 && len(versions) < num; version-- {
+		if _, ok := replicateList[versionName(sdfsFileName, version)]; ok {
+			versions = append(versions, version)
+		}
+	}
+	fileLock.RUnlock()
+	return versions
+}
+
+
+// func keptVersions(sdfsFileName string) []string
+// ------------------------------------------------------------------
+// Description: A helper function that lists the names of the older
+//				versions of a sdfs file that are still in the replica
+//				list. The caller holds fileLock
+// Input:   sdfsFileName string: the name of the sdfs file
+// Output:  the names of the older versions
+func keptVersions(sdfsFileName string) []string {
+	names := make([]string, 0)
+	sdfsMap, ok := replicateList[sdfsFileName]
+	if !ok {
+		return names
+	}
+	latest, err := strconv.Atoi(sdfsMap[FILEVERSION])
+	if err != nil {
+		return names
+	}
+
+	// versions up to the mark are already deleted
+	pruneLock.Lock()
+	first := prunedVersions[sdfsFileName] + 1
+	pruneLock.Unlock()
+	for version := first; version < latest; version++ {
+		if _, ok := replicateList[versionName(sdfsFileName, version)]; ok {
+			names = append(names, versionName(sdfsFileName, version))
+		}
+	}
+	return names
+}
+
+
+// func handleGetVersions(sdfsFileName string, num int, localFileName string)
+// ------------------------------------------------------------------
+// Description: This function handles the get-versions instruction. The
+//				latest num versions are fetched at the same time and then
+//				concatenated into the local file, latest version first
+// Input:   sdfsFileName string: sdfs file name in the get-versions instruction
+//			num int: number of versions to get
+//			localFileName string: local file name in the get-versions instruction
+// Output:  None
+func handleGetVersions(sdfsFileName string, num int, localFileName string) {
+	versions := listVersions(sdfsFileName, num)
+	if len(versions) == 0 {
+		fmt.Printf("SDFS File: %v doesn't exist\n", sdfsFileName)
+		return
+	}
+
+	// fetch all versions at the same time
+	tempNames := make([]string, len(versions))
+	for i, version := range versions {
+		tempNames[i] = localFileName + VERSIONSEP + strconv.Itoa(version)
+		_ = os.Remove(LOCALFILEPATH + tempNames[i])
+		handleGet(tempNames[i], versionName(sdfsFileName, version), false, READLATEST, 0)
+	}
+
+	out, err := os.Create(LOCALFILEPATH + localFileName)
+	if err != nil {
+		ErrorHandler("Can't create local file " + localFileName, err, false)
+		return
+	}
+	defer out.Close()
+
+	written := 0
+	skipped := make([]string, 0)
+	for i, version := range versions {
+		if !waitForLocalFile(LOCALFILEPATH + tempNames[i], GETTIMEOUT) {
+			fmt.Printf("Version %v of SDFS file %v is not received in time, skipped\n", version, sdfsFileName)
+			skipped = append(skipped, tempNames[i])
+			continue
+		}
+		_, _ = out.WriteString(fmt.Sprintf("========== %v version %d ==========\n", sdfsFileName, version))
+		in, err := os.Open(LOCALFILEPATH + tempNames[i])
+		if err != nil {
+			ErrorHandler("Can't open version of " + sdfsFileName, err, false)
+			continue
+		}
+		_, err = io.Copy(out, in)
+		ErrorHandler("Can't copy version of " + sdfsFileName, err, false)
+		_ = in.Close()
+		if err == nil {
+			written++
+		}
+	}
+
+	// a skipped version may still arrive after its timeout, it is removed
+	// once the transfer had another GETTIMEOUT to finish
+	for _, tempName := range tempNames {
+		_ = os.Remove(LOCALFILEPATH + tempName)
+	}
+	time.AfterFunc(GETTIMEOUT, func() {
+		for _, tempName := range skipped {
+			_ = os.Remove(LOCALFILEPATH + tempName)
+		}
+	})
+	fmt.Printf("%d versions of SDFS file %v are stored in %v\n", written, sdfsFileName, localFileName)
+}
+
+
+// func retainedVersions() int
+// ------------------------------------------------------------------
+// Description: A helper function that gives the number of versions of
+//				every sdfs file that are kept
+// Input:   None
+// Output:  the number of versions
+func retainedVersions() int {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	return versionRetain
+}
+
+
+// func pruneAllVersions()
+// ------------------------------------------------------------------
+// Description: This function deletes the versions of every sdfs file that
+//				fall out of the retention. It should only be called by the
+//				master node
+// Input:   None
+// Output:  None
+func pruneAllVersions() {
+	fileLock.RLock()
+	sdfsFileNames := make([]string, 0)
+	for sdfsFileName := range replicateList {
+		if !isInternalName(sdfsFileName) {
+			sdfsFileNames = append(sdfsFileNames, sdfsFileName)
+		}
+	}
+	fileLock.RUnlock()
+
+	for _, sdfsFileName := range sdfsFileNames {
+		if latest := getVersion(sdfsFileName); latest > 0 {
+			pruneVersions(sdfsFileName, latest)
+		}
+	}
+}
+
+
+// func handleRetention(num int)
+// ------------------------------------------------------------------
+// Description: This function handles the retention instruction which sets
+//				how many versions of every sdfs file the master node keeps
+// Input:   num int: number of versions to keep
+// Output:  None
+func handleRetention(num int) {
+	if isMaster {
+		policyLock.Lock()
+		previous := versionRetain
+		versionRetain = num
+		policyLock.Unlock()
+		publishReplicaDelta()
+		logMsg := fmt.Sprintf("SDFS keeps the last %v versions of every file\n", num)
+		fmt.Print(logMsg)
+		WriteLog(logFile, logMsg, false)
+		// versions beyond the lower retention are deleted right away
+		if num < previous {
+			go pruneAllVersions()
+		}
+		return
+	}
+
+	sentMap := make(map[string]string)
+	sentMap[FILEVERSION] = strconv.Itoa(num)
+	msgContent, _ := json.Marshal(sentMap)
+	msgSent := MakeMessage(RETENTION, string(msgContent), strconv.Itoa(selfID))
+	sendRequest(masterID, msgSent)
+}
+
+
+// func waitForLocalFile(path string, timeout time.Duration) bool
+// ------------------------------------------------------------------
+// Description: A helper function that waits until a fetched file is
+//				moved in place
+// Input:   path string: path to the file
+//			timeout time.Duration: the maximum time to wait
+// Output:  true if the file exists before the timeout
+func waitForLocalFile(path string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if Exist(path) {
+			return true
+		}
+		time.Sleep(CHECKTIME)
+	}
+	return false
+}